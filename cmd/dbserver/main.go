@@ -1,70 +1,608 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/Ricky004/dungeonDB/config"
+	"github.com/Ricky004/dungeonDB/internal/dump"
+	"github.com/Ricky004/dungeonDB/internal/metrics"
 	"github.com/Ricky004/dungeonDB/internal/storage"
-	u "github.com/Ricky004/dungeonDB/internal/utils"
+	"github.com/Ricky004/dungeonDB/pkg/api"
 )
 
+// the subcommands, `dbserver [serve] [flags]` runs the server
+var commands = map[string]func(args []string) error{
+	"serve":   serve,
+	"config":  configCmd,
+	"backup":  backupCmd,
+	"dump":    dumpCmd,
+	"restore": restoreCmd,
+	"import":  importCmd,
+	"export":  exportCmd,
+	"vacuum":  vacuumCmd,
+	"rekey":   rekeyCmd,
+}
+
 func main() {
-	// Define the path to the database file
-	dbPath := "test.db"
+	args := os.Args[1:]
+	cmd := serve
+	if len(args) > 0 && commands[args[0]] != nil {
+		cmd, args = commands[args[0]], args[1:]
+	}
+	if err := cmd(args); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(2)
+	}
+}
 
-	// Remove the file if it exists to start fresh (for testing purposes)
-	if _, err := os.Stat(dbPath); err == nil {
-		os.Remove(dbPath)
+// dbserver config print [flags]
+func configCmd(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: dbserver config print [flags]")
+	}
+	cfg, err := config.Load(flag.NewFlagSet("config print", flag.ContinueOnError), args[1:])
+	if err != nil {
+		return err
 	}
+	return cfg.WriteTOML(os.Stdout)
+}
 
-	// Create a new KV instance
-	db := &storage.KV{
-		Path: dbPath,
+// dbserver backup <db> <out>
+// <db> is a database file, or the URL of the HTTP API of a running server.
+// the backup is written next to <out>, verified, then renamed to <out>.
+func backupCmd(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver backup [-key-file f] <db file | http://server> <out>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	src, out := fs.Arg(0), fs.Arg(1)
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+
+	tmp := out + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // after a failure
+	want, err := writeBackup(fp, src, key)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("backup: %w", err)
 	}
 
-	// Open the database
-	err := db.OpenWindows()
+	stats, err := storage.VerifyFileKey(tmp, key)
 	if err != nil {
-		log.Fatalf("Failed to open the database: %v", err)
+		return fmt.Errorf("backup: %w", err)
+	}
+	if want != nil && stats != *want {
+		return fmt.Errorf("backup: verify: %+v in the file, %+v expected", stats, *want)
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return err
 	}
-	defer func() {
-		if err := db.CloseWindows(); err != nil {
-			log.Printf("Error closing database: %v", err)
+	fmt.Printf("%s: %d pages, %d keys\n", out, stats.Pages, stats.Keys)
+	return nil
+}
+
+// copy the database to `w`, returns the expected stats if known
+func writeBackup(w io.Writer, src string, key []byte) (*storage.BackupStats, error) {
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		resp, err := http.Get(strings.TrimSuffix(src, "/") + "/backup")
+		if err != nil {
+			return nil, err
 		}
-	}() // Ensure cleanup happens even if something fails
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", src, resp.Status)
+		}
+		_, err = io.Copy(w, resp.Body)
+		return nil, err
+	}
 
-	fmt.Println("Database opened successfully!")
+	// a file that no server is using
+	db, err := openDB(src, key)
+	if err != nil {
+		return nil, err
+	}
+	snap := db.Snapshot()
+	_, err = snap.WriteTo(w)
+	snap.Close()
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	stats := snap.Stats()
+	return &stats, err
+}
 
-	// Perform some basic operations (e.g., adding a page, deleting a page)
-	// Create a new BNode (sample data)
-	node := storage.BNode{
-		Data: []byte(`work in progress by Ricky004`),
+// open an existing database file for a command, `key` if it's encrypted
+func openDB(path string, key []byte) (*storage.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db := &storage.DB{Path: path, Options: storage.Options{Key: key}}
+	if err := db.Open(); err != nil {
+		return nil, err
 	}
+	return db, nil
+}
 
-	// Allocate a new page
-	pageID := db.PageAppend(node)
-	fmt.Printf("Added a new page with ID: %d\n", pageID)
+// the -key-file flag of the commands opening a database
+func keyFileFlag(fs *flag.FlagSet) *string {
+	return fs.String("key-file", "", "the encryption key of the database, raw or in hex")
+}
 
-	// Delete the page
-	// db.PageDel(pageID)
-	// fmt.Printf("Deleted the page with ID: %d\n", pageID)
-	db.PageUse(pageID, node)
+// the key in a -key-file, nil if there's none
+func readKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return storage.ReadKeyFile(path)
+}
+
+// the dump format of a file, by its extension
+func dumpFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return dump.FORMAT_JSONL
+	default:
+		return dump.FORMAT_SQL
+	}
+}
 
-	// Verify master page load/store
-	err = storage.MasterStore(db)
+// dbserver dump [-format sql|jsonl] [-o out] <db>
+func dumpCmd(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	format := fs.String("format", "", "sql or jsonl, by the extension of -o if omitted, sql for stdout")
+	out := fs.String("o", "", "output file, stdout if omitted")
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver dump [-format sql|jsonl] [-o out] <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	if *format == "" {
+		*format = dumpFormat(*out)
+	}
+
+	key, err := readKey(*keyFile)
 	if err != nil {
-		log.Fatalf("Failed to store the master page: %v", err)
+		return fmt.Errorf("dump: %w", err)
 	}
-	fmt.Println("Master page stored successfully!")
+	db, err := openDB(fs.Arg(0), key)
+	if err != nil {
+		return fmt.Errorf("dump: %w", err)
+	}
+	defer db.Close()
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		fp, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("dump: %w", err)
+		}
+		defer fp.Close()
+		w = fp
+	}
+	stats, err := dump.Dump(db, w, *format)
+	if err != nil {
+		return fmt.Errorf("dump: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d tables, %d rows, %d sequences\n", stats.Tables, stats.Rows, stats.Sequences)
+	return nil
+}
 
-	fmt.Println("All operations completed successfully!")
+// dbserver restore [-format sql|jsonl] <db> <dump>
+func restoreCmd(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	format := fs.String("format", "", "sql or jsonl, by the extension of the dump if omitted")
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver restore [-format sql|jsonl] <db> <dump | ->")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	path, in := fs.Arg(0), fs.Arg(1)
+	if *format == "" {
+		*format = dumpFormat(in)
+	}
 
-	file, err := os.Open(dbPath)
+	r := io.Reader(os.Stdin)
+	if in != "-" {
+		fp, err := os.Open(in)
+		if err != nil {
+			return fmt.Errorf("restore: %w", err)
+		}
+		defer fp.Close()
+		r = fp
+	}
+	key, err := readKey(*keyFile)
 	if err != nil {
-		log.Fatalf("Failed to open database file: %v", err)
+		return fmt.Errorf("restore: %w", err)
+	}
+	db := &storage.DB{Path: path, Options: storage.Options{Key: key}}
+	if err := db.Open(); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	stats, err := dump.Restore(db, r, *format)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d tables, %d rows, %d sequences\n", stats.Tables, stats.Rows, stats.Sequences)
+	return nil
+}
+
+// the rune of a -delimiter flag, `\t` for a tab
+func delimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	r := []rune(s)
+	if len(r) != 1 {
+		return 0, fmt.Errorf("the delimiter must be one character, got %q", s)
+	}
+	return r[0], nil
+}
+
+// dbserver import -table t -csv file [flags] <db>
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	table := fs.String("table", "", "the table to insert into")
+	in := fs.String("csv", "", "the CSV file with a header line, - for stdin")
+	delim := fs.String("delimiter", ",", "the field delimiter")
+	null := fs.String("null", "", "the field for an omitted column, so it gets its default")
+	batch := fs.Int("batch", dump.RESTORE_BATCH, "rows per transaction")
+	maxErrors := fs.Int("max-errors", 0, "stop after this many bad lines, 0 for no limit")
+	bulk := fs.Bool("bulk", false, "load the rows at once by rebuilding the B-tree, all or nothing")
+	sorted := fs.Bool("sorted", false, "with -bulk, the rows are in primary key order")
+	fill := fs.Float64("fill-factor", storage.BULK_FILL_FACTOR, "with -bulk, the share of a page filled")
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver import -table t -csv file [flags] <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || *table == "" || *in == "" {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	opts := dump.CSVOptions{Null: *null, Batch: *batch, MaxErrors: *maxErrors}
+	if *bulk {
+		opts.Bulk = &storage.BulkOptions{Sorted: *sorted, FillFactor: *fill}
+	}
+	var err error
+	if opts.Comma, err = delimiter(*delim); err != nil {
+		return fmt.Errorf("import: %w", err)
 	}
-	defer file.Close()
 
-	u.HexViewr(file, 4096, 64)
+	r := io.Reader(os.Stdin)
+	if *in != "-" {
+		fp, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("import: %w", err)
+		}
+		defer fp.Close()
+		r = fp
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	db, err := openDB(fs.Arg(0), key)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	stats, err := dump.ImportCSV(db, *table, r, opts)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	for _, lerr := range stats.Errors {
+		fmt.Fprintln(os.Stderr, lerr)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d rows, skipped %d lines\n", stats.Rows, len(stats.Errors))
+	if len(stats.Errors) > 0 {
+		return errors.New("import: some lines were skipped")
+	}
+	return nil
+}
+
+// dbserver export (-table t | -query sql) [flags] <db>
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	table := fs.String("table", "", "the table to export, in primary key order")
+	query := fs.String("query", "", "a SELECT to export instead of a table")
+	delim := fs.String("delimiter", ",", "the field delimiter")
+	quote := fs.String("quote", dump.QUOTE_MINIMAL, "minimal, all or none")
+	header := fs.Bool("header", true, "write the column names first")
+	out := fs.String("o", "", "output file, stdout if omitted")
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver export (-table t | -query sql) [flags] <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*table == "") == (*query == "") {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	opts := dump.CSVOptions{Quote: *quote, Header: *header}
+	var err error
+	if opts.Comma, err = delimiter(*delim); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	db, err := openDB(fs.Arg(0), key)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	defer db.Close()
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		fp, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		defer fp.Close()
+		w = fp
+	}
+	var n int
+	if *table != "" {
+		n, err = dump.ExportCSV(db, *table, w, opts)
+	} else {
+		n, err = dump.ExportQueryCSV(db, *query, w, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d rows\n", n)
+	return nil
+}
+
+// dbserver vacuum [-incremental] [flags] <db>
+func vacuumCmd(args []string) error {
+	fs := flag.NewFlagSet("vacuum", flag.ContinueOnError)
+	incremental := fs.Bool("incremental", false, "move the pages at the end of the file instead of rewriting it")
+	maxPages := fs.Int("max-pages", 0, "with -incremental, move at most this many pages, 0 for no limit")
+	fill := fs.Float64("fill-factor", storage.BULK_FILL_FACTOR, "the share of a page filled by the rewrite")
+	keyFile := keyFileFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver vacuum [-incremental] [flags] <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	db, err := openDB(fs.Arg(0), key)
+	if err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	stats, err := db.Vacuum(storage.VacuumOptions{
+		Incremental: *incremental, MaxPages: *maxPages, FillFactor: *fill,
+	})
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "vacuumed %s: %d -> %d bytes\n", fs.Arg(0), stats.SizeBefore, stats.SizeAfter)
+	return nil
+}
+
+// dbserver rekey [-key-file old] (-new-key-file new | -decrypt) <db>
+// without -key-file, it encrypts an unencrypted database.
+func rekeyCmd(args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	keyFile := keyFileFlag(fs)
+	newKeyFile := fs.String("new-key-file", "", "the new encryption key, raw or in hex")
+	decrypt := fs.Bool("decrypt", false, "store the database unencrypted")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: dbserver rekey [-key-file old] (-new-key-file new | -decrypt) <db>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (*newKeyFile == "") == !*decrypt {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	newKey, err := readKey(*newKeyFile)
+	if err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	db, err := openDB(fs.Arg(0), key)
+	if err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	err = db.Rekey(newKey)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "rekeyed %s, encrypted: %v\n", fs.Arg(0), newKey != nil)
+	return nil
+}
+
+func serve(args []string) error {
+	cfg, err := config.Load(flag.NewFlagSet("dbserver", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+
+	// JSON logs, the log package of the other components goes there too
+	logger, err := storage.NewJSONLogger(os.Stderr, cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	opts := cfg.StorageOptions()
+	opts.Logger = logger
+	if opts.Key, err = readKey(cfg.KeyFile); err != nil {
+		logger.Error("failed to read the encryption key", "file", cfg.KeyFile, "err", err)
+		os.Exit(1)
+	}
+	reg := metrics.NewRegistry()
+	opts.Metrics = storage.NewMetrics(reg)
+	db := &storage.DB{Path: cfg.DataPath, Options: opts}
+	if err := db.Open(); err != nil {
+		logger.Error("failed to open the database", "path", cfg.DataPath, "err", err)
+		os.Exit(1)
+	}
+
+	srv := api.NewServer(db)
+	srv.Metrics = reg
+	srv.IdleInTxTimeout = cfg.IdleInTxTimeout
+	if cfg.PGBytea {
+		srv.PGBytesOID = api.PG_OID_BYTEA
+	}
+	errc := make(chan error, 5)
+	if addr := cfg.Listen.Binary; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServe(addr)
+		}()
+		logger.Info("serving the binary protocol", "path", cfg.DataPath, "addr", addr)
+	}
+	if addr := cfg.Listen.PG; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServePG(addr)
+		}()
+		logger.Info("serving the PostgreSQL protocol", "addr", addr)
+	}
+	if addr := cfg.Listen.HTTP; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServeJSON(addr)
+		}()
+		logger.Info("serving the HTTP API", "addr", addr)
+	}
+	if addr := cfg.Listen.RESP; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServeRESP(addr)
+		}()
+		logger.Info("serving the Redis protocol", "addr", addr)
+	}
+	if addr := cfg.Listen.Metrics; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServeMetrics(addr)
+		}()
+		logger.Info("serving the metrics", "addr", addr)
+	}
+	if addr := cfg.Listen.Replication; addr != "" {
+		go func() {
+			errc <- srv.ListenAndServeReplication(addr)
+		}()
+		logger.Info("serving the followers", "addr", addr)
+	}
+	// the follower or the expiry sweeper, stopped after the listeners
+	bctx, stopBackground := context.WithCancel(context.Background())
+	background := make(chan struct{})
+	if addr := cfg.ReplicateFrom; addr != "" {
+		go func() {
+			defer close(background)
+			srv.Follow(bctx, addr)
+		}()
+		logger.Info("following a primary, read-only", "primary", addr)
+	} else {
+		// a follower gets the deletes of the primary's sweeper
+		go func() {
+			defer close(background)
+			srv.SweepExpired(bctx, storage.EXPIRY_INTERVAL)
+		}()
+	}
+
+	// wait for a signal or a listener failure
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down, draining in-flight requests")
+	case err := <-errc:
+		if !errors.Is(err, api.ErrServerClosed) {
+			logger.Error("listener failed", "err", err)
+		}
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		logger.Warn("shutdown", "err", err)
+	}
+	stopBackground()
+	<-background
+	// with the DB lock, a request may outlive a timed out shutdown
+	if err := srv.CloseDB(); err != nil {
+		logger.Error("failed to close the database", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("database closed")
+	return nil
 }
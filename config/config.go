@@ -1 +1,490 @@
-package config
\ No newline at end of file
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the server configuration.
+// the layers, from the lowest priority: the defaults, a TOML or JSON file,
+// DUNGEONDB_* environment variables and the command line flags.
+type Config struct {
+	DataPath        string        // the database file
+	IOBackend       string        // mmap or pool, see storage.BACKEND_*
+	PageCacheSize   int           // pages cached in memory by the pool backend, the mmap backend ignores it
+	PageSize        int64         // the page size of a new database file, 1KiB to 32KiB, an existing file keeps its own
+	KeyFile         string        // the encryption key of the database file, unencrypted if empty
+	SyncMode        string        // full, normal or off, see storage.SYNC_*
+	Listen          Listen        // the listener addresses, empty to disable
+	LogLevel        string        // debug, info, warn or error
+	MaxDBSize       int64         // the maximum file size in bytes, 0 for no limit
+	MmapInitialSize int64         // the initial mmap size in bytes, a multiple of the page size
+	ShutdownTimeout time.Duration // how long to wait for in-flight requests on shutdown
+	IdleInTxTimeout time.Duration // roll back a transaction idle for longer and close its connection, 0 for no limit
+	PGBytea         bool          // report BYTES columns as bytea over the PostgreSQL protocol
+	ChangelogSize   int           // the row changes kept for GET /changes, none if 0
+	ReplicateFrom   string        // the replication address of a primary, the server is then a read-only follower
+}
+
+type Listen struct {
+	Binary  string
+	PG      string
+	HTTP    string
+	RESP    string
+	Metrics string // a separate listener for GET /metrics, also served by the HTTP API
+	// the followers connect there, see api.ServeReplication
+	Replication string
+}
+
+// the environment variable naming the config file
+const ENV_CONFIG = "DUNGEONDB_CONFIG"
+
+// the prefix of the environment variables, e.g. DUNGEONDB_LISTEN_HTTP
+const ENV_PREFIX = "DUNGEONDB_"
+
+func Default() *Config {
+	return &Config{
+		DataPath:        "dungeon.db",
+		IOBackend:       "mmap",
+		PageCacheSize:   1024,
+		PageSize:        storage.BTREE_PAGE_SIZE,
+		SyncMode:        "full",
+		Listen:          Listen{Binary: "127.0.0.1:4807"},
+		LogLevel:        "info",
+		MmapInitialSize: storage.MMAP_INITIAL_SIZE,
+		ShutdownTimeout: 30 * time.Second,
+		IdleInTxTimeout: time.Minute,
+	}
+}
+
+// a config setting, the same in every layer
+type setting struct {
+	key   string // in the file, e.g. "listen.http"
+	flag  string // the command line flag
+	usage string
+	set   func(c *Config, v string) error
+	get   func(c *Config) interface{} // string, int64, bool or time.Duration
+}
+
+var settings = []setting{
+	{"data_path", "db", "path to the database file",
+		func(c *Config, v string) error { c.DataPath = v; return nil },
+		func(c *Config) interface{} { return c.DataPath }},
+	{"io_backend", "io-backend", "mmap, or pool for pread & pwrite through a page cache",
+		func(c *Config, v string) error { c.IOBackend = strings.ToLower(v); return nil },
+		func(c *Config) interface{} { return c.IOBackend }},
+	{"page_cache_size", "page-cache-size", "pages cached in memory by the pool backend",
+		func(c *Config, v string) (err error) { c.PageCacheSize, err = parseInt(v); return err },
+		func(c *Config) interface{} { return int64(c.PageCacheSize) }},
+	{"page_size", "page-size", "page size of a new database file, a power of 2 from 1KiB to 32KiB",
+		func(c *Config, v string) (err error) { c.PageSize, err = ParseSize(v); return err },
+		func(c *Config) interface{} { return c.PageSize }},
+	{"encryption_key_file", "key-file", "file with the AES key encrypting the database, raw or in hex",
+		func(c *Config, v string) error { c.KeyFile = v; return nil },
+		func(c *Config) interface{} { return c.KeyFile }},
+	{"sync_mode", "sync-mode", "full, normal or off",
+		func(c *Config, v string) error { c.SyncMode = strings.ToLower(v); return nil },
+		func(c *Config) interface{} { return c.SyncMode }},
+	{"log_level", "log-level", "debug, info, warn or error",
+		func(c *Config, v string) error { c.LogLevel = strings.ToLower(v); return nil },
+		func(c *Config) interface{} { return c.LogLevel }},
+	{"max_db_size", "max-db-size", "maximum database file size, e.g. 10GiB, 0 for no limit",
+		func(c *Config, v string) (err error) { c.MaxDBSize, err = ParseSize(v); return err },
+		func(c *Config) interface{} { return c.MaxDBSize }},
+	{"mmap_initial_size", "mmap-initial-size", "initial mmap size, e.g. 64MiB",
+		func(c *Config, v string) (err error) { c.MmapInitialSize, err = ParseSize(v); return err },
+		func(c *Config) interface{} { return c.MmapInitialSize }},
+	{"shutdown_timeout", "shutdown-timeout", "how long to wait for in-flight requests on shutdown",
+		func(c *Config, v string) (err error) { c.ShutdownTimeout, err = time.ParseDuration(v); return err },
+		func(c *Config) interface{} { return c.ShutdownTimeout }},
+	{"idle_in_tx_timeout", "idle-in-tx-timeout", "roll back a transaction idle for longer and close its connection, 0 for no limit",
+		func(c *Config, v string) (err error) { c.IdleInTxTimeout, err = time.ParseDuration(v); return err },
+		func(c *Config) interface{} { return c.IdleInTxTimeout }},
+	{"changelog_size", "changelog-size", "row changes kept for the consumers of GET /changes, 0 to record none",
+		func(c *Config, v string) (err error) { c.ChangelogSize, err = parseInt(v); return err },
+		func(c *Config) interface{} { return int64(c.ChangelogSize) }},
+	{"pg_bytea", "pg-bytea", "report BYTES columns as bytea instead of text over the PostgreSQL protocol",
+		func(c *Config, v string) (err error) { c.PGBytea, err = strconv.ParseBool(v); return err },
+		func(c *Config) interface{} { return c.PGBytea }},
+	{"listen.binary", "listen", "address of the binary protocol listener",
+		func(c *Config, v string) error { c.Listen.Binary = v; return nil },
+		func(c *Config) interface{} { return c.Listen.Binary }},
+	{"listen.pg", "pg-listen", "address of the PostgreSQL protocol listener",
+		func(c *Config, v string) error { c.Listen.PG = v; return nil },
+		func(c *Config) interface{} { return c.Listen.PG }},
+	{"listen.http", "http-listen", "address of the HTTP/JSON API listener",
+		func(c *Config, v string) error { c.Listen.HTTP = v; return nil },
+		func(c *Config) interface{} { return c.Listen.HTTP }},
+	{"listen.resp", "resp-listen", "address of the Redis protocol listener",
+		func(c *Config, v string) error { c.Listen.RESP = v; return nil },
+		func(c *Config) interface{} { return c.Listen.RESP }},
+	{"listen.metrics", "metrics-listen", "address of the Prometheus metrics listener",
+		func(c *Config, v string) error { c.Listen.Metrics = v; return nil },
+		func(c *Config) interface{} { return c.Listen.Metrics }},
+	{"listen.replication", "replication-listen", "address the followers connect to",
+		func(c *Config, v string) error { c.Listen.Replication = v; return nil },
+		func(c *Config) interface{} { return c.Listen.Replication }},
+	{"replicate_from", "replicate-from", "replication address of a primary to follow, read-only",
+		func(c *Config, v string) error { c.ReplicateFrom = v; return nil },
+		func(c *Config) interface{} { return c.ReplicateFrom }},
+}
+
+func (s *setting) env() string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func parseInt(v string) (int, error) {
+	return strconv.Atoi(strings.ReplaceAll(v, "_", ""))
+}
+
+// a size in bytes with an optional binary unit: 4096, 64KiB, 64MB, 1G.
+// K, M and G are powers of 1024 with or without the B and iB suffixes.
+func ParseSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		mult = 1 << 40
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(strings.ReplaceAll(s, "_", "")), 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/mult {
+		return 0, fmt.Errorf("bad size %q", v)
+	}
+	return n * mult, nil
+}
+
+// the command line flags of a config, see Load
+type Flags struct {
+	fs   *flag.FlagSet
+	file string
+	vals []*flagValue
+}
+
+type flagValue struct {
+	s   *setting
+	val string
+	set bool
+}
+
+func (f *flagValue) String() string {
+	return f.val
+}
+
+func (f *flagValue) Set(v string) error {
+	if err := f.s.set(&Config{}, v); err != nil {
+		return err
+	}
+	f.val, f.set = v, true
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	if f.s == nil {
+		return false
+	}
+	_, ok := f.s.get(&Config{}).(bool)
+	return ok
+}
+
+// register the config flags, including -config for the file
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs}
+	fs.StringVar(&f.file, "config", "", "path to a TOML or JSON config file (also $"+ENV_CONFIG+")")
+	def := Default()
+	for i := range settings {
+		s := &settings[i]
+		fv := &flagValue{s: s, val: formatValue(s.get(def))}
+		f.vals = append(f.vals, fv)
+		fs.Var(fv, s.flag, s.usage+" ($"+s.env()+")")
+	}
+	return f
+}
+
+// the effective config from the layers, call after parsing the flags
+func (f *Flags) Load() (*Config, error) {
+	cfg := Default()
+	path := f.file
+	if path == "" {
+		path = os.Getenv(ENV_CONFIG)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	for i := range settings {
+		s := &settings[i]
+		if v, ok := os.LookupEnv(s.env()); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("config: $%s: %v", s.env(), err)
+			}
+		}
+	}
+	for _, fv := range f.vals {
+		if fv.set {
+			if err := fv.s.set(cfg, fv.val); err != nil {
+				return nil, fmt.Errorf("config: -%s: %v", fv.s.flag, err)
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// parse the command line and load the config
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	f := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return f.Load()
+}
+
+// apply a config file, TOML unless the extension is .json
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	var vals map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		vals, err = parseJSON(data)
+	} else {
+		vals, err = parseTOML(string(data))
+	}
+	if err != nil {
+		return fmt.Errorf("config: %s: %v", path, err)
+	}
+
+	keys := []string{}
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := []error{}
+	for _, key := range keys {
+		s := lookup(key)
+		if s == nil {
+			errs = append(errs, fmt.Errorf("config: %s: unknown setting %s", path, key))
+			continue
+		}
+		if err := s.set(c, fmt.Sprint(vals[key])); err != nil {
+			errs = append(errs, fmt.Errorf("config: %s: %s: %v", path, key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func lookup(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// a JSON object flattened to dotted keys
+func parseJSON(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	obj := map[string]interface{}{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	var flatten func(prefix string, obj map[string]interface{})
+	flatten = func(prefix string, obj map[string]interface{}) {
+		for k, v := range obj {
+			if sub, ok := v.(map[string]interface{}); ok {
+				flatten(prefix+k+".", sub)
+			} else {
+				out[prefix+k] = v
+			}
+		}
+	}
+	flatten("", obj)
+	return out, nil
+}
+
+// check the settings, all problems are reported
+func (c *Config) Validate() error {
+	errs := []error{}
+	bad := func(key string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("config: %s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	if c.DataPath == "" {
+		bad("data_path", "is empty")
+	}
+	if _, ok := ioBackends[c.IOBackend]; !ok {
+		bad("io_backend", "%q is not one of mmap or pool", c.IOBackend)
+	}
+	if c.PageCacheSize < 0 {
+		bad("page_cache_size", "is negative")
+	}
+	if c.ChangelogSize < 0 {
+		bad("changelog_size", "is negative")
+	}
+	if c.ReplicateFrom != "" {
+		if c.Listen.Replication != "" {
+			bad("replicate_from", "a follower can't serve replication")
+		}
+		if _, port, err := net.SplitHostPort(c.ReplicateFrom); err != nil || port == "" {
+			bad("replicate_from", "%q is not a host:port address", c.ReplicateFrom)
+		}
+	}
+	if err := storage.CheckPageSize(int(c.PageSize)); err != nil {
+		bad("page_size", "%v", err)
+	}
+	if _, ok := syncModes[c.SyncMode]; !ok {
+		bad("sync_mode", "%q is not one of full, normal or off", c.SyncMode)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log_level", "%q is not one of debug, info, warn or error", c.LogLevel)
+	}
+	if c.MaxDBSize < 0 {
+		bad("max_db_size", "is negative")
+	} else if c.MaxDBSize != 0 && c.MaxDBSize < 2*c.PageSize {
+		bad("max_db_size", "must be at least %d bytes", 2*c.PageSize)
+	}
+	if c.MmapInitialSize <= 0 || c.PageSize > 0 && c.MmapInitialSize%c.PageSize != 0 {
+		bad("mmap_initial_size", "must be a positive multiple of the page size (%d)", c.PageSize)
+	}
+	if c.ShutdownTimeout < 0 {
+		bad("shutdown_timeout", "is negative")
+	}
+	if c.IdleInTxTimeout < 0 {
+		bad("idle_in_tx_timeout", "is negative")
+	}
+	addrs := map[string]string{
+		"listen.binary": c.Listen.Binary, "listen.pg": c.Listen.PG,
+		"listen.http": c.Listen.HTTP, "listen.resp": c.Listen.RESP,
+		"listen.metrics": c.Listen.Metrics, "listen.replication": c.Listen.Replication,
+	}
+	enabled := 0
+	for _, key := range []string{"listen.binary", "listen.pg", "listen.http", "listen.resp", "listen.metrics", "listen.replication"} {
+		if addrs[key] == "" {
+			continue
+		}
+		enabled++
+		if _, port, err := net.SplitHostPort(addrs[key]); err != nil || port == "" {
+			bad(key, "%q is not a host:port address", addrs[key])
+		}
+	}
+	if enabled == 0 {
+		bad("listen", "no listener is enabled")
+	}
+	return errors.Join(errs...)
+}
+
+var syncModes = map[string]int{
+	"full":   storage.SYNC_FULL,
+	"normal": storage.SYNC_NORMAL,
+	"off":    storage.SYNC_OFF,
+}
+
+var ioBackends = map[string]int{
+	"mmap": storage.BACKEND_MMAP,
+	"pool": storage.BACKEND_POOL,
+}
+
+// the options of the storage layer, without the key of KeyFile
+func (c *Config) StorageOptions() storage.Options {
+	return storage.Options{
+		PageSize:    int(c.PageSize),
+		Backend:     ioBackends[c.IOBackend],
+		MmapInitial: int(c.MmapInitialSize),
+		PageCache:   c.PageCacheSize,
+		MaxSize:     c.MaxDBSize,
+		SyncMode:    syncModes[c.SyncMode],
+		ReadOnly:    c.ReplicateFrom != "",
+		Changelog:   c.ChangelogSize,
+	}
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// write the config as TOML, the output can be loaded back
+func (c *Config) WriteTOML(w io.Writer) error {
+	// the top-level keys go before the tables
+	order := []*setting{}
+	for _, tables := range []bool{false, true} {
+		for i := range settings {
+			if strings.Contains(settings[i].key, ".") == tables {
+				order = append(order, &settings[i])
+			}
+		}
+	}
+	buf := bytes.Buffer{}
+	table := ""
+	for _, s := range order {
+		key := s.key
+		if dot := strings.LastIndexByte(key, '.'); dot >= 0 {
+			if t := key[:dot]; t != table {
+				table = t
+				fmt.Fprintf(&buf, "\n[%s]\n", table)
+			}
+			key = key[dot+1:]
+		}
+		switch v := s.get(c).(type) {
+		case string:
+			fmt.Fprintf(&buf, "%s = %s\n", key, tomlString(v))
+		case time.Duration:
+			fmt.Fprintf(&buf, "%s = %s\n", key, tomlString(v.String()))
+		default:
+			fmt.Fprintf(&buf, "%s = %v\n", key, v)
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// a TOML basic string
+func tomlString(s string) string {
+	out := strings.Builder{}
+	out.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, "\\u%04x", r)
+		default:
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// a TOML subset for config files: [tables], dotted keys, comments,
+// basic and literal strings, integers and booleans.
+// the result is flattened to dotted keys, e.g. "listen.http".
+func parseTOML(data string) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	table := ""
+	for n, line := range strings.Split(data, "\n") {
+		lineNo := n + 1
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: bad table header", lineNo)
+			}
+			if rest := strings.TrimSpace(line[end+1:]); rest != "" && rest[0] != '#' {
+				return nil, fmt.Errorf("line %d: unexpected %q", lineNo, rest)
+			}
+			key, rest, err := parseKey(strings.TrimSpace(line[1:end]))
+			if err != nil || rest != "" {
+				return nil, fmt.Errorf("line %d: bad table name", lineNo)
+			}
+			table = key
+			continue
+		}
+
+		key, rest, err := parseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if !strings.HasPrefix(rest, "=") {
+			return nil, fmt.Errorf("line %d: expected '=' after the key", lineNo)
+		}
+		val, rest, err := parseValue(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+			return nil, fmt.Errorf("line %d: unexpected %q", lineNo, rest)
+		}
+		if table != "" {
+			key = table + "." + key
+		}
+		if _, ok := out[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %s", lineNo, key)
+		}
+		out[key] = val
+	}
+	return out, nil
+}
+
+// a possibly dotted key, returns the rest of the line
+func parseKey(s string) (string, string, error) {
+	parts := []string{}
+	for {
+		s = strings.TrimSpace(s)
+		var part string
+		switch {
+		case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, `'`):
+			v, rest, err := parseString(s)
+			if err != nil {
+				return "", "", err
+			}
+			part, s = v, rest
+		default:
+			i := 0
+			for i < len(s) && isBareKeyChar(s[i]) {
+				i++
+			}
+			if i == 0 {
+				return "", "", fmt.Errorf("expected a key")
+			}
+			part, s = s[:i], s[i:]
+		}
+		parts = append(parts, part)
+		s = strings.TrimSpace(s)
+		if !strings.HasPrefix(s, ".") {
+			return strings.Join(parts, "."), s, nil
+		}
+		s = s[1:]
+	}
+}
+
+func isBareKeyChar(ch byte) bool {
+	return ch == '_' || ch == '-' ||
+		('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
+
+// a value, returns the rest of the line
+func parseValue(s string) (interface{}, string, error) {
+	switch {
+	case s == "":
+		return nil, "", fmt.Errorf("missing value")
+	case s[0] == '"' || s[0] == '\'':
+		return parseString(s)
+	case strings.HasPrefix(s, "true"):
+		return true, s[4:], nil
+	case strings.HasPrefix(s, "false"):
+		return false, s[5:], nil
+	}
+	i := 0
+	for i < len(s) && (s[i] == '+' || s[i] == '-' || s[i] == '_' || ('0' <= s[i] && s[i] <= '9')) {
+		i++
+	}
+	num := strings.ReplaceAll(s[:i], "_", "")
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || i == 0 {
+		return nil, "", fmt.Errorf("unsupported value %q", s)
+	}
+	return v, s[i:], nil
+}
+
+// a basic "string" or a literal 'string', returns the rest of the line
+func parseString(s string) (string, string, error) {
+	if s[0] == '\'' {
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : 1+end], s[2+end:], nil
+	}
+	out := strings.Builder{}
+	for i := 1; i < len(s); i++ {
+		switch ch := s[i]; ch {
+		case '"':
+			return out.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i >= len(s) {
+				return "", "", fmt.Errorf("unterminated string")
+			}
+			switch s[i] {
+			case '"', '\\':
+				out.WriteByte(s[i])
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case 'r':
+				out.WriteByte('\r')
+			case 'u', 'U':
+				size := 4
+				if s[i] == 'U' {
+					size = 8
+				}
+				if i+size >= len(s) {
+					return "", "", fmt.Errorf("bad unicode escape")
+				}
+				r, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", "", fmt.Errorf("bad unicode escape")
+				}
+				out.WriteRune(rune(r))
+				i += size
+			default:
+				return "", "", fmt.Errorf("bad escape \\%c", s[i])
+			}
+		default:
+			out.WriteByte(ch)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
@@ -2,4 +2,7 @@ module github.com/Ricky004/dungeonDB
 
 go 1.23.4
 
-require golang.org/x/sys v0.28.0
+require (
+	github.com/lib/pq v1.10.9
+	golang.org/x/sys v0.28.0
+)
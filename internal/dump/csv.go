@@ -0,0 +1,336 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// CSV quoting of the exports
+const (
+	QUOTE_MINIMAL = "minimal" // only the fields that need it
+	QUOTE_ALL     = "all"
+	QUOTE_NONE    = "none" // a field that needs quoting is an error
+)
+
+type CSVOptions struct {
+	Comma     rune   // the delimiter, ',' if 0
+	Quote     string // export: QUOTE_MINIMAL if empty
+	Header    bool   // export: write the column names first
+	Null      string // import: the field that stands for an omitted column
+	Batch     int    // import: rows per transaction, RESTORE_BATCH if 0
+	MaxErrors int    // import: give up after this many bad lines, 0 for no limit
+	// import: load the rows with DB.BulkLoad, nil for batched inserts
+	Bulk *storage.BulkOptions
+}
+
+func (opts *CSVOptions) comma() rune {
+	if opts.Comma == 0 {
+		return ','
+	}
+	return opts.Comma
+}
+
+// the outcome of an import
+type CSVStats struct {
+	Rows   int     // rows inserted
+	Errors []error // the bad lines, they are skipped
+}
+
+// import CSV rows into an existing table.
+// the header maps the fields to the columns, in any order, omitted
+// columns get their defaults. values are parsed by the column types.
+// a bad line is reported with its line number and skipped, the rows are
+// committed in batches, so a fatal error keeps the committed batches.
+// with opts.Bulk, the rows are loaded with DB.BulkLoad instead, the lines
+// that don't parse are still skipped but any other error loads nothing.
+func ImportCSV(db *storage.DB, table string, r io.Reader, opts CSVOptions) (stats CSVStats, err error) {
+	tdef := db.GetTableDef(table)
+	if tdef == nil {
+		return stats, fmt.Errorf("%w: %s", storage.ErrTableNotFound, table)
+	}
+	imp := &csvImport{tdef: tdef, opts: &opts, stats: &stats}
+	if err := imp.start(r); err != nil {
+		return stats, err
+	}
+	if opts.Bulk != nil {
+		bstats, err := db.BulkLoad(table, imp.next, *opts.Bulk)
+		stats.Rows = bstats.Rows
+		return stats, err
+	}
+
+	batch := opts.Batch
+	if batch <= 0 {
+		batch = RESTORE_BATCH
+	}
+	if err := db.Begin(); err != nil {
+		return stats, err
+	}
+	defer func() {
+		if err != nil {
+			_ = db.Abort()
+		} else {
+			err = db.Commit()
+		}
+	}()
+	pending := 0
+	for {
+		rec, ok, err := imp.next()
+		if err != nil || !ok {
+			return stats, err
+		}
+		added, err := db.Insert(table, &rec)
+		if err == nil && !added {
+			err = errors.New("duplicate primary key")
+		}
+		if err != nil {
+			if err := imp.skip(imp.line, err); err != nil {
+				return stats, err
+			}
+			continue
+		}
+		stats.Rows++
+		if pending++; pending == batch {
+			pending = 0
+			if err := db.Commit(); err != nil {
+				return stats, err
+			}
+			if err := db.Begin(); err != nil {
+				return stats, err
+			}
+		}
+	}
+}
+
+// parses the lines of an import into records
+type csvImport struct {
+	tdef   *storage.TableDef
+	opts   *CSVOptions
+	stats  *CSVStats
+	cr     *csv.Reader
+	header []string
+	cols   []int // field -> column
+	line   int   // of the last record
+}
+
+// read the header
+func (imp *csvImport) start(r io.Reader) error {
+	imp.cr = csv.NewReader(r)
+	imp.cr.Comma = imp.opts.comma()
+	imp.cr.ReuseRecord = true
+	fields, err := imp.cr.Read()
+	if err != nil {
+		return fmt.Errorf("import: reading the header: %w", err)
+	}
+	imp.header = make([]string, len(fields)) // the record is reused
+	imp.cols = make([]int, len(fields))
+	for i, name := range fields {
+		name = strings.TrimSpace(name)
+		imp.header[i] = name
+		imp.cols[i] = indexOf(imp.tdef.Cols, name)
+		if imp.cols[i] < 0 {
+			return fmt.Errorf("import: line 1: table %s has no column %q", imp.tdef.Name, name)
+		}
+		if indexOf(imp.header[:i], name) >= 0 {
+			return fmt.Errorf("import: line 1: duplicate column %q", name)
+		}
+	}
+	return nil
+}
+
+// record a bad line, fails after opts.MaxErrors of them
+func (imp *csvImport) skip(line int, err error) error {
+	imp.stats.Errors = append(imp.stats.Errors, &lineError{"import", line, err})
+	if imp.opts.MaxErrors > 0 && len(imp.stats.Errors) >= imp.opts.MaxErrors {
+		return fmt.Errorf("import: too many errors, stopped at line %d", line)
+	}
+	return nil
+}
+
+// the record of the next good line, false at the end, a storage.RowSource
+func (imp *csvImport) next() (storage.Record, bool, error) {
+	for {
+		fields, err := imp.cr.Read()
+		if err == io.EOF {
+			return storage.Record{}, false, nil
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			err, imp.line = perr.Err, perr.Line
+		} else if err == nil {
+			imp.line, _ = imp.cr.FieldPos(0)
+			var rec storage.Record
+			if rec, err = imp.record(fields); err == nil {
+				return rec, true, nil
+			}
+		}
+		if err := imp.skip(imp.line, err); err != nil {
+			return storage.Record{}, false, err
+		}
+	}
+}
+
+func (imp *csvImport) record(fields []string) (storage.Record, error) {
+	rec := storage.Record{}
+	if len(fields) != len(imp.header) {
+		return rec, fmt.Errorf("%d fields for %d columns", len(fields), len(imp.header))
+	}
+	for i, field := range fields {
+		if field == imp.opts.Null {
+			continue
+		}
+		col := imp.cols[i]
+		v := storage.Value{Type: imp.tdef.Types[col]}
+		switch v.Type {
+		case storage.TYPE_INT64:
+			i64, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+			if err != nil {
+				return rec, fmt.Errorf("column %s: bad integer %q", imp.tdef.Cols[col], field)
+			}
+			v.I64 = i64
+		case storage.TYPE_BYTES:
+			v.Str = []byte(field)
+		}
+		rec.Cols = append(rec.Cols, imp.tdef.Cols[col])
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// a CSV writer with a choice of quoting
+type csvWriter struct {
+	w     *bufio.Writer
+	comma rune
+	quote string
+	row   []string
+}
+
+func newCSVWriter(w io.Writer, opts CSVOptions) (*csvWriter, error) {
+	cw := &csvWriter{w: bufio.NewWriter(w), comma: opts.comma(), quote: opts.Quote}
+	switch cw.quote {
+	case "":
+		cw.quote = QUOTE_MINIMAL
+	case QUOTE_MINIMAL, QUOTE_ALL, QUOTE_NONE:
+	default:
+		return nil, fmt.Errorf("export: unknown quoting %q", opts.Quote)
+	}
+	if cw.comma == '"' || cw.comma == '\r' || cw.comma == '\n' {
+		return nil, fmt.Errorf("export: bad delimiter %q", cw.comma)
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) needsQuotes(field string) bool {
+	return field != "" && (strings.ContainsRune(field, cw.comma) ||
+		strings.ContainsAny(field, "\"\r\n") || field[0] == ' ' || field[len(field)-1] == ' ')
+}
+
+func (cw *csvWriter) write(fields []string) error {
+	for i, field := range fields {
+		if i > 0 {
+			cw.w.WriteRune(cw.comma)
+		}
+		quoted := cw.quote == QUOTE_ALL || (cw.quote == QUOTE_MINIMAL && cw.needsQuotes(field))
+		if cw.quote == QUOTE_NONE && cw.needsQuotes(field) {
+			return fmt.Errorf("export: the field %q needs quoting", field)
+		}
+		if quoted {
+			cw.w.WriteByte('"')
+			cw.w.WriteString(strings.ReplaceAll(field, `"`, `""`))
+			cw.w.WriteByte('"')
+		} else {
+			cw.w.WriteString(field)
+		}
+	}
+	_, err := cw.w.WriteString("\n")
+	return err
+}
+
+func (cw *csvWriter) values(vals []storage.Value) error {
+	cw.row = cw.row[:0]
+	for _, v := range vals {
+		if v.Type == storage.TYPE_INT64 {
+			cw.row = append(cw.row, strconv.FormatInt(v.I64, 10))
+		} else {
+			cw.row = append(cw.row, string(v.Str))
+		}
+	}
+	return cw.write(cw.row)
+}
+
+// stream a table to CSV in primary key order, returns the number of rows
+func ExportCSV(db *storage.DB, table string, w io.Writer, opts CSVOptions) (int, error) {
+	tdef := db.GetTableDef(table)
+	if tdef == nil {
+		return 0, fmt.Errorf("%w: %s", storage.ErrTableNotFound, table)
+	}
+	cw, err := newCSVWriter(w, opts)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Header {
+		if err := cw.write(tdef.Cols); err != nil {
+			return 0, err
+		}
+	}
+	sc := storage.Scanner{Cmp1: storage.CMP_GE, Cmp2: storage.CMP_LE}
+	if err := db.Scan(table, &sc); err != nil {
+		return 0, err
+	}
+	n := 0
+	for rec := (storage.Record{}); sc.Valid(); sc.Next() {
+		sc.Deref(&rec)
+		if err := cw.values(rec.Vals); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, cw.w.Flush()
+}
+
+// run a SELECT and write its result to CSV, returns the number of rows
+func ExportQueryCSV(db *storage.DB, sql string, w io.Writer, opts CSVOptions) (int, error) {
+	stmt, err := parser.Parse(sql)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := stmt.Stmt.(*parser.Select); !ok {
+		return 0, errors.New("export: the query must be a SELECT")
+	}
+	res, err := executer.Exec(db, stmt, nil)
+	if err != nil {
+		return 0, err
+	}
+	cw, err := newCSVWriter(w, opts)
+	if err != nil {
+		return 0, err
+	}
+	if opts.Header {
+		if err := cw.write(res.Cols); err != nil {
+			return 0, err
+		}
+	}
+	for i, row := range res.Rows {
+		if err := cw.values(row); err != nil {
+			return i, err
+		}
+	}
+	return len(res.Rows), cw.w.Flush()
+}
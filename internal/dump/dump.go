@@ -0,0 +1,252 @@
+// Package dump writes the schema and the rows of a database in a portable
+// text format, and loads them back into another database.
+//
+// the SQL format is a script of CREATE SEQUENCE, CREATE TABLE, INSERT and
+// ALTER SEQUENCE statements, one per line. the JSON Lines format has one
+// object per line:
+//
+//	{"sequence":"s","next":5}
+//	{"table":{"name":"t","cols":["id","name"],"types":["int64","bytes"],"pkeys":1}}
+//	{"row":"t","values":[1,"ann"]}
+//
+// bytes are a JSON string if they are valid UTF-8, {"base64":"..."} otherwise.
+// a restore creates the tables with TableNew, so the key prefixes are reassigned.
+package dump
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// dump formats
+const (
+	FORMAT_SQL   = "sql"
+	FORMAT_JSONL = "jsonl"
+)
+
+// rows restored per transaction
+const RESTORE_BATCH = 1000
+
+// what was dumped or restored
+type Stats struct {
+	Tables    int
+	Rows      int
+	Sequences int
+}
+
+// write the whole database, the caller serializes access to it
+func Dump(db *storage.DB, w io.Writer, format string) (Stats, error) {
+	var enc encoder
+	switch format {
+	case FORMAT_SQL:
+		enc = &sqlEncoder{}
+	case FORMAT_JSONL:
+		enc = &jsonEncoder{}
+	default:
+		return Stats{}, fmt.Errorf("dump: unknown format %q", format)
+	}
+	bw := bufio.NewWriter(w)
+	stats, err := dump(db, bw, enc)
+	if err == nil {
+		err = bw.Flush()
+	}
+	return stats, err
+}
+
+// the output of a format
+type encoder interface {
+	sequence(w *bufio.Writer, name string, next int64, created bool) error
+	table(w *bufio.Writer, tdef *storage.TableDef) error
+	row(w *bufio.Writer, tdef *storage.TableDef, rec storage.Record) error
+}
+
+func dump(db *storage.DB, w *bufio.Writer, enc encoder) (stats Stats, err error) {
+	defs, err := db.TableDefs()
+	if err != nil {
+		return stats, err
+	}
+	seqs, err := db.Sequences()
+	if err != nil {
+		return stats, err
+	}
+	auto := map[string]*storage.TableDef{}
+	for _, tdef := range defs {
+		if tdef.AutoIncrement {
+			auto[storage.AutoSeqName(tdef)] = tdef
+		}
+	}
+
+	// the standalone sequences, those of the tables follow their rows
+	names := []string{}
+	for name := range seqs {
+		if auto[name] == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := enc.sequence(w, name, seqs[name], false); err != nil {
+			return stats, err
+		}
+		stats.Sequences++
+	}
+
+	for _, tdef := range defs {
+		if err := enc.table(w, tdef); err != nil {
+			return stats, err
+		}
+		stats.Tables++
+		sc := storage.Scanner{Cmp1: storage.CMP_GE, Cmp2: storage.CMP_LE}
+		if err := db.Scan(tdef.Name, &sc); err != nil {
+			return stats, err
+		}
+		for rec := (storage.Record{}); sc.Valid(); sc.Next() {
+			sc.Deref(&rec)
+			if err := enc.row(w, tdef, rec); err != nil {
+				return stats, err
+			}
+			stats.Rows++
+		}
+		if next, ok := seqs[storage.AutoSeqName(tdef)]; ok && tdef.AutoIncrement {
+			if err := enc.sequence(w, storage.AutoSeqName(tdef), next, true); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+// load a dump into `db`, the tables must not exist.
+// the rows are committed in batches, a failure leaves the committed part.
+func Restore(db *storage.DB, r io.Reader, format string) (Stats, error) {
+	rs := &restorer{db: db}
+	var err error
+	switch format {
+	case FORMAT_SQL:
+		err = rs.run(func() error { return restoreSQL(rs, r) })
+	case FORMAT_JSONL:
+		err = rs.run(func() error { return restoreJSON(rs, r) })
+	default:
+		err = fmt.Errorf("restore: unknown format %q", format)
+	}
+	return rs.stats, err
+}
+
+type restorer struct {
+	db      *storage.DB
+	stats   Stats
+	pending int // updates in the current transaction
+}
+
+func (rs *restorer) run(fn func() error) error {
+	if err := rs.db.Begin(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		_ = rs.db.Abort()
+		return err
+	}
+	return rs.db.Commit()
+}
+
+// count an update, commit a full batch
+func (rs *restorer) step() error {
+	rs.pending++
+	if rs.pending < RESTORE_BATCH {
+		return nil
+	}
+	rs.pending = 0
+	if err := rs.db.Commit(); err != nil {
+		return err
+	}
+	return rs.db.Begin()
+}
+
+func (rs *restorer) sequence(name string, next int64) error {
+	rs.stats.Sequences++
+	seqs, err := rs.db.Sequences()
+	if err != nil {
+		return err
+	}
+	if _, ok := seqs[name]; ok {
+		return rs.db.SequenceRestart(name, next)
+	}
+	return rs.db.SequenceNew(name, next)
+}
+
+func (rs *restorer) table(tdef *storage.TableDef) error {
+	if err := rs.db.TableNew(tdef); err != nil {
+		return err
+	}
+	rs.stats.Tables++
+	return rs.step()
+}
+
+func (rs *restorer) row(table string, rec storage.Record) error {
+	added, err := rs.db.Insert(table, &rec)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return fmt.Errorf("duplicate primary key in table %s", table)
+	}
+	rs.stats.Rows++
+	return rs.step()
+}
+
+// a line number for the errors of a restore or an import
+type lineError struct {
+	op   string
+	line int
+	err  error
+}
+
+func (e *lineError) Error() string {
+	return fmt.Sprintf("%s: line %d: %v", e.op, e.line, e.err)
+}
+
+func (e *lineError) Unwrap() error {
+	return e.err
+}
+
+// the type names of the dump formats
+func typeName(typ uint32) string {
+	switch typ {
+	case storage.TYPE_INT64:
+		return "int64"
+	case storage.TYPE_BYTES:
+		return "bytes"
+	default:
+		return "unknown"
+	}
+}
+
+func typeFromName(name string) (uint32, error) {
+	switch strings.ToLower(name) {
+	case "int64":
+		return storage.TYPE_INT64, nil
+	case "bytes":
+		return storage.TYPE_BYTES, nil
+	default:
+		return 0, fmt.Errorf("unknown type %q", name)
+	}
+}
+
+// bytes that read well as text
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
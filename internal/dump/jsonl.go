@@ -0,0 +1,212 @@
+package dump
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+type jsonEncoder struct{}
+
+// a table in the JSON Lines format
+type jsonTable struct {
+	Name          string        `json:"name"`
+	Cols          []string      `json:"cols"`
+	Types         []string      `json:"types"`
+	Pkeys         int           `json:"pkeys"`
+	Indexes       [][]string    `json:"indexes,omitempty"`
+	Defaults      []interface{} `json:"defaults,omitempty"`
+	NotNull       []bool        `json:"not_null,omitempty"`
+	Checks        []string      `json:"checks,omitempty"`
+	AutoIncrement bool          `json:"auto_increment,omitempty"`
+	Compression   string        `json:"compression,omitempty"`
+	TTL           string        `json:"ttl,omitempty"`
+}
+
+// a line in the JSON Lines format, one of sequence, table and row is set
+type jsonLine struct {
+	Sequence *string       `json:"sequence,omitempty"`
+	Next     *int64        `json:"next,omitempty"`
+	Table    *jsonTable    `json:"table,omitempty"`
+	Row      *string       `json:"row,omitempty"`
+	Values   []interface{} `json:"values,omitempty"`
+}
+
+// the longest line of a restore, a row fits in a page but base64 expands it
+const JSONL_MAX_LINE = 1 << 20
+
+func writeLine(w *bufio.Writer, line jsonLine) error {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.WriteByte('\n')
+}
+
+func jsonValue(v storage.Value) interface{} {
+	switch {
+	case v.Type == storage.TYPE_INT64:
+		return v.I64
+	case utf8.Valid(v.Str):
+		return string(v.Str)
+	default:
+		return map[string][]byte{"base64": v.Str}
+	}
+}
+
+// the inverse of jsonValue, numbers are json.Number
+func valueFromJSON(x interface{}, typ uint32) (storage.Value, error) {
+	v := storage.Value{Type: typ}
+	switch typ {
+	case storage.TYPE_INT64:
+		n, ok := x.(json.Number)
+		if !ok {
+			return v, fmt.Errorf("expected an integer, got %v", x)
+		}
+		i64, err := n.Int64()
+		if err != nil {
+			return v, fmt.Errorf("bad integer %s", n)
+		}
+		v.I64 = i64
+	case storage.TYPE_BYTES:
+		switch x := x.(type) {
+		case string:
+			v.Str = []byte(x)
+		case map[string]interface{}:
+			b64, ok := x["base64"].(string)
+			if !ok || len(x) != 1 {
+				return v, errors.New(`expected a string or {"base64": "..."}`)
+			}
+			str, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return v, fmt.Errorf("bad base64: %v", err)
+			}
+			v.Str = str
+		default:
+			return v, fmt.Errorf("expected a string, got %v", x)
+		}
+	}
+	return v, nil
+}
+
+func (*jsonEncoder) sequence(w *bufio.Writer, name string, next int64, created bool) error {
+	return writeLine(w, jsonLine{Sequence: &name, Next: &next})
+}
+
+func (*jsonEncoder) table(w *bufio.Writer, tdef *storage.TableDef) error {
+	t := &jsonTable{
+		Name: tdef.Name, Cols: tdef.Cols, Pkeys: tdef.Pkeys,
+		Indexes: tdef.Indexes, NotNull: tdef.NotNull, Checks: tdef.Checks,
+		AutoIncrement: tdef.AutoIncrement, Compression: tdef.Compression, TTL: tdef.TTL,
+	}
+	for _, typ := range tdef.Types {
+		t.Types = append(t.Types, typeName(typ))
+	}
+	for _, def := range tdef.Defaults {
+		if def == nil {
+			t.Defaults = append(t.Defaults, nil)
+		} else {
+			t.Defaults = append(t.Defaults, jsonValue(*def))
+		}
+	}
+	return writeLine(w, jsonLine{Table: t})
+}
+
+func (*jsonEncoder) row(w *bufio.Writer, tdef *storage.TableDef, rec storage.Record) error {
+	vals := []interface{}{}
+	for _, v := range rec.Vals {
+		vals = append(vals, jsonValue(v))
+	}
+	return writeLine(w, jsonLine{Row: &tdef.Name, Values: vals})
+}
+
+func (t *jsonTable) tableDef() (*storage.TableDef, error) {
+	tdef := &storage.TableDef{
+		Name: t.Name, Cols: t.Cols, Pkeys: t.Pkeys,
+		Indexes: t.Indexes, NotNull: t.NotNull, Checks: t.Checks,
+		AutoIncrement: t.AutoIncrement, Compression: t.Compression, TTL: t.TTL,
+	}
+	for _, name := range t.Types {
+		typ, err := typeFromName(name)
+		if err != nil {
+			return nil, err
+		}
+		tdef.Types = append(tdef.Types, typ)
+	}
+	if t.Defaults != nil && len(t.Defaults) != len(tdef.Types) {
+		return nil, fmt.Errorf("table %s: %d defaults for %d columns", t.Name, len(t.Defaults), len(tdef.Types))
+	}
+	for i, x := range t.Defaults {
+		if x == nil {
+			tdef.Defaults = append(tdef.Defaults, nil)
+			continue
+		}
+		v, err := valueFromJSON(x, tdef.Types[i])
+		if err != nil {
+			return nil, fmt.Errorf("table %s: default of %s: %v", t.Name, t.Cols[i], err)
+		}
+		tdef.Defaults = append(tdef.Defaults, &v)
+	}
+	return tdef, nil
+}
+
+func restoreJSON(rs *restorer, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), JSONL_MAX_LINE)
+	for n := 1; sc.Scan(); n++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		if err := restoreLine(rs, sc.Bytes()); err != nil {
+			return &lineError{"restore", n, err}
+		}
+	}
+	return sc.Err()
+}
+
+func restoreLine(rs *restorer, data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	dec.DisallowUnknownFields()
+	line := jsonLine{}
+	if err := dec.Decode(&line); err != nil {
+		return err
+	}
+	switch {
+	case line.Sequence != nil && line.Next != nil:
+		return rs.sequence(*line.Sequence, *line.Next)
+	case line.Table != nil:
+		tdef, err := line.Table.tableDef()
+		if err != nil {
+			return err
+		}
+		return rs.table(tdef)
+	case line.Row != nil:
+		tdef := rs.db.GetTableDef(*line.Row)
+		if tdef == nil {
+			return fmt.Errorf("%w: %s", storage.ErrTableNotFound, *line.Row)
+		}
+		if len(line.Values) != len(tdef.Cols) {
+			return fmt.Errorf("table %s: %d values for %d columns", tdef.Name, len(line.Values), len(tdef.Cols))
+		}
+		rec := storage.Record{Cols: append([]string{}, tdef.Cols...)}
+		for i, x := range line.Values {
+			v, err := valueFromJSON(x, tdef.Types[i])
+			if err != nil {
+				return fmt.Errorf("table %s: column %s: %v", tdef.Name, tdef.Cols[i], err)
+			}
+			rec.Vals = append(rec.Vals, v)
+		}
+		return rs.row(tdef.Name, rec)
+	default:
+		return errors.New("expected a sequence, a table or a row")
+	}
+}
@@ -0,0 +1,208 @@
+package dump
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+type sqlEncoder struct{}
+
+// an identifier, quoted unless it's a plain one
+func sqlIdent(name string) (string, error) {
+	plain := name != ""
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if !(ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || (i > 0 && '0' <= ch && ch <= '9')) {
+			plain = false
+		}
+	}
+	if plain {
+		return name, nil
+	}
+	if name == "" || strings.ContainsRune(name, '"') {
+		return "", fmt.Errorf("dump: the name %q cannot be written in SQL", name)
+	}
+	return `"` + name + `"`, nil
+}
+
+func sqlString(b []byte) string {
+	return "'" + strings.ReplaceAll(string(b), "'", "''") + "'"
+}
+
+func sqlValue(v storage.Value) string {
+	switch {
+	case v.Type == storage.TYPE_INT64:
+		return strconv.FormatInt(v.I64, 10)
+	case printable(v.Str):
+		return sqlString(v.Str)
+	default:
+		return "UNHEX('" + hex.EncodeToString(v.Str) + "')"
+	}
+}
+
+func sqlNames(names []string) (string, error) {
+	out := []string{}
+	for _, name := range names {
+		id, err := sqlIdent(name)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, id)
+	}
+	return strings.Join(out, ", "), nil
+}
+
+func (*sqlEncoder) sequence(w *bufio.Writer, name string, next int64, created bool) error {
+	id, err := sqlIdent(name)
+	if err != nil {
+		return err
+	}
+	if created {
+		_, err = fmt.Fprintf(w, "ALTER SEQUENCE %s RESTART WITH %d;\n", id, next)
+	} else {
+		_, err = fmt.Fprintf(w, "CREATE SEQUENCE %s START WITH %d;\n", id, next)
+	}
+	return err
+}
+
+func (*sqlEncoder) table(w *bufio.Writer, tdef *storage.TableDef) error {
+	name, err := sqlIdent(tdef.Name)
+	if err != nil {
+		return err
+	}
+	parts := []string{}
+	for i, col := range tdef.Cols {
+		id, err := sqlIdent(col)
+		if err != nil {
+			return err
+		}
+		part := id + " " + strings.ToUpper(typeName(tdef.Types[i]))
+		if i == 0 && tdef.AutoIncrement {
+			part += " AUTOINCREMENT"
+		}
+		if col == tdef.TTL {
+			part += " TTL"
+		}
+		if tdef.NotNull != nil && tdef.NotNull[i] {
+			part += " NOT NULL"
+		}
+		if tdef.Defaults != nil && tdef.Defaults[i] != nil {
+			def := *tdef.Defaults[i]
+			if def.Type == storage.TYPE_INT64 {
+				part += " DEFAULT " + strconv.FormatInt(def.I64, 10)
+			} else {
+				part += " DEFAULT " + sqlString(def.Str) // a literal, not UNHEX()
+			}
+		}
+		parts = append(parts, part)
+	}
+	pkeys, err := sqlNames(tdef.Cols[:tdef.Pkeys])
+	if err != nil {
+		return err
+	}
+	parts = append(parts, "PRIMARY KEY ("+pkeys+")")
+	for _, index := range tdef.Indexes {
+		cols, err := sqlNames(index)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, "INDEX ("+cols+")")
+	}
+	for _, check := range tdef.Checks {
+		parts = append(parts, "CHECK ("+check+")")
+	}
+	suffix := ""
+	if tdef.Compression != "" {
+		suffix = " COMPRESSION " + tdef.Compression
+	}
+	_, err = fmt.Fprintf(w, "CREATE TABLE %s (%s)%s;\n", name, strings.Join(parts, ", "), suffix)
+	return err
+}
+
+func (*sqlEncoder) row(w *bufio.Writer, tdef *storage.TableDef, rec storage.Record) error {
+	name, err := sqlIdent(tdef.Name)
+	if err != nil {
+		return err
+	}
+	cols, err := sqlNames(rec.Cols)
+	if err != nil {
+		return err
+	}
+	vals := []string{}
+	for _, v := range rec.Vals {
+		vals = append(vals, sqlValue(v))
+	}
+	_, err = fmt.Fprintf(w, "INSERT INTO %s (%s) VALUES (%s);\n", name, cols, strings.Join(vals, ", "))
+	return err
+}
+
+func restoreSQL(rs *restorer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	buf := strings.Builder{}
+	line, start := 0, 1 // the first line of the buffered statements
+	for {
+		text, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+		line++
+		buf.WriteString(text)
+		// run the buffered statements at the end of one, or of the input
+		if rerr == nil && !strings.HasSuffix(strings.TrimSpace(text), ";") {
+			continue
+		}
+		stmts, err := parser.Split(buf.String())
+		if err != nil && rerr == nil {
+			continue // a ';' inside a string
+		}
+		if err != nil {
+			return &lineError{"restore", start, err}
+		}
+		for _, stmt := range stmts {
+			if err := rs.exec(stmt); err != nil {
+				return &lineError{"restore", start, err}
+			}
+		}
+		buf.Reset()
+		start = line + 1
+		if rerr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// run a statement of a SQL dump
+func (rs *restorer) exec(sql string) error {
+	stmt, err := parser.Parse(sql)
+	if err != nil {
+		return err
+	}
+	switch s := stmt.Stmt.(type) {
+	case *parser.CreateTable:
+		tdef := s.Def
+		return rs.table(&tdef)
+	case *parser.CreateSequence:
+		return rs.sequence(s.Name, s.Start)
+	case *parser.AlterSequence:
+		return rs.sequence(s.Name, s.Restart)
+	case *parser.Insert:
+		if s.Mode != storage.MODE_INSERT_ONLY {
+			break
+		}
+		res, err := executer.Exec(rs.db, stmt, nil)
+		if err != nil {
+			return err
+		}
+		rs.stats.Rows += int(res.Affected)
+		return rs.step()
+	}
+	return fmt.Errorf("unexpected statement in a dump: %s", sql)
+}
@@ -0,0 +1,124 @@
+package executer
+
+import (
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the output columns of a statement without executing it,
+// nil for statements without rows. the args can be nil if unknown.
+func Describe(db *storage.DB, stmt *parser.Statement, args []storage.Value) ([]string, []uint32, error) {
+	s, ok := stmt.Stmt.(*parser.Select)
+	if !ok {
+		return nil, nil, nil
+	}
+	ex := &executer{db: db, args: args}
+	if s.Table != "" {
+		tdef, err := ex.tableDef(s.Table)
+		if err != nil {
+			return nil, nil, err
+		}
+		ex.tdef = tdef
+		if s.Star {
+			return tdef.Cols, tdef.Types, nil
+		}
+	}
+	types := []uint32{}
+	for _, expr := range s.Exprs {
+		types = append(types, ex.typeOf(expr))
+	}
+	return s.Names, types, nil
+}
+
+// the expected types of the placeholders, inferred from the columns
+// they are compared with or assigned to. TYPE_BYTES if unknown.
+func ParamTypes(db *storage.DB, stmt *parser.Statement) []uint32 {
+	types := make([]uint32, stmt.NumParams)
+	for i := range types {
+		types[i] = storage.TYPE_BYTES
+	}
+	var tdef *storage.TableDef
+	colType := func(expr parser.Expr, col string) {
+		p, ok := expr.(*parser.Param)
+		if !ok || tdef == nil {
+			return
+		}
+		if i := indexOf(tdef.Cols, col); i >= 0 {
+			types[p.Index] = tdef.Types[i]
+		}
+	}
+	var walk func(expr parser.Expr)
+	walk = func(expr parser.Expr) {
+		switch e := expr.(type) {
+		case *parser.Unary:
+			if e.Op == "-" {
+				if p, ok := e.Expr.(*parser.Param); ok {
+					types[p.Index] = storage.TYPE_INT64
+				}
+			}
+			walk(e.Expr)
+		case *parser.Binary:
+			switch e.Op {
+			case "AND", "OR":
+			case "=", "!=", "<", "<=", ">", ">=":
+				if c, ok := e.Left.(*parser.Column); ok {
+					colType(e.Right, c.Name)
+				}
+				if c, ok := e.Right.(*parser.Column); ok {
+					colType(e.Left, c.Name)
+				}
+			default: // arithmetic
+				for _, side := range []parser.Expr{e.Left, e.Right} {
+					if p, ok := side.(*parser.Param); ok {
+						types[p.Index] = storage.TYPE_INT64
+					}
+				}
+			}
+			walk(e.Left)
+			walk(e.Right)
+		case *parser.Call:
+			for _, arg := range e.Args {
+				walk(arg)
+			}
+		}
+	}
+
+	switch s := stmt.Stmt.(type) {
+	case *parser.Insert:
+		tdef = db.GetTableDef(s.Table)
+		cols := s.Cols
+		if cols == nil && tdef != nil {
+			cols = tdef.Cols
+		}
+		for _, row := range s.Rows {
+			for i, expr := range row {
+				if i < len(cols) {
+					colType(expr, cols[i])
+				}
+				walk(expr)
+			}
+		}
+	case *parser.Select:
+		if s.Table != "" {
+			tdef = db.GetTableDef(s.Table)
+		}
+		for _, expr := range s.Exprs {
+			walk(expr)
+		}
+		walk(s.Where)
+		if p, ok := s.Limit.(*parser.Param); ok {
+			types[p.Index] = storage.TYPE_INT64
+		}
+	case *parser.Update:
+		tdef = db.GetTableDef(s.Table)
+		for i, expr := range s.Vals {
+			colType(expr, s.Cols[i])
+			walk(expr)
+		}
+		walk(s.Where)
+	case *parser.Delete:
+		tdef = db.GetTableDef(s.Table)
+		walk(s.Where)
+	}
+	return types
+}
@@ -1 +1,673 @@
-package executer
\ No newline at end of file
+package executer
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the result of a statement
+type Result struct {
+	Cols         []string // output columns, nil for statements without rows
+	Types        []uint32 // TYPE_INT64 or TYPE_BYTES
+	Rows         [][]storage.Value
+	Affected     int64 // number of rows inserted, updated or deleted
+	LastInsertID int64 // the last AUTOINCREMENT key assigned by INSERT
+}
+
+// execute a parsed statement with the placeholder values.
+// the caller serializes access to the DB.
+func Exec(db *storage.DB, stmt *parser.Statement, args []storage.Value) (*Result, error) {
+	return ExecContext(context.Background(), db, stmt, args)
+}
+
+// like Exec, the statement is interrupted between the rows once ctx is
+// done. it's rolled back unless it runs in a transaction, which is then
+// left with the rows updated so far, like for the other errors.
+func ExecContext(
+	ctx context.Context, db *storage.DB, stmt *parser.Statement, args []storage.Value,
+) (*Result, error) {
+	if len(args) != stmt.NumParams {
+		return nil, fmt.Errorf("expected %d arguments, got %d", stmt.NumParams, len(args))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ex := &executer{ctx: ctx, db: db, args: args}
+	switch s := stmt.Stmt.(type) {
+	case *parser.CreateTable:
+		tdef := s.Def // TableNew assigns the prefixes
+		return &Result{}, db.TableNew(&tdef)
+	case *parser.CreateSequence:
+		return &Result{}, db.SequenceNew(s.Name, s.Start)
+	case *parser.AlterSequence:
+		return &Result{}, db.SequenceRestart(s.Name, s.Restart)
+	case *parser.AlterTable:
+		return &Result{}, db.SetCompression(s.Name, s.Compression)
+	case *parser.Insert:
+		return ex.atomically(func() (*Result, error) { return ex.insert(s) })
+	case *parser.Select:
+		return ex.query(s)
+	case *parser.Update:
+		return ex.atomically(func() (*Result, error) { return ex.update(s) })
+	case *parser.Delete:
+		return ex.atomically(func() (*Result, error) { return ex.delete(s) })
+	case *parser.Begin:
+		return &Result{}, db.Begin()
+	case *parser.Commit:
+		return &Result{}, db.Commit()
+	case *parser.Rollback:
+		return &Result{}, db.Abort()
+	case *parser.Vacuum:
+		_, err := db.Vacuum(storage.VacuumOptions{Incremental: s.Incremental})
+		return &Result{}, err
+	default:
+		panic("bad statement")
+	}
+}
+
+type executer struct {
+	ctx  context.Context
+	db   *storage.DB
+	args []storage.Value
+	// the current row
+	tdef *storage.TableDef
+	row  []storage.Value // indexed like tdef.Cols
+}
+
+// statements outside of a transaction are all or nothing
+func (ex *executer) atomically(fn func() (*Result, error)) (*Result, error) {
+	if ex.db.InTx() {
+		return fn()
+	}
+	if err := ex.db.Begin(); err != nil {
+		return nil, err
+	}
+	res, err := fn()
+	if err != nil {
+		_ = ex.db.Abort()
+		return nil, err
+	}
+	return res, ex.db.Commit()
+}
+
+func (ex *executer) tableDef(name string) (*storage.TableDef, error) {
+	tdef := ex.db.GetTableDef(name)
+	if tdef == nil {
+		return nil, fmt.Errorf("%w: %s", storage.ErrTableNotFound, name)
+	}
+	return tdef, nil
+}
+
+func (ex *executer) insert(s *parser.Insert) (*Result, error) {
+	tdef, err := ex.tableDef(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	cols := s.Cols
+	if cols == nil {
+		cols = tdef.Cols
+	}
+	res := &Result{}
+	for _, exprs := range s.Rows {
+		if err := ex.ctx.Err(); err != nil {
+			return nil, err
+		}
+		if len(exprs) != len(cols) {
+			return nil, fmt.Errorf("table %s: %d values for %d columns", tdef.Name, len(exprs), len(cols))
+		}
+		rec := storage.Record{}
+		for i, expr := range exprs {
+			v, err := ex.eval(expr)
+			if err != nil {
+				return nil, err
+			}
+			rec.Cols = append(rec.Cols, cols[i])
+			rec.Vals = append(rec.Vals, v)
+		}
+		if s.Mode == storage.MODE_UPSERT {
+			_, err = ex.db.Upsert(tdef.Name, rec)
+		} else {
+			added := false
+			added, err = ex.db.Insert(tdef.Name, &rec)
+			if err == nil && !added {
+				err = fmt.Errorf("table %s: duplicate primary key", tdef.Name)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tdef.AutoIncrement {
+			res.LastInsertID = rec.Get(tdef.Cols[0]).I64
+		}
+		res.Affected++
+	}
+	return res, nil
+}
+
+func (ex *executer) query(s *parser.Select) (*Result, error) {
+	res := &Result{Cols: s.Names}
+	limit := int64(-1)
+	if s.Limit != nil {
+		v, err := ex.eval(s.Limit)
+		if err != nil {
+			return nil, err
+		}
+		if v.Type != storage.TYPE_INT64 || v.I64 < 0 {
+			return nil, fmt.Errorf("LIMIT must be a non-negative integer")
+		}
+		limit = v.I64
+	}
+
+	// SELECT without FROM
+	if s.Table == "" {
+		for _, expr := range s.Exprs {
+			res.Types = append(res.Types, ex.typeOf(expr))
+		}
+		if limit == 0 {
+			return res, nil
+		}
+		row, err := ex.project(s)
+		if err != nil {
+			return nil, err
+		}
+		res.Rows = append(res.Rows, row)
+		return res, nil
+	}
+
+	tdef, err := ex.tableDef(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	ex.tdef = tdef
+	if s.Star {
+		res.Cols, res.Types = tdef.Cols, tdef.Types
+	} else {
+		for _, expr := range s.Exprs {
+			res.Types = append(res.Types, ex.typeOf(expr))
+		}
+	}
+	err = ex.scan(tdef, s.Where, func() (bool, error) {
+		if limit >= 0 && int64(len(res.Rows)) >= limit {
+			return false, nil
+		}
+		row, err := ex.project(s)
+		if err != nil {
+			return false, err
+		}
+		res.Rows = append(res.Rows, row)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// the output row of a SELECT
+func (ex *executer) project(s *parser.Select) ([]storage.Value, error) {
+	if s.Star {
+		return append([]storage.Value{}, ex.row...), nil
+	}
+	row := make([]storage.Value, len(s.Exprs))
+	for i, expr := range s.Exprs {
+		v, err := ex.eval(expr)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = v
+	}
+	return row, nil
+}
+
+func (ex *executer) update(s *parser.Update) (*Result, error) {
+	tdef, err := ex.tableDef(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	ex.tdef = tdef
+	for _, col := range s.Cols {
+		if indexOf(tdef.Cols, col) < 0 {
+			return nil, fmt.Errorf("column %s not found in table %s", col, tdef.Name)
+		}
+	}
+	// collect the new rows first, the tree can't be modified while scanning
+	olds, news := [][]storage.Value{}, [][]storage.Value{}
+	err = ex.scan(tdef, s.Where, func() (bool, error) {
+		row := append([]storage.Value{}, ex.row...)
+		for i, col := range s.Cols {
+			v, err := ex.eval(s.Vals[i])
+			if err != nil {
+				return false, err
+			}
+			row[indexOf(tdef.Cols, col)] = v
+		}
+		olds = append(olds, append([]storage.Value{}, ex.row...))
+		news = append(news, row)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	for i := range news {
+		if err := ex.ctx.Err(); err != nil {
+			return nil, err
+		}
+		rec := storage.Record{Cols: tdef.Cols, Vals: news[i]}
+		if !samePrimaryKey(tdef, olds[i], news[i]) {
+			// the primary key is changed, move the row
+			old := storage.Record{Cols: tdef.Cols[:tdef.Pkeys], Vals: olds[i][:tdef.Pkeys]}
+			if _, err := ex.db.Delete(tdef.Name, old); err != nil {
+				return nil, err
+			}
+			added, err := ex.db.Insert(tdef.Name, &rec)
+			if err != nil {
+				return nil, err
+			}
+			if !added {
+				return nil, fmt.Errorf("table %s: duplicate primary key", tdef.Name)
+			}
+		} else if _, err := ex.db.Update(tdef.Name, rec); err != nil {
+			return nil, err
+		}
+		res.Affected++
+	}
+	return res, nil
+}
+
+func samePrimaryKey(tdef *storage.TableDef, a []storage.Value, b []storage.Value) bool {
+	for i := 0; i < tdef.Pkeys; i++ {
+		if a[i].Type != b[i].Type || a[i].I64 != b[i].I64 || !bytes.Equal(a[i].Str, b[i].Str) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ex *executer) delete(s *parser.Delete) (*Result, error) {
+	tdef, err := ex.tableDef(s.Table)
+	if err != nil {
+		return nil, err
+	}
+	ex.tdef = tdef
+	keys := []storage.Record{}
+	err = ex.scan(tdef, s.Where, func() (bool, error) {
+		pk := append([]storage.Value{}, ex.row[:tdef.Pkeys]...)
+		keys = append(keys, storage.Record{Cols: tdef.Cols[:tdef.Pkeys], Vals: pk})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, key := range keys {
+		if err := ex.ctx.Err(); err != nil {
+			return nil, err
+		}
+		deleted, err := ex.db.Delete(tdef.Name, key)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			res.Affected++
+		}
+	}
+	return res, nil
+}
+
+// call `fn` for each row matching the condition, with the row in ex.row.
+// a point lookup is used if the condition fixes the whole primary key,
+// otherwise the primary key range is narrowed by the bounds on its first column.
+func (ex *executer) scan(
+	tdef *storage.TableDef, where parser.Expr, fn func() (bool, error),
+) error {
+	ex.tdef = tdef
+	match := func(rec *storage.Record) (bool, error) {
+		ex.row = rec.Vals
+		if where == nil {
+			return fn()
+		}
+		v, err := ex.eval(where)
+		if err != nil || !truthy(v) {
+			return err == nil, err
+		}
+		return fn()
+	}
+
+	conds := []*parser.Binary{}
+	splitAnd(where, &conds)
+
+	// point lookup
+	key := storage.Record{}
+	for _, col := range tdef.Cols[:tdef.Pkeys] {
+		for _, cond := range conds {
+			if v, op, ok := ex.bound(tdef, cond, col); ok && op == "=" {
+				key.Cols = append(key.Cols, col)
+				key.Vals = append(key.Vals, v)
+				break
+			}
+		}
+	}
+	if len(key.Cols) == tdef.Pkeys {
+		rec := storage.Record{Cols: key.Cols, Vals: key.Vals}
+		ok, err := ex.db.Get(tdef.Name, &rec)
+		if err != nil || !ok {
+			return err
+		}
+		full := storage.Record{Vals: make([]storage.Value, len(tdef.Cols))}
+		for i, col := range tdef.Cols {
+			full.Vals[i] = *rec.Get(col)
+		}
+		_, err = match(&full)
+		return err
+	}
+
+	// range scan
+	sc := storage.Scanner{Cmp1: storage.CMP_GE, Cmp2: storage.CMP_LE}
+	first := tdef.Cols[0]
+	for _, cond := range conds {
+		v, op, ok := ex.bound(tdef, cond, first)
+		if !ok {
+			continue
+		}
+		lower := storage.Record{Cols: []string{first}, Vals: []storage.Value{v}}
+		switch op {
+		case "=":
+			sc.Key1, sc.Key2 = lower, lower
+		case ">", ">=":
+			sc.Key1, sc.Cmp1 = lower, storage.CMP_GE
+			if op == ">" {
+				sc.Cmp1 = storage.CMP_GT
+			}
+		case "<", "<=":
+			sc.Key2, sc.Cmp2 = lower, storage.CMP_LE
+			if op == "<" {
+				sc.Cmp2 = storage.CMP_LT
+			}
+		}
+	}
+	if err := ex.db.Scan(tdef.Name, &sc); err != nil {
+		return err
+	}
+	for rec := (storage.Record{}); sc.Valid(); sc.Next() {
+		if err := ex.ctx.Err(); err != nil {
+			return err
+		}
+		sc.Deref(&rec)
+		more, err := match(&rec)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// the top-level conjunction of a WHERE clause
+func splitAnd(expr parser.Expr, out *[]*parser.Binary) {
+	if b, ok := expr.(*parser.Binary); ok {
+		if b.Op == "AND" {
+			splitAnd(b.Left, out)
+			splitAnd(b.Right, out)
+		} else {
+			*out = append(*out, b)
+		}
+	}
+}
+
+// extract `col op constant` from a condition, the operator is normalized
+// so that the column is on the left.
+func (ex *executer) bound(
+	tdef *storage.TableDef, cond *parser.Binary, col string,
+) (storage.Value, string, bool) {
+	flip := map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+	op, left, right := cond.Op, cond.Left, cond.Right
+	if c, ok := right.(*parser.Column); ok && c.Name == col {
+		op, left, right = flip[op], right, left
+	}
+	c, ok := left.(*parser.Column)
+	if !ok || c.Name != col || op == "" || hasColumn(right) {
+		return storage.Value{}, "", false
+	}
+	v, err := ex.eval(right)
+	if err != nil || v.Type != tdef.Types[indexOf(tdef.Cols, col)] {
+		return storage.Value{}, "", false // let the filter report it
+	}
+	return v, op, true
+}
+
+func hasColumn(expr parser.Expr) bool {
+	switch e := expr.(type) {
+	case *parser.Column:
+		return true
+	case *parser.Unary:
+		return hasColumn(e.Expr)
+	case *parser.Binary:
+		return hasColumn(e.Left) || hasColumn(e.Right)
+	case *parser.Call:
+		// NEXTVAL has side effects, never evaluate it for planning
+		return true
+	default:
+		return false
+	}
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// expressions
+func truthy(v storage.Value) bool {
+	if v.Type == storage.TYPE_INT64 {
+		return v.I64 != 0
+	}
+	return len(v.Str) > 0
+}
+
+func boolValue(b bool) storage.Value {
+	v := storage.Value{Type: storage.TYPE_INT64}
+	if b {
+		v.I64 = 1
+	}
+	return v
+}
+
+func typeName(typ uint32) string {
+	switch typ {
+	case storage.TYPE_INT64:
+		return "int64"
+	case storage.TYPE_BYTES:
+		return "bytes"
+	default:
+		return "unknown"
+	}
+}
+
+// the static type of an expression
+func (ex *executer) typeOf(expr parser.Expr) uint32 {
+	switch e := expr.(type) {
+	case *parser.Literal:
+		return e.Val.Type
+	case *parser.Param:
+		if e.Index < len(ex.args) {
+			return ex.args[e.Index].Type
+		}
+		return storage.TYPE_BYTES
+	case *parser.Column:
+		if ex.tdef != nil {
+			if i := indexOf(ex.tdef.Cols, e.Name); i >= 0 {
+				return ex.tdef.Types[i]
+			}
+		}
+		return storage.TYPE_BYTES
+	default:
+		return storage.TYPE_INT64
+	}
+}
+
+func (ex *executer) eval(expr parser.Expr) (storage.Value, error) {
+	switch e := expr.(type) {
+	case *parser.Literal:
+		return e.Val, nil
+	case *parser.Param:
+		return ex.args[e.Index], nil
+	case *parser.Column:
+		if ex.tdef == nil || ex.row == nil {
+			return storage.Value{}, fmt.Errorf("column %s not allowed here", e.Name)
+		}
+		i := indexOf(ex.tdef.Cols, e.Name)
+		if i < 0 {
+			return storage.Value{}, fmt.Errorf("column %s not found in table %s", e.Name, ex.tdef.Name)
+		}
+		return ex.row[i], nil
+	case *parser.Unary:
+		v, err := ex.eval(e.Expr)
+		if err != nil {
+			return v, err
+		}
+		if e.Op == "NOT" {
+			return boolValue(!truthy(v)), nil
+		}
+		if v.Type != storage.TYPE_INT64 {
+			return storage.Value{}, fmt.Errorf("bad operand for unary %s: %s", e.Op, typeName(v.Type))
+		}
+		return storage.Value{Type: storage.TYPE_INT64, I64: -v.I64}, nil
+	case *parser.Binary:
+		return ex.evalBinary(e)
+	case *parser.Call:
+		return ex.evalCall(e)
+	default:
+		panic("bad expression")
+	}
+}
+
+func (ex *executer) evalBinary(e *parser.Binary) (storage.Value, error) {
+	left, err := ex.eval(e.Left)
+	if err != nil {
+		return left, err
+	}
+	// short circuit
+	switch {
+	case e.Op == "AND" && !truthy(left):
+		return boolValue(false), nil
+	case e.Op == "OR" && truthy(left):
+		return boolValue(true), nil
+	}
+	right, err := ex.eval(e.Right)
+	if err != nil {
+		return right, err
+	}
+
+	switch e.Op {
+	case "AND", "OR":
+		return boolValue(truthy(right)), nil
+	case "=", "!=", "<", "<=", ">", ">=":
+		if left.Type != right.Type {
+			return storage.Value{}, fmt.Errorf("cannot compare %s with %s",
+				typeName(left.Type), typeName(right.Type))
+		}
+		r := 0
+		if left.Type == storage.TYPE_INT64 {
+			switch {
+			case left.I64 < right.I64:
+				r = -1
+			case left.I64 > right.I64:
+				r = +1
+			}
+		} else {
+			r = bytes.Compare(left.Str, right.Str)
+		}
+		switch e.Op {
+		case "=":
+			return boolValue(r == 0), nil
+		case "!=":
+			return boolValue(r != 0), nil
+		case "<":
+			return boolValue(r < 0), nil
+		case "<=":
+			return boolValue(r <= 0), nil
+		case ">":
+			return boolValue(r > 0), nil
+		default:
+			return boolValue(r >= 0), nil
+		}
+	}
+
+	// arithmetic
+	if left.Type != storage.TYPE_INT64 || right.Type != storage.TYPE_INT64 {
+		return storage.Value{}, fmt.Errorf("bad operands for %s: %s and %s",
+			e.Op, typeName(left.Type), typeName(right.Type))
+	}
+	out := storage.Value{Type: storage.TYPE_INT64}
+	switch e.Op {
+	case "+":
+		out.I64 = left.I64 + right.I64
+	case "-":
+		out.I64 = left.I64 - right.I64
+	case "*":
+		out.I64 = left.I64 * right.I64
+	case "/", "%":
+		if right.I64 == 0 {
+			return storage.Value{}, fmt.Errorf("division by zero")
+		}
+		if e.Op == "/" {
+			out.I64 = left.I64 / right.I64
+		} else {
+			out.I64 = left.I64 % right.I64
+		}
+	default:
+		panic("bad operator")
+	}
+	return out, nil
+}
+
+func (ex *executer) evalCall(e *parser.Call) (storage.Value, error) {
+	args := []storage.Value{}
+	for _, arg := range e.Args {
+		v, err := ex.eval(arg)
+		if err != nil {
+			return v, err
+		}
+		args = append(args, v)
+	}
+	switch e.Func {
+	case "NEXTVAL", "CURRVAL":
+		if len(args) != 1 || args[0].Type != storage.TYPE_BYTES {
+			return storage.Value{}, fmt.Errorf("%s expects a sequence name", e.Func)
+		}
+		var i64 int64
+		var err error
+		if e.Func == "NEXTVAL" {
+			i64, err = ex.db.NextVal(string(args[0].Str))
+		} else {
+			i64, err = ex.db.CurrVal(string(args[0].Str))
+		}
+		return storage.Value{Type: storage.TYPE_INT64, I64: i64}, err
+	case "LENGTH":
+		if len(args) != 1 || args[0].Type != storage.TYPE_BYTES {
+			return storage.Value{}, fmt.Errorf("LENGTH expects a bytes value")
+		}
+		return storage.Value{Type: storage.TYPE_INT64, I64: int64(len(args[0].Str))}, nil
+	case "UNHEX":
+		if len(args) != 1 || args[0].Type != storage.TYPE_BYTES {
+			return storage.Value{}, fmt.Errorf("UNHEX expects a bytes value")
+		}
+		str, err := hex.DecodeString(string(args[0].Str))
+		if err != nil {
+			return storage.Value{}, fmt.Errorf("UNHEX: %v", err)
+		}
+		return storage.Value{Type: storage.TYPE_BYTES, Str: str}, nil
+	default:
+		return storage.Value{}, fmt.Errorf("unknown function %s", e.Func)
+	}
+}
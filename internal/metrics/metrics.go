@@ -0,0 +1,272 @@
+// Package metrics implements counters, gauges and histograms
+// exposed in the Prometheus text format (version 0.0.4).
+// the updates are lock-free, a metric with labels takes a lock
+// only to find or create the series of a new label set.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// the default histogram buckets for latencies in seconds
+var LATENCY_BUCKETS = []float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5,
+}
+
+// a set of metric families
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// a value that only goes up
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// a value that can go up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// counts observations in buckets by their upper bounds
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, not cumulative, the last one is +Inf
+	sum    atomic.Uint64   // float64 bits
+	count  atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // the first bound >= v
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+	h.count.Add(1)
+}
+
+// the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// a family of metrics with the same name and label names
+type family struct {
+	name   string
+	help   string
+	typ    string // counter, gauge or histogram
+	labels []string
+	bounds []float64 // histograms only
+	fn     func() int64
+
+	mu     sync.Mutex
+	series map[string]interface{} // label values joined by 0xff -> *Counter, *Gauge or *Histogram
+}
+
+func (r *Registry) register(f *family) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.families {
+		if old.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+	f.series = map[string]interface{}{}
+	r.families = append(r.families, f)
+	return f
+}
+
+// the series for the label values, created on the first use
+func (f *family) with(vals []string) interface{} {
+	if len(vals) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values", f.name, len(f.labels)))
+	}
+	key := strings.Join(vals, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.series[key]
+	if !ok {
+		switch f.typ {
+		case "counter":
+			m = &Counter{}
+		case "gauge":
+			m = &Gauge{}
+		case "histogram":
+			m = newHistogram(f.bounds)
+		}
+		f.series[key] = m
+	}
+	return m
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.register(&family{name: name, help: help, typ: "counter"}).with(nil).(*Counter)
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.register(&family{name: name, help: help, typ: "gauge"}).with(nil).(*Gauge)
+}
+
+// a gauge read from `fn` at each exposition
+func (r *Registry) NewGaugeFunc(name, help string, fn func() int64) {
+	r.register(&family{name: name, help: help, typ: "gauge", fn: fn})
+}
+
+// `bounds` are the increasing upper bounds of the buckets, +Inf is implied
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	return r.register(&family{name: name, help: help, typ: "histogram", bounds: bounds}).with(nil).(*Histogram)
+}
+
+// counters partitioned by labels
+type CounterVec struct {
+	f *family
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(&family{name: name, help: help, typ: "counter", labels: labels})}
+}
+
+// the counter for the label values, in the order of the label names
+func (v *CounterVec) With(vals ...string) *Counter {
+	return v.f.with(vals).(*Counter)
+}
+
+// write all metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	buf := bytes.Buffer{}
+	for _, f := range families {
+		f.write(&buf)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.typ)
+	if f.fn != nil {
+		fmt.Fprintf(buf, "%s %d\n", f.name, f.fn())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labels := f.labelPairs(key)
+		switch m := f.series[key].(type) {
+		case *Counter:
+			fmt.Fprintf(buf, "%s%s %d\n", f.name, braces(labels), m.Value())
+		case *Gauge:
+			fmt.Fprintf(buf, "%s%s %d\n", f.name, braces(labels), m.Value())
+		case *Histogram:
+			cum := uint64(0)
+			for i := range m.counts {
+				cum += m.counts[i].Load()
+				le := "+Inf"
+				if i < len(m.bounds) {
+					le = formatFloat(m.bounds[i])
+				}
+				pairs := append(append([]string{}, labels...), `le="`+le+`"`)
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, braces(pairs), cum)
+			}
+			sum := math.Float64frombits(m.sum.Load())
+			fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, braces(labels), formatFloat(sum))
+			fmt.Fprintf(buf, "%s_count%s %d\n", f.name, braces(labels), m.count.Load())
+		}
+	}
+}
+
+// name="value" pairs for a series key
+func (f *family) labelPairs(key string) []string {
+	if len(f.labels) == 0 {
+		return nil
+	}
+	pairs := []string{}
+	for i, val := range strings.Split(key, "\xff") {
+		pairs = append(pairs, f.labels[i]+`="`+escapeLabel(val)+`"`)
+	}
+	return pairs
+}
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+// serve the metrics for a Prometheus scrape
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.WriteText(w)
+	})
+}
@@ -1 +1,865 @@
-package parser
\ No newline at end of file
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a parsed statement
+type Statement struct {
+	SQL       string
+	Stmt      Stmt
+	NumParams int // number of placeholders
+}
+
+// statements
+type Stmt interface{ stmt() }
+
+type CreateTable struct {
+	Def storage.TableDef
+}
+
+type CreateSequence struct {
+	Name  string
+	Start int64
+}
+
+// ALTER SEQUENCE name RESTART [WITH] n
+type AlterSequence struct {
+	Name    string
+	Restart int64
+}
+
+// ALTER TABLE name SET COMPRESSION codec
+type AlterTable struct {
+	Name        string
+	Compression string
+}
+
+type Insert struct {
+	Table string
+	Cols  []string // nil: all columns in the table order
+	Rows  [][]Expr
+	Mode  int // MODE_INSERT_ONLY or MODE_UPSERT (REPLACE INTO)
+}
+
+type Select struct {
+	Table string // empty for SELECT without FROM
+	Star  bool   // SELECT *
+	Exprs []Expr
+	Names []string // output column names
+	Where Expr     // nil: all rows
+	Limit Expr     // nil: no limit
+}
+
+type Update struct {
+	Table string
+	Cols  []string
+	Vals  []Expr
+	Where Expr
+}
+
+type Delete struct {
+	Table string
+	Where Expr
+}
+
+// BEGIN [WORK | TRANSACTION] [mode, ...] or START TRANSACTION [mode, ...]
+// the modes are accepted for the drivers and ignored, the transactions
+// are serializable.
+type Begin struct{}
+
+// COMMIT [WORK | TRANSACTION], ROLLBACK [WORK | TRANSACTION]
+type Commit struct{}
+type Rollback struct{}
+
+// VACUUM [INCREMENTAL]
+type Vacuum struct {
+	Incremental bool
+}
+
+func (*CreateTable) stmt()    {}
+func (*CreateSequence) stmt() {}
+func (*AlterSequence) stmt()  {}
+func (*AlterTable) stmt()     {}
+func (*Insert) stmt()         {}
+func (*Select) stmt()         {}
+func (*Update) stmt()         {}
+func (*Delete) stmt()         {}
+func (*Begin) stmt()          {}
+func (*Commit) stmt()         {}
+func (*Rollback) stmt()       {}
+func (*Vacuum) stmt()         {}
+
+// expressions
+type Expr interface{ expr() }
+
+type Literal struct {
+	Val storage.Value
+}
+
+// a placeholder, `?` or `$n`
+type Param struct {
+	Index int // 0-based
+}
+
+type Column struct {
+	Name string
+}
+
+// unary: - NOT
+type Unary struct {
+	Op   string
+	Expr Expr
+}
+
+// binary: OR AND = != < <= > >= + - * / %
+type Binary struct {
+	Op    string
+	Left  Expr
+	Right Expr
+}
+
+// function calls, the name is upper case
+type Call struct {
+	Func string
+	Args []Expr
+}
+
+func (*Literal) expr() {}
+func (*Param) expr()   {}
+func (*Column) expr()  {}
+func (*Unary) expr()   {}
+func (*Binary) expr()  {}
+func (*Call) expr()    {}
+
+// token types
+const (
+	TOK_EOF    = 0
+	TOK_IDENT  = 1
+	TOK_INT    = 2
+	TOK_STRING = 3
+	TOK_PARAM  = 4
+	TOK_PUNCT  = 5 // operators and punctuation
+)
+
+type token struct {
+	typ int
+	str string // the raw text; the unquoted value for strings
+	pos int
+}
+
+type parser struct {
+	toks    []token
+	pos     int
+	sql     string
+	nparams int  // the number of placeholders seen
+	dollar  bool // $n placeholders are in use
+	qmark   bool // ? placeholders are in use
+}
+
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// parse a single SQL statement, an optional trailing `;` is allowed
+func Parse(sql string) (stmt *Statement, err error) {
+	toks, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, sql: sql}
+	defer func() {
+		if r := recover(); r != nil {
+			serr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			stmt, err = nil, serr
+		}
+	}()
+	s := p.parseStmt()
+	p.tryPunct(";")
+	if p.peek().typ != TOK_EOF {
+		p.fail("unexpected %q", p.peek().str)
+	}
+	return &Statement{SQL: sql, Stmt: s, NumParams: p.nparams}, nil
+}
+
+func lex(sql string) ([]token, error) {
+	toks := []token{}
+	for i := 0; i < len(sql); {
+		ch := sql[i]
+		start := i
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+			continue
+		case ch == '-' && strings.HasPrefix(sql[i:], "--"):
+			// comment to the end of the line
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			continue
+		case isIdentStart(ch):
+			for i < len(sql) && isIdentChar(sql[i]) {
+				i++
+			}
+			toks = append(toks, token{TOK_IDENT, sql[start:i], start})
+		case '0' <= ch && ch <= '9':
+			for i < len(sql) && '0' <= sql[i] && sql[i] <= '9' {
+				i++
+			}
+			toks = append(toks, token{TOK_INT, sql[start:i], start})
+		case ch == '\'':
+			// 'string', a doubled quote is the escape
+			str := []byte{}
+			for i++; ; i++ {
+				if i >= len(sql) {
+					return nil, &SyntaxError{start, "unterminated string"}
+				}
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				str = append(str, sql[i])
+			}
+			i++
+			toks = append(toks, token{TOK_STRING, string(str), start})
+		case ch == '"':
+			// "quoted identifier"
+			end := strings.IndexByte(sql[i+1:], '"')
+			if end < 0 {
+				return nil, &SyntaxError{start, "unterminated identifier"}
+			}
+			toks = append(toks, token{TOK_IDENT, sql[i+1 : i+1+end], start})
+			i += end + 2
+		case ch == '?':
+			i++
+			toks = append(toks, token{TOK_PARAM, "?", start})
+		case ch == '$':
+			for i++; i < len(sql) && '0' <= sql[i] && sql[i] <= '9'; i++ {
+			}
+			if i == start+1 {
+				return nil, &SyntaxError{start, "bad placeholder"}
+			}
+			toks = append(toks, token{TOK_PARAM, sql[start:i], start})
+		default:
+			op := string(ch)
+			for _, two := range []string{"<=", ">=", "!=", "<>", "=="} {
+				if strings.HasPrefix(sql[i:], two) {
+					op = two
+				}
+			}
+			if !strings.Contains("(),;*=<>!+-/%.", op[:1]) {
+				return nil, &SyntaxError{start, fmt.Sprintf("unexpected character %q", ch)}
+			}
+			i += len(op)
+			toks = append(toks, token{TOK_PUNCT, op, start})
+		}
+	}
+	return append(toks, token{TOK_EOF, "", len(sql)}), nil
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+
+func isIdentChar(ch byte) bool {
+	return isIdentStart(ch) || ('0' <= ch && ch <= '9')
+}
+
+// helpers
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(&SyntaxError{p.peek().pos, fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.typ != TOK_EOF {
+		p.pos++
+	}
+	return tok
+}
+
+// is the next token the keyword? keywords are case-insensitive.
+func (p *parser) isKeyword(kw string) bool {
+	tok := p.peek()
+	return tok.typ == TOK_IDENT && strings.EqualFold(tok.str, kw)
+}
+
+func (p *parser) tryKeyword(kws ...string) bool {
+	save := p.pos
+	for _, kw := range kws {
+		if !p.isKeyword(kw) {
+			p.pos = save
+			return false
+		}
+		p.next()
+	}
+	return true
+}
+
+func (p *parser) keyword(kws ...string) {
+	if !p.tryKeyword(kws...) {
+		p.fail("expected %s", strings.Join(kws, " "))
+	}
+}
+
+func (p *parser) tryPunct(s string) bool {
+	tok := p.peek()
+	if tok.typ == TOK_PUNCT && tok.str == s {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) punct(s string) {
+	if !p.tryPunct(s) {
+		p.fail("expected %q", s)
+	}
+}
+
+func (p *parser) ident() string {
+	tok := p.peek()
+	if tok.typ != TOK_IDENT {
+		p.fail("expected a name")
+	}
+	p.next()
+	return tok.str
+}
+
+func (p *parser) int64() int64 {
+	neg := p.tryPunct("-")
+	tok := p.next()
+	if tok.typ != TOK_INT {
+		p.fail("expected an integer")
+	}
+	i64, err := strconv.ParseInt(tok.str, 10, 64)
+	if err != nil {
+		p.fail("bad integer %s", tok.str)
+	}
+	if neg {
+		i64 = -i64
+	}
+	return i64
+}
+
+// statements
+func (p *parser) parseStmt() Stmt {
+	switch {
+	case p.tryKeyword("CREATE", "TABLE"):
+		return p.parseCreateTable()
+	case p.tryKeyword("CREATE", "SEQUENCE"):
+		stmt := &CreateSequence{Name: p.ident(), Start: 1}
+		if p.tryKeyword("START") {
+			p.tryKeyword("WITH")
+			stmt.Start = p.int64()
+		}
+		return stmt
+	case p.tryKeyword("ALTER", "SEQUENCE"):
+		stmt := &AlterSequence{Name: p.ident()}
+		p.keyword("RESTART")
+		p.tryKeyword("WITH")
+		stmt.Restart = p.int64()
+		return stmt
+	case p.tryKeyword("ALTER", "TABLE"):
+		stmt := &AlterTable{Name: p.ident()}
+		p.keyword("SET")
+		p.keyword("COMPRESSION")
+		stmt.Compression = strings.ToLower(p.ident())
+		return stmt
+	case p.tryKeyword("INSERT", "INTO"):
+		return p.parseInsert(storage.MODE_INSERT_ONLY)
+	case p.tryKeyword("REPLACE", "INTO"):
+		return p.parseInsert(storage.MODE_UPSERT)
+	case p.tryKeyword("SELECT"):
+		return p.parseSelect()
+	case p.tryKeyword("UPDATE"):
+		return p.parseUpdate()
+	case p.tryKeyword("DELETE", "FROM"):
+		stmt := &Delete{Table: p.ident()}
+		stmt.Where = p.parseWhere()
+		return stmt
+	case p.tryKeyword("BEGIN"):
+		_ = p.tryKeyword("TRANSACTION") || p.tryKeyword("WORK")
+		p.parseTxModes()
+		return &Begin{}
+	case p.tryKeyword("START", "TRANSACTION"):
+		p.parseTxModes()
+		return &Begin{}
+	case p.tryKeyword("COMMIT"):
+		_ = p.tryKeyword("TRANSACTION") || p.tryKeyword("WORK")
+		return &Commit{}
+	case p.tryKeyword("ROLLBACK"):
+		_ = p.tryKeyword("TRANSACTION") || p.tryKeyword("WORK")
+		return &Rollback{}
+	case p.tryKeyword("VACUUM"):
+		return &Vacuum{Incremental: p.tryKeyword("INCREMENTAL")}
+	default:
+		p.fail("unknown statement")
+		return nil
+	}
+}
+
+// the transaction modes of BEGIN, like PostgreSQL:
+// ISOLATION LEVEL level, READ WRITE, READ ONLY, [NOT] DEFERRABLE
+func (p *parser) parseTxModes() {
+	for {
+		switch {
+		case p.tryKeyword("ISOLATION", "LEVEL"):
+			switch {
+			case p.tryKeyword("SERIALIZABLE"):
+			case p.tryKeyword("REPEATABLE", "READ"):
+			case p.tryKeyword("READ", "COMMITTED"):
+			case p.tryKeyword("READ", "UNCOMMITTED"):
+			default:
+				p.fail("expected an isolation level")
+			}
+		case p.tryKeyword("READ", "WRITE"), p.tryKeyword("READ", "ONLY"):
+		case p.tryKeyword("DEFERRABLE"), p.tryKeyword("NOT", "DEFERRABLE"):
+		default:
+			return
+		}
+		p.tryPunct(",")
+	}
+}
+
+func columnType(name string) (uint32, bool) {
+	switch strings.ToUpper(name) {
+	case "INT64", "INT", "INTEGER", "BIGINT", "INT8":
+		return storage.TYPE_INT64, true
+	case "BYTES", "BLOB", "BYTEA", "TEXT", "STRING", "VARCHAR":
+		return storage.TYPE_BYTES, true
+	default:
+		return storage.TYPE_ERROR, false
+	}
+}
+
+// CREATE TABLE t (
+//
+//	col type [PRIMARY KEY] [AUTOINCREMENT] [NOT NULL] [DEFAULT lit] [CHECK (expr)] [TTL],
+//	...,
+//	[PRIMARY KEY (a, b)], [INDEX (a, b)], [CHECK (expr)]
+//
+// ) [COMPRESSION codec]
+func (p *parser) parseCreateTable() Stmt {
+	tdef := storage.TableDef{Name: p.ident()}
+	pkeys := []string{}
+	defaults := []*storage.Value{}
+	notnull := []bool{}
+	p.punct("(")
+	for {
+		switch {
+		case p.tryKeyword("PRIMARY", "KEY"):
+			pkeys = append(pkeys, p.parseNameList()...)
+		case p.tryKeyword("INDEX"):
+			tdef.Indexes = append(tdef.Indexes, p.parseNameList())
+		case p.tryKeyword("CHECK"):
+			tdef.Checks = append(tdef.Checks, p.parseCheck())
+		default:
+			col := p.ident()
+			typ, ok := columnType(p.ident())
+			if !ok {
+				p.fail("unknown type for column %s", col)
+			}
+			tdef.Cols = append(tdef.Cols, col)
+			tdef.Types = append(tdef.Types, typ)
+			defaults = append(defaults, nil)
+			notnull = append(notnull, false)
+			for done := false; !done; {
+				switch {
+				case p.tryKeyword("PRIMARY", "KEY"):
+					pkeys = append(pkeys, col)
+				case p.tryKeyword("AUTOINCREMENT"):
+					tdef.AutoIncrement = true
+				case p.tryKeyword("TTL"):
+					// the expiry of the row, in Unix milliseconds
+					tdef.TTL = col
+				case p.tryKeyword("NOT", "NULL"):
+					notnull[len(notnull)-1] = true
+				case p.tryKeyword("DEFAULT"):
+					neg := p.tryPunct("-")
+					lit, ok := p.parsePrimary().(*Literal)
+					if !ok || lit.Val.Type != typ || (neg && typ != storage.TYPE_INT64) {
+						p.fail("bad default for column %s", col)
+					}
+					if neg {
+						lit.Val.I64 = -lit.Val.I64
+					}
+					defaults[len(defaults)-1] = &lit.Val
+				case p.tryKeyword("CHECK"):
+					tdef.Checks = append(tdef.Checks, p.parseCheck())
+				default:
+					done = true
+				}
+			}
+		}
+		if !p.tryPunct(",") {
+			break
+		}
+	}
+	p.punct(")")
+	if p.tryKeyword("COMPRESSION") {
+		tdef.Compression = strings.ToLower(p.ident())
+	}
+	if len(pkeys) == 0 {
+		p.fail("table %s has no primary key", tdef.Name)
+	}
+
+	// the primary key columns come first
+	order := append([]string{}, pkeys...)
+	for _, col := range tdef.Cols {
+		if indexOf(pkeys, col) < 0 {
+			order = append(order, col)
+		}
+	}
+	cols, types := tdef.Cols, tdef.Types
+	tdef.Cols, tdef.Types = nil, nil
+	reDefaults, reNotNull := []*storage.Value{}, []bool{}
+	hasDefaults, hasNotNull := false, false
+	for _, col := range order {
+		i := indexOf(cols, col)
+		if i < 0 {
+			p.fail("primary key column %s not found", col)
+		}
+		tdef.Cols = append(tdef.Cols, col)
+		tdef.Types = append(tdef.Types, types[i])
+		reDefaults = append(reDefaults, defaults[i])
+		reNotNull = append(reNotNull, notnull[i])
+		hasDefaults = hasDefaults || defaults[i] != nil
+		hasNotNull = hasNotNull || notnull[i]
+	}
+	if hasDefaults {
+		tdef.Defaults = reDefaults
+	}
+	if hasNotNull {
+		tdef.NotNull = reNotNull
+	}
+	tdef.Pkeys = len(pkeys)
+	return &CreateTable{Def: tdef}
+}
+
+// (a, b, c)
+func (p *parser) parseNameList() []string {
+	names := []string{}
+	p.punct("(")
+	for {
+		names = append(names, p.ident())
+		if !p.tryPunct(",") {
+			break
+		}
+	}
+	p.punct(")")
+	return names
+}
+
+// CHECK (col op literal), the text is kept for storage.TableDef.Checks
+func (p *parser) parseCheck() string {
+	p.punct("(")
+	start := p.peek().pos
+	depth := 0
+	for depth > 0 || !(p.peek().typ == TOK_PUNCT && p.peek().str == ")") {
+		tok := p.next()
+		switch {
+		case tok.typ == TOK_EOF:
+			p.fail("unterminated CHECK")
+		case tok.typ == TOK_PUNCT && tok.str == "(":
+			depth++
+		case tok.typ == TOK_PUNCT && tok.str == ")":
+			depth--
+		}
+	}
+	text := strings.TrimSpace(p.sql[start:p.peek().pos])
+	p.punct(")")
+	return text
+}
+
+// INSERT INTO t [(cols)] VALUES (exprs), ...
+func (p *parser) parseInsert(mode int) Stmt {
+	stmt := &Insert{Table: p.ident(), Mode: mode}
+	if p.peek().typ == TOK_PUNCT && p.peek().str == "(" {
+		stmt.Cols = p.parseNameList()
+	}
+	p.keyword("VALUES")
+	for {
+		p.punct("(")
+		row := []Expr{}
+		for {
+			row = append(row, p.parseExpr())
+			if !p.tryPunct(",") {
+				break
+			}
+		}
+		p.punct(")")
+		if stmt.Cols != nil && len(row) != len(stmt.Cols) {
+			p.fail("%d values for %d columns", len(row), len(stmt.Cols))
+		}
+		stmt.Rows = append(stmt.Rows, row)
+		if !p.tryPunct(",") {
+			break
+		}
+	}
+	return stmt
+}
+
+// SELECT exprs [FROM t [WHERE expr]] [LIMIT expr]
+func (p *parser) parseSelect() Stmt {
+	stmt := &Select{}
+	if p.tryPunct("*") {
+		stmt.Star = true
+	} else {
+		for {
+			start := p.peek().pos
+			expr := p.parseExpr()
+			name := strings.TrimSpace(p.sql[start:p.peek().pos])
+			if col, ok := expr.(*Column); ok {
+				name = col.Name
+			}
+			if p.tryKeyword("AS") {
+				name = p.ident()
+			}
+			stmt.Exprs = append(stmt.Exprs, expr)
+			stmt.Names = append(stmt.Names, name)
+			if !p.tryPunct(",") {
+				break
+			}
+		}
+	}
+	if p.tryKeyword("FROM") {
+		stmt.Table = p.ident()
+		stmt.Where = p.parseWhere()
+	} else if stmt.Star {
+		p.fail("SELECT * requires FROM")
+	}
+	if p.tryKeyword("LIMIT") {
+		stmt.Limit = p.parseExpr()
+	}
+	return stmt
+}
+
+// UPDATE t SET a = expr, ... [WHERE expr]
+func (p *parser) parseUpdate() Stmt {
+	stmt := &Update{Table: p.ident()}
+	p.keyword("SET")
+	for {
+		stmt.Cols = append(stmt.Cols, p.ident())
+		p.punct("=")
+		stmt.Vals = append(stmt.Vals, p.parseExpr())
+		if !p.tryPunct(",") {
+			break
+		}
+	}
+	stmt.Where = p.parseWhere()
+	return stmt
+}
+
+func (p *parser) parseWhere() Expr {
+	if p.tryKeyword("WHERE") {
+		return p.parseExpr()
+	}
+	return nil
+}
+
+// expressions, from the lowest precedence to the highest
+func (p *parser) parseExpr() Expr {
+	return p.parseOr()
+}
+
+func (p *parser) parseOr() Expr {
+	left := p.parseAnd()
+	for p.tryKeyword("OR") {
+		left = &Binary{Op: "OR", Left: left, Right: p.parseAnd()}
+	}
+	return left
+}
+
+func (p *parser) parseAnd() Expr {
+	left := p.parseNot()
+	for p.tryKeyword("AND") {
+		left = &Binary{Op: "AND", Left: left, Right: p.parseNot()}
+	}
+	return left
+}
+
+func (p *parser) parseNot() Expr {
+	if p.tryKeyword("NOT") {
+		return &Unary{Op: "NOT", Expr: p.parseNot()}
+	}
+	return p.parseCmp()
+}
+
+func (p *parser) parseCmp() Expr {
+	left := p.parseAdd()
+	tok := p.peek()
+	if tok.typ == TOK_PUNCT {
+		switch tok.str {
+		case "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+			p.next()
+			op := tok.str
+			switch op {
+			case "==":
+				op = "="
+			case "<>":
+				op = "!="
+			}
+			return &Binary{Op: op, Left: left, Right: p.parseAdd()}
+		}
+	}
+	return left
+}
+
+func (p *parser) parseAdd() Expr {
+	left := p.parseMul()
+	for {
+		tok := p.peek()
+		if tok.typ != TOK_PUNCT || (tok.str != "+" && tok.str != "-") {
+			return left
+		}
+		p.next()
+		left = &Binary{Op: tok.str, Left: left, Right: p.parseMul()}
+	}
+}
+
+func (p *parser) parseMul() Expr {
+	left := p.parseUnary()
+	for {
+		tok := p.peek()
+		if tok.typ != TOK_PUNCT || (tok.str != "*" && tok.str != "/" && tok.str != "%") {
+			return left
+		}
+		p.next()
+		left = &Binary{Op: tok.str, Left: left, Right: p.parseUnary()}
+	}
+}
+
+func (p *parser) parseUnary() Expr {
+	if p.tryPunct("-") {
+		expr := p.parseUnary()
+		if lit, ok := expr.(*Literal); ok && lit.Val.Type == storage.TYPE_INT64 {
+			lit.Val.I64 = -lit.Val.I64
+			return lit
+		}
+		return &Unary{Op: "-", Expr: expr}
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() Expr {
+	tok := p.peek()
+	switch tok.typ {
+	case TOK_INT:
+		p.next()
+		// parsed as unsigned so that the minimum int64 can be negated
+		u64, err := strconv.ParseUint(tok.str, 10, 64)
+		if err != nil || u64 > 1<<63 {
+			p.fail("integer out of range: %s", tok.str)
+		}
+		return &Literal{storage.Value{Type: storage.TYPE_INT64, I64: int64(u64)}}
+	case TOK_STRING:
+		p.next()
+		return &Literal{storage.Value{Type: storage.TYPE_BYTES, Str: []byte(tok.str)}}
+	case TOK_PARAM:
+		p.next()
+		return p.param(tok)
+	case TOK_IDENT:
+		p.next()
+		if p.tryPunct("(") {
+			call := &Call{Func: strings.ToUpper(tok.str)}
+			for !p.tryPunct(")") {
+				if len(call.Args) > 0 {
+					p.punct(",")
+				}
+				call.Args = append(call.Args, p.parseExpr())
+			}
+			return call
+		}
+		switch {
+		case strings.EqualFold(tok.str, "TRUE"):
+			return &Literal{storage.Value{Type: storage.TYPE_INT64, I64: 1}}
+		case strings.EqualFold(tok.str, "FALSE"):
+			return &Literal{storage.Value{Type: storage.TYPE_INT64, I64: 0}}
+		}
+		return &Column{Name: tok.str}
+	case TOK_PUNCT:
+		if tok.str == "(" {
+			p.next()
+			expr := p.parseExpr()
+			p.punct(")")
+			return expr
+		}
+	}
+	p.fail("unexpected %q", tok.str)
+	return nil
+}
+
+// `?` placeholders are numbered in order, `$n` are explicit. mixing is an error.
+func (p *parser) param(tok token) Expr {
+	if tok.str == "?" {
+		if p.dollar {
+			p.fail("cannot mix ? and $n placeholders")
+		}
+		p.qmark = true
+		p.nparams++
+		return &Param{Index: p.nparams - 1}
+	}
+	if p.qmark {
+		p.fail("cannot mix ? and $n placeholders")
+	}
+	p.dollar = true
+	n, err := strconv.Atoi(tok.str[1:])
+	if err != nil || n < 1 {
+		p.fail("bad placeholder %s", tok.str)
+	}
+	if n > p.nparams {
+		p.nparams = n
+	}
+	return &Param{Index: n - 1}
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// split a string into statements at the top-level `;`.
+// empty statements (whitespace and comments) are dropped.
+func Split(sql string) ([]string, error) {
+	toks, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	out := []string{}
+	start, ntoks := 0, 0
+	for _, tok := range toks {
+		if tok.typ == TOK_EOF || (tok.typ == TOK_PUNCT && tok.str == ";") {
+			if ntoks > 0 {
+				out = append(out, strings.TrimSpace(sql[start:tok.pos]))
+			}
+			start, ntoks = tok.pos+1, 0
+			continue
+		}
+		ntoks++
+	}
+	return out, nil
+}
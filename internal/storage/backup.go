@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// online backups.
+// the B-tree is copy-on-write and a freed page is not reused while a
+// snapshot is open, so the pages reachable from a committed root don't
+// change. a snapshot pins the root of the last commit and copies its pages
+// without blocking the writers.
+// the copy is compacted: only the live pages, renumbered in BFS order.
+// the backup of an encrypted database is encrypted with the same key.
+
+// a consistent view of the last commit, see KV.Snapshot
+type Snapshot struct {
+	kv     *KV
+	root   uint64
+	used   uint64
+	chunks [][]byte // the mappings at the time of the snapshot
+	closed bool
+	stats  BackupStats // of the last WriteTo
+}
+
+// the size of a backup
+type BackupStats struct {
+	Pages int // including the master page
+	Keys  int // key-value pairs in the leaves
+}
+
+// pin the last commit.
+// like the updates, it must be serialized with the other KV calls,
+// but the snapshot can then be used concurrently with them.
+// close it before closing the KV.
+func (db *KV) Snapshot() *Snapshot {
+	db.snapshots.Add(1)
+	root, used := db.committed()
+	chunks := append([][]byte{}, db.mmap.chunks...)
+	return &Snapshot{kv: db, root: root, used: used, chunks: chunks}
+}
+
+// unpin the commit
+func (snap *Snapshot) Close() {
+	if !snap.closed {
+		snap.closed = true
+		snap.kv.snapshots.Add(-1)
+	}
+}
+
+func (snap *Snapshot) page(ptr uint64) BNode {
+	if snap.kv.pool != nil {
+		return snap.kv.pageRead(ptr)
+	}
+	return mappedPage(snap.chunks, ptr, snap.kv.PageSize())
+}
+
+// write a standalone database file with the live pages of the snapshot
+func (snap *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	if snap.closed {
+		return 0, errors.New("backup: the snapshot is closed")
+	}
+	bw := bufio.NewWriterSize(w, 16*snap.kv.PageSize())
+	cw := &countWriter{w: bw}
+	stats, err := snap.write(cw)
+	snap.stats = stats
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && cw.n != int64(stats.Pages)*int64(snap.kv.PageSize()) {
+		err = fmt.Errorf("backup: wrote %d bytes for %d pages", cw.n, stats.Pages)
+	}
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// the number of pages reachable from the snapshot root
+func (snap *Snapshot) count() int {
+	if snap.root == 0 {
+		return 0
+	}
+	total := 1
+	queue := []uint64{snap.root}
+	for len(queue) > 0 {
+		node := snap.page(queue[0])
+		queue = queue[1:]
+		if node.Btype() != BNODE_NODE {
+			continue
+		}
+		for i := uint16(0); i < node.Nkeys(); i++ {
+			total++
+			queue = append(queue, node.GetPtr(i))
+		}
+	}
+	return total
+}
+
+func (snap *Snapshot) write(w io.Writer) (BackupStats, error) {
+	npages := snap.count()
+	stats := BackupStats{Pages: 1 + npages}
+
+	// the master page, the root is the first page after it
+	root := uint64(0)
+	if npages > 0 {
+		root = 1
+	}
+	size, crypt := snap.kv.PageSize(), snap.kv.crypt
+	counter := uint64(0)
+	if crypt != nil {
+		// reserved before the master page is written
+		var err error
+		if counter, err = crypt.take(uint64(npages)); err != nil {
+			return stats, err
+		}
+		// the restored backup must not repeat the nonces of the database
+		if crypt, err = crypt.resalt(); err != nil {
+			return stats, err
+		}
+	}
+	if _, err := w.Write(masterPage(root, uint64(stats.Pages), size, crypt)); err != nil {
+		return stats, err
+	}
+	if npages == 0 {
+		return stats, nil
+	}
+
+	// the pages in BFS order, so the new pointers are known in advance
+	ptr, next := uint64(1), uint64(2)
+	queue := []uint64{snap.root}
+	page := make([]byte, size)
+	out := BNode{page}
+	if crypt != nil {
+		out = BNode{make([]byte, snap.kv.nodeSize())}
+	}
+	for len(queue) > 0 {
+		node := snap.page(queue[0])
+		queue = queue[1:]
+		copy(out.Data, node.Data)
+		switch node.Btype() {
+		case BNODE_NODE:
+			for i := uint16(0); i < node.Nkeys(); i++ {
+				queue = append(queue, node.GetPtr(i))
+				out.SetPtr(i, next)
+				next++
+			}
+		case BNODE_LEAF:
+			for i := uint16(0); i < node.Nkeys(); i++ {
+				if len(node.GetKey(i)) > 0 {
+					stats.Keys++ // not the sentinel key
+				}
+			}
+		default:
+			return stats, fmt.Errorf("backup: bad node type %d", node.Btype())
+		}
+		if crypt != nil {
+			crypt.seal(page, ptr, counter, out.Data)
+			counter++
+		}
+		if _, err := w.Write(page); err != nil {
+			return stats, err
+		}
+		ptr++
+	}
+	return stats, nil
+}
+
+// a master page for a new file, see MasterStore
+func masterPage(root uint64, used uint64, size int, crypt *pageCrypt) []byte {
+	master := make([]byte, size)
+	copy(master, DB_SIG)
+	binary.LittleEndian.PutUint64(master[16:], root)
+	binary.LittleEndian.PutUint64(master[24:], used)
+	binary.LittleEndian.PutUint32(master[32:], uint32(size))
+	if crypt != nil {
+		crypt.mu.Lock()
+		crypt.header(master[36:])
+		crypt.mu.Unlock()
+	}
+	return master
+}
+
+// the stats of the last WriteTo, to compare with VerifyFile
+func (snap *Snapshot) Stats() BackupStats {
+	return snap.stats
+}
+
+// write a backup of the last commit
+func (db *KV) Backup(w io.Writer) error {
+	snap := db.Snapshot()
+	defer snap.Close()
+	_, err := snap.WriteTo(w)
+	return err
+}
+
+// check that a backup is a well formed database file: the signature,
+// the master page, and every page is reachable exactly once from the root.
+func VerifyFile(path string) (stats BackupStats, err error) {
+	return VerifyFileKey(path, nil)
+}
+
+// VerifyFile for an encrypted file, the pages are authenticated too
+func VerifyFileKey(path string, key []byte) (stats BackupStats, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return stats, err
+	}
+
+	// the master page, it has the page size
+	master := make([]byte, MASTER_SIZE)
+	if _, err := fp.ReadAt(master, 0); err != nil {
+		return stats, fmt.Errorf("verify: reading the master page: %w", err)
+	}
+	sig := make([]byte, 16)
+	copy(sig, DB_SIG)
+	if !bytes.Equal(master[:16], sig) {
+		return stats, errors.New("verify: bad signature")
+	}
+	size := int(binary.LittleEndian.Uint32(master[32:]))
+	if size == 0 {
+		size = BTREE_PAGE_SIZE
+	}
+	if err := CheckPageSize(size); err != nil {
+		return stats, fmt.Errorf("verify: %w", err)
+	}
+	if fi.Size()%int64(size) != 0 {
+		return stats, fmt.Errorf("verify: the file size %d is not a multiple of the page size %d", fi.Size(), size)
+	}
+	crypt, err := loadCrypt(master, key)
+	if err != nil {
+		return stats, fmt.Errorf("verify: %w", err)
+	}
+	nodeSize := size
+	if crypt != nil {
+		nodeSize -= CRYPT_OVERHEAD
+	}
+	// a corrupted node can fail the assertions of the node accessors
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("verify: bad node: %v", r)
+		}
+	}()
+
+	read := func(ptr uint64) (BNode, error) {
+		page := make([]byte, size)
+		if _, err := fp.ReadAt(page, int64(ptr)*int64(size)); err != nil || crypt == nil {
+			return BNode{page}, err
+		}
+		node := BNode{make([]byte, nodeSize)}
+		return node, crypt.open(node.Data, ptr, page)
+	}
+	root := binary.LittleEndian.Uint64(master[16:])
+	used := binary.LittleEndian.Uint64(master[24:])
+	if used < 1 || used > uint64(fi.Size()/int64(size)) || root >= used {
+		return stats, fmt.Errorf("verify: bad master page, root %d, used %d", root, used)
+	}
+	stats.Pages = 1
+	if root == 0 {
+		if used != 1 {
+			return stats, fmt.Errorf("verify: %d pages in an empty tree", used)
+		}
+		return stats, nil
+	}
+
+	seen := map[uint64]bool{}
+	queue := []uint64{root}
+	for len(queue) > 0 {
+		ptr := queue[0]
+		queue = queue[1:]
+		if ptr == 0 || ptr >= used || seen[ptr] {
+			return stats, fmt.Errorf("verify: bad or shared page pointer %d", ptr)
+		}
+		seen[ptr] = true
+		stats.Pages++
+		node, err := read(ptr)
+		if err != nil {
+			return stats, err
+		}
+		if node.Nkeys() == 0 || int(node.Nbytes()) > nodeSize {
+			return stats, fmt.Errorf("verify: page %d: bad node size", ptr)
+		}
+		if node.Btype() != BNODE_LEAF && len(node.prefix()) > 0 {
+			return stats, fmt.Errorf("verify: page %d: a key prefix in an internal node", ptr)
+		}
+		for i := uint16(1); i < node.Nkeys(); i++ {
+			if bytes.Compare(node.GetKey(i-1), node.GetKey(i)) >= 0 {
+				return stats, fmt.Errorf("verify: page %d: unsorted keys", ptr)
+			}
+		}
+		switch node.Btype() {
+		case BNODE_NODE:
+			for i := uint16(0); i < node.Nkeys(); i++ {
+				queue = append(queue, node.GetPtr(i))
+			}
+		case BNODE_LEAF:
+			for i := uint16(0); i < node.Nkeys(); i++ {
+				if len(node.GetKey(i)) > 0 {
+					stats.Keys++
+				}
+			}
+		default:
+			return stats, fmt.Errorf("verify: page %d: bad node type %d", ptr, node.Btype())
+		}
+	}
+	if uint64(stats.Pages) != used {
+		return stats, fmt.Errorf("verify: %d pages are reachable, %d are used", stats.Pages, used)
+	}
+	return stats, nil
+}
+
+// DB-level wrappers, serialized by the caller like the other DB calls
+
+// pin the last commit, see KV.Snapshot
+func (db *DB) Snapshot() *Snapshot {
+	return db.kv.Snapshot()
+}
+
+// write a backup of the last commit
+func (db *DB) Backup(w io.Writer) error {
+	return db.kv.Backup(w)
+}
@@ -11,13 +11,17 @@ import (
 const (
 	BNODE_NODE = 1 // internal nodes without values
 	BNODE_LEAF = 2 // leaf nodes with values
+	// a flag in the type of a leaf that stores the common prefix of its keys
+	BNODE_PREFIX = 0x8000
 )
 
 const (
-	HEADER             = 4    // header (4 byte) store metadata of nodes
-	BTREE_PAGE_SIZE    = 4096 // 4kb
-	BTREE_MAX_KEY_SIZE = 1000
-	BTREE_MAX_VAL_SIZE = 3000
+	HEADER              = 4    // header (4 byte) store metadata of nodes
+	BTREE_PAGE_SIZE     = 4096 // the default page size, 4kb
+	BTREE_MIN_PAGE_SIZE = 1 << 10
+	// the offsets in a node are 16 bits and a node is up to 2 pages
+	// before it's split, so larger pages need a new node format.
+	BTREE_MAX_PAGE_SIZE = 32 << 10
 )
 
 const (
@@ -44,6 +48,12 @@ type BTree struct {
 	Get func(uint64) BNode // dereference a pointer
 	New func(BNode) uint64 // allocate a new page
 	Del func(uint64)       // deallocate a page
+	// the page size, BTREE_PAGE_SIZE if 0
+	pageSize int
+	// store the common key prefix of a leaf once, see BNODE_PREFIX
+	Prefix bool
+	// instrumentation, nil if none
+	metrics *Metrics
 }
 
 // InsertReq is a struct for the insert request to the B-tree
@@ -87,20 +97,52 @@ type Scanner struct {
 	indexNo int    // -1: use the primary key; >= 0: use an index
 	iter    *BIter // the underlying B-tree iterator
 	keyEnd  []byte // the encoded Key2
+	now     int64  // the rows expired at the start are skipped
 }
 
 func init() {
-	// 8 = space reserved for a pointer or page number
-	// 2 = space for storing number of entries(key and values) in the node
-	// 4 = space for additional metadata (e.g. flags and alignment)
-	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	u.Assert(node1max <= BTREE_PAGE_SIZE, "Node size exceeds pagesize")
+	for size := BTREE_MIN_PAGE_SIZE; size <= BTREE_MAX_PAGE_SIZE; size *= 2 {
+		// 8 = space reserved for a pointer or page number
+		// 2 = space for storing number of entries(key and values) in the node
+		// 4 = space for additional metadata (e.g. flags and alignment)
+		node1max := HEADER + 8 + 2 + 4 + MaxKeySize(size) + MaxValSize(size)
+		u.Assert(node1max <= size, "Node size exceeds pagesize")
+	}
+}
+
+// the size limits of a key and a value, a node holds at least one KV.
+// 1000 and 3000 bytes with the default page size.
+func MaxKeySize(pageSize int) int {
+	return pageSize/4 - 24
+}
+
+func MaxValSize(pageSize int) int {
+	return pageSize*3/4 - 72
+}
+
+// check a page size for a new database
+func CheckPageSize(size int) error {
+	if size > BTREE_MAX_PAGE_SIZE && size&(size-1) == 0 {
+		return fmt.Errorf("page size %d is not supported, the largest is %d", size, BTREE_MAX_PAGE_SIZE)
+	}
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d, must be a power of 2 from %d to %d",
+			size, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
+	return nil
+}
+
+func (tree *BTree) page() int {
+	if tree.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return tree.pageSize
 }
 
 //	helper functions
 // header
 func (node BNode) Btype() uint16 {
-	return binary.LittleEndian.Uint16(node.Data)
+	return binary.LittleEndian.Uint16(node.Data) &^ BNODE_PREFIX
 }
 
 func (node BNode) Nkeys() uint16 {
@@ -112,6 +154,40 @@ func (node BNode) SetHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node.Data[2:4], nkeys)
 }
 
+// the prefix of a leaf, it's stored after the offset list:
+// | type | nkeys | pointers | offsets | plen | prefix | key-values |
+// | 2B | 2B | nkeys * 8B | nkeys * 2B | 2B | plen | ... |
+// the keys of the key-values are the rest after the prefix.
+// the leaves without the BNODE_PREFIX flag store the whole keys.
+func (node BNode) prefix() []byte {
+	if binary.LittleEndian.Uint16(node.Data)&BNODE_PREFIX == 0 {
+		return nil
+	}
+	pos := HEADER + 10*node.Nkeys()
+	plen := binary.LittleEndian.Uint16(node.Data[pos:])
+	return node.Data[pos+2:][:plen]
+}
+
+// the bytes between the offset list and the key-values
+func (node BNode) prefixBytes() uint16 {
+	if binary.LittleEndian.Uint16(node.Data)&BNODE_PREFIX == 0 {
+		return 0
+	}
+	return 2 + uint16(len(node.prefix()))
+}
+
+// store a prefix, after SetHeader and before adding the keys
+func (node BNode) SetPrefix(prefix []byte) {
+	if len(prefix) == 0 {
+		return
+	}
+	u.Assert(node.Btype() == BNODE_LEAF)
+	binary.LittleEndian.PutUint16(node.Data, BNODE_LEAF|BNODE_PREFIX)
+	pos := HEADER + 10*node.Nkeys()
+	binary.LittleEndian.PutUint16(node.Data[pos:], uint16(len(prefix)))
+	copy(node.Data[pos+2:], prefix)
+}
+
 // pointers
 func (node BNode) GetPtr(idx uint16) uint64 {
 	u.Assert(idx < node.Nkeys())
@@ -145,10 +221,20 @@ func (node BNode) SetOffset(idx uint16, offset uint16) {
 // key-values
 func (node BNode) KvPos(idx uint16) uint16 {
 	u.Assert(idx <= node.Nkeys())
-	return HEADER + 8*node.Nkeys() + 2*node.Nkeys() + node.GetOffset(idx)
+	return HEADER + 8*node.Nkeys() + 2*node.Nkeys() + node.prefixBytes() + node.GetOffset(idx)
 }
 
+// the key, it's a copy if the node has a prefix
 func (node BNode) GetKey(idx uint16) []byte {
+	rest := node.keyRest(idx)
+	if prefix := node.prefix(); len(prefix) > 0 {
+		return append(append(make([]byte, 0, len(prefix)+len(rest)), prefix...), rest...)
+	}
+	return rest
+}
+
+// the key without the prefix of the node
+func (node BNode) keyRest(idx uint16) []byte {
 	u.Assert(idx < node.Nkeys())
 	pos := node.KvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.Data[pos:])
@@ -172,11 +258,21 @@ func (node BNode) Nbytes() uint16 {
 // TODO: bisect
 func NodeLookupLE(node BNode, key []byte) uint16 {
 	nkeys := node.Nkeys()
+	if prefix := node.prefix(); len(prefix) > 0 {
+		// all the keys have the prefix, compare the rest
+		if !bytes.HasPrefix(key, prefix) {
+			if bytes.Compare(key, prefix) < 0 {
+				return 0
+			}
+			return nkeys - 1
+		}
+		key = key[len(prefix):]
+	}
 	found := uint16(0)
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.GetKey(i), key)
+		cmp := bytes.Compare(node.keyRest(i), key)
 		if cmp <= 0 {
 			found = i
 		}
@@ -187,9 +283,11 @@ func NodeLookupLE(node BNode, key []byte) uint16 {
 	return found
 }
 
-// add a new key to a leaf node
+// add a new key to a leaf node.
+// the prefix is shortened if the key doesn't have it.
 func LeafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 	new.SetHeader(BNODE_LEAF, old.Nkeys()+1)
+	new.SetPrefix(old.prefix()[:commonPrefix(old.prefix(), key)])
 	NodeAppendRange(new, old, 0, 0, idx)
 	NodeAppendKV(new, idx, 0, key, val)
 	NodeAppendRange(new, old, idx+1, idx, old.Nkeys()-idx)
@@ -198,11 +296,11 @@ func LeafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
 
 // upadete the leaf
 func LeafUpadate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
-	new.SetHeader(BNODE_LEAF, old.Nkeys()+1)
+	new.SetHeader(BNODE_LEAF, old.Nkeys())
+	new.SetPrefix(old.prefix())
 	NodeAppendRange(new, old, 0, 0, idx)
 	NodeAppendKV(new, idx, 0, key, val)
-	NodeAppendRange(new, old, idx+1, idx, old.Nkeys()-idx)
-
+	NodeAppendRange(new, old, idx+1, idx+1, old.Nkeys()-(idx+1))
 }
 
 // copy multiple KVs into the position
@@ -215,6 +313,14 @@ func NodeAppendRange(
 	if n == 0 {
 		return
 	}
+	if !bytes.Equal(new.prefix(), old.prefix()) {
+		// the keys are split differently, copy them one by one
+		for i := uint16(0); i < n; i++ {
+			src := srcOld + i
+			nodeAppendKV(new, dstNew+i, old.GetPtr(src), old.prefix(), old.keyRest(src), old.GetVal(src))
+		}
+		return
+	}
 
 	// pointers
 	for i := uint16(0); i < n; i++ {
@@ -235,18 +341,89 @@ func NodeAppendRange(
 	copy(new.Data[new.KvPos(dstNew):], old.Data[begin:end])
 }
 
-// copy a KV into the position
+// copy a KV into the position, the key must have the prefix of the node
 func NodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	u.Assert(bytes.HasPrefix(key, new.prefix()))
+	nodeAppendKV(new, idx, ptr, nil, key, val)
+}
+
+// NodeAppendKV with the key in 2 parts, head + tail
+func nodeAppendKV(new BNode, idx uint16, ptr uint64, head []byte, tail []byte, val []byte) {
+	// drop the prefix of the new node
+	skip := len(new.prefix())
+	if skip <= len(head) {
+		head = head[skip:]
+	} else {
+		head, tail = nil, tail[skip-len(head):]
+	}
+	klen := uint16(len(head) + len(tail))
 	// ptrs
 	new.SetPtr(idx, ptr)
 	// KVs
 	pos := new.KvPos(idx)
-	binary.LittleEndian.PutUint16(new.Data[pos+0:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(new.Data[pos+0:], klen)
 	binary.LittleEndian.PutUint16(new.Data[pos+2:], uint16(len(val)))
-	copy(new.Data[pos+4:], key)
-	copy(new.Data[pos+4+uint16(len(key)):], val)
+	copy(new.Data[pos+4:], head)
+	copy(new.Data[pos+4+uint16(len(head)):], tail)
+	copy(new.Data[pos+4+klen:], val)
 	// the offset of the next key
-	new.SetOffset(idx+1, new.GetOffset(idx)+4+uint16((len(key)+len(val))))
+	new.SetOffset(idx+1, new.GetOffset(idx)+4+klen+uint16(len(val)))
+}
+
+// the size of a node with the keys [from, to) of `node`.
+// with `plen`, their common prefix of that length is stored once.
+func rangeBytes(node BNode, from uint16, to uint16, plen int) int {
+	n := int(to - from)
+	kvs := int(node.GetOffset(to)-node.GetOffset(from)) + n*len(node.prefix())
+	size := HEADER + 10*n + kvs
+	if plen > 0 {
+		size += 2 + plen - n*plen
+	}
+	return size
+}
+
+// the prefix worth storing for the keys [from, to) of a leaf, nil if none
+func (tree *BTree) rangePrefix(node BNode, from uint16, to uint16) []byte {
+	n := int(to - from)
+	if node.Btype() != BNODE_LEAF || n == 0 {
+		return nil
+	}
+	if !tree.Prefix {
+		// don't add one, but keep the existing one,
+		// the keys of a split node could be too long without it
+		return node.prefix()
+	}
+	if n < 2 {
+		return nil
+	}
+	first := node.keyRest(from)
+	common := commonPrefix(first, node.keyRest(to-1))
+	if !prefixSaves(n, len(node.prefix())+common) {
+		return nil
+	}
+	return append(append([]byte{}, node.prefix()...), first[:common]...)
+}
+
+// the length of the common prefix of 2 keys,
+// for sorted keys it's the common prefix of the keys between them.
+func commonPrefix(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// whether n keys are smaller with a prefix of plen stored once
+func prefixSaves(n int, plen int) bool {
+	return n*plen > 2+plen
+}
+
+// the node with its keys [from, to) and their prefix
+func (tree *BTree) nodeRange(new BNode, old BNode, from uint16, to uint16) {
+	new.SetHeader(old.Btype(), to-from)
+	new.SetPrefix(tree.rangePrefix(old, from, to))
+	NodeAppendRange(new, old, 0, from, to-from)
 }
 
 // insert a KV into a node, the result might be split into 2 nodes.
@@ -255,8 +432,13 @@ func NodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
 func TreeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
+	size := 2 * tree.page()
+	if !bytes.HasPrefix(key, node.prefix()) {
+		// the prefix is shortened, the other keys get longer
+		size += int(node.Nkeys()) * len(node.prefix())
+	}
 	new := BNode{
-		Data: make([]byte, 2*BTREE_PAGE_SIZE),
+		Data: make([]byte, size),
 	}
 
 	// where to insert the key?
@@ -290,51 +472,61 @@ func NodeInsert(
 	kptr := node.GetPtr(idx)
 	knode := tree.Get(kptr)
 	tree.Del(kptr)
-	// recursive insertion to the kid node
-	knode = TreeInsert(tree, knode, key, val)
-	// split the result
-	nsplit, splited := NodeSplit3(knode)
+	// recursive insertion to the kid node, then split the result
+	nsplit, splited := NodeSplit3(tree, TreeInsert(tree, knode, key, val))
+	tree.metrics.split(nsplit)
 	// update the kid links
 	NodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
 }
 
 // split a bigger-than-allowed node into two.
 // the second node always fits on a page.
-func NodeSplit2(left BNode, right BNode, old BNode) {
-	// Calculate the midpoint of the old node's data
-	mid := len(old.Data) / 2
-
-	// Copy the left half of the old node's data into the left node
-	copy(left.Data, old.Data[:mid])
-
-	// Copy the right half of the old node's data into the right node
-	copy(right.Data, old.Data[mid:])
-
-	// Trim excess data in both left and right nodes
-	left.Data = left.Data[:mid]
-	right.Data = right.Data[:len(old.Data)-mid]
-
-	u.Assert(len(left.Data) <= len(left.Data))
+func NodeSplit2(tree *BTree, left BNode, right BNode, old BNode) {
+	page, nkeys := tree.page(), old.Nkeys()
+	// the size of a node with the keys [from, to)
+	size := func(from uint16, to uint16) int {
+		return rangeBytes(old, from, to, len(tree.rangePrefix(old, from, to)))
+	}
+	// start from the middle, then make sure the right half fits
+	nleft := nkeys / 2
+	for nleft > 1 && size(0, nleft) > page {
+		nleft--
+	}
+	for size(nleft, nkeys) > page {
+		nleft++
+	}
+	u.Assert(1 <= nleft && nleft < nkeys)
+	tree.nodeRange(left, old, 0, nleft)
+	tree.nodeRange(right, old, nleft, nkeys)
+	u.Assert(int(right.Nbytes()) <= page)
 }
 
 // split a node if it's too big. the result are 1-3 nodes.
-func NodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.Nbytes() <= BTREE_PAGE_SIZE {
-		old.Data = old.Data[:BTREE_PAGE_SIZE]
+// a leaf is rewritten if the prefix of its keys changed.
+func NodeSplit3(tree *BTree, old BNode) (uint16, [3]BNode) {
+	page := tree.page()
+	prefix := tree.rangePrefix(old, 0, old.Nkeys())
+	if len(prefix) != len(old.prefix()) && rangeBytes(old, 0, old.Nkeys(), len(prefix)) <= page {
+		new := BNode{make([]byte, page)}
+		tree.nodeRange(new, old, 0, old.Nkeys())
+		return 1, [3]BNode{new}
+	}
+	if int(old.Nbytes()) <= page {
+		old.Data = old.Data[:page]
 		return 1, [3]BNode{old}
 	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	NodeSplit2(left, right, old)
-	if left.Btype() <= BTREE_PAGE_SIZE {
-		left.Data = left.Data[:BTREE_PAGE_SIZE]
+	left := BNode{make([]byte, 2*page)} // might be split later
+	right := BNode{make([]byte, page)}
+	NodeSplit2(tree, left, right, old)
+	if int(left.Nbytes()) <= page {
+		left.Data = left.Data[:page]
 		return 2, [3]BNode{left, right}
 	}
 	// left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	NodeSplit2(leftleft, middle, left)
-	u.Assert(leftleft.Nbytes() <= BTREE_PAGE_SIZE)
+	leftleft := BNode{make([]byte, page)}
+	middle := BNode{make([]byte, page)}
+	NodeSplit2(tree, leftleft, middle, left)
+	u.Assert(int(leftleft.Nbytes()) <= page)
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
@@ -355,6 +547,7 @@ func NodeReplaceKidN(
 // remove a key from a leaf node
 func LeafDelete(new BNode, old BNode, idx uint16) {
 	new.SetHeader(BNODE_LEAF, old.Nkeys()-1)
+	new.SetPrefix(old.prefix())
 	NodeAppendRange(new, old, 0, 0, idx)
 	NodeAppendRange(new, old, idx, idx+1, old.Nkeys()-(idx+1))
 }
@@ -370,7 +563,7 @@ func TreeDelete(tree *BTree, node BNode, key []byte) BNode {
 			return BNode{} // not found
 		}
 		// delete the key in the leaf
-		new := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		new := BNode{Data: make([]byte, tree.page())}
 		LeafDelete(new, node, idx)
 		return new
 	case BNODE_NODE:
@@ -390,23 +583,29 @@ func NodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.Del(kptr)
 
-	new := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+	new := BNode{Data: make([]byte, tree.page())}
 	// check for merging
 	mergeDir, sibling := ShouldMerge(tree, node, idx, updated)
+	tree.metrics.merge(mergeDir)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
-		NodeMerge(merged, sibling, updated)
+		merged := BNode{Data: make([]byte, tree.page())}
+		NodeMerge(tree, merged, sibling, updated)
 		tree.Del(node.GetPtr(idx - 1))
 		NodeReplace2Kid(new, node, idx-1, tree.New(merged), merged.GetKey(0))
 	case mergeDir > 0: // right
-		merged := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
-		NodeMerge(merged, updated, sibling)
+		merged := BNode{Data: make([]byte, tree.page())}
+		NodeMerge(tree, merged, updated, sibling)
 		tree.Del(node.GetPtr(idx + 1))
 		NodeReplace2Kid(new, node, idx, tree.New(merged), merged.GetKey(0))
+	case mergeDir == 0 && updated.Nkeys() == 0:
+		// the only kid is empty, so is the node, the parent merges it.
+		// a bulk load can leave a node with a single kid.
+		u.Assert(node.Nkeys() == 1)
+		new.SetHeader(BNODE_NODE, 0)
 	case mergeDir == 0:
-		u.Assert(updated.Nkeys() > 0)
-		NodeReplaceKidN(tree, new, node, idx, updated)
+		_, packed := NodeSplit3(tree, updated) // the prefix can be longer
+		NodeReplaceKidN(tree, new, node, idx, packed[0])
 	}
 	return new
 }
@@ -416,54 +615,80 @@ func ShouldMerge(
 	tree *BTree, node BNode,
 	idx uint16, updated BNode,
 ) (int, BNode) {
-	if updated.Nbytes() > BTREE_PAGE_SIZE/4 {
+	page := tree.page()
+	if int(updated.Nbytes()) > page/4 {
 		return 0, BNode{}
 	}
 	if idx > 0 {
 		sibling := tree.Get(node.GetPtr(idx - 1))
-		merged := sibling.Nbytes() + updated.Nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if tree.mergedBytes(sibling, updated) <= page {
 			return -1, sibling
 		}
 	}
 	if idx+1 < node.Nkeys() {
 		sibling := tree.Get(node.GetPtr(idx + 1))
-		merged := sibling.Nbytes() + updated.Nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if tree.mergedBytes(updated, sibling) <= page {
 			return +1, sibling
 		}
 	}
 	return 0, BNode{}
 }
 
+// the size of 2 nodes merged, with their common prefix
+func (tree *BTree) mergedBytes(left BNode, right BNode) int {
+	size := int(left.Nbytes()) + int(right.Nbytes()) - HEADER
+	size -= int(left.prefixBytes()) + int(right.prefixBytes())
+	size += int(left.Nkeys())*len(left.prefix()) + int(right.Nkeys())*len(right.prefix())
+	if plen := len(tree.mergedPrefix(left, right)); plen > 0 {
+		size += 2 + plen - int(left.Nkeys()+right.Nkeys())*plen
+	}
+	return size
+}
+
+// the prefix worth storing for 2 merged leaves, nil if none
+func (tree *BTree) mergedPrefix(left BNode, right BNode) []byte {
+	if !tree.Prefix || left.Btype() != BNODE_LEAF {
+		return nil
+	}
+	n := int(left.Nkeys() + right.Nkeys())
+	if n < 2 {
+		return nil
+	}
+	// one of them can be empty after a deletion
+	keys := func(i int) []byte {
+		if i < int(left.Nkeys()) {
+			return left.GetKey(uint16(i))
+		}
+		return right.GetKey(uint16(i) - left.Nkeys())
+	}
+	first := keys(0)
+	plen := commonPrefix(first, keys(n-1))
+	if !prefixSaves(n, plen) {
+		return nil
+	}
+	return first[:plen]
+}
+
 // merge 2 nodes into 1
-func NodeMerge(new BNode, left BNode, right BNode) {
+func NodeMerge(tree *BTree, new BNode, left BNode, right BNode) {
 	new.SetHeader(left.Btype(), left.Nkeys()+right.Nkeys())
+	new.SetPrefix(tree.mergedPrefix(left, right))
 	NodeAppendRange(new, left, 0, 0, left.Nkeys())
 	NodeAppendRange(new, right, left.Nkeys(), 0, right.Nkeys())
 }
 
-// The NodeReplace2Kid function replaces two children of a node with a single child during a merge operation.
-func NodeReplace2Kid(new BNode, parentNode BNode, idx uint16, val uint64, key []byte) {
-	// Create a temporary child node for the merged key and pointer
-	tempChild := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
-	tempChild.SetHeader(BNODE_LEAF, 1) // Assuming it's a single key node
-
-	// Directly set the key and pointer in the tempChild node
-	copy(tempChild.Data[:len(key)], key) // Copy the key to the start of the data
-	tempChild.SetPtr(0, val)             // Set the pointer for the child node
-
-	// Update the tempChild's metadata if necessary (e.g., byte size, nkeys)
-	// Ensure any header fields are consistent with your implementation.
-
-	// Use nodeReplaceKidN to replace the two child nodes with the new merged child
-	NodeReplaceKidN(nil, new, parentNode, idx, tempChild)
+// replace 2 adjacent links with 1 after a merge
+func NodeReplace2Kid(new BNode, old BNode, idx uint16, ptr uint64, key []byte) {
+	new.SetHeader(BNODE_NODE, old.Nkeys()-1)
+	NodeAppendRange(new, old, 0, 0, idx)
+	NodeAppendKV(new, idx, ptr, key, nil)
+	NodeAppendRange(new, old, idx+1, idx+2, old.Nkeys()-(idx+2))
 }
 
 // root node
 func (tree *BTree) Delete(key []byte) bool {
 	u.Assert(len(key) != 0)
-	u.Assert(len(key) <= BTREE_MAX_KEY_SIZE)
+	u.Assert(len(key) <= MaxKeySize(tree.page()))
 	if tree.root == 0 {
 		return false
 	}
@@ -484,11 +709,11 @@ func (tree *BTree) Delete(key []byte) bool {
 // the final interface for insertion
 func (tree *BTree) Insert(key []byte, val []byte) {
 	u.Assert(len(key) != 0)
-	u.Assert(len(key) <= BTREE_MAX_KEY_SIZE)
-	u.Assert(len(val) <= BTREE_MAX_VAL_SIZE)
+	u.Assert(len(key) <= MaxKeySize(tree.page()))
+	u.Assert(len(val) <= MaxValSize(tree.page()))
 	if tree.root == 0 {
 		// create the first node
-		root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{Data: make([]byte, tree.page())}
 		root.SetHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
@@ -499,11 +724,11 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	}
 	node := tree.Get(tree.root)
 	tree.Del(tree.root)
-	node = TreeInsert(tree, node, key, val)
-	nsplit, splitted := NodeSplit3(node)
+	nsplit, splitted := NodeSplit3(tree, TreeInsert(tree, node, key, val))
+	tree.metrics.split(nsplit)
 	if nsplit > 1 {
 		// the root was split, add a new level.
-		root := BNode{Data: make([]byte, BTREE_PAGE_SIZE)}
+		root := BNode{Data: make([]byte, tree.page())}
 		root.SetHeader(BNODE_NODE, nsplit)
 		for i, knode := range splitted[:nsplit] {
 			ptr, key := tree.New(knode), knode.GetKey(0)
@@ -515,12 +740,51 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	}
 }
 
+// point query
+func (tree *BTree) Lookup(key []byte) ([]byte, bool) {
+	iter := tree.SeekLE(key)
+	if !iter.Valid() {
+		return nil, false
+	}
+	cur, val := iter.Deref()
+	if !bytes.Equal(cur, key) {
+		return nil, false
+	}
+	return val, true
+}
+
+// insert with update modes, reports what happened in the request
 func (tree *BTree) InsertEx(req *InsertReq) {
-	// code
+	req.tree = tree
+	old, exists := tree.Lookup(req.Key)
+	switch req.Mode {
+	case MODE_UPDATE_ONLY:
+		if !exists {
+			return
+		}
+	case MODE_INSERT_ONLY:
+		if exists {
+			return
+		}
+	}
+	if exists && bytes.Equal(old, req.Val) {
+		return // unchanged
+	}
+	req.Old = append([]byte{}, old...)
+	req.Added = !exists
+	req.Updated = true
+	tree.Insert(req.Key, req.Val)
 }
 
-func (tree *BTree) DeleteEx(req *DeleteReq) {
-	// code
+// delete and return the old value in the request
+func (tree *BTree) DeleteEx(req *DeleteReq) bool {
+	req.tree = tree
+	old, exists := tree.Lookup(req.Key)
+	if !exists {
+		return false
+	}
+	req.Old = append([]byte{}, old...)
+	return tree.Delete(req.Key)
 }
 
 // get the current KV pair
@@ -532,7 +796,8 @@ func (iter *BIter) Deref() ([]byte, []byte) {
 
 // precondition of the Deref()
 func (iter *BIter) Valid() bool {
-	return len(iter.path) > 0
+	last := len(iter.path) - 1
+	return last >= 0 && iter.pos[last] < iter.path[last].Nkeys()
 }
 
 // moving backward and forward
@@ -541,7 +806,7 @@ func (iter *BIter) Prev() {
 }
 
 func (iter *BIter) Next() {
-	iterNext(iter, len(iter.path)+1)
+	iterNext(iter, len(iter.path)-1)
 }
 
 func iterPrev(iter *BIter, level int) {
@@ -562,7 +827,21 @@ func iterPrev(iter *BIter, level int) {
 }
 
 func iterNext(iter *BIter, level int) {
-	// code
+	if iter.pos[level]+1 < iter.path[level].Nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level > 0 {
+		iterNext(iter, level-1) // move to a slibing node
+	} else {
+		iter.pos[len(iter.pos)-1]++ // past the last key
+		return
+	}
+	if level+1 < len(iter.pos) && iter.Valid() {
+		// update the kid node
+		node := iter.path[level]
+		kid := iter.tree.Get(node.GetPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
 }
 
 // find the closest position that is less or equal to the input key
@@ -628,6 +907,11 @@ func (sc *Scanner) Valid() bool {
 // move the underlying B-tree iterator
 func (sc *Scanner) Next() {
 	u.Assert(sc.Valid())
+	sc.step()
+	sc.skipExpired()
+}
+
+func (sc *Scanner) step() {
 	if sc.Cmp1 > 0 {
 		sc.iter.Next()
 	} else {
@@ -635,14 +919,36 @@ func (sc *Scanner) Next() {
 	}
 }
 
+// skip the expired rows of a table with a TTL column, see expiry.go
+func (sc *Scanner) skipExpired() {
+	for sc.tdef.TTL != "" && sc.Valid() {
+		key, val := sc.iter.Deref()
+		if !rowExpired(sc.tdef, keyRow(sc.tdef, key, val), sc.now) {
+			return
+		}
+		sc.step()
+	}
+}
+
 // fetch the current row
 func (sc *Scanner) Deref(rec *Record) {
+	u.Assert(sc.Valid())
+	tdef := sc.tdef
+	key, val := sc.iter.Deref()
+	values := make([]Value, len(tdef.Cols))
+	for i := range values {
+		values[i].Type = tdef.Types[i]
+	}
+	decodeValues(key[4:], values[:tdef.Pkeys]) // skip the table prefix
+	decodeRow(tdef, val, values[tdef.Pkeys:])
+	rec.Cols = append(rec.Cols[:0], tdef.Cols...)
+	rec.Vals = append(rec.Vals[:0], values...)
 }
 
 func (db *DB) Scan(table string, req *Scanner) error {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return fmt.Errorf("table not found: %s", table)
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return DbScan(db, tdef, req)
 }
@@ -656,24 +962,48 @@ func DbScan(db *DB, tdef *TableDef, req *Scanner) error {
 		return fmt.Errorf("bad range")
 	}
 
-	val1, err := checkRecord(tdef, req.Key1, tdef.Pkeys)
+	// the keys can be a prefix of the primary key,
+	// an empty key covers the whole table.
+	val1, n1, err := checkKeyPrefix(tdef, req.Key1)
 	if err != nil {
 		return err
 	}
-	val2, err := checkRecord(tdef, req.Key2, tdef.Pkeys)
+	val2, n2, err := checkKeyPrefix(tdef, req.Key2)
 	if err != nil {
 		return err
 	}
 
+	req.db = db
 	req.tdef = tdef
+	req.indexNo = -1
 
 	// seek to the start key
-	keyStart := encodeKey(nil, tdef.Prefix, val1[:tdef.Pkeys])
-	req.keyEnd = encodeKey(nil, tdef.Prefix, val2[:tdef.Pkeys])
+	pk := tdef.Cols[:tdef.Pkeys]
+	keyStart := encodeKeyPartial(nil, tdef.Prefix, val1[:n1], tdef, pk, req.Cmp1)
+	req.keyEnd = encodeKeyPartial(nil, tdef.Prefix, val2[:n2], tdef, pk, req.Cmp2)
 	req.iter = db.kv.tree.Seek(keyStart, req.Cmp1)
+	req.now = nowMillis()
+	req.skipExpired()
 	return nil
 }
 
+// check a record that is a prefix of the primary key,
+// returns the values and the length of the prefix.
+func checkKeyPrefix(tdef *TableDef, rec Record) ([]Value, int, error) {
+	values, err := checkRecord(tdef, rec, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	n := 0
+	for n < tdef.Pkeys && values[n].Type != TYPE_ERROR {
+		n++
+	}
+	if n != len(rec.Cols) {
+		return nil, 0, fmt.Errorf("table %s: scan key is not a prefix of the primary key", tdef.Name)
+	}
+	return values, n, nil
+}
+
 // get a single row by the primary key
 func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	// just a shortcut for the scan operation
@@ -708,9 +1038,9 @@ func indexOP(db *DB, tdef *TableDef, rec Record, op int) {
 		done, err := false, error(nil)
 		switch op {
 		case INDEX_ADD:
-			done, err = db.kv.UpdateW(&InsertReq{Key: key})
+			done, err = db.kv.update(&InsertReq{Key: key})
 		case INDEX_DEL:
-			done, err = db.kv.DelW(&DeleteReq{Key: key})
+			done, err = db.kv.del(&DeleteReq{Key: key})
 		default:
 			panic("bad op")
 		}
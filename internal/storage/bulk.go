@@ -0,0 +1,680 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// bulk loading.
+// inserting rows one by one copies the root-to-leaf path and may split
+// nodes for every key. a bulk load instead encodes the rows, sorts the
+// keys (in memory, spilling sorted runs to temporary files when they
+// don't fit), merges them with the keys already in the tree, and packs
+// the merged stream into new leaves from left to right, building the
+// internal levels above them. the new root replaces the old one at the
+// commit, so there is a single master page update.
+// only the subtrees whose key range gets new keys are rewritten, the
+// others are linked from the new nodes as they are. a load into a table
+// rewrites its key range and the paths to it, not the rest of the
+// database. the nodes at the edges of the range can be underfull.
+
+// the default share of a page filled by a bulk load
+const BULK_FILL_FACTOR = 0.9
+
+// the default memory for sorting before spilling a run to a file
+const BULK_SORT_MEMORY = 64 << 20
+
+// new pages kept in memory before they are written ahead of the commit
+const BULK_WRITE_PAGES = 1024
+
+type BulkOptions struct {
+	// the share of a node filled with keys, in (0, 1],
+	// less leaves room for later inserts without splits
+	FillFactor float64
+	// the rows are in primary key order, they are not sorted again.
+	// the index keys are always sorted.
+	Sorted bool
+	// bytes of keys and values sorted in memory, the rest is spilled
+	SortMemory int
+	// the directory of the sorted runs, the system default if empty
+	TempDir string
+}
+
+// what a bulk load did
+type BulkStats struct {
+	Rows  int // rows inserted
+	Keys  int // keys in the rewritten leaves, of the table and its indexes
+	Pages int // pages written
+	Runs  int // sorted runs spilled to files
+}
+
+// the input of a bulk load, returns false after the last row
+type RowSource func() (Record, bool, error)
+
+// insert the rows into a table with a bulk load.
+// the table may have rows already, a duplicate primary key is an error.
+// the rows are checked like an Insert. it's a transaction of its own,
+// the caller serializes access like for the other updates.
+func (db *DB) BulkLoad(table string, rows RowSource, opts BulkOptions) (stats BulkStats, err error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return stats, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if opts.FillFactor == 0 {
+		opts.FillFactor = BULK_FILL_FACTOR
+	}
+	if !(opts.FillFactor > 0 && opts.FillFactor <= 1) {
+		return stats, fmt.Errorf("bulk load: bad fill factor %v", opts.FillFactor)
+	}
+	if opts.SortMemory <= 0 {
+		opts.SortMemory = BULK_SORT_MEMORY
+	}
+	if err := db.Begin(); err != nil {
+		return stats, err
+	}
+	defer func() {
+		if err != nil {
+			_ = db.Abort()
+		}
+	}()
+	start := time.Now()
+
+	// encode the rows and the index keys
+	primary := &bulkSorter{opts: &opts, sorted: opts.Sorted}
+	index := &bulkSorter{opts: &opts}
+	defer primary.close()
+	defer index.close()
+	for {
+		rec, ok, err := rows()
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			break
+		}
+		if err := bulkRow(db, tdef, rec, primary, index); err != nil {
+			return stats, fmt.Errorf("bulk load: row %d: %w", stats.Rows+1, err)
+		}
+		stats.Rows++
+	}
+	if stats.Rows == 0 {
+		return stats, db.Commit()
+	}
+
+	// merge them into a new tree
+	sources := []bulkSource{}
+	for _, s := range []*bulkSorter{primary, index} {
+		src, err := s.sources()
+		if err != nil {
+			return stats, fmt.Errorf("bulk load: %w", err)
+		}
+		sources = append(sources, src...)
+		stats.Runs += len(s.runs)
+	}
+	stats.Keys, stats.Pages, err = db.kv.bulkBuild(sources, opts.FillFactor)
+	if errors.Is(err, errBulkDuplicate) {
+		return stats, constraintErrorf("table %s: duplicate primary key", tdef.Name)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("bulk load: %w", err)
+	}
+	if err := db.Commit(); err != nil {
+		return stats, err
+	}
+	db.kv.Options.Metrics.rowsLoaded(tdef.Name, stats.Rows)
+	db.kv.log().Info("bulk load", "table", tdef.Name, "rows", stats.Rows,
+		"pages", stats.Pages, "runs", stats.Runs, "duration", time.Since(start))
+	return stats, nil
+}
+
+// check and encode a row, like DbUpdate and indexOP
+func bulkRow(db *DB, tdef *TableDef, rec Record, primary *bulkSorter, index *bulkSorter) error {
+	if err := assignAutoKey(db, tdef, &rec); err != nil {
+		return err
+	}
+	values, err := checkRecord(tdef, rec, tdef.Pkeys)
+	if err != nil {
+		return err
+	}
+	if err := applyConstraints(tdef, values); err != nil {
+		return err
+	}
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
+	val := encodeRow(tdef, values[tdef.Pkeys:])
+	if err := checkRowSize(db, tdef, key, val, values); err != nil {
+		return err
+	}
+	if err := primary.add(key, val); err != nil {
+		return err
+	}
+	if at := rowExpiry(tdef, values); at > 0 {
+		if err := db.kv.checkExpiryKey(key); err != nil {
+			return err
+		}
+		if err := index.add(expiryIndexKey(at, key), []byte(tdef.Name)); err != nil {
+			return err
+		}
+	}
+	irec := make([]Value, len(tdef.Cols))
+	for i, cols := range tdef.Indexes {
+		for j, c := range cols {
+			irec[j] = values[colIndex(tdef, c)]
+		}
+		ikey := encodeKey(nil, tdef.IndexPrefixes[i], irec[:len(cols)])
+		if err := index.add(ikey, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a key-value pair of a sorter
+type bulkPair struct {
+	key []byte
+	val []byte
+}
+
+// an external sorter: the pairs are sorted in memory,
+// and spilled to a temporary file as a sorted run when they don't fit.
+type bulkSorter struct {
+	opts   *BulkOptions
+	sorted bool // the input is in order, it's checked instead of sorted
+	pairs  []bulkPair
+	mem    int // bytes of the pairs in memory
+	last   []byte
+	runs   []*os.File
+}
+
+func (s *bulkSorter) add(key []byte, val []byte) error {
+	if s.sorted && s.last != nil && bytes.Compare(s.last, key) >= 0 {
+		return errors.New("the rows are not sorted by the primary key")
+	}
+	buf := make([]byte, len(key)+len(val))
+	copy(buf, key)
+	copy(buf[len(key):], val)
+	pair := bulkPair{key: buf[:len(key):len(key)], val: buf[len(key):]}
+	s.pairs = append(s.pairs, pair)
+	s.last = pair.key
+	s.mem += len(buf) + 64 // and the slice headers
+	if s.mem >= s.opts.SortMemory {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *bulkSorter) sort() {
+	if !s.sorted {
+		sort.Slice(s.pairs, func(i, j int) bool {
+			return bytes.Compare(s.pairs[i].key, s.pairs[j].key) < 0
+		})
+	}
+}
+
+// write the pairs in memory as a sorted run:
+// | klen uvarint | vlen uvarint | key | val |
+func (s *bulkSorter) spill() error {
+	s.sort()
+	fp, err := os.CreateTemp(s.opts.TempDir, "dungeondb-bulk-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, fp)
+	w := bufio.NewWriterSize(fp, 64<<10)
+	var hdr [2 * binary.MaxVarintLen64]byte
+	for _, pair := range s.pairs {
+		n := binary.PutUvarint(hdr[:], uint64(len(pair.key)))
+		n += binary.PutUvarint(hdr[n:], uint64(len(pair.val)))
+		w.Write(hdr[:n])
+		w.Write(pair.key)
+		w.Write(pair.val)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("writing a sorted run: %w", err)
+	}
+	clear(s.pairs)
+	s.pairs = s.pairs[:0]
+	s.mem = 0
+	return nil
+}
+
+// the sorted runs and the pairs in memory
+func (s *bulkSorter) sources() ([]bulkSource, error) {
+	sources := []bulkSource{}
+	for _, fp := range s.runs {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		sources = append(sources, &runSource{r: bufio.NewReaderSize(fp, 64<<10)})
+	}
+	s.sort()
+	if len(s.pairs) > 0 {
+		sources = append(sources, &memSource{pairs: s.pairs})
+	}
+	return sources, nil
+}
+
+// remove the runs
+func (s *bulkSorter) close() {
+	for _, fp := range s.runs {
+		fp.Close()
+		os.Remove(fp.Name())
+	}
+	s.runs = nil
+}
+
+// a sorted stream of pairs for the merge
+type bulkSource interface {
+	// the next pair, false at the end
+	next() (key []byte, val []byte, ok bool, err error)
+}
+
+type memSource struct {
+	pairs []bulkPair
+}
+
+func (src *memSource) next() ([]byte, []byte, bool, error) {
+	if len(src.pairs) == 0 {
+		return nil, nil, false, nil
+	}
+	pair := src.pairs[0]
+	src.pairs = src.pairs[1:]
+	return pair.key, pair.val, true, nil
+}
+
+type runSource struct {
+	r *bufio.Reader
+}
+
+func (src *runSource) next() ([]byte, []byte, bool, error) {
+	klen, err := binary.ReadUvarint(src.r)
+	if err == io.EOF {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	vlen, err := binary.ReadUvarint(src.r)
+	if err != nil {
+		return nil, nil, false, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, klen+vlen)
+	if _, err := io.ReadFull(src.r, buf); err != nil {
+		return nil, nil, false, io.ErrUnexpectedEOF
+	}
+	return buf[:klen:klen], buf[klen:], true, nil
+}
+
+// the keys already in the tree, without the sentinel key
+type treeSource struct {
+	iter *BIter
+}
+
+func (src *treeSource) next() ([]byte, []byte, bool, error) {
+	for ; src.iter.Valid(); src.iter.Next() {
+		key, val := src.iter.Deref()
+		if len(key) > 0 {
+			src.iter.Next()
+			return key, val, true, nil
+		}
+	}
+	return nil, nil, false, nil
+}
+
+// a k-way merge of the sources by their current keys
+type bulkHead struct {
+	key []byte
+	val []byte
+	src bulkSource
+}
+
+type bulkHeap []*bulkHead
+
+func (h bulkHeap) Len() int           { return len(h) }
+func (h bulkHeap) Less(i, j int) bool { return bytes.Compare(h[i].key, h[j].key) < 0 }
+func (h bulkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *bulkHeap) Push(x any)        { *h = append(*h, x.(*bulkHead)) }
+func (h *bulkHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+var errBulkDuplicate = errors.New("duplicate key")
+
+// the pairs of all sources in key order
+type bulkMerger struct {
+	h    bulkHeap
+	prev []byte
+}
+
+func newBulkMerger(sources []bulkSource) (*bulkMerger, error) {
+	m := &bulkMerger{}
+	for _, src := range sources {
+		key, val, ok, err := src.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.h = append(m.h, &bulkHead{key, val, src})
+		}
+	}
+	heap.Init(&m.h)
+	return m, nil
+}
+
+// the current pair, false at the end
+func (m *bulkMerger) peek() ([]byte, []byte, bool) {
+	if m.h.Len() == 0 {
+		return nil, nil, false
+	}
+	return m.h[0].key, m.h[0].val, true
+}
+
+// move to the next pair, a key seen twice is an error
+func (m *bulkMerger) next() error {
+	top := m.h[0]
+	m.prev = top.key
+	key, val, ok, err := top.src.next()
+	if err != nil {
+		return err
+	}
+	if ok {
+		top.key, top.val = key, val
+		heap.Fix(&m.h, 0)
+	} else {
+		heap.Pop(&m.h)
+	}
+	if m.h.Len() > 0 && bytes.Equal(m.prev, m.h[0].key) {
+		return errBulkDuplicate
+	}
+	return nil
+}
+
+// call `fn` with the pairs of all sources in key order
+func bulkMerge(sources []bulkSource, fn func(key []byte, val []byte) error) error {
+	m, err := newBulkMerger(sources)
+	if err != nil {
+		return err
+	}
+	for {
+		key, val, ok := m.peek()
+		if !ok {
+			return nil
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+		if err := m.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// packs sorted keys into nodes, level by level from the leaves
+type bulkBuilder struct {
+	new    func(BNode) uint64 // allocate a page
+	page   int                // the page size
+	limit  int                // bytes per node
+	prefix bool               // store the common prefix of a leaf once
+	levels []*bulkLevel
+	pages  int
+}
+
+// the pending keys of the node being filled at a level
+type bulkLevel struct {
+	keys  [][]byte
+	vals  [][]byte
+	ptrs  []uint64
+	size  int // bytes of the node with these keys
+	nodes int // nodes written at this level
+}
+
+func (b *bulkBuilder) add(level int, key []byte, val []byte, ptr uint64) {
+	for level >= len(b.levels) {
+		b.levels = append(b.levels, &bulkLevel{size: HEADER})
+	}
+	lv := b.levels[level]
+	kvsize := 8 + 2 + 4 + len(key) + len(val)
+	if len(lv.keys) > 0 && b.size(level, key, kvsize) > b.limit {
+		b.emit(level)
+	}
+	lv.keys = append(lv.keys, key)
+	lv.vals = append(lv.vals, val)
+	lv.ptrs = append(lv.ptrs, ptr)
+	lv.size += kvsize
+}
+
+// the size of the pending node of a level with one more key
+func (b *bulkBuilder) size(level int, key []byte, kvsize int) int {
+	lv := b.levels[level]
+	size := lv.size + kvsize
+	if b.prefix && level == 0 {
+		// the keys are sorted, the first and the last have the common prefix
+		n, plen := len(lv.keys)+1, commonPrefix(lv.keys[0], key)
+		if prefixSaves(n, plen) {
+			size += 2 + plen - n*plen
+		}
+	}
+	return size
+}
+
+// add an existing subtree of `height` levels, 1 for a leaf, whose first
+// key is `key`. the pending nodes below it are written first.
+func (b *bulkBuilder) keep(height int, key []byte, ptr uint64) {
+	for level := 0; level < height && level < len(b.levels); level++ {
+		if len(b.levels[level].keys) > 0 {
+			b.emit(level)
+		}
+	}
+	b.add(height, key, nil, ptr)
+}
+
+// can a subtree of `height` levels be kept without writing a node with
+// a single kid below it?
+func (b *bulkBuilder) canKeep(height int) bool {
+	carry := false
+	for level := 0; level < height && level < len(b.levels); level++ {
+		n := len(b.levels[level].keys)
+		if carry {
+			n++
+		}
+		if level > 0 && n == 1 {
+			return false
+		}
+		carry = n > 0
+	}
+	return true
+}
+
+// write the pending node of a level and add it to the level above
+func (b *bulkBuilder) emit(level int) {
+	ptr := b.write(level)
+	b.levels[level].nodes++
+	b.add(level+1, b.levels[level].keys[0], nil, ptr)
+	lv := b.levels[level]
+	lv.keys, lv.vals, lv.ptrs = lv.keys[:0], lv.vals[:0], lv.ptrs[:0]
+	lv.size = HEADER
+}
+
+func (b *bulkBuilder) write(level int) uint64 {
+	lv := b.levels[level]
+	btype := uint16(BNODE_NODE)
+	if level == 0 {
+		btype = BNODE_LEAF
+	}
+	node := BNode{make([]byte, b.page)}
+	node.SetHeader(btype, uint16(len(lv.keys)))
+	if n := len(lv.keys); b.prefix && level == 0 && n > 1 {
+		if plen := commonPrefix(lv.keys[0], lv.keys[n-1]); prefixSaves(n, plen) {
+			node.SetPrefix(lv.keys[0][:plen])
+		}
+	}
+	for i := range lv.keys {
+		NodeAppendKV(node, uint16(i), lv.ptrs[i], lv.keys[i], lv.vals[i])
+	}
+	b.pages++
+	return b.new(node)
+}
+
+// write the pending nodes, returns the root
+func (b *bulkBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		lv := b.levels[level]
+		if level == len(b.levels)-1 && lv.nodes == 0 {
+			if level > 0 && len(lv.keys) == 1 {
+				return lv.ptrs[0] // no root with a single kid
+			}
+			return b.write(level) // a single node, the root
+		}
+		if len(lv.keys) > 0 {
+			b.emit(level)
+		}
+	}
+}
+
+// merge the sorted sources into the current tree, the subtrees without
+// new keys in their range are kept. the pages are committed by the caller.
+// returns the number of keys and pages written.
+func (db *KV) bulkBuild(sources []bulkSource, fill float64) (int, int, error) {
+	if err := db.writable(); err != nil {
+		return 0, 0, err
+	}
+	m, err := newBulkMerger(sources)
+	if err != nil {
+		return 0, 0, err
+	}
+	page := db.nodeSize()
+	w := &bulkWalk{
+		db: db, m: m,
+		b: &bulkBuilder{new: db.tree.New, page: page, limit: int(fill * float64(page)), prefix: db.tree.Prefix},
+	}
+	if db.tree.root == 0 {
+		w.b.add(0, nil, nil, 0) // the sentinel key, the tree covers the whole key space
+		err = w.leaf(BNode{}, nil)
+	} else {
+		height := 1
+		for node := db.tree.Get(db.tree.root); node.Btype() == BNODE_NODE; node = db.tree.Get(node.GetPtr(0)) {
+			height++
+		}
+		err = w.node(db.tree.root, nil, nil, height)
+	}
+	if err != nil {
+		return w.keys, w.b.pages, err
+	}
+	root := w.b.finish()
+
+	// free the rewritten nodes, their pages are not read anymore
+	for _, ptr := range w.freed {
+		db.tree.Del(ptr)
+	}
+	db.tree.root = root
+	return w.keys, w.b.pages, nil
+}
+
+// a walk of the current tree merging the new pairs into it
+type bulkWalk struct {
+	db      *KV
+	m       *bulkMerger
+	b       *bulkBuilder
+	keys    int      // added to the new leaves
+	written int      // pages written ahead
+	freed   []uint64 // the rewritten nodes
+}
+
+// merge the new pairs into the subtree at `ptr` of `height` levels,
+// its keys are in [first, hi), no bound if hi is nil
+func (w *bulkWalk) node(ptr uint64, first []byte, hi []byte, height int) error {
+	key, _, ok := w.m.peek()
+	if !ok || (hi != nil && bytes.Compare(key, hi) >= 0) {
+		// no new keys, the subtree is kept unless it would leave a
+		// node with a single kid, then its kids are kept instead
+		if w.b.canKeep(height) {
+			w.b.keep(height, first, ptr)
+			return nil
+		}
+	}
+	node := w.db.tree.Get(ptr)
+	w.freed = append(w.freed, ptr)
+	if height == 1 {
+		return w.leaf(node, hi)
+	}
+	for i := uint16(0); i < node.Nkeys(); i++ {
+		khi := hi
+		if i+1 < node.Nkeys() {
+			khi = node.GetKey(i + 1)
+		}
+		if err := w.node(node.GetPtr(i), node.GetKey(i), khi, height-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge the new pairs below `hi` with the keys of a leaf, if any
+func (w *bulkWalk) leaf(node BNode, hi []byte) error {
+	i, n := uint16(0), uint16(0)
+	if len(node.Data) > 0 {
+		n = node.Nkeys()
+	}
+	for {
+		key, val, ok := w.m.peek()
+		ok = ok && (hi == nil || bytes.Compare(key, hi) < 0)
+		switch {
+		case i < n && ok && bytes.Equal(node.GetKey(i), key):
+			return errBulkDuplicate
+		case i < n && (!ok || bytes.Compare(node.GetKey(i), key) < 0):
+			key, val = node.GetKey(i), node.GetVal(i)
+			if len(key) > 0 {
+				w.keys++ // not the sentinel key
+			}
+			w.b.add(0, key, val, 0)
+			i++
+		case ok:
+			w.keys++
+			w.b.add(0, key, val, 0)
+			if err := w.m.next(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		if w.b.pages-w.written >= BULK_WRITE_PAGES {
+			w.written = w.b.pages
+			if err := w.db.writeAhead(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// write the new pages to the file before the commit, so they don't have to
+// stay in memory. they are not reachable from the master page until then.
+func (db *KV) writeAhead() error {
+	if err := db.extend(int(db.page.flushed) + db.page.nappend); err != nil {
+		return err
+	}
+	written := 0
+	for ptr, page := range db.page.updates {
+		if page != nil && ptr >= db.page.flushed {
+			if err := db.pageWrite(ptr, page); err != nil {
+				return err
+			}
+			delete(db.page.updates, ptr)
+			written++
+		}
+	}
+	db.Options.Metrics.pagesWritten(written)
+	if db.repl.hook != nil {
+		db.repl.reset = true // not in the page set of the commit
+	}
+	return db.writeBack()
+}
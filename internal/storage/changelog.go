@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// change data capture.
+// the row updates of the tables are recorded as change events in the
+// "@changelog" keyspace, in the same commit as the rows when the update
+// runs in a transaction (the executer runs every statement in one).
+// an event is keyed by its sequence number, in commit order, so a consumer
+// resumes after the last number it has seen, as long as the event is among
+// the last Options.Changelog kept. the older ones are dropped as new ones
+// are recorded.
+// the subscriber, see DB.SubscribeChanges, gets the events once committed.
+// a bulk load and the rows rewritten by SetCompression are not recorded.
+
+const CHANGELOG_KEYSPACE = "@changelog"
+
+// the ops of the change events, like the row metrics
+const (
+	CHANGE_INSERT = "insert"
+	CHANGE_UPDATE = "update"
+	CHANGE_DELETE = "delete"
+)
+
+// a row change
+type Change struct {
+	Seq   uint64  // the sequence number, from 1
+	Table string  // the table name
+	Op    string  // CHANGE_INSERT, CHANGE_UPDATE or CHANGE_DELETE
+	Key   Record  // the primary key
+	Old   *Record // the row before, nil for an insert
+	New   *Record // the row after, nil for a delete
+}
+
+// receives the committed changes in order, with the DB serialized.
+// it must not block or keep the DB busy.
+type ChangeHook func(changes []Change)
+
+// the changelog state of a DB
+type changelog struct {
+	hook    ChangeHook
+	next    uint64   // the next sequence number, 0 until loaded
+	pending []Change // recorded in the transaction, not committed yet
+}
+
+// get the committed changes as they are recorded, nil to stop
+func (db *DB) SubscribeChanges(hook ChangeHook) {
+	db.changes.hook = hook
+}
+
+// the changes are lost with the transaction, or the schemas reloaded
+func (db *DB) resetChanges() {
+	db.changes.next = 0
+	db.changes.pending = nil
+}
+
+// hand the committed changes to the subscriber
+func (db *DB) publishChanges() {
+	pending := db.changes.pending
+	db.changes.pending = nil
+	if db.changes.hook != nil && len(pending) > 0 {
+		db.changes.hook(pending)
+	}
+}
+
+// an event key: the sequence number and the chunk of the event.
+// an event larger than a value is split in chunks.
+func changeKey(seq uint64, chunk uint16) []byte {
+	key := binary.BigEndian.AppendUint64(nil, seq)
+	return binary.BigEndian.AppendUint16(key, chunk)
+}
+
+// the next sequence number, after the last event kept
+func (db *DB) nextChange(ks *Keyspace) uint64 {
+	if db.changes.next == 0 {
+		db.changes.next = 1
+		last := ks.key(bytes.Repeat([]byte{0xff}, 10))
+		iter := db.kv.tree.Seek(last, CMP_LE)
+		if iter.Valid() {
+			key, _ := iter.Deref()
+			if bytes.HasPrefix(key, ks.key(nil)) && len(key) == 4+10 {
+				db.changes.next = binary.BigEndian.Uint64(key[4:]) + 1
+			}
+		}
+	}
+	return db.changes.next
+}
+
+// are the changes of the table recorded?
+func (db *DB) recordsChanges(tdef *TableDef) bool {
+	return db.Options.Changelog > 0 && tdef.Prefix >= TABLE_PREFIX_MIN
+}
+
+// the full row stored under a primary key
+func storedRow(tdef *TableDef, pkey []Value, val []byte) []Value {
+	row := make([]Value, len(tdef.Cols))
+	copy(row, pkey[:tdef.Pkeys])
+	for i := tdef.Pkeys; i < len(tdef.Cols); i++ {
+		row[i].Type = tdef.Types[i]
+	}
+	decodeRow(tdef, val, row[tdef.Pkeys:])
+	return row
+}
+
+// record a row change of a table, `before` and `after` are full rows
+func recordChange(db *DB, tdef *TableDef, op string, before []Value, after []Value) error {
+	if !db.recordsChanges(tdef) {
+		return nil
+	}
+	ks, err := db.Keyspace(CHANGELOG_KEYSPACE)
+	if err != nil {
+		return err
+	}
+	ch := Change{Seq: db.nextChange(ks), Table: tdef.Name, Op: op}
+	row := after
+	if row == nil {
+		row = before
+	}
+	ch.Key = Record{tdef.Cols[:tdef.Pkeys], append([]Value{}, row[:tdef.Pkeys]...)}
+	if before != nil {
+		ch.Old = &Record{tdef.Cols, append([]Value{}, before...)}
+	}
+	if after != nil {
+		ch.New = &Record{tdef.Cols, append([]Value{}, after...)}
+	}
+
+	data := encodeChange(&ch)
+	for chunk := uint16(0); len(data) > 0 || chunk == 0; chunk++ {
+		n := min(len(data), ks.MaxVal())
+		if _, err := ks.Set(changeKey(ch.Seq, chunk), data[:n], MODE_UPSERT); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	if err := trimChanges(ks, ch.Seq, uint64(db.Options.Changelog)); err != nil {
+		return err
+	}
+	db.changes.next++
+	db.changes.pending = append(db.changes.pending, ch)
+	if !db.kv.tx.active {
+		db.publishChanges()
+	}
+	return nil
+}
+
+// drop the events older than the last `keep`
+func trimChanges(ks *Keyspace, last uint64, keep uint64) error {
+	if last <= keep {
+		return nil
+	}
+	end := changeKey(last-keep+1, 0)
+	old := [][]byte{}
+	ks.Scan(nil, func(key []byte, val []byte) bool {
+		if bytes.Compare(key, end) >= 0 {
+			return false
+		}
+		old = append(old, append([]byte{}, key...))
+		return true
+	})
+	for _, key := range old {
+		if _, err := ks.Del(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call `fn` with the changes kept from the sequence number `from` in order,
+// until it returns false. `from` 0 starts from the oldest kept.
+// ErrChangesGone if the changes since `from` are no longer all kept.
+func (db *DB) ChangesSince(from uint64, fn func(ch *Change) bool) error {
+	if db.Options.Changelog <= 0 {
+		return fmt.Errorf("the changelog is disabled")
+	}
+	ks, err := db.keyspace(CHANGELOG_KEYSPACE, false)
+	if err != nil || ks == nil {
+		return err // nothing recorded yet
+	}
+	if from >= db.nextChange(ks) {
+		return nil
+	}
+	if from > 0 {
+		if _, ok := ks.Get(changeKey(from, 0)); !ok {
+			return fmt.Errorf("%w: %d is older than the last %d kept", ErrChangesGone, from, db.Options.Changelog)
+		}
+	}
+
+	// the chunks of an event are consecutive
+	var ch *Change
+	var data []byte
+	ks.Scan(changeKey(from, 0), func(key []byte, val []byte) bool {
+		if len(key) != 10 {
+			err = fmt.Errorf("changelog: bad key %q", key)
+			return false
+		}
+		if binary.BigEndian.Uint16(key[8:]) == 0 && data != nil {
+			if ch, err = decodeChange(data); err != nil || !fn(ch) {
+				data = nil
+				return false
+			}
+			data = data[:0]
+		}
+		data = append(data, val...)
+		return true
+	})
+	if err == nil && len(data) > 0 {
+		if ch, err = decodeChange(data); err == nil {
+			fn(ch)
+		}
+	}
+	return err
+}
+
+// the event encoding: the fields in order, the strings and the bytes
+// prefixed by their length, a flag before the optional rows.
+func encodeChange(ch *Change) []byte {
+	out := binary.AppendUvarint(nil, ch.Seq)
+	out = appendChangeBytes(out, []byte(ch.Table))
+	out = appendChangeBytes(out, []byte(ch.Op))
+	out = appendChangeRecord(out, &ch.Key)
+	for _, rec := range []*Record{ch.Old, ch.New} {
+		if rec == nil {
+			out = append(out, 0)
+			continue
+		}
+		out = appendChangeRecord(append(out, 1), rec)
+	}
+	return out
+}
+
+func appendChangeBytes(out []byte, b []byte) []byte {
+	return append(binary.AppendUvarint(out, uint64(len(b))), b...)
+}
+
+func appendChangeRecord(out []byte, rec *Record) []byte {
+	out = binary.AppendUvarint(out, uint64(len(rec.Cols)))
+	for i, col := range rec.Cols {
+		v := &rec.Vals[i]
+		out = appendChangeBytes(out, []byte(col))
+		out = binary.AppendUvarint(out, uint64(v.Type))
+		out = binary.AppendVarint(out, v.I64)
+		out = appendChangeBytes(out, v.Str)
+	}
+	return out
+}
+
+// a reader of encodeChange
+type changeReader struct {
+	buf []byte
+	err error
+}
+
+func (r *changeReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *changeReader) varint() int64 {
+	x, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *changeReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := append([]byte{}, r.buf[:n]...)
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *changeReader) record() *Record {
+	rec := &Record{}
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		rec.Cols = append(rec.Cols, string(r.bytes()))
+		v := Value{Type: uint32(r.uvarint()), I64: r.varint()}
+		if str := r.bytes(); v.Type == TYPE_BYTES {
+			v.Str = str
+		}
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec
+}
+
+func (r *changeReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("changelog: bad event")
+	}
+	r.buf = nil
+}
+
+func decodeChange(data []byte) (*Change, error) {
+	r := &changeReader{buf: data}
+	ch := &Change{Seq: r.uvarint(), Table: string(r.bytes()), Op: string(r.bytes())}
+	ch.Key = *r.record()
+	for _, rec := range []**Record{&ch.Old, &ch.New} {
+		if len(r.buf) == 0 {
+			r.fail()
+		} else if flag := r.buf[0]; flag == 1 {
+			r.buf = r.buf[1:]
+			*rec = r.record()
+		} else {
+			r.buf = r.buf[1:]
+		}
+	}
+	if r.err == nil && len(r.buf) > 0 {
+		r.fail()
+	}
+	return ch, r.err
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// value compression, set per table by TableDef.Compression.
+// the value of a row in a table with a codec starts with a byte naming the
+// codec it was written with, so a table can switch codecs and still read
+// the old rows. the tables without a codec ("", the default) have no header
+// byte, switching to or from "" rewrites the rows, see DB.SetCompression.
+
+// the header byte
+const (
+	CODEC_NONE  = 0 // stored as is
+	CODEC_FLATE = 1 // compress/flate
+)
+
+// the names in TableDef.Compression
+var codecNames = map[string]byte{
+	"none":  CODEC_NONE,
+	"flate": CODEC_FLATE,
+}
+
+// values shorter than this are stored as is, it's not worth it
+const CODEC_MIN_SIZE = 64
+
+func checkCodec(name string) error {
+	if _, ok := codecNames[name]; name != "" && !ok {
+		return fmt.Errorf("unknown compression %q, one of none or flate", name)
+	}
+	return nil
+}
+
+// the flate writers are large, reuse them
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		panic(err)
+	}
+	return w
+}}
+
+// encode the non-key values of a row
+func encodeRow(tdef *TableDef, vals []Value) []byte {
+	if tdef.Compression == "" {
+		return EncodeValues(nil, vals)
+	}
+	raw := EncodeValues([]byte{CODEC_NONE}, vals)
+	codec := codecNames[tdef.Compression]
+	if codec == CODEC_NONE || len(raw)-1 < CODEC_MIN_SIZE {
+		return raw
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(raw)))
+	buf.WriteByte(codec)
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(buf)
+	_, err := w.Write(raw[1:])
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriters.Put(w)
+	if err != nil || buf.Len() >= len(raw) {
+		return raw // incompressible
+	}
+	return buf.Bytes()
+}
+
+// decode the non-key values of a row, the reverse of encodeRow()
+func decodeRow(tdef *TableDef, in []byte, out []Value) {
+	if tdef.Compression == "" {
+		decodeValues(in, out)
+		return
+	}
+	decodeValues(decompress(in), out)
+}
+
+// the encoded values without the codec header
+func decompress(in []byte) []byte {
+	if len(in) == 0 {
+		panic("bad row: no codec header")
+	}
+	switch in[0] {
+	case CODEC_NONE:
+		return in[1:]
+	case CODEC_FLATE:
+		r := flate.NewReader(bytes.NewReader(in[1:]))
+		out, err := io.ReadAll(r)
+		if err != nil {
+			panic(fmt.Sprintf("bad row: %v", err))
+		}
+		return out
+	default:
+		panic(fmt.Sprintf("bad row: unknown codec %d", in[0]))
+	}
+}
+
+// change the compression of a table.
+// the rows keep their codec until they are updated, except when switching
+// to or from "": the rows are rewritten in a transaction.
+func (db *DB) SetCompression(table string, codec string) error {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if err := checkCodec(codec); err != nil {
+		return err
+	}
+	if codec == tdef.Compression {
+		return nil
+	}
+	rewrite := (tdef.Compression == "") != (codec == "")
+	ownTx := rewrite && !db.InTx()
+	if ownTx {
+		if err := db.Begin(); err != nil {
+			return err
+		}
+	}
+	err := db.setCompression(tdef, codec, rewrite)
+	if ownTx {
+		if err != nil {
+			return errors.Join(err, db.Abort())
+		}
+		err = db.Commit()
+	}
+	if err == nil {
+		db.kv.log().Info("table compression changed", "table", table, "compression", codec, "rewritten", rewrite)
+	}
+	return err
+}
+
+func (db *DB) setCompression(tdef *TableDef, codec string, rewrite bool) error {
+	newdef := *tdef
+	newdef.Compression = codec
+	if rewrite {
+		if err := rewriteRows(db, tdef, &newdef); err != nil {
+			return err
+		}
+	}
+	// store the definition
+	if err := putTableDef(db, &newdef); err != nil {
+		return err
+	}
+	*tdef = newdef // the cached one
+	return nil
+}
+
+// the rows read per step of rewriteRows
+const REWRITE_BATCH = 256
+
+// re-encode the values of the rows, the keys and the indexes don't change
+func rewriteRows(db *DB, old *TableDef, new *TableDef) error {
+	start := encodeKey(nil, old.Prefix, nil)
+	end := encodeKey(nil, old.Prefix+1, nil)
+	values := make([]Value, len(old.Cols)-old.Pkeys)
+	for {
+		// collect a batch, the tree is not updated while it's iterated
+		keys, vals := [][]byte{}, [][]byte{}
+		for iter := db.kv.tree.Seek(start, CMP_GE); iter.Valid() && len(keys) < REWRITE_BATCH; iter.Next() {
+			key, val := iter.Deref()
+			if bytes.Compare(key, end) >= 0 {
+				break
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			vals = append(vals, append([]byte(nil), val...))
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for i, key := range keys {
+			for j := range values {
+				values[j] = Value{Type: old.Types[old.Pkeys+j]}
+			}
+			decodeRow(old, vals[i], values)
+			req := InsertReq{Key: key, Val: encodeRow(new, values), Mode: MODE_UPDATE_ONLY}
+			if _, err := db.kv.update(&req); err != nil {
+				return err
+			}
+		}
+		start = append(keys[len(keys)-1], 0) // the next key
+	}
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// a parsed CHECK expression of the form `col op literal`
+type checkExpr struct {
+	expr string // the original text
+	col  int    // index into tdef.Cols
+	op   string // one of = != < <= > >=
+	val  Value  // the literal
+}
+
+// comparison operators, the longer ones first so that "<=" is not read as "<"
+var checkOps = []string{"<=", ">=", "!=", "<>", "==", "=", "<", ">"}
+
+func typeName(typ uint32) string {
+	switch typ {
+	case TYPE_BYTES:
+		return "bytes"
+	case TYPE_INT64:
+		return "int64"
+	default:
+		return "unknown"
+	}
+}
+
+// check the constraint part of the table definition
+func constraintDefCheck(tdef *TableDef) error {
+	if tdef.Defaults != nil && len(tdef.Defaults) != len(tdef.Cols) {
+		return fmt.Errorf("table %s: number of defaults does not match number of columns", tdef.Name)
+	}
+	if tdef.NotNull != nil && len(tdef.NotNull) != len(tdef.Cols) {
+		return fmt.Errorf("table %s: number of NOT NULL flags does not match number of columns", tdef.Name)
+	}
+	for i, def := range tdef.Defaults {
+		if def != nil && def.Type != tdef.Types[i] {
+			return fmt.Errorf("table %s: column %s: default is %s, expected %s",
+				tdef.Name, tdef.Cols[i], typeName(def.Type), typeName(tdef.Types[i]))
+		}
+	}
+	tdef.checks = nil
+	for _, expr := range tdef.Checks {
+		chk, err := parseCheck(tdef, expr)
+		if err != nil {
+			return err
+		}
+		tdef.checks = append(tdef.checks, chk)
+	}
+	return nil
+}
+
+// parse a CHECK expression: `col op literal`.
+// the literal is an integer for int64 columns and a quoted string for bytes.
+func parseCheck(tdef *TableDef, expr string) (checkExpr, error) {
+	chk := checkExpr{expr: expr}
+	bad := func(format string, args ...interface{}) (checkExpr, error) {
+		msg := fmt.Sprintf(format, args...)
+		return checkExpr{}, fmt.Errorf("table %s: bad CHECK (%s): %s", tdef.Name, expr, msg)
+	}
+
+	// the column name
+	s := strings.TrimSpace(expr)
+	end := 0
+	for end < len(s) && isIdentChar(s[end]) {
+		end++
+	}
+	chk.col = colIndex(tdef, s[:end])
+	if chk.col < 0 {
+		return bad("column %q not found", s[:end])
+	}
+	s = strings.TrimSpace(s[end:])
+
+	// the operator
+	for _, op := range checkOps {
+		if strings.HasPrefix(s, op) {
+			chk.op = op
+			break
+		}
+	}
+	if chk.op == "" {
+		return bad("missing comparison operator")
+	}
+	s = strings.TrimSpace(s[len(chk.op):])
+	switch chk.op {
+	case "==":
+		chk.op = "="
+	case "<>":
+		chk.op = "!="
+	}
+
+	// the literal
+	switch tdef.Types[chk.col] {
+	case TYPE_INT64:
+		i64, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return bad("expected an integer, got %q", s)
+		}
+		chk.val = Value{Type: TYPE_INT64, I64: i64}
+	case TYPE_BYTES:
+		str, ok := unquote(s)
+		if !ok {
+			return bad("expected a quoted string, got %q", s)
+		}
+		chk.val = Value{Type: TYPE_BYTES, Str: []byte(str)}
+	default:
+		return bad("unsupported column type")
+	}
+	return chk, nil
+}
+
+func isIdentChar(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') ||
+		('0' <= ch && ch <= '9')
+}
+
+// 'single' quotes (a doubled quote is the escape) or Go-style "double" quotes
+func unquote(s string) (string, bool) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		body := s[1 : len(s)-1]
+		if strings.Count(body, "'")%2 != 0 {
+			return "", false
+		}
+		return strings.ReplaceAll(body, "''", "'"), true
+	}
+	str, err := strconv.Unquote(s)
+	return str, err == nil && len(s) > 0 && s[0] == '"'
+}
+
+// compare 2 values of the same type
+func compareValues(a Value, b Value) int {
+	switch a.Type {
+	case TYPE_INT64:
+		switch {
+		case a.I64 < b.I64:
+			return -1
+		case a.I64 > b.I64:
+			return +1
+		default:
+			return 0
+		}
+	case TYPE_BYTES:
+		return bytes.Compare(a.Str, b.Str)
+	default:
+		panic("bad type")
+	}
+}
+
+func (chk *checkExpr) eval(v Value) bool {
+	r := compareValues(v, chk.val)
+	switch chk.op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	default:
+		panic("bad op")
+	}
+}
+
+// fill in the defaults for omitted columns, then validate the row
+// against the column types and the constraints.
+// values are indexed like tdef.Cols, omitted columns have the type TYPE_ERROR.
+// an update is merged with the stored row first, see mergeStored.
+func applyConstraints(tdef *TableDef, values []Value) error {
+	if len(tdef.Checks) != len(tdef.checks) {
+		// loaded from JSON, parse the expressions
+		if err := constraintDefCheck(tdef); err != nil {
+			return err
+		}
+	}
+	for i, col := range tdef.Cols {
+		if values[i].Type == TYPE_ERROR {
+			switch {
+			case i < tdef.Pkeys:
+				return constraintErrorf("table %s: column %s: primary key is missing", tdef.Name, col)
+			case tdef.Defaults != nil && tdef.Defaults[i] != nil:
+				values[i] = *tdef.Defaults[i]
+			case tdef.NotNull != nil && tdef.NotNull[i]:
+				return constraintErrorf("table %s: column %s: violates NOT NULL", tdef.Name, col)
+			default:
+				values[i] = Value{Type: tdef.Types[i]} // the zero value
+			}
+		}
+		if values[i].Type != tdef.Types[i] {
+			return constraintErrorf("table %s: column %s: got %s, expected %s",
+				tdef.Name, col, typeName(values[i].Type), typeName(tdef.Types[i]))
+		}
+	}
+	for i := range tdef.checks {
+		chk := &tdef.checks[i]
+		if !chk.eval(values[chk.col]) {
+			return constraintErrorf("table %s: column %s: violates CHECK (%s)",
+				tdef.Name, tdef.Cols[chk.col], chk.expr)
+		}
+	}
+	return nil
+}
+
+// the row has the primary key and omits some other columns
+func partialRow(tdef *TableDef, values []Value) bool {
+	omitted := false
+	for i := range values {
+		if values[i].Type == TYPE_ERROR {
+			if i < tdef.Pkeys {
+				return false // applyConstraints rejects it
+			}
+			omitted = true
+		}
+	}
+	return omitted
+}
+
+// fill in the omitted columns from the stored row, so that the
+// defaults only apply to a new row. false if there is no live row.
+func mergeStored(db *DB, tdef *TableDef, values []Value) bool {
+	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
+	val, ok := db.kv.get(key)
+	if !ok {
+		return false
+	}
+	stored := storedRow(tdef, values, val)
+	if rowExpired(tdef, stored, nowMillis()) {
+		return false
+	}
+	for i := range values {
+		if values[i].Type == TYPE_ERROR {
+			values[i] = stored[i]
+		}
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+
+	u "github.com/Ricky004/dungeonDB/internal/utils"
+)
+
+// encryption at rest, with Options.Key.
+// every page but the master page is encrypted with AES-GCM:
+// | counter | ciphertext | tag |
+// | 8B | page size - 24 | 16B |
+// so a node is CRYPT_OVERHEAD bytes smaller than a page.
+// the nonce is the low 4 bytes of the page number and the write counter,
+// xored with a random salt of the file, and the page number is
+// authenticated, a page can't be moved or replayed at another place.
+// the counter is never reused in a file: the counters are reserved in
+// blocks in the master page, which is fsynced before a counter of a new
+// block is used, so a crash can only skip some.
+// a backup gets its own salt, so a restored backup and its database do
+// not share the nonces though they continue from the same counters.
+// the files created before the salt have a zero salt.
+// the header of the master page stays plaintext, with a key check to tell
+// a wrong key from a corrupted page.
+// the mapped pages can't be used in place, an encrypted file is read and
+// written through the buffer pool (see pool.go), which decrypts a page
+// when it's loaded and encrypts it when it's written back.
+
+// the bytes of a page used by the encryption
+const CRYPT_OVERHEAD = 8 + 16
+
+// the counters reserved at once
+const CRYPT_RESERVE = 1 << 16
+
+// the flags in the master page
+const MASTER_ENCRYPTED = 1
+
+// the key check is the encrypted signature
+const KEY_CHECK_SIZE = 16 + 16
+
+// the salt of the nonces
+const NONCE_SALT_SIZE = 12
+
+type pageCrypt struct {
+	aead cipher.AEAD
+	// store a new reservation in the master page, nil while it's not written
+	persist func(mark uint64) error
+
+	salt [NONCE_SALT_SIZE]byte // of the file
+
+	mu      sync.Mutex
+	counter uint64 // the next counter, 0 is the key check
+	mark    uint64 // the counters below it are reserved
+}
+
+// an AES key of 16, 24 or 32 bytes, with a new salt
+func newPageCrypt(key []byte) (*pageCrypt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadKey, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	pc := &pageCrypt{aead: aead, counter: 1}
+	if _, err := rand.Read(pc.salt[:]); err != nil {
+		return nil, fmt.Errorf("nonce salt: %w", err)
+	}
+	return pc, nil
+}
+
+// the encryption of a copy of the file, a backup: the same key and
+// counters with a new salt
+func (pc *pageCrypt) resalt() (*pageCrypt, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	cp := &pageCrypt{aead: pc.aead, counter: pc.counter, mark: pc.mark}
+	if _, err := rand.Read(cp.salt[:]); err != nil {
+		return nil, fmt.Errorf("nonce salt: %w", err)
+	}
+	return cp, nil
+}
+
+// take `n` counters, reserving a new block if needed
+func (pc *pageCrypt) take(n uint64) (uint64, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	first := pc.counter
+	if first+n > pc.mark {
+		mark := first + n + CRYPT_RESERVE
+		if pc.persist != nil {
+			if err := pc.persist(mark); err != nil {
+				return 0, fmt.Errorf("reserve the write counters: %w", err)
+			}
+		}
+		pc.mark = mark
+	}
+	pc.counter += n
+	return first, nil
+}
+
+func cryptNonce(ptr uint64, counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint32(nonce[0:], uint32(ptr))
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// the nonce of a page
+func (pc *pageCrypt) nonce(ptr uint64, counter uint64) []byte {
+	nonce := cryptNonce(ptr, counter)
+	for i := range nonce {
+		nonce[i] ^= pc.salt[i]
+	}
+	return nonce
+}
+
+func cryptAD(ptr uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, ptr)
+}
+
+// encrypt a node into a page of len(node) + CRYPT_OVERHEAD bytes
+func (pc *pageCrypt) seal(page []byte, ptr uint64, counter uint64, node []byte) {
+	u.Assert(len(page) == len(node)+CRYPT_OVERHEAD)
+	binary.LittleEndian.PutUint64(page, counter)
+	pc.aead.Seal(page[8:8], pc.nonce(ptr, counter), node, cryptAD(ptr))
+}
+
+// encrypt a node with the next counter
+func (pc *pageCrypt) sealNext(ptr uint64, node []byte) ([]byte, error) {
+	counter, err := pc.take(1)
+	if err != nil {
+		return nil, err
+	}
+	page := make([]byte, len(node)+CRYPT_OVERHEAD)
+	pc.seal(page, ptr, counter, node)
+	return page, nil
+}
+
+// decrypt a page into a node of len(page) - CRYPT_OVERHEAD bytes
+func (pc *pageCrypt) open(node []byte, ptr uint64, page []byte) error {
+	counter := binary.LittleEndian.Uint64(page)
+	out, err := pc.aead.Open(node[:0], pc.nonce(ptr, counter), page[8:], cryptAD(ptr))
+	if err != nil || len(out) != len(node) {
+		return fmt.Errorf("page %d: authentication failed, the file is damaged or the key is wrong", ptr)
+	}
+	return nil
+}
+
+// the key check of the master page
+func (pc *pageCrypt) check() []byte {
+	sig := make([]byte, 16)
+	copy(sig, DB_SIG)
+	return pc.aead.Seal(nil, cryptNonce(0, 0), sig, nil)
+}
+
+// the encryption fields of the master page header, data[36:]
+// | flags | counter mark | key check | nonce salt |
+// | 4B | 8B | 32B | 12B |
+func (pc *pageCrypt) header(data []byte) {
+	if pc == nil {
+		return // not encrypted, all zeros
+	}
+	binary.LittleEndian.PutUint32(data[0:], MASTER_ENCRYPTED)
+	binary.LittleEndian.PutUint64(data[4:], pc.mark)
+	copy(data[12:], pc.check())
+	copy(data[12+KEY_CHECK_SIZE:], pc.salt[:])
+}
+
+// the encryption of a file by its master page header,
+// nil if it's not encrypted
+func loadCrypt(master []byte, key []byte) (*pageCrypt, error) {
+	flags := binary.LittleEndian.Uint32(master[36:])
+	if flags&MASTER_ENCRYPTED == 0 {
+		if key != nil {
+			return nil, fmt.Errorf("%w: the database is not encrypted, use rekey to encrypt it", ErrBadKey)
+		}
+		return nil, nil
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: the database is encrypted, a key is needed", ErrBadKey)
+	}
+	pc, err := newPageCrypt(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(master[48:48+KEY_CHECK_SIZE], pc.check()) {
+		return nil, fmt.Errorf("%w: the key does not match", ErrBadKey)
+	}
+	copy(pc.salt[:], master[48+KEY_CHECK_SIZE:])
+	// the counters below the mark may have been used before a crash
+	pc.counter = binary.LittleEndian.Uint64(master[40:])
+	pc.mark = pc.counter
+	return pc, nil
+}
+
+// use the encryption of the file, after loadCrypt()
+func (db *KV) useCrypt(pc *pageCrypt) {
+	db.crypt = pc
+	if pc == nil {
+		return
+	}
+	pc.persist = func(mark uint64) error {
+		data := binary.LittleEndian.AppendUint64(nil, mark)
+		if _, err := db.fp.WriteAt(data, 40); err != nil {
+			return err
+		}
+		return db.fsync()
+	}
+}
+
+// read a key file: the raw key, or the key in hex
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch len(data) {
+	case 16, 24, 32:
+		return data, nil
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		return nil, fmt.Errorf("%s: a key is 16, 24 or 32 bytes, raw or in hex", path)
+	}
+	return key, nil
+}
+
+// re-encrypt the database under a new key, nil to decrypt it.
+// the keys are copied into a new file like a full vacuum.
+func (db *KV) Rekey(key []byte) error {
+	if db.tx.active {
+		return ErrTxActive
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if n := db.snapshots.Load(); n > 0 {
+		return fmt.Errorf("rekey: %w: %d open", ErrSnapshotOpen, n)
+	}
+	if key != nil {
+		if _, err := newPageCrypt(key); err != nil {
+			return fmt.Errorf("rekey: %w", err)
+		}
+	}
+	if err := db.vacuumFull(BULK_FILL_FACTOR, key); err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+	db.shipReset()
+	db.log().Info("database rekeyed", "path", db.Path, "encrypted", key != nil)
+	return nil
+}
+
+// DB-level wrapper, serialized by the caller like the other DB calls
+
+// re-encrypt the database, see KV.Rekey
+func (db *DB) Rekey(key []byte) error {
+	return db.kv.Rekey(key)
+}
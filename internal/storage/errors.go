@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors that callers can test for with errors.Is,
+// the returned errors wrap them with more details.
+var (
+	ErrTableNotFound = errors.New("table not found")
+	ErrTableExists   = errors.New("table exists")
+	ErrConstraint    = errors.New("constraint violation")
+	ErrTxActive      = errors.New("a transaction is already in progress")
+	ErrNoTx          = errors.New("no transaction in progress")
+	ErrDBFull        = errors.New("database is full")
+	ErrSnapshotOpen  = errors.New("a snapshot is open")
+	ErrBadKey        = errors.New("bad encryption key")
+	ErrReadOnly      = errors.New("the database is read-only")
+	ErrChangesGone   = errors.New("the changes were dropped from the changelog")
+)
+
+// a constraint violation, the message is kept as is
+type constraintError struct {
+	msg string
+}
+
+func (e *constraintError) Error() string {
+	return e.msg
+}
+
+func (e *constraintError) Is(target error) bool {
+	return target == ErrConstraint
+}
+
+func constraintErrorf(format string, args ...interface{}) error {
+	return &constraintError{msg: fmt.Sprintf(format, args...)}
+}
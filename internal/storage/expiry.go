@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// expiry, the entries that disappear at a given time.
+// a raw entry set with KV.SetEx, or a row of a table with a TTL column,
+// reads as absent once expired, the expired ones are deleted in batches
+// by DB.SweepExpired, which the server runs in the background.
+// the sweeper finds them in an index ordered by the expiry, so it doesn't
+// scan the tables. the index is under the table prefix 0, never allocated:
+//
+//	| 0 0 0 0 | 'x' | expire_at | key | -> the table name, empty for a raw entry
+//	| 0 0 0 0 | 'k' | key |             -> expire_at, of a raw entry
+//
+// expire_at is in Unix milliseconds, big-endian so the index is in time order.
+// the rows of a table are indexed when they are written, the TTL column
+// of a row has its expiry, 0 or less for none.
+
+var (
+	expiryIndexPrefix = []byte{0, 0, 0, 0, 'x'}
+	expiryKeysPrefix  = []byte{0, 0, 0, 0, 'k'}
+)
+
+// the index key is longer than the key
+const EXPIRY_KEY_OVERHEAD = 5 + 8
+
+// the expired entries deleted per batch of the sweeper
+const EXPIRY_BATCH = 256
+
+// how often the server runs the sweeper
+const EXPIRY_INTERVAL = time.Second
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+func expiryIndexKey(expireAt int64, key []byte) []byte {
+	out := binary.BigEndian.AppendUint64(append([]byte{}, expiryIndexPrefix...), uint64(expireAt))
+	return append(out, key...)
+}
+
+func rawExpiryKey(key []byte) []byte {
+	return append(append([]byte{}, expiryKeysPrefix...), key...)
+}
+
+// check that a key can be indexed by its expiry
+func (db *KV) checkExpiryKey(key []byte) error {
+	if len(key)+EXPIRY_KEY_OVERHEAD > db.MaxKeySize() {
+		return fmt.Errorf("the key is too long to expire (%d bytes)", len(key))
+	}
+	return nil
+}
+
+// set a raw entry that reads as absent from `expireAt` on, in Unix
+// milliseconds, 0 for none. like Set, it replaces the expiry of the key.
+func (db *KV) SetEx(key []byte, val []byte, expireAt int64) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if expireAt > 0 {
+		if err := db.checkExpiryKey(key); err != nil {
+			return err
+		}
+	}
+	db.dropExpiry(key)
+	db.tree.Insert(key, val)
+	if expireAt > 0 {
+		db.tree.Insert(rawExpiryKey(key), binary.BigEndian.AppendUint64(nil, uint64(expireAt)))
+		db.tree.Insert(expiryIndexKey(expireAt, key), nil)
+		db.expiry.checked, db.expiry.raw = true, true
+	}
+	return db.flush()
+}
+
+// are there raw entries with an expiry? checked once, the reads of the
+// other keys don't pay for the expiry.
+func (db *KV) hasRawExpiry() bool {
+	if !db.expiry.checked {
+		iter := db.tree.Seek(expiryKeysPrefix, CMP_GE)
+		if iter.Valid() {
+			key, _ := iter.Deref()
+			db.expiry.raw = bytes.HasPrefix(key, expiryKeysPrefix)
+		}
+		db.expiry.checked = true
+	}
+	return db.expiry.raw
+}
+
+// the expiry of a raw entry
+func (db *KV) rawExpiry(key []byte) (int64, bool) {
+	if !db.hasRawExpiry() {
+		return 0, false
+	}
+	val, ok := db.tree.Lookup(rawExpiryKey(key))
+	if !ok {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(val)), true
+}
+
+func (db *KV) rawExpired(key []byte) bool {
+	at, ok := db.rawExpiry(key)
+	return ok && at <= nowMillis()
+}
+
+// remove the expiry of a raw entry, with the update of the entry
+func (db *KV) dropExpiry(key []byte) {
+	if at, ok := db.rawExpiry(key); ok {
+		db.tree.Delete(rawExpiryKey(key))
+		db.tree.Delete(expiryIndexKey(at, key))
+	}
+}
+
+// the expiry of a row, 0 for none
+func rowExpiry(tdef *TableDef, row []Value) int64 {
+	if tdef.TTL == "" || row == nil {
+		return 0
+	}
+	v := row[colIndex(tdef, tdef.TTL)]
+	if v.Type != TYPE_INT64 || v.I64 < 0 {
+		return 0
+	}
+	return v.I64
+}
+
+func rowExpired(tdef *TableDef, row []Value, now int64) bool {
+	at := rowExpiry(tdef, row)
+	return at > 0 && at <= now
+}
+
+// the full row of a stored key-value pair
+func keyRow(tdef *TableDef, key []byte, val []byte) []Value {
+	row := make([]Value, len(tdef.Cols))
+	for i := range row {
+		row[i].Type = tdef.Types[i]
+	}
+	decodeValues(key[4:], row[:tdef.Pkeys]) // skip the table prefix
+	decodeRow(tdef, val, row[tdef.Pkeys:])
+	return row
+}
+
+// move the index entry of a row whose expiry changed, like indexOP
+func updateRowExpiry(db *DB, tdef *TableDef, key []byte, old []Value, row []Value) error {
+	before, after := rowExpiry(tdef, old), rowExpiry(tdef, row)
+	if before == after {
+		return nil
+	}
+	if before > 0 {
+		if _, err := db.kv.del(&DeleteReq{Key: expiryIndexKey(before, key)}); err != nil {
+			return err
+		}
+	}
+	if after > 0 {
+		req := InsertReq{Key: expiryIndexKey(after, key), Val: []byte(tdef.Name)}
+		if _, err := db.kv.update(&req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete the row under `key` if it has expired, so that it's replaced
+// like an absent row
+func dropExpiredRow(db *DB, tdef *TableDef, key []byte) error {
+	val, ok := db.kv.tree.Lookup(key)
+	if !ok {
+		return nil
+	}
+	row := keyRow(tdef, key, val)
+	if !rowExpired(tdef, row, nowMillis()) {
+		return nil
+	}
+	_, err := DbDelete(db, tdef, Record{tdef.Cols[:tdef.Pkeys], row[:tdef.Pkeys]})
+	return err
+}
+
+// delete up to `max` expired rows and raw entries, the oldest first,
+// returns how many. it's a transaction of its own unless one is in
+// progress, the caller serializes access like for the other updates.
+func (db *DB) SweepExpired(max int) (int, error) {
+	if err := db.kv.writable(); err != nil {
+		return 0, err
+	}
+	type expired struct {
+		at    int64
+		key   []byte // of the entry or the row
+		table string // empty for a raw entry
+	}
+	batch := []expired{}
+	end := expiryIndexKey(nowMillis()+1, nil)
+	for iter := db.kv.tree.Seek(expiryIndexPrefix, CMP_GE); iter.Valid() && len(batch) < max; iter.Next() {
+		key, val := iter.Deref()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		at := int64(binary.BigEndian.Uint64(key[len(expiryIndexPrefix):]))
+		key = key[len(expiryIndexPrefix)+8:]
+		batch = append(batch, expired{at, append([]byte{}, key...), string(val)})
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	ownTx := !db.InTx()
+	if ownTx {
+		if err := db.Begin(); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for _, e := range batch {
+		ok, err := db.sweep(e.at, e.key, e.table)
+		if err != nil {
+			if ownTx {
+				db.Abort()
+			}
+			return 0, err
+		}
+		if ok {
+			n++
+		}
+	}
+	if ownTx {
+		if err := db.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	db.kv.log().Debug("expired entries deleted", "count", n)
+	return n, nil
+}
+
+// delete an expired entry of the index, false if the index was stale
+func (db *DB) sweep(at int64, key []byte, table string) (bool, error) {
+	if table == "" {
+		if expireAt, ok := db.kv.rawExpiry(key); ok && expireAt == at {
+			db.kv.dropExpiry(key)
+			db.kv.tree.Delete(key)
+			return true, nil
+		}
+	} else if tdef := getTableDef(db, table); tdef != nil {
+		val, ok := db.kv.tree.Lookup(key)
+		if ok && bytes.HasPrefix(key, encodeKey(nil, tdef.Prefix, nil)) {
+			row := keyRow(tdef, key, val)
+			if rowExpiry(tdef, row) == at {
+				// removes the index entry too
+				_, err := DbDelete(db, tdef, Record{tdef.Cols[:tdef.Pkeys], row[:tdef.Pkeys]})
+				return err == nil, err
+			}
+		}
+	}
+	// the table was dropped or the row rewritten
+	db.kv.tree.Delete(expiryIndexKey(at, key))
+	return false, nil
+}
@@ -0,0 +1,11 @@
+//go:build darwin
+// +build darwin
+
+package storage
+
+import "os"
+
+// no fallocate on darwin, the file is only extended
+func fallocate(fp *os.File, size int64) error {
+	return fp.Truncate(size)
+}
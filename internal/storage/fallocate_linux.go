@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reserve the disk space of the file up to `size`
+func fallocate(fp *os.File, size int64) error {
+	return unix.Fallocate(int(fp.Fd()), 0, 0, size)
+}
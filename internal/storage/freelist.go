@@ -8,16 +8,28 @@ import (
 
 const BNODE_FREE_LIST = 3
 const FREE_LIST_HEADER = 4 + 8 + 8
-const FREE_LIST_CAP = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) / 8
 
 type FreeList struct {
-	head uint64
+	head     uint64
+	pageSize int // BTREE_PAGE_SIZE if 0
 	// callbacks for managing on-disk pages
 	get func(ptr uint64) BNode // dereference a pointer
 	new func(BNode) uint64     // allocate a new page
 	use func(uint64, BNode)    // reuse a page
 }
 
+func (fl *FreeList) page() int {
+	if fl.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return fl.pageSize
+}
+
+// the pointers in a node of the list
+func (fl *FreeList) cap() int {
+	return (fl.page() - FREE_LIST_HEADER) / 8
+}
+
 // number of items in the list
 func (fl *FreeList) Total() int {
 	return 0
@@ -38,6 +50,12 @@ func (fl *FreeList) Get(topn int) uint64 {
 
 func (fl *FreeList) Update(popn int, freed []uint64) {
 	u.Assert(popn <= fl.Total())
+	if fl.new == nil {
+		// the list is not connected to the pages: the callbacks are unset,
+		// its head is not in the master page and Total is 0. the freed
+		// pages are not reused, the file only grows.
+		return
+	}
 	if popn == 0 && len(freed) == 0 {
 		return // nothing to do
 	}
@@ -45,7 +63,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 	// prepare the new list
 	total := fl.Total()
 	reuse := []uint64{}
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	for fl.head != 0 && len(reuse)*fl.cap() < len(freed) {
 		node := fl.get(fl.head)
 		freed = append(freed, fl.head) // recycle the node itself
 		if popn >= flnSize(node) {
@@ -58,7 +76,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 			remain := flnSize(node) - popn
 			popn = 0
 			// reuse pointers from the free list itself
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
+			for remain > 0 && len(reuse)*fl.cap() < len(freed)+remain {
 				remain--
 				reuse = append(reuse, flnPtr(node, remain))
 			}
@@ -71,7 +89,7 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 		total -= flnSize(node)
 		fl.head = flnNext(node)
 	}
-	u.Assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0)
+	u.Assert(len(reuse)*fl.cap() >= len(freed) || fl.head == 0)
 
 	// phase 3: prepend new nodes
 	flPush(fl, freed, reuse)
@@ -83,12 +101,12 @@ func (fl *FreeList) Update(popn int, freed []uint64) {
 func flPush(fl *FreeList, freed []uint64, reuse []uint64) {
 	// code
 	for len(freed) > 0 {
-		new := BNode{make([]byte, BTREE_PAGE_SIZE)}
+		new := BNode{make([]byte, fl.page())}
 
 		// construct the new node
 		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+		if size > fl.cap() {
+			size = fl.cap()
 		}
 		flnSetHeader(new, uint16(size), fl.head)
 		for i, ptr := range freed[:size] {
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// a keyspace is a raw key-value namespace sharing the B-tree with the tables.
+// its keys are the raw bytes behind a 4-byte prefix, allocated like the
+// prefix of a table and recorded in @meta under the key "keyspace:<name>".
+// the caller serializes access, like for the other DB methods.
+type Keyspace struct {
+	Name   string
+	db     *DB
+	prefix uint32
+}
+
+// the @meta key prefix for keyspaces
+const KEYSPACE_META_PREFIX = "keyspace:"
+
+// get a keyspace by name, creating it on first use
+func (db *DB) Keyspace(name string) (*Keyspace, error) {
+	return db.keyspace(name, true)
+}
+
+// nil if it doesn't exist and `create` is false
+func (db *DB) keyspace(name string, create bool) (*Keyspace, error) {
+	if ks, ok := db.keyspaces[name]; ok {
+		return ks, nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("keyspace name is empty")
+	}
+	meta := (&Record{}).AddStr("key", []byte(KEYSPACE_META_PREFIX+name))
+	ok, err := DbGet(db, TDEF_META, meta)
+	if err != nil {
+		return nil, err
+	}
+	ks := &Keyspace{Name: name, db: db}
+	if ok {
+		ks.prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+	} else if !create {
+		return nil, nil
+	} else {
+		if ks.prefix, err = allocPrefixes(db, 1); err != nil {
+			return nil, err
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], ks.prefix)
+		meta.AddStr("val", buf[:])
+		if _, err := DbUpdate(db, TDEF_META, *meta, MODE_INSERT_ONLY); err != nil {
+			return nil, err
+		}
+	}
+	if db.keyspaces == nil {
+		db.keyspaces = map[string]*Keyspace{}
+	}
+	db.keyspaces[name] = ks
+	return ks, nil
+}
+
+// the limits of raw keys and values, they depend on the page size
+func (ks *Keyspace) MaxKey() int {
+	return ks.db.kv.MaxKeySize() - 4
+}
+
+func (ks *Keyspace) MaxVal() int {
+	return ks.db.kv.MaxValSize()
+}
+
+func (ks *Keyspace) key(key []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, ks.prefix)
+	return append(out, key...)
+}
+
+// get a value, the result is a copy. an expired key is absent.
+func (ks *Keyspace) Get(key []byte) ([]byte, bool) {
+	val, ok := ks.db.kv.get(ks.key(key))
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, val...), true
+}
+
+// the expiry of a key in Unix milliseconds, 0 for none
+func (ks *Keyspace) Expiry(key []byte) int64 {
+	at, _ := ks.db.kv.rawExpiry(ks.key(key))
+	return at
+}
+
+// set a value with one of the update modes, it has no expiry.
+// returns false if the mode did not allow the update.
+func (ks *Keyspace) Set(key []byte, val []byte, mode int) (bool, error) {
+	return ks.SetEx(key, val, 0, mode)
+}
+
+// set a value that reads as absent from `expireAt` on, see KV.SetEx.
+// an expired key counts as absent for the mode.
+func (ks *Keyspace) SetEx(key []byte, val []byte, expireAt int64, mode int) (bool, error) {
+	if len(key) > ks.MaxKey() {
+		return false, fmt.Errorf("keyspace %s: key is too long (%d bytes)", ks.Name, len(key))
+	}
+	if len(val) > ks.MaxVal() {
+		return false, fmt.Errorf("keyspace %s: value is too long (%d bytes)", ks.Name, len(val))
+	}
+	_, exists := ks.db.kv.get(ks.key(key))
+	if (mode == MODE_UPDATE_ONLY && !exists) || (mode == MODE_INSERT_ONLY && exists) {
+		return false, nil
+	}
+	err := ks.db.kv.SetEx(ks.key(key), val, expireAt)
+	return err == nil, err
+}
+
+// delete a key, returns false if it did not exist
+func (ks *Keyspace) Del(key []byte) (bool, error) {
+	return ks.db.kv.del(&DeleteReq{Key: ks.key(key)})
+}
+
+// call `fn` for the keys >= `start` in order until it returns false,
+// the expired keys are skipped.
+// the arguments are only valid during the call and must not be modified,
+// the keyspace must not be updated during the scan.
+func (ks *Keyspace) Scan(start []byte, fn func(key []byte, val []byte) bool) {
+	prefix := ks.key(nil)
+	for iter := ks.db.kv.tree.Seek(ks.key(start), CMP_GE); iter.Valid(); iter.Next() {
+		key, val := iter.Deref()
+		if !bytes.HasPrefix(key, prefix) {
+			return
+		}
+		if ks.db.kv.rawExpired(key) {
+			continue
+		}
+		if !fn(key[len(prefix):], val) {
+			return
+		}
+	}
+}
@@ -4,22 +4,60 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"sync/atomic"
+	"time"
 
 	u "github.com/Ricky004/dungeonDB/internal/utils"
 )
 
+// sync modes, how commits are flushed to the disk
+const (
+	SYNC_FULL   = 0 // fsync the pages, then the master page
+	SYNC_NORMAL = 1 // fsync the pages only, a crash can lose the last commit but not corrupt the file
+	SYNC_OFF    = 2 // leave it to the OS, a crash can corrupt the file
+)
+
+// the default initial mmap size
+const MMAP_INITIAL_SIZE = 64 << 20
+
+// how the pages are read and written
+const (
+	BACKEND_MMAP = 0 // map the whole file
+	BACKEND_POOL = 1 // pread & pwrite through a buffer pool, see pool.go
+)
+
+// storage options, the zero values are the defaults
+type Options struct {
+	PageSize     int      // the page size of a new file, BTREE_PAGE_SIZE if 0, up to BTREE_MAX_PAGE_SIZE. a file keeps its own
+	Backend      int      // BACKEND_MMAP or BACKEND_POOL
+	MmapInitial  int      // the initial mmap size in bytes, a multiple of the page size
+	PageCache    int      // the buffer pool size in pages, POOL_DEFAULT_PAGES if 0
+	MaxSize      int64    // the maximum file size in bytes, 0 for no limit
+	SyncMode     int      // SYNC_FULL, SYNC_NORMAL or SYNC_OFF
+	NoLeafPrefix bool     // write the leaves without the common key prefix, they are read either way
+	Key          []byte   // the AES key of an encrypted file, see crypt.go
+	ReadOnly     bool     // refuse the updates, for a follower, see replication.go
+	Changelog    int      // the row changes kept for the consumers, none if 0, see changelog.go
+	Logger       Logger   // diagnostics, silent if nil
+	Metrics      *Metrics // engine metrics, none if nil
+}
+
 type KV struct {
-	Path string
+	Path    string
+	Options Options
 	// internals
-	fp   *os.File
-	tree BTree
+	fp       *os.File
+	pageSize int // of the file, the nodes are smaller when it's encrypted
+	crypt    *pageCrypt
+	tree     BTree
 	mmap struct {
 		file   int      // file size, can be larger than the database size
 		total  int      // mmap size, can be larger than the file size
 		chunks [][]byte // multiple mmaps, can be non-continuous
 	}
+	pool *bufferPool // instead of the mmap with BACKEND_POOL
 	page struct {
 		flushed uint64 // database size in number of pages
 		nfree   int    // number of pages taken from the free list
@@ -29,6 +67,19 @@ type KV struct {
 		updates map[uint64][]byte
 	}
 	free FreeList
+	tx   struct {
+		active bool   // updates are not flushed until the commit
+		root   uint64 // the root before the transaction
+	}
+	snapshots atomic.Int32 // open snapshots, their pages must not be reused
+	repl      struct {
+		hook  CommitHook // ships the commits to the followers
+		reset bool       // pages were written outside of the commit
+	}
+	expiry struct {
+		checked bool // raw is known
+		raw     bool // raw entries have an expiry, see expiry.go
+	}
 }
 
 // callback for BTree, dereference a pointer.
@@ -37,29 +88,157 @@ func (db *KV) PageGet(ptr uint64) BNode {
 		u.Assert(page != nil)
 		return BNode{page} // for new pages
 	}
-	return PageGetMapped(db, ptr) // for written pages
+	db.Options.Metrics.pageRead()
+	return db.pageRead(ptr) // for written pages
+}
+
+// read a written page from the backend
+func (db *KV) pageRead(ptr uint64) BNode {
+	if db.pool == nil {
+		return PageGetMapped(db, ptr)
+	}
+	node, err := db.pool.read(ptr)
+	if err != nil {
+		// the B-tree callbacks can't fail
+		panic(fmt.Errorf("KV: %w", err))
+	}
+	return node
+}
+
+// write a page to the backend, the file is updated by writeBack()
+func (db *KV) pageWrite(ptr uint64, page []byte) error {
+	if db.pool == nil {
+		copy(PageGetMapped(db, ptr).Data, page)
+		return nil
+	}
+	return db.pool.write(ptr, page)
+}
+
+// write the pages to the file before an fsync
+func (db *KV) writeBack() error {
+	if db.pool == nil {
+		return nil // the mmap is the file
+	}
+	return db.pool.flush()
+}
+
+// the master page header as stored in the file
+func (db *KV) master() []byte {
+	if db.pool == nil {
+		return db.mmap.chunks[0]
+	}
+	data := make([]byte, MASTER_SIZE)
+	if _, err := db.fp.ReadAt(data, 0); err != nil {
+		panic(fmt.Errorf("KV: read the master page: %w", err))
+	}
+	return data
 }
 
 func PageGetMapped(db *KV, ptr uint64) BNode {
+	return mappedPage(db.mmap.chunks, ptr, db.PageSize())
+}
+
+func mappedPage(chunks [][]byte, ptr uint64, size int) BNode {
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk)/size)
 		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
+			offset := uint64(size) * (ptr - start)
+			return BNode{chunk[offset : offset+uint64(size)]}
 		}
 		start = end
 	}
 	panic("bad ptr")
 }
 
+// the page size of the opened file
+func (db *KV) PageSize() int {
+	if db.pageSize == 0 {
+		return BTREE_PAGE_SIZE
+	}
+	return db.pageSize
+}
+
+// the size of a B-tree node, the page size less the encryption overhead
+func (db *KV) nodeSize() int {
+	return db.tree.page()
+}
+
+// the size limits of a key and a value, derived from the node size
+func (db *KV) MaxKeySize() int {
+	return MaxKeySize(db.nodeSize())
+}
+
+func (db *KV) MaxValSize() int {
+	return MaxValSize(db.nodeSize())
+}
+
+// the buffer pool is used for BACKEND_POOL and for an encrypted file
+func (db *KV) usePool() bool {
+	return db.Options.Backend == BACKEND_POOL || db.crypt != nil
+}
+
 // the signature of the database file
 const DB_SIG = "DungeonDB01"
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B | 8B | 8B |
+// | sig | btree_root | page_used | page_size | flags | counter | key_check | salt |
+// | 16B | 8B | 8B | 4B | 4B | 8B | 32B | 12B |
+// the page size is 0 in the files created before it was recorded,
+// they have BTREE_PAGE_SIZE pages.
+// the last 4 fields are for the encryption, zeros if it's not encrypted.
+const MASTER_SIZE = 16 + 8 + 8 + 4 + 4 + 8 + KEY_CHECK_SIZE + NONCE_SALT_SIZE
+
+// set the page size and the encryption before mapping the file: the ones
+// in the master page, or the options for a new file.
+func (db *KV) loadPageSize() error {
+	var data [MASTER_SIZE]byte
+	n, err := db.fp.ReadAt(data[:], 0)
+	sig := make([]byte, 16)
+	copy(sig, DB_SIG)
+	size := BTREE_PAGE_SIZE
+	var crypt *pageCrypt
+	switch {
+	case n == 0 && err == io.EOF: // a new file
+		if db.Options.PageSize != 0 {
+			size = db.Options.PageSize
+		}
+		if err := CheckPageSize(size); err != nil {
+			return err
+		}
+		if db.Options.Key != nil {
+			if crypt, err = newPageCrypt(db.Options.Key); err != nil {
+				return err
+			}
+		}
+	case n < len(data) || !bytes.Equal(data[:16], sig):
+		// not a database file, MasterLoad reports it
+	default:
+		if stored := binary.LittleEndian.Uint32(data[32:]); stored != 0 {
+			size = int(stored)
+		}
+		if err := CheckPageSize(size); err != nil {
+			return fmt.Errorf("Bad master page: %w", err)
+		}
+		if db.Options.PageSize != 0 && db.Options.PageSize != size {
+			db.log().Warn("the page size option only applies to new files",
+				"path", db.Path, "page_size", size, "option", db.Options.PageSize)
+		}
+		if crypt, err = loadCrypt(data[:], db.Options.Key); err != nil {
+			return err
+		}
+	}
+	db.useCrypt(crypt)
+	db.pageSize = size
+	if crypt != nil {
+		size -= CRYPT_OVERHEAD
+	}
+	db.tree.pageSize = size
+	db.free.pageSize = size
+	return nil
+}
+
 func MasterLoad(db *KV) error {
     // Initialize the updates map first
     db.page.updates = make(map[uint64][]byte)
@@ -68,32 +247,28 @@ func MasterLoad(db *KV) error {
     if db.mmap.file == 0 {
         // If the file is empty, initialize the master page with signature
         db.page.flushed = 1 // Set the page to 1 as the master page is initialized
-        fmt.Println("File is empty, initializing master page with signature...")
+        db.log().Info("initializing a new database file", "path", db.Path)
         err := MasterStore(db) // Store the master page with initialized values
         if err != nil {
             return fmt.Errorf("failed to initialize master page: %w", err)
         }
 
         // Sync the file to ensure all changes are written to disk
-        fmt.Println("Syncing the file after initializing master page...")
         err = db.fp.Sync()
         if err != nil {
             return fmt.Errorf("failed to sync file: %w", err)
         }
 
         // Re-initialize memory map after writing the master page
-        fmt.Println("Re-initializing memory map after master page write...")
-        if err := ExtendMmapWindows(db, 1); err != nil {
+        if err := db.extend(1); err != nil {
             return fmt.Errorf("failed to re-initialize mmap after master page write: %w", err)
         }
 
         // Verify the initialization
-        data := db.mmap.chunks[0]
+        data := db.master()
         expectedSig := make([]byte, 16)
         copy(expectedSig, []byte(DB_SIG))
-        
-        fmt.Printf("Verifying signature - Expected: %x, Got: %x\n", expectedSig, data[:16])
-        
+
         if !bytes.Equal(expectedSig, data[:16]) {
             return fmt.Errorf("signature verification failed after initialization - Expected: %x, Got: %x", 
                 expectedSig, data[:16])
@@ -107,19 +282,15 @@ func MasterLoad(db *KV) error {
     }
 
     // Load the data (first chunk in the memory map)
-    data := db.mmap.chunks[0]
+    data := db.master()
     
     // Create properly padded expected signature
     expectedSig := make([]byte, 16)
     copy(expectedSig, []byte(DB_SIG))
-    
-    // Log the loaded signature and values for debugging
-    fmt.Printf("Loaded data signature: %s\n", string(data[:16]))
-    fmt.Printf("Raw signature bytes - Expected: %x, Got: %x\n", expectedSig, data[:16])
-    
+
     root := binary.LittleEndian.Uint64(data[16:])
     used := binary.LittleEndian.Uint64(data[24:])
-    fmt.Printf("Root: %d, Used: %d\n", root, used)
+    db.log().Debug("master page loaded", "path", db.Path, "root", root, "used", used, "file_size", db.mmap.file)
 
     // Check if the signature matches with proper padding comparison
     if !bytes.Equal(expectedSig, data[:16]) {
@@ -129,7 +300,7 @@ func MasterLoad(db *KV) error {
     // Handle the case where the file is newly initialized
     if used == 0 {
         // If this is the first valid page, treat it as initialized but with 0 pages
-        fmt.Println("Initializing master page with signature due to 0 pages used.")
+        db.log().Info("initializing the master page of an empty database", "path", db.Path)
         db.page.flushed = 1
         err := MasterStore(db)
         if err != nil {
@@ -137,15 +308,13 @@ func MasterLoad(db *KV) error {
         }
 
         // Sync the file to ensure changes are written to disk
-        fmt.Println("Syncing the file after writing master page...")
         err = db.fp.Sync()
         if err != nil {
             return fmt.Errorf("failed to sync file after master page write: %w", err)
         }
 
         // Re-initialize memory map after master page write
-        fmt.Println("Re-initializing memory map after master page write...")
-        if err := ExtendMmapWindows(db, 1); err != nil {
+        if err := db.extend(1); err != nil {
             return fmt.Errorf("failed to re-initialize mmap after master page write: %w", err)
         }
 
@@ -153,9 +322,9 @@ func MasterLoad(db *KV) error {
     }
 
     // Further checks to ensure `used` and `root` values are within valid ranges
-    if !(0 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE)) {
+    if !(0 <= used && used <= uint64(db.mmap.file/db.PageSize())) {
         return fmt.Errorf("Bad master page: used value out of range (used: %d, max: %d)", 
-            used, uint64(db.mmap.file/BTREE_PAGE_SIZE))
+            used, uint64(db.mmap.file/db.PageSize()))
     }
 
     if !(0 <= root && root < used) {
@@ -175,9 +344,7 @@ func MasterStore(db *KV) error {
     if db.fp == nil {
         return fmt.Errorf("db.fp is nil, file is not open")
     }
-    fmt.Println("File pointer is valid, proceeding with master page store.")
-	
-    var data [32]byte
+    var data [MASTER_SIZE]byte
     
     // Create a properly padded signature
     sigBytes := []byte(DB_SIG)
@@ -194,33 +361,99 @@ func MasterStore(db *KV) error {
     // Store the root and flushed values
     binary.LittleEndian.PutUint64(data[16:], db.tree.root)
     binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+    binary.LittleEndian.PutUint32(data[32:], uint32(db.PageSize()))
+    if db.crypt != nil {
+        // not interleaved with a new counter reservation
+        db.crypt.mu.Lock()
+        defer db.crypt.mu.Unlock()
+        db.crypt.header(data[36:])
+    }
     
     // Write the data
     _, err := db.fp.WriteAt(data[:], 0)
     if err != nil {
         return fmt.Errorf("write master page: %w", err)
     }
-    
-    // Sync to ensure write is flushed to disk
-    if err := db.fp.Sync(); err != nil {
-        return fmt.Errorf("sync master page: %w", err)
-    }
-    
+    db.log().Debug("master page stored", "root", db.tree.root, "used", db.page.flushed)
     return nil
 }
 
+// fsync the file, timed for the metrics
+func (db *KV) fsync() error {
+	start := time.Now()
+	err := db.fp.Sync()
+	db.Options.Metrics.synced(start)
+	return err
+}
+
+// the root and the number of pages of the last commit, from the master page
+func (db *KV) committed() (root uint64, used uint64) {
+	data := db.master()
+	return binary.LittleEndian.Uint64(data[16:]), binary.LittleEndian.Uint64(data[24:])
+}
+
+// drop the pending updates after a failed write,
+// the tree goes back to the root in the master page.
+func (db *KV) revert() {
+	db.tree.root, _ = db.committed()
+	if db.pool != nil {
+		db.pool.discard()
+	}
+	db.page.nfree = 0
+	db.page.nappend = 0
+	db.page.updates = map[uint64][]byte{}
+}
+
+// the initial mmap size, a multiple of the page size
+func (db *KV) mmapInitial() int {
+	size := db.Options.MmapInitial
+	if size == 0 {
+		size = MMAP_INITIAL_SIZE
+	}
+	page := db.PageSize()
+	return (size + page - 1) / page * page
+}
+
+// check the file size limit for `npages`
+func (db *KV) checkSize(npages int) error {
+	if db.Options.MaxSize > 0 && int64(npages)*int64(db.PageSize()) > db.Options.MaxSize {
+		return fmt.Errorf("%w: %d pages exceed %d bytes", ErrDBFull, npages, db.Options.MaxSize)
+	}
+	return nil
+}
+
+// the file size for `npages` pages, grown exponentially
+// so that we don't have to extend the file for every update.
+func (db *KV) growFile(filePages int, npages int) int {
+	for filePages < npages {
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+	page := db.PageSize()
+	size := filePages * page
+	if db.Options.MaxSize > 0 && int64(size) > db.Options.MaxSize {
+		size = int(db.Options.MaxSize / int64(page) * int64(page))
+	}
+	return size
+}
+
 // callback for BTree, allocate a new page.
 func (db *KV) PageNew(node BNode) uint64 {
-	u.Assert(len(node.Data) <= BTREE_PAGE_SIZE)
+	u.Assert(len(node.Data) <= db.nodeSize())
 	ptr := uint64(0)
 	if db.page.nfree < db.free.Total() {
 		// reuse a deallocated page
 		ptr = db.free.Get(db.page.nfree)
 		db.page.nfree++
+		db.Options.Metrics.pageAlloc(true)
 	} else {
 		// append a new page
 		ptr = db.page.flushed + uint64(db.page.nappend)
 		db.page.nappend++
+		db.Options.Metrics.pageAlloc(false)
 	}
 	db.page.updates[ptr] = node.Data
 	return ptr
@@ -233,48 +466,12 @@ func (db *KV) PageDel(ptr uint64) {
 
 // callback for FreeList, allocate a new page
 func (db *KV) PageAppend(node BNode) uint64 {
-    u.Assert(len(node.Data) <= BTREE_PAGE_SIZE)
+    u.Assert(len(node.Data) <= db.nodeSize())
     ptr := db.page.flushed + uint64(db.page.nappend)
     db.page.nappend++
 
-    // Update in-memory page map
     db.page.updates[ptr] = node.Data
-
-    // Calculate offset
-    offset := ptr * BTREE_PAGE_SIZE
-    log.Printf("Writing node data to file at offset: %d", offset)
-
-    // Write to the database file
-    _, err := db.fp.WriteAt(node.Data, int64(offset))
-    if err != nil {
-        log.Fatalf("Failed to write node data to file: %v", err)
-    } else {
-        log.Printf("Node data written successfully at offset: %d", offset)
-    }
-
-    // Sync file to persist changes
-    err = db.fp.Sync()
-    if err != nil {
-        log.Fatalf("Failed to sync file: %v", err)
-    } else {
-        log.Println("File synced successfully.")
-    }
-
-    // Verify file size
-    info, err := db.fp.Stat()
-    if err != nil {
-        log.Fatalf("Failed to stat file: %v", err)
-    }
-    log.Printf("File size after write: %d bytes", info.Size())
-
-    // Read back data for verification
-    data := make([]byte, BTREE_PAGE_SIZE)
-    _, err = db.fp.ReadAt(data, int64(offset))
-    if err != nil {
-        log.Fatalf("Failed to read back data: %v", err)
-    }
-    log.Printf("Read back data at offset %d: %s", offset, string(data))
-
+    db.log().Debug("page appended", "ptr", ptr)
     return ptr
 }
 
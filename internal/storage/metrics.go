@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/metrics"
+)
+
+// engine metrics, set through Options.Metrics.
+// the methods do nothing on a nil *Metrics.
+type Metrics struct {
+	pageReads  *metrics.Counter
+	pageWrites *metrics.Counter
+	pageCaches *metrics.CounterVec // buffer pool lookups by result: hit or miss
+	pageAllocs *metrics.CounterVec // by source: free or append
+	splits     *metrics.CounterVec // by the number of resulting nodes
+	merges     *metrics.CounterVec // by the sibling: left or right
+	fsync      *metrics.Histogram
+	fileSize   *metrics.Gauge
+	mmapSize   *metrics.Gauge
+	height     *metrics.Gauge
+	rowOps     *metrics.CounterVec // by table and op: insert, update or delete
+}
+
+// register the engine metrics, one DB per registry
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	return &Metrics{
+		pageReads:  reg.NewCounter("dungeondb_page_reads_total", "Pages read from the file."),
+		pageWrites: reg.NewCounter("dungeondb_page_writes_total", "Pages written to the file."),
+		pageCaches: reg.NewCounterVec("dungeondb_page_cache_total", "Buffer pool lookups, hits or misses.", "result"),
+		pageAllocs: reg.NewCounterVec("dungeondb_page_allocs_total", "Pages allocated, from the free list or appended.", "source"),
+		splits:     reg.NewCounterVec("dungeondb_node_splits_total", "B-tree nodes split, by the number of resulting nodes.", "nodes"),
+		merges:     reg.NewCounterVec("dungeondb_node_merges_total", "B-tree nodes merged with a sibling.", "sibling"),
+		fsync:      reg.NewHistogram("dungeondb_fsync_seconds", "Latency of the file syncs.", metrics.LATENCY_BUCKETS),
+		fileSize:   reg.NewGauge("dungeondb_file_size_bytes", "Size of the database file."),
+		mmapSize:   reg.NewGauge("dungeondb_mmap_size_bytes", "Size of the mapped address space."),
+		height:     reg.NewGauge("dungeondb_tree_height", "Levels of the B-tree after the last commit."),
+		rowOps:     reg.NewCounterVec("dungeondb_row_ops_total", "Row operations, including those of rolled back transactions.", "table", "op"),
+	}
+}
+
+func (m *Metrics) pageRead() {
+	if m != nil {
+		m.pageReads.Inc()
+	}
+}
+
+func (m *Metrics) pagesWritten(n int) {
+	if m != nil {
+		m.pageWrites.Add(uint64(n))
+	}
+}
+
+func (m *Metrics) pageCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.pageCaches.With("hit").Inc()
+	} else {
+		m.pageCaches.With("miss").Inc()
+	}
+}
+
+func (m *Metrics) pageAlloc(reused bool) {
+	if m == nil {
+		return
+	}
+	if reused {
+		m.pageAllocs.With("free").Inc()
+	} else {
+		m.pageAllocs.With("append").Inc()
+	}
+}
+
+// a NodeSplit3 result
+func (m *Metrics) split(nsplit uint16) {
+	if m != nil && nsplit > 1 {
+		m.splits.With(strconv.Itoa(int(nsplit))).Inc()
+	}
+}
+
+// a ShouldMerge result
+func (m *Metrics) merge(dir int) {
+	if m == nil || dir == 0 {
+		return
+	}
+	if dir < 0 {
+		m.merges.With("left").Inc()
+	} else {
+		m.merges.With("right").Inc()
+	}
+}
+
+func (m *Metrics) synced(start time.Time) {
+	if m != nil {
+		m.fsync.Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) rowOp(table string, op string) {
+	if m != nil {
+		m.rowOps.With(table, op).Inc()
+	}
+}
+
+// rows inserted by a bulk load
+func (m *Metrics) rowsLoaded(table string, n int) {
+	if m != nil {
+		m.rowOps.With(table, "insert").Add(uint64(n))
+	}
+}
+
+// update the gauges after a commit
+func (m *Metrics) flushed(db *KV) {
+	if m == nil {
+		return
+	}
+	m.fileSize.Set(int64(db.mmap.file))
+	m.mmapSize.Set(int64(db.mmap.total))
+	height := int64(0)
+	for ptr := db.tree.root; ptr != 0; {
+		node := db.pageRead(ptr)
+		height++
+		if node.Btype() != BNODE_NODE {
+			break
+		}
+		ptr = node.GetPtr(0)
+	}
+	m.height.Set(height)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	u "github.com/Ricky004/dungeonDB/internal/utils"
 	"golang.org/x/sys/unix"
@@ -14,18 +15,17 @@ import (
 
 // create the initial mmap that covers the whole file
 // unix specific code for mmap
-func MmapInit(fp *os.File) (int, []byte, error) {
+func MmapInit(fp *os.File, mmapSize int, pageSize int) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
 
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+	if fi.Size()%int64(pageSize) != 0 {
 		return 0, nil, errors.New("File size is not a multiple of page size.")
 	}
 
-	mmapSize := 64 << 20
-	u.Assert(mmapSize%BTREE_PAGE_SIZE == 0)
+	u.Assert(mmapSize%pageSize == 0)
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
@@ -45,41 +45,37 @@ func MmapInit(fp *os.File) (int, []byte, error) {
 
 // extend the mmap by adding new mappings
 func ExtendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
+	if db.pool != nil || db.mmap.total >= npages*db.PageSize() {
 		return nil
 	}
 
-	// double the address space
-	chunk, err := unix.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED,
-	)
-	if err != nil {
-		return fmt.Errorf("mmap: %w", err)
-	}
+	// double the address space, as many times as a large commit needs
+	for db.mmap.total < npages*db.PageSize() {
+		chunk, err := unix.Mmap(
+			int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
+			unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED,
+		)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
 
-	db.mmap.total += db.mmap.total
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
+		db.mmap.total += db.mmap.total
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+	}
 	return nil
 }
 
 // extend the file to at least `npages`.
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.mmap.file / db.PageSize()
 	if filePages >= npages {
 		return nil
 	}
-	for filePages < npages {
-		// the file size is increased exponentially,
-		// so that we don't have to extend the file for every update.
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
-		}
-		filePages += inc
+	if err := db.checkSize(npages); err != nil {
+		return err
 	}
-	fileSize := filePages * BTREE_PAGE_SIZE
-	err := unix.Fallocate(int(db.fp.Fd()), 0, 0, int64(fileSize))
+	fileSize := db.growFile(filePages, npages)
+	err := fallocate(db.fp, int64(fileSize))
 	if err != nil {
 		return fmt.Errorf("fallocate: %w", err)
 	}
@@ -94,24 +90,39 @@ func (db *KV) Open() error {
 		return fmt.Errorf("OpenFile: %w", err)
 	}
 	db.fp = fp
-	// create the initial mmap
-	sz, chunk, err := MmapInit(db.fp)
-	if err != nil {
+	var sz int
+	var chunk []byte
+	if err = db.loadPageSize(); err != nil {
 		goto fail
 	}
-	db.mmap.file = sz
-	db.mmap.total = len(chunk)
-	db.mmap.chunks = [][]byte{chunk}
+	if db.usePool() {
+		if err = db.openPool(); err != nil {
+			goto fail
+		}
+	} else {
+		// create the initial mmap
+		sz, chunk, err = MmapInit(db.fp, db.mmapInitial(), db.PageSize())
+		if err != nil {
+			goto fail
+		}
+		db.mmap.file = sz
+		db.mmap.total = len(chunk)
+		db.mmap.chunks = [][]byte{chunk}
+	}
 	// btree callbacks
 	db.tree.Get = db.PageGet
 	db.tree.New = db.PageNew
 	db.tree.Del = db.PageDel
+	db.tree.metrics = db.Options.Metrics
+	db.tree.Prefix = !db.Options.NoLeafPrefix
 	// read the master page
 	err = MasterLoad(db)
 	if err != nil {
 		goto fail
 	}
 	// done
+	db.Options.Metrics.flushed(db)
+	db.log().Info("database opened", "path", db.Path, "root", db.tree.root, "used", db.page.flushed)
 	return nil
 fail:
 	db.Close()
@@ -124,30 +135,98 @@ func (db *KV) Close() {
 		err := unix.Munmap(chunk)
 		u.Assert(err == nil)
 	}
+	db.mmap.chunks, db.mmap.total, db.pool = nil, 0, nil
 	_ = db.fp.Close()
 }
 
+// hooks for the platform independent code
+func (db *KV) open() error {
+	return db.Open()
+}
+
+func (db *KV) close() error {
+	db.Close()
+	return nil
+}
+
+func (db *KV) flush() error {
+	return FlushPages(db)
+}
+
+// extend the file & mmap to at least `npages`
+func (db *KV) extend(npages int) error {
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	return ExtendMmap(db, npages)
+}
+
+func (db *KV) get(key []byte) ([]byte, bool) {
+	return db.Get(key)
+}
+
+func (db *KV) update(req *InsertReq) (bool, error) {
+	return db.Update(req)
+}
+
+func (db *KV) del(req *DeleteReq) (bool, error) {
+	return db.DelEx(req)
+}
+
 // read the db
 func (db *KV) Get(key []byte) ([]byte, bool) {
-	// code
-	return nil, false
+	val, ok := db.tree.Lookup(key)
+	if ok && db.rawExpired(key) {
+		return nil, false
+	}
+	return val, ok
 }
 
+// set a value without an expiry, see SetEx
 func (db *KV) Set(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return FlushPages(db)
+	return db.SetEx(key, val, 0)
 }
 func (db *KV) Del(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
+	return db.DelEx(&DeleteReq{Key: key})
+}
+
+func (db *KV) DelEx(req *DeleteReq) (bool, error) {
+	if err := db.writable(); err != nil {
+		return false, err
+	}
+	db.dropExpiry(req.Key)
+	deleted := db.tree.DeleteEx(req)
 	return deleted, FlushPages(db)
 }
 
+func (db *KV) Update(req *InsertReq) (bool, error) {
+	if err := db.writable(); err != nil {
+		return false, err
+	}
+	db.tree.InsertEx(req)
+	return req.Added, FlushPages(db)
+}
+
 // persist the newly allocated pages after updates
 func FlushPages(db *KV) error {
+	if db.tx.active {
+		return nil // deferred until the commit
+	}
+	start := time.Now()
+	npages := len(db.page.updates)
 	if err := WritePages(db); err != nil {
+		db.revert()
+		db.log().Warn("write failed, updates reverted", "path", db.Path, "pages", npages, "err", err)
+		return err
+	}
+	ps := db.commitPages()
+	if err := SyncPages(db); err != nil {
 		return err
 	}
-	return SyncPages(db)
+	db.shipCommit(ps)
+	db.Options.Metrics.flushed(db)
+	db.log().Debug("pages flushed", "pages", npages, "root", db.tree.root, "used", db.page.flushed, "duration", time.Since(start))
+	return nil
 }
 
 func WritePages(db *KV) error {
@@ -161,7 +240,7 @@ func WritePages(db *KV) error {
 	db.free.Update(db.page.nfree, freed)
 
 	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + len(db.page.updates)
+	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
 		return err
 	}
@@ -170,27 +249,38 @@ func WritePages(db *KV) error {
 	}
 	
 	// copy pages to the file
+	written := 0
 	for ptr, page := range db.page.updates {
 		if page != nil {
-		copy(PageGetMapped(db, ptr).Data, page)
+			written++
+			if err := db.pageWrite(ptr, page); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	db.Options.Metrics.pagesWritten(written)
+	return db.writeBack()
 }
 
 func SyncPages(db *KV) error {
     // flush data to the disk. must be done before updating the master page.
-    if err := db.fp.Sync(); err != nil {
-        return fmt.Errorf("fsync: %w", err)
+    if db.Options.SyncMode != SYNC_OFF {
+        if err := db.fsync(); err != nil {
+            return fmt.Errorf("fsync: %w", err)
+        }
     }
-    db.page.flushed += uint64(len(db.page.updates))
+    db.page.flushed += uint64(db.page.nappend)
+    db.page.nfree = 0
+    db.page.nappend = 0
     db.page.updates = make(map[uint64][]byte)
     // update & flush the master page
     if err := MasterStore(db); err != nil {
         return err
     }
-    if err := db.fp.Sync(); err != nil {
-        return fmt.Errorf("fsync: %w", err)
+    if db.Options.SyncMode == SYNC_FULL {
+        if err := db.fsync(); err != nil {
+            return fmt.Errorf("fsync: %w", err)
+        }
     }
     return nil
 }
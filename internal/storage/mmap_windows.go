@@ -6,6 +6,7 @@ package storage
 import (
 	"fmt"
 	"os"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
@@ -13,7 +14,7 @@ import (
 
 // create the initial mmap that covers the whole file
 // windows specific code for mmap
-func MmapInitWindows(fp *os.File) (int, []byte, error) {
+func MmapInitWindows(fp *os.File, pageSize int) (int, []byte, error) {
 	// Truncate file if necessary
 	fi, err := fp.Stat()
 	if err != nil {
@@ -21,8 +22,8 @@ func MmapInitWindows(fp *os.File) (int, []byte, error) {
 	}
 
 	fileSize := fi.Size()
-	if fileSize%BTREE_PAGE_SIZE != 0 {
-		fileSize = (fileSize/BTREE_PAGE_SIZE + 1) * BTREE_PAGE_SIZE
+	if page := int64(pageSize); fileSize%page != 0 {
+		fileSize = (fileSize/page + 1) * page
 		if err := fp.Truncate(fileSize); err != nil {
 			return 0, nil, fmt.Errorf("truncate: %w", err)
 		}
@@ -69,8 +70,24 @@ func MmapInitWindows(fp *os.File) (int, []byte, error) {
 	return int(fileSize), unsafe.Slice((*byte)(unsafe.Pointer(addr)), fileSize), nil
 }
 
+// the allocation granularity of windows, the views start at a multiple of it
+const mmapGranularity = 64 << 10
+
+// extend the mmap to at least `npages` by mapping the range after the mapped
+// chunks, which stay consecutive in the file
 func ExtendMmapWindows(db *KV, npages int) error {
-	newSize := db.mmap.total + (npages * BTREE_PAGE_SIZE)
+	if db.pool != nil {
+		return nil // no mapping
+	}
+	start := db.mmap.total
+	newSize := npages * db.PageSize()
+	if start >= newSize {
+		return nil
+	}
+	// map the whole file, a mapping larger than the file extends it
+	if newSize < db.mmap.file {
+		newSize = db.mmap.file
+	}
 
 	// Use the existing file handle (db.fp) instead of reopening the file
 	handle := db.fp.Fd()
@@ -80,7 +97,7 @@ func ExtendMmapWindows(db *KV, npages int) error {
 		windows.Handle(handle),
 		nil,
 		windows.PAGE_READWRITE,
-		0,
+		uint32(uint64(newSize)>>32),
 		uint32(newSize),
 		nil,
 	)
@@ -89,44 +106,41 @@ func ExtendMmapWindows(db *KV, npages int) error {
 	}
 	defer windows.CloseHandle(mapHandle)
 
-	// Map the extended file into memory
+	// Map the new range, from the aligned offset before it
+	base := start / mmapGranularity * mmapGranularity
 	addr, err := windows.MapViewOfFile(
 		mapHandle,
 		windows.FILE_MAP_READ|windows.FILE_MAP_WRITE,
-		0,
-		0,
-		uintptr(newSize),
+		uint32(uint64(base)>>32),
+		uint32(base),
+		uintptr(newSize-base),
 	)
 	if err != nil {
 		return fmt.Errorf("MapViewOfFile: %w", err)
 	}
 
 	// Update the mmap struct
+	view := unsafe.Slice((*byte)(unsafe.Pointer(addr)), newSize-base)
+	db.mmap.chunks = append(db.mmap.chunks, view[start-base:])
 	db.mmap.total = newSize
-	chunk := unsafe.Slice((*byte)(unsafe.Pointer(addr)), newSize)
-	db.mmap.chunks = append(db.mmap.chunks, chunk)
-
+	if db.mmap.file < newSize {
+		db.mmap.file = newSize
+	}
 	return nil
 }
 
 func extendFileWindows(db *KV, npages int) error {
 	// Calculate the number of pages already in the file
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.mmap.file / db.PageSize()
 	if filePages >= npages {
 		return nil
 	}
 
-	// Increase the file size exponentially, similar to the original logic
-	for filePages < npages {
-		inc := filePages / 8
-		if inc < 1 {
-			inc = 1
-		}
-		filePages += inc
+	// Increase the file size exponentially, up to the size limit
+	if err := db.checkSize(npages); err != nil {
+		return err
 	}
-
-	// Calculate the new file size
-	fileSize := filePages * BTREE_PAGE_SIZE
+	fileSize := db.growFile(filePages, npages)
 
 	// Use the existing file handle to resize the file
 	if err := db.fp.Truncate(int64(fileSize)); err != nil {
@@ -140,12 +154,9 @@ func extendFileWindows(db *KV, npages int) error {
 
 // OpenWindows opens the DB file and sets up the memory-mapping
 func (db *KV) OpenWindows() error {
-	fmt.Println("Starting OpenWindows...")
-
 	if db.Path == "" {
 		return fmt.Errorf("database path is empty")
 	}
-	fmt.Printf("Opening database file at path: %q\n", db.Path)
 
 	// Open or create the file
 	file, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0666)
@@ -153,63 +164,62 @@ func (db *KV) OpenWindows() error {
 		return fmt.Errorf("failed to open or create file: %w", err)
 	}
 	db.fp = file // Assign file pointer to KV struct
-	fmt.Println("File pointer assigned:", db.fp)
-
-	fmt.Println("File opened successfully.")
+	if err := db.loadPageSize(); err != nil {
+		file.Close()
+		return fmt.Errorf("KV.OpenWindows: %w", err)
+	}
+	if db.usePool() {
+		if err := db.openPool(); err != nil {
+			file.Close()
+			return fmt.Errorf("KV.OpenWindows: %w", err)
+		}
+	}
 
 	// Check if the file is empty and initialize the signature if needed
 	fileInfo, err := file.Stat()
 	if err != nil {
 		return fmt.Errorf("failed to stat file: %w", err)
 	}
-	fmt.Printf("File size before any operations: %d\n", fileInfo.Size())
+	db.log().Debug("opening the database", "path", db.Path, "file_size", fileInfo.Size())
+	db.mmap.file = int(fileInfo.Size())
 
 	// If file is empty, initialize it with the master page
 	if fileInfo.Size() == 0 {
-		fmt.Println("File is empty, initializing master page with signature...")
 		if err := MasterStore(db); err != nil {
 			return fmt.Errorf("failed to initialize master page: %w", err)
 		}
-		fmt.Println("Master page initialized successfully!")
 	}
 
 	// Resize the file if necessary
 	pagesRequired := 1 // Adjust this based on your use case
-	fmt.Println("Ensuring file size is sufficient...")
 	if err := extendFileWindows(db, pagesRequired); err != nil {
 		return fmt.Errorf("failed to extend file: %w", err)
 	}
-	fmt.Println("File size ensured.")
 
 	// Initialize memory map
-	fmt.Println("Initializing memory map...")
 	if err := ExtendMmapWindows(db, pagesRequired); err != nil {
 		return fmt.Errorf("failed to initialize mmap: %w", err)
 	}
-	fmt.Println("Memory map initialized successfully.")
 
 	// Set up BTree callbacks
 	db.tree.Get = db.PageGet
 	db.tree.New = db.PageNew
 	db.tree.Del = db.PageDel
-	fmt.Println("BTree callbacks configured.")
+	db.tree.metrics = db.Options.Metrics
+	db.tree.Prefix = !db.Options.NoLeafPrefix
 
 	// Load the master page
-	fmt.Println("Loading master page...")
-	if err := MasterLoad(db); err != nil {
-		fmt.Printf("Failed to load master page: %v\n", err)
+	if err = MasterLoad(db); err != nil {
 		goto fail
 	}
-	fmt.Println("Master page loaded successfully.")
-
-	fmt.Println("OpenWindows completed successfully.")
+	db.Options.Metrics.flushed(db)
+	db.log().Info("database opened", "path", db.Path, "root", db.tree.root, "used", db.page.flushed)
 	return nil
 
 fail:
-	fmt.Println("Error occurred, performing cleanup...")
 	// Close the file explicitly only at the end
-	if err := db.CloseWindows(); err != nil {
-		fmt.Printf("Error closing database: %v", err)
+	if cerr := db.CloseWindows(); cerr != nil {
+		db.log().Error("closing the database after a failed open", "path", db.Path, "err", cerr)
 	}
 	return fmt.Errorf("KV.OpenWindows: %w", err)
 }
@@ -226,13 +236,16 @@ func (db *KV) CloseWindows() error {
 		return fmt.Errorf("failed to sync final changes: %w", err)
 	}
 
-	// Then unmap all chunks
+	// Then unmap all chunks, each view starts at the aligned offset before its chunk
+	off := 0
 	for _, chunk := range db.mmap.chunks {
-		err := windows.UnmapViewOfFile(uintptr(unsafe.Pointer(&chunk[0])))
-		if err != nil {
+		addr := uintptr(unsafe.Pointer(&chunk[0])) - uintptr(off%mmapGranularity)
+		if err := windows.UnmapViewOfFile(addr); err != nil {
 			return fmt.Errorf("failed to unmap view: %w", err)
 		}
+		off += len(chunk)
 	}
+	db.mmap.chunks, db.mmap.total, db.pool = nil, 0, nil
 
 	// Finally close the file
 	if db.fp != nil {
@@ -246,32 +259,89 @@ func (db *KV) CloseWindows() error {
 	return nil
 }
 
+// hooks for the platform independent code
+func (db *KV) open() error {
+	return db.OpenWindows()
+}
+
+func (db *KV) close() error {
+	return db.CloseWindows()
+}
+
+func (db *KV) flush() error {
+	return FlushPagesW(db)
+}
+
+// extend the file & mmap to at least `npages`
+func (db *KV) extend(npages int) error {
+	if err := extendFileWindows(db, npages); err != nil {
+		return err
+	}
+	return ExtendMmapWindows(db, npages)
+}
+
+func (db *KV) get(key []byte) ([]byte, bool) {
+	return db.GetW(key)
+}
+
+func (db *KV) update(req *InsertReq) (bool, error) {
+	return db.UpdateW(req)
+}
+
+func (db *KV) del(req *DeleteReq) (bool, error) {
+	return db.DelW(req)
+}
+
 // read the db
 func (db *KV) GetW(key []byte) ([]byte, bool) {
-	// code
-	return nil, false
+	val, ok := db.tree.Lookup(key)
+	if ok && db.rawExpired(key) {
+		return nil, false
+	}
+	return val, ok
 }
 
+// set a value without an expiry, see SetEx
 func (db *KV) SetW(key []byte, val []byte) error {
-	db.tree.Insert(key, val)
-	return FlushPagesW(db)
+	return db.SetEx(key, val, 0)
 }
 func (db *KV) DelW(req *DeleteReq) (bool, error) {
-	deleted := db.tree.Delete(req.Key)
+	if err := db.writable(); err != nil {
+		return false, err
+	}
+	db.dropExpiry(req.Key)
+	deleted := db.tree.DeleteEx(req)
 	return deleted, FlushPagesW(db)
 }
 
 func (db *KV) UpdateW(req *InsertReq) (bool, error) {
-	// code
-	return false, nil
+	if err := db.writable(); err != nil {
+		return false, err
+	}
+	db.tree.InsertEx(req)
+	return req.Added, FlushPagesW(db)
 }
 
 // persist the newly allocated pages after updates
 func FlushPagesW(db *KV) error {
+	if db.tx.active {
+		return nil // deferred until the commit
+	}
+	start := time.Now()
+	npages := len(db.page.updates)
 	if err := WritePagesW(db); err != nil {
+		db.revert()
+		db.log().Warn("write failed, updates reverted", "path", db.Path, "pages", npages, "err", err)
+		return err
+	}
+	ps := db.commitPages()
+	if err := SyncPagesW(db); err != nil {
 		return err
 	}
-	return SyncPagesW(db)
+	db.shipCommit(ps)
+	db.Options.Metrics.flushed(db)
+	db.log().Debug("pages flushed", "pages", npages, "root", db.tree.root, "used", db.page.flushed, "duration", time.Since(start))
+	return nil
 }
 
 func WritePagesW(db *KV) error {
@@ -285,7 +355,7 @@ func WritePagesW(db *KV) error {
 	db.free.Update(db.page.nfree, freed)
 
 	// extend the file & mmap if needed
-	npages := int(db.page.flushed) + len(db.page.updates)
+	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFileWindows(db, npages); err != nil {
 		return err
 	}
@@ -294,27 +364,38 @@ func WritePagesW(db *KV) error {
 	}
 
 	// copy pages to the file
+	written := 0
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(PageGetMapped(db, ptr).Data, page)
+			written++
+			if err := db.pageWrite(ptr, page); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	db.Options.Metrics.pagesWritten(written)
+	return db.writeBack()
 }
 
 func SyncPagesW(db *KV) error {
 	// flush data to the disk. must be done before updating the master page.
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if db.Options.SyncMode != SYNC_OFF {
+		if err := db.fsync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
 	}
-	db.page.flushed += uint64(len(db.page.updates))
+	db.page.flushed += uint64(db.page.nappend)
+	db.page.nfree = 0
+	db.page.nappend = 0
 	db.page.updates = make(map[uint64][]byte)
 	// update & flush the master page
 	if err := MasterStore(db); err != nil {
 		return err
 	}
-	if err := db.fp.Sync(); err != nil {
-		return fmt.Errorf("fsync: %w", err)
+	if db.Options.SyncMode == SYNC_FULL {
+		if err := db.fsync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// the buffer pool backend, selected by Options.Backend.
+// instead of mapping the file, the pages are read with pread into a fixed
+// number of frames, evicted with the CLOCK algorithm. the updated pages
+// are written to the frames at the commit and written back with pwrite
+// before the fsync, so an I/O error is returned by the commit instead of
+// arriving as a SIGBUS.
+// the B-tree keeps the nodes it reads beyond a call (the iterators),
+// so a read returns a copy. a frame is pinned while it's being loaded or
+// copied, a pinned frame is not evicted.
+// the pool is safe for concurrent use, the snapshots read through it.
+// the frames of an encrypted file hold the decrypted nodes, see crypt.go.
+
+// the default number of frames
+const POOL_DEFAULT_PAGES = 1024
+
+type bufferPool struct {
+	fp      *os.File
+	size    int        // the page size
+	crypt   *pageCrypt // the frames are smaller by CRYPT_OVERHEAD if set
+	metrics *Metrics
+
+	mu     sync.Mutex
+	loaded *sync.Cond     // a frame finished loading
+	frames []poolFrame    // fixed
+	table  map[uint64]int // page number -> frame
+	hand   int            // the CLOCK hand
+}
+
+type poolFrame struct {
+	ptr     uint64
+	data    []byte
+	valid   bool // holds the page `ptr`
+	loading bool // being read from the file
+	pins    int  // not evicted while > 0
+	ref     bool // used since the hand passed
+	dirty   bool // to be written back
+}
+
+func newBufferPool(fp *os.File, size int, crypt *pageCrypt, npages int, metrics *Metrics) *bufferPool {
+	if npages <= 0 {
+		npages = POOL_DEFAULT_PAGES
+	}
+	bp := &bufferPool{fp: fp, size: size, crypt: crypt, metrics: metrics, table: map[uint64]int{}}
+	bp.loaded = sync.NewCond(&bp.mu)
+	node := size
+	if crypt != nil {
+		node -= CRYPT_OVERHEAD
+	}
+	data := make([]byte, npages*node)
+	bp.frames = make([]poolFrame, npages)
+	for i := range bp.frames {
+		bp.frames[i].data = data[i*node:][:node]
+	}
+	return bp
+}
+
+// find a frame for a new page, the caller holds the lock.
+// a dirty victim is written back first.
+func (bp *bufferPool) victim() (int, error) {
+	// 2 rounds clear the reference bits of the unpinned frames
+	for n := 0; n < 2*len(bp.frames)+1; n++ {
+		i := bp.hand
+		bp.hand = (bp.hand + 1) % len(bp.frames)
+		f := &bp.frames[i]
+		if f.pins > 0 {
+			continue
+		}
+		if f.ref {
+			f.ref = false
+			continue
+		}
+		if f.dirty {
+			if err := bp.writeBack(f); err != nil {
+				return 0, err
+			}
+		}
+		if f.valid {
+			delete(bp.table, f.ptr)
+			f.valid = false
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("buffer pool: all %d frames are pinned", len(bp.frames))
+}
+
+func (bp *bufferPool) writeBack(f *poolFrame) error {
+	page := f.data
+	if bp.crypt != nil {
+		var err error
+		if page, err = bp.crypt.sealNext(f.ptr, f.data); err != nil {
+			return err
+		}
+	}
+	if _, err := bp.fp.WriteAt(page, int64(f.ptr)*int64(bp.size)); err != nil {
+		return fmt.Errorf("write page %d: %w", f.ptr, err)
+	}
+	f.dirty = false
+	return nil
+}
+
+// pin the frame of a page, reading it on a miss
+func (bp *bufferPool) pin(ptr uint64) (*poolFrame, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for {
+		i, ok := bp.table[ptr]
+		if !ok {
+			break
+		}
+		f := &bp.frames[i]
+		if f.loading {
+			bp.loaded.Wait() // then look it up again
+			continue
+		}
+		bp.metrics.pageCache(true)
+		f.pins++
+		f.ref = true
+		return f, nil
+	}
+	bp.metrics.pageCache(false)
+	i, err := bp.victim()
+	if err != nil {
+		return nil, err
+	}
+	f := &bp.frames[i]
+	f.ptr, f.valid, f.loading, f.pins, f.ref = ptr, true, true, 1, true
+	bp.table[ptr] = i
+
+	// read without the lock, the others wait for this page only
+	bp.mu.Unlock()
+	err = bp.load(f)
+	bp.mu.Lock()
+	f.loading = false
+	bp.loaded.Broadcast()
+	if err != nil {
+		delete(bp.table, ptr)
+		f.valid, f.pins = false, 0
+		return nil, err
+	}
+	return f, nil
+}
+
+// read a page into its frame
+func (bp *bufferPool) load(f *poolFrame) error {
+	if bp.crypt == nil {
+		if _, err := bp.fp.ReadAt(f.data, int64(f.ptr)*int64(bp.size)); err != nil {
+			return fmt.Errorf("read page %d: %w", f.ptr, err)
+		}
+		return nil
+	}
+	page := make([]byte, bp.size)
+	if _, err := bp.fp.ReadAt(page, int64(f.ptr)*int64(bp.size)); err != nil {
+		return fmt.Errorf("read page %d: %w", f.ptr, err)
+	}
+	return bp.crypt.open(f.data, f.ptr, page)
+}
+
+func (bp *bufferPool) unpin(f *poolFrame) {
+	bp.mu.Lock()
+	f.pins--
+	bp.mu.Unlock()
+}
+
+// a copy of a page
+func (bp *bufferPool) read(ptr uint64) (BNode, error) {
+	f, err := bp.pin(ptr)
+	if err != nil {
+		return BNode{}, err
+	}
+	node := BNode{append([]byte(nil), f.data...)}
+	bp.unpin(f)
+	return node, nil
+}
+
+// replace a page, it's written back by flush() or an eviction
+func (bp *bufferPool) write(ptr uint64, data []byte) error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	i, ok := bp.table[ptr]
+	for ok && bp.frames[i].loading {
+		bp.loaded.Wait()
+		i, ok = bp.table[ptr]
+	}
+	if !ok {
+		var err error
+		if i, err = bp.victim(); err != nil {
+			return err
+		}
+		bp.frames[i].ptr, bp.frames[i].valid = ptr, true
+		bp.table[ptr] = i
+	}
+	f := &bp.frames[i]
+	copy(f.data, data)
+	f.dirty, f.ref = true, true
+	return nil
+}
+
+// write back the dirty pages in file order
+func (bp *bufferPool) flush() error {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	dirty := []*poolFrame{}
+	for i := range bp.frames {
+		if bp.frames[i].dirty {
+			dirty = append(dirty, &bp.frames[i])
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].ptr < dirty[j].ptr })
+	for _, f := range dirty {
+		if err := bp.writeBack(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop the dirty pages after a failed commit, the file has the committed ones
+func (bp *bufferPool) discard() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	for i := range bp.frames {
+		if f := &bp.frames[i]; f.dirty {
+			delete(bp.table, f.ptr)
+			f.valid, f.dirty = false, false
+		}
+	}
+}
+
+// use the buffer pool instead of the mmap, after loadPageSize()
+func (db *KV) openPool() error {
+	fi, err := db.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size()%int64(db.PageSize()) != 0 {
+		return fmt.Errorf("the file size %d is not a multiple of the page size", fi.Size())
+	}
+	db.mmap.file = int(fi.Size())
+	db.pool = newBufferPool(db.fp, db.PageSize(), db.crypt, db.Options.PageCache, db.Options.Metrics)
+	return nil
+}
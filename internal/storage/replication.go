@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// replication, shipping the committed pages to followers.
+// the B-tree is copy-on-write: a commit writes new pages, then the master
+// page, and a written page doesn't change (the freed pages are not reused).
+// so a commit is its page set, the nodes written and the new root, and a
+// follower applying the page sets of the primary in order has the same
+// pages at the same page numbers.
+// a follower starts from a base backup: the live pages of a snapshot at
+// their page numbers, written to a new file that replaces its own.
+// the updates that rewrite pages in place (vacuum, rekey) or write pages
+// outside of the commit (a bulk load) are shipped as a reset, the
+// followers take a new base backup.
+// the nodes are shipped decrypted, a follower has its own key, if any.
+// the network protocol is in pkg/api.
+
+// a commit shipped to the followers
+type PageSet struct {
+	Root  uint64            // the new root
+	Used  uint64            // the new number of pages
+	Pages map[uint64][]byte // the nodes written, by page number
+	Reset bool              // can't be applied, start over from a base backup
+}
+
+// receives the page sets of the commits in commit order, with the KV
+// serialized. it must not block or keep the DB busy.
+type CommitHook func(ps *PageSet)
+
+// ship the commits to `hook`, nil to stop.
+// serialized like the updates.
+func (db *KV) ShipCommits(hook CommitHook) {
+	db.repl.hook = hook
+	db.repl.reset = false
+}
+
+// the page set of the commit being flushed, after WritePages
+func (db *KV) commitPages() *PageSet {
+	if db.repl.hook == nil {
+		return nil
+	}
+	ps := &PageSet{Pages: map[uint64][]byte{}}
+	for ptr, page := range db.page.updates {
+		if page != nil {
+			ps.Pages[ptr] = page // not modified after the commit
+		}
+	}
+	return ps
+}
+
+// ship a page set after the master page is stored
+func (db *KV) shipCommit(ps *PageSet) {
+	if ps == nil {
+		return
+	}
+	ps.Root, ps.Used = db.tree.root, db.page.flushed
+	if db.repl.reset {
+		ps.Pages, ps.Reset = nil, true
+		db.repl.reset = false
+	}
+	db.repl.hook(ps)
+}
+
+// the followers start over after the pages changed outside of a commit
+func (db *KV) shipReset() {
+	if db.repl.hook != nil {
+		db.repl.hook(&PageSet{Root: db.tree.root, Used: db.page.flushed, Reset: true})
+		db.repl.reset = false
+	}
+}
+
+// refuse the updates of a follower, see Options.ReadOnly
+func (db *KV) writable() error {
+	if db.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// apply a page set of the primary on a follower.
+// the pages are written before the master page, like a commit.
+func (db *KV) ApplyPages(ps *PageSet) error {
+	if db.tx.active {
+		return ErrTxActive
+	}
+	if ps.Reset {
+		return errors.New("replica: a reset can't be applied")
+	}
+	if ps.Used < 1 || (ps.Root != 0 && ps.Root >= ps.Used) {
+		return fmt.Errorf("replica: bad root %d, used %d", ps.Root, ps.Used)
+	}
+	for ptr, node := range ps.Pages {
+		if ptr == 0 || ptr >= ps.Used || len(node) != db.nodeSize() {
+			return fmt.Errorf("replica: bad page %d of %d bytes", ptr, len(node))
+		}
+	}
+	if err := db.extend(int(ps.Used)); err != nil {
+		return err
+	}
+	for ptr, node := range ps.Pages {
+		if err := db.pageWrite(ptr, node); err != nil {
+			return err
+		}
+	}
+	if err := db.writeBack(); err != nil {
+		return err
+	}
+	if db.Options.SyncMode != SYNC_OFF {
+		if err := db.fsync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	db.tree.root, db.page.flushed = ps.Root, ps.Used
+	db.expiry.checked = false // the primary may have set some
+	if err := MasterStore(db); err != nil {
+		return err
+	}
+	if db.Options.SyncMode == SYNC_FULL {
+		if err := db.fsync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	db.Options.Metrics.pagesWritten(len(ps.Pages))
+	db.Options.Metrics.flushed(db)
+	return nil
+}
+
+// the root and the number of pages of the snapshot
+func (snap *Snapshot) Root() (root uint64, used uint64) {
+	return snap.root, snap.used
+}
+
+// call `fn` with the live pages of the snapshot at their page numbers,
+// a base backup for a follower. the nodes are only valid during the call.
+func (snap *Snapshot) Pages(fn func(ptr uint64, node []byte) error) error {
+	if snap.closed {
+		return errors.New("replica: the snapshot is closed")
+	}
+	if snap.root == 0 {
+		return nil
+	}
+	queue := []uint64{snap.root}
+	for len(queue) > 0 {
+		ptr := queue[0]
+		queue = queue[1:]
+		node := snap.page(ptr)
+		if node.Btype() == BNODE_NODE {
+			for i := uint16(0); i < node.Nkeys(); i++ {
+				queue = append(queue, node.GetPtr(i))
+			}
+		}
+		if err := fn(ptr, node.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the pages of a base backup applied at once
+const BASE_BATCH = 1024
+
+// a base backup received by a follower, written to a new file next to the
+// database. see DB.ReplaceWithBase.
+type Base struct {
+	kv    *KV
+	used  uint64
+	pages map[uint64][]byte
+}
+
+// start a base backup of a primary with this page and node size,
+// they differ when the primary is encrypted. so does the node size of
+// the follower, it must match.
+func (db *DB) NewBase(pageSize int, nodeSize int, used uint64) (*Base, error) {
+	path := db.Path + ".base"
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	opts := db.Options
+	opts.PageSize, opts.ReadOnly, opts.Metrics = pageSize, false, nil
+	b := &Base{kv: &KV{Path: path, Options: opts}, used: used, pages: map[uint64][]byte{}}
+	if err := b.kv.open(); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("replica: %w", err)
+	}
+	if b.kv.nodeSize() != nodeSize {
+		b.Abort()
+		return nil, fmt.Errorf("replica: the node size %d differs from %d on the primary, "+
+			"both must be encrypted or neither", b.kv.nodeSize(), nodeSize)
+	}
+	return b, nil
+}
+
+// add a page of the base backup
+func (b *Base) Add(ptr uint64, node []byte) error {
+	b.pages[ptr] = append([]byte(nil), node...)
+	if len(b.pages) < BASE_BATCH {
+		return nil
+	}
+	// an empty tree until the last batch
+	return b.apply(0)
+}
+
+func (b *Base) apply(root uint64) error {
+	err := b.kv.ApplyPages(&PageSet{Root: root, Used: b.used, Pages: b.pages})
+	b.pages = map[uint64][]byte{}
+	return err
+}
+
+// write the last pages and the root of the base backup
+func (b *Base) Finish(root uint64) error {
+	if err := b.apply(root); err != nil {
+		return err
+	}
+	return b.kv.close()
+}
+
+// drop an unfinished base backup
+func (b *Base) Abort() {
+	if b.kv.fp != nil {
+		b.kv.close()
+	}
+	os.Remove(b.kv.Path)
+}
+
+// replace the database file with a finished base backup
+func (db *DB) ReplaceWithBase(b *Base) error {
+	if db.kv.tx.active {
+		return ErrTxActive
+	}
+	if n := db.kv.snapshots.Load(); n > 0 {
+		return fmt.Errorf("replica: %w: %d open", ErrSnapshotOpen, n)
+	}
+	if err := db.kv.close(); err != nil {
+		return err
+	}
+	// the caches are from the old file
+	db.tables = nil
+	db.seqs = nil
+	db.keyspaces = nil
+	db.resetChanges()
+	if err := os.Rename(b.kv.Path, db.Path); err != nil {
+		os.Remove(b.kv.Path)
+		return errors.Join(err, db.kv.open())
+	}
+	db.kv.expiry.checked = false
+	return db.kv.open()
+}
+
+// apply a page set of the primary, see KV.ApplyPages
+func (db *DB) ApplyPages(ps *PageSet) error {
+	if err := db.kv.ApplyPages(ps); err != nil {
+		return err
+	}
+	// the schemas, sequences and keyspaces may have changed
+	db.tables = nil
+	db.seqs = nil
+	db.keyspaces = nil
+	db.resetChanges()
+	return nil
+}
+
+// ship the commits, see KV.ShipCommits
+func (db *DB) ShipCommits(hook CommitHook) {
+	db.kv.ShipCommits(hook)
+}
+
+// the page size and the node size of the snapshot's file
+func (snap *Snapshot) Sizes() (page int, node int) {
+	return snap.kv.PageSize(), snap.kv.nodeSize()
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// sequences are stored in @meta under the key "seq:<name>".
+// the stored value is the upper bound of the values reserved so far,
+// values below it may have been handed out before a crash,
+// so a reopened DB continues from the bound and never goes backwards.
+// reserving values in batches keeps @meta writes off the hot path.
+const SEQ_BATCH = 128
+
+// the @meta key prefix for sequences
+const SEQ_META_PREFIX = "seq:"
+
+// in-memory state of a sequence
+type sequence struct {
+	next  int64 // the next value to hand out
+	limit int64 // values in [next, limit) are reserved
+	curr  int64 // the last value handed out
+	used  bool  // curr is valid
+}
+
+// the sequence backing an AUTOINCREMENT primary key
+func AutoSeqName(tdef *TableDef) string {
+	return "@auto:" + tdef.Name
+}
+
+func seqMetaKey(name string) *Record {
+	return (&Record{}).AddStr("key", []byte(SEQ_META_PREFIX+name))
+}
+
+// the sequences and the value each continues from after a reopen
+func (db *DB) Sequences() (map[string]int64, error) {
+	sc := Scanner{
+		Cmp1: CMP_GE, Key1: *(&Record{}).AddStr("key", []byte(SEQ_META_PREFIX)),
+		Cmp2: CMP_LE,
+	}
+	if err := DbScan(db, TDEF_META, &sc); err != nil {
+		return nil, err
+	}
+	seqs := map[string]int64{}
+	for rec := (Record{}); sc.Valid(); sc.Next() {
+		sc.Deref(&rec)
+		key := string(rec.Get("key").Str)
+		if !strings.HasPrefix(key, SEQ_META_PREFIX) {
+			break
+		}
+		seqs[key[len(SEQ_META_PREFIX):]] = int64(binary.LittleEndian.Uint64(rec.Get("val").Str))
+	}
+	return seqs, nil
+}
+
+// ALTER SEQUENCE ... RESTART: the next NEXTVAL returns `next`
+func (db *DB) SequenceRestart(name string, next int64) error {
+	if _, err := getSequence(db, name); err != nil {
+		return err
+	}
+	delete(db.seqs, name) // reloaded from the new bound
+	return seqStore(db, name, next)
+}
+
+// create a sequence, the first NEXTVAL returns `start`
+func (db *DB) SequenceNew(name string, start int64) error {
+	if name == "" {
+		return fmt.Errorf("sequence name is empty")
+	}
+	meta := seqMetaKey(name)
+	ok, err := DbGet(db, TDEF_META, meta)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("sequence exists: %s", name)
+	}
+	return seqStore(db, name, start)
+}
+
+// persist the reserved upper bound of a sequence
+func seqStore(db *DB, name string, limit int64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(limit))
+	meta := seqMetaKey(name).AddStr("val", buf[:])
+	_, err := DbUpdate(db, TDEF_META, *meta, MODE_UPSERT)
+	return err
+}
+
+// get the sequence state, loading it from @meta on first use
+func getSequence(db *DB, name string) (*sequence, error) {
+	seq, ok := db.seqs[name]
+	if ok {
+		return seq, nil
+	}
+	meta := seqMetaKey(name)
+	ok, err := DbGet(db, TDEF_META, meta)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("sequence not found: %s", name)
+	}
+	limit := int64(binary.LittleEndian.Uint64(meta.Get("val").Str))
+	seq = &sequence{next: limit, limit: limit}
+	if db.seqs == nil {
+		db.seqs = map[string]*sequence{}
+	}
+	db.seqs[name] = seq
+	return seq, nil
+}
+
+// NEXTVAL: advance the sequence and return the new value
+func (db *DB) NextVal(name string) (int64, error) {
+	seq, err := getSequence(db, name)
+	if err != nil {
+		return 0, err
+	}
+	if seq.next >= seq.limit {
+		// reserve the next batch before handing out any of it
+		if err := seqStore(db, name, seq.next+SEQ_BATCH); err != nil {
+			return 0, err
+		}
+		seq.limit = seq.next + SEQ_BATCH
+	}
+	seq.curr, seq.used = seq.next, true
+	seq.next++
+	return seq.curr, nil
+}
+
+// CURRVAL: the value most recently returned by NEXTVAL on this DB
+func (db *DB) CurrVal(name string) (int64, error) {
+	seq, err := getSequence(db, name)
+	if err != nil {
+		return 0, err
+	}
+	if !seq.used {
+		return 0, fmt.Errorf("currval of sequence %s is not yet defined", name)
+	}
+	return seq.curr, nil
+}
+
+// assign the primary key of an AUTOINCREMENT table if it's omitted.
+// the assigned key is added to the record.
+func assignAutoKey(db *DB, tdef *TableDef, rec *Record) error {
+	if !tdef.AutoIncrement || rec.Get(tdef.Cols[0]) != nil {
+		return nil
+	}
+	id, err := db.NextVal(AutoSeqName(tdef))
+	if err != nil {
+		return err
+	}
+	rec.AddInt64(tdef.Cols[0], id)
+	return nil
+}
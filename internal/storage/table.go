@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	u "github.com/Ricky004/dungeonDB/internal/utils"
 )
@@ -40,10 +41,14 @@ type Record struct {
 }
 
 type DB struct {
-	Path string
+	Path    string
+	Options Options // passed to the KV
 	// internals
-	kv     KV
-	tables map[string]*TableDef // table name -> table definition
+	kv        KV
+	tables    map[string]*TableDef // table name -> table definition
+	seqs      map[string]*sequence // sequence name -> reserved values
+	keyspaces map[string]*Keyspace // keyspace name -> prefix
+	changes   changelog            // the row changes, see changelog.go
 }
 
 // table definition
@@ -54,9 +59,21 @@ type TableDef struct {
 	Cols    []string   // column names
 	Pkeys   int        // the first pkeys columns are primary keys
 	Indexes [][]string // secondary indexes
+	// column constraints, indexed like Cols. nil slices mean no constraints.
+	Defaults []*Value // default values for omitted columns
+	NotNull  []bool   // reject omitted columns without a default
+	Checks   []string // simple CHECK expressions, e.g. "age >= 0"
+	// the int64 primary key is assigned from a sequence if omitted
+	AutoIncrement bool
+	// the codec of the non-key values: "", "none" or "flate", see codec.go
+	Compression string
+	// the int64 column with the expiry of a row in Unix milliseconds, see expiry.go
+	TTL string
 	// auto-assigned B-tree key prefixes for different tables
 	Prefix        uint32
 	IndexPrefixes []uint32
+	// internal
+	checks []checkExpr // parsed Checks
 }
 
 // internal table: metadata
@@ -77,15 +94,58 @@ var TDEF_TABLE = &TableDef{
 	Pkeys:  1,
 }
 
+// open the underlying KV store
+func (db *DB) Open() error {
+	db.kv.Path = db.Path
+	db.kv.Options = db.Options
+	return db.kv.open()
+}
+
+func (db *DB) Close() error {
+	return db.kv.close()
+}
+
+// get the table definition by name, nil if not found
+func (db *DB) GetTableDef(name string) *TableDef {
+	return getTableDef(db, name)
+}
+
+// list the table definitions stored in @table, ordered by name
+func (db *DB) TableDefs() ([]*TableDef, error) {
+	sc := Scanner{Cmp1: CMP_GE, Cmp2: CMP_LE}
+	if err := DbScan(db, TDEF_TABLE, &sc); err != nil {
+		return nil, err
+	}
+	defs := []*TableDef{}
+	for rec := (Record{}); sc.Valid(); sc.Next() {
+		sc.Deref(&rec)
+		tdef := &TableDef{}
+		if err := json.Unmarshal(rec.Get("def").Str, tdef); err != nil {
+			return nil, err
+		}
+		defs = append(defs, tdef)
+	}
+	return defs, nil
+}
+
 func (rec *Record) AddStr(key string, val []byte) *Record {
-	return nil
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_BYTES, Str: val})
+	return rec
 }
 
 func (rec *Record) AddInt64(key string, val int64) *Record {
-	return nil
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{Type: TYPE_INT64, I64: val})
+	return rec
 }
 
 func (rec *Record) Get(key string) *Value {
+	for i, c := range rec.Cols {
+		if c == key {
+			return &rec.Vals[i]
+		}
+	}
 	return nil
 }
 
@@ -93,7 +153,7 @@ func (rec *Record) Get(key string) *Value {
 func (db *DB) Get(table string, rec *Record) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return DbGet(db, tdef, rec)
 }
@@ -102,14 +162,23 @@ func (db *DB) Get(table string, rec *Record) (bool, error) {
 func (db *DB) Set(table string, rec Record, mode int) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return DbUpdate(db, tdef, rec, mode)
 }
 
-// insert a record
-func (db *DB) Insert(table string, rec Record) (bool, error) {
-	return db.Set(table, rec, MODE_INSERT_ONLY)
+// insert a record.
+// the primary key of an AUTOINCREMENT table can be omitted,
+// the assigned key is then added to the record.
+func (db *DB) Insert(table string, rec *Record) (bool, error) {
+	tdef := getTableDef(db, table)
+	if tdef == nil {
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	if err := assignAutoKey(db, tdef, rec); err != nil {
+		return false, err
+	}
+	return DbUpdate(db, tdef, *rec, MODE_INSERT_ONLY)
 }
 
 // update a record
@@ -126,7 +195,7 @@ func (db *DB) Upsert(table string, rec Record) (bool, error) {
 func (db *DB) Delete(table string, rec Record) (bool, error) {
 	tdef := getTableDef(db, table)
 	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+		return false, fmt.Errorf("%w: %s", ErrTableNotFound, table)
 	}
 	return DbDelete(db, tdef, rec)
 }
@@ -140,42 +209,65 @@ func (db *DB) TableNew(tdef *TableDef) error {
 	ok, err := DbGet(db, TDEF_TABLE, table)
 	u.Assert(err == nil)
 	if ok {
-		return fmt.Errorf("table exists: %s", tdef.Name)
+		return fmt.Errorf("%w: %s", ErrTableExists, tdef.Name)
 	}
 
-	// allocate a new prefix
-	u.Assert(tdef.Prefix == 0)
-	tdef.Prefix = TABLE_PREFIX_MIN
-	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = DbGet(db, TDEF_META, meta)
-	u.Assert(err == nil)
-	if ok {
-		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		u.Assert(tdef.Prefix > TABLE_PREFIX_MIN)
-	} else {
-		meta.AddStr("val", make([]byte, 4))
+	// allocate the prefixes of the table and its indexes
+	if tdef.Prefix != 0 || tdef.IndexPrefixes != nil {
+		return fmt.Errorf("table %s: the prefixes are assigned by TableNew", tdef.Name)
+	}
+	tdef.Prefix, err = allocPrefixes(db, 1+uint32(len(tdef.Indexes)))
+	if err != nil {
+		return err
 	}
 	for i := range tdef.Indexes {
 		prefix := tdef.Prefix + 1 + uint32(i)
 		tdef.IndexPrefixes = append(tdef.IndexPrefixes, prefix)
 	}
 
-	// update the next prefix
-	ntree := 1 + uint32(len(tdef.Indexes))
-	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+ntree)
-	_, err = DbUpdate(db, TDEF_META, *meta, 0)
-	if err != nil {
-		return err
+	// the sequence for the AUTOINCREMENT primary key
+	if tdef.AutoIncrement {
+		if err := db.SequenceNew(AutoSeqName(tdef), 1); err != nil {
+			return err
+		}
 	}
 
 	// store the definition
+	if err := putTableDef(db, tdef); err != nil {
+		return err
+	}
+	db.kv.log().Info("table created", "table", tdef.Name, "prefix", tdef.Prefix)
+	return nil
+}
+
+// store a table definition in @table
+func putTableDef(db *DB, tdef *TableDef) error {
 	val, err := json.Marshal(tdef)
 	u.Assert(err == nil)
-	table.AddStr("def", val)
+	table := (&Record{}).AddStr("name", []byte(tdef.Name)).AddStr("def", val)
 	_, err = DbUpdate(db, TDEF_TABLE, *table, 0)
 	return err
 }
 
+// allocate `n` consecutive B-tree key prefixes, returns the first one
+func allocPrefixes(db *DB, n uint32) (uint32, error) {
+	prefix := uint32(TABLE_PREFIX_MIN)
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err := DbGet(db, TDEF_META, meta)
+	u.Assert(err == nil)
+	if ok {
+		prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+		u.Assert(prefix > TABLE_PREFIX_MIN)
+	} else {
+		meta.AddStr("val", make([]byte, 4))
+	}
+
+	// update the next prefix
+	binary.LittleEndian.PutUint32(meta.Get("val").Str, prefix+n)
+	_, err = DbUpdate(db, TDEF_META, *meta, 0)
+	return prefix, err
+}
+
 // check the table definition
 func tableDefCheck(tdef *TableDef) error {
 	// verify the table definition
@@ -188,6 +280,30 @@ func tableDefCheck(tdef *TableDef) error {
 	if len(tdef.Types) != len(tdef.Cols) {
 		return fmt.Errorf("number of types does not match number of columns")
 	}
+	if tdef.Pkeys < 1 || tdef.Pkeys > len(tdef.Cols) {
+		return fmt.Errorf("table %s: bad number of primary key columns %d", tdef.Name, tdef.Pkeys)
+	}
+	for i, col := range tdef.Cols {
+		if col == "" || indexOf(tdef.Cols[:i], col) >= 0 {
+			return fmt.Errorf("table %s: empty or duplicate column name %q", tdef.Name, col)
+		}
+		if typ := tdef.Types[i]; typ != TYPE_INT64 && typ != TYPE_BYTES {
+			return fmt.Errorf("table %s: column %s: bad type %d", tdef.Name, col, typ)
+		}
+	}
+	if tdef.AutoIncrement && (tdef.Pkeys != 1 || tdef.Types[0] != TYPE_INT64) {
+		return fmt.Errorf("table %s: AUTOINCREMENT requires a single int64 primary key", tdef.Name)
+	}
+	if err := checkCodec(tdef.Compression); err != nil {
+		return fmt.Errorf("table %s: %w", tdef.Name, err)
+	}
+	if i := colIndex(tdef, tdef.TTL); tdef.TTL != "" && (i < 0 || tdef.Types[i] != TYPE_INT64) {
+		return fmt.Errorf("table %s: the TTL column %s is not an int64 column", tdef.Name, tdef.TTL)
+	}
+	// verify the constraints
+	if err := constraintDefCheck(tdef); err != nil {
+		return err
+	}
 	// verify the indexes
 	for i, index := range tdef.Indexes {
 		index, err := CheckIndexKeys(tdef, index)
@@ -229,13 +345,13 @@ func getTableDefDB(db *DB, name string) *TableDef {
 
 // get a single row by primary key
 func DbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
-	values, err := checkRecord(tdef, *rec, tdef.Pkeys)
+	values, err := checkKey(tdef, *rec)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
-	val, ok := db.kv.GetW(key)
+	val, ok := db.kv.get(key)
 	if !ok {
 		return false, nil
 	}
@@ -243,7 +359,10 @@ func DbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 	for i := tdef.Pkeys; i < len(tdef.Cols); i++ {
 		values[i].Type = tdef.Types[i]
 	}
-	decodeValues(val, values[tdef.Pkeys:])
+	decodeRow(tdef, val, values[tdef.Pkeys:])
+	if rowExpired(tdef, values, nowMillis()) {
+		return false, nil
+	}
 
 	rec.Cols = append(rec.Cols, tdef.Cols[tdef.Pkeys:]...)
 	rec.Vals = append(rec.Vals, values[tdef.Pkeys:]...)
@@ -252,12 +371,36 @@ func DbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
 
 // add a row to the table
 func DbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
-	values, err := checkRecord(tdef, rec, len(tdef.Cols))
+	values, err := checkRecord(tdef, rec, tdef.Pkeys)
 	if err != nil {
 		return false, err
 	}
+	// an update keeps the stored values of the omitted columns
+	if mode != MODE_INSERT_ONLY && partialRow(tdef, values) {
+		if !mergeStored(db, tdef, values) && mode == MODE_UPDATE_ONLY {
+			return false, nil // no row to update
+		}
+	}
+	// fill in the defaults and validate the row
+	if err := applyConstraints(tdef, values); err != nil {
+		return false, err
+	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.Pkeys])
-	val := EncodeValues(nil, values[tdef.Pkeys:])
+	val := encodeRow(tdef, values[tdef.Pkeys:])
+	if err := checkRowSize(db, tdef, key, val, values); err != nil {
+		return false, err
+	}
+	if tdef.TTL != "" {
+		// an expired row is replaced like an absent one
+		if rowExpiry(tdef, values) > 0 {
+			if err := db.kv.checkExpiryKey(key); err != nil {
+				return false, err
+			}
+		}
+		if err := dropExpiredRow(db, tdef, key); err != nil {
+			return false, err
+		}
+	}
 	req := InsertReq{
 		Key:  key,
 		Val:  val,
@@ -265,25 +408,63 @@ func DbUpdate(db *DB, tdef *TableDef, rec Record, mode int) (bool, error) {
 	}
 
 	// Call the B-tree update function and check if the record was added
-	added, err := db.kv.UpdateW(&req)
-	if err != nil || !req.Updated || len(tdef.Indexes) == 0 {
+	added, err := db.kv.update(&req)
+	op := CHANGE_UPDATE
+	if req.Added {
+		op = CHANGE_INSERT
+	}
+	if err == nil && req.Updated && tdef.Prefix >= TABLE_PREFIX_MIN {
+		db.kv.Options.Metrics.rowOp(tdef.Name, op)
+	}
+	if err != nil || !req.Updated {
+		return added, err
+	}
+
+	// the full rows, the caller's record may have omitted defaulted columns
+	row := append([]Value{}, values...)
+	var old []Value
+	if !req.Added && (db.recordsChanges(tdef) || len(tdef.Indexes) > 0 || tdef.TTL != "") {
+		old = storedRow(tdef, values, req.Old)
+	}
+	if err := updateRowExpiry(db, tdef, key, old, row); err != nil {
+		return added, err
+	}
+	if err := recordChange(db, tdef, op, old, row); err != nil {
 		return added, err
 	}
 
 	// maintain the indexes
-	if req.Updated && !req.Added {
-		decodeValues(req.Old, values[tdef.Pkeys:]) // decode the old values
-		indexOP(db, tdef, Record{tdef.Cols, values}, INDEX_DEL)
+	if len(tdef.Indexes) == 0 {
+		return added, nil
 	}
-	if req.Updated {
-		indexOP(db, tdef, rec, INDEX_ADD)
+	if old != nil {
+		indexOP(db, tdef, Record{tdef.Cols, old}, INDEX_DEL)
 	}
+	indexOP(db, tdef, Record{tdef.Cols, row}, INDEX_ADD)
 	return added, nil
 }
 
+// check an encoded row and its index keys against the B-tree limits
+func checkRowSize(db *DB, tdef *TableDef, key []byte, val []byte, values []Value) error {
+	if len(key) > db.kv.MaxKeySize() || len(val) > db.kv.MaxValSize() {
+		return fmt.Errorf("the row is too large, %d key bytes and %d value bytes", len(key), len(val))
+	}
+	irec := make([]Value, len(tdef.Cols))
+	for i, cols := range tdef.Indexes {
+		for j, c := range cols {
+			irec[j] = values[colIndex(tdef, c)]
+		}
+		ikey := encodeKey(nil, tdef.IndexPrefixes[i], irec[:len(cols)])
+		if len(ikey) > db.kv.MaxKeySize() {
+			return fmt.Errorf("the key of index %d is too large, %d bytes", i, len(ikey))
+		}
+	}
+	return nil
+}
+
 // delete a record by its primary key
 func DbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
-	values, err := checkRecord(tdef, rec, tdef.Pkeys)
+	values, err := checkKey(tdef, rec)
 	if err != nil {
 		return false, err
 	}
@@ -292,16 +473,33 @@ func DbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
 		Key: key,
 	}
 	// Call the B-tree delete function
-	deleted, err := db.kv.DelW(&req)
-	if err != nil || !deleted || len(tdef.Indexes) == 0 {
+	deleted, err := db.kv.del(&req)
+	if err == nil && deleted && tdef.Prefix >= TABLE_PREFIX_MIN {
+		db.kv.Options.Metrics.rowOp(tdef.Name, "delete")
+	}
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	// the full row, for the indexes and the changelog
+	var old []Value
+	if db.recordsChanges(tdef) || len(tdef.Indexes) > 0 || tdef.TTL != "" {
+		old = storedRow(tdef, values, req.Old)
+	}
+	if err := updateRowExpiry(db, tdef, key, old, nil); err != nil {
 		return deleted, err
 	}
+	if err := recordChange(db, tdef, CHANGE_DELETE, old, nil); err != nil {
+		return deleted, err
+	}
+	// an expired row was already absent
+	live := !rowExpired(tdef, old, nowMillis())
+	if len(tdef.Indexes) == 0 {
+		return live, nil
+	}
 
 	// maintain the indexes
-	if deleted {
-		indexOP(db, tdef, rec, INDEX_DEL)
-	}
-	return true, nil
+	indexOP(db, tdef, Record{tdef.Cols, old}, INDEX_DEL)
+	return live, nil
 }
 
 // indexOf returns the index of the first occurrence of str in slice, or -1 if not present.
@@ -335,11 +533,34 @@ func checkRecord(tdef *TableDef, rec Record, n int) ([]Value, error) {
 			return nil,
 				fmt.Errorf("column %s not found in table %s", key, tdef.Name)
 		}
+		if indexOf(rec.Cols[:i], key) >= 0 {
+			return nil, fmt.Errorf("duplicate column %s", key)
+		}
 		values[j] = rec.Vals[i]
 	}
 	return values, nil
 }
 
+// check a record that is exactly a primary key, of the column types
+func checkKey(tdef *TableDef, rec Record) ([]Value, error) {
+	values, err := checkRecord(tdef, rec, tdef.Pkeys)
+	if err != nil {
+		return nil, err
+	}
+	for i, col := range tdef.Cols {
+		switch {
+		case i >= tdef.Pkeys && values[i].Type != TYPE_ERROR:
+			return nil, fmt.Errorf("table %s: column %s is not in the primary key", tdef.Name, col)
+		case i < tdef.Pkeys && values[i].Type == TYPE_ERROR:
+			return nil, fmt.Errorf("table %s: primary key column %s is missing", tdef.Name, col)
+		case i < tdef.Pkeys && values[i].Type != tdef.Types[i]:
+			return nil, fmt.Errorf("table %s: column %s: got %s, expected %s",
+				tdef.Name, col, typeName(values[i].Type), typeName(tdef.Types[i]))
+		}
+	}
+	return values, nil
+}
+
 // for primary keys
 func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 	var buf [4]byte
@@ -376,17 +597,18 @@ func EncodeValues(out []byte, vals []Value) []byte {
 func EscapeString(in []byte) []byte {
 	zeros := bytes.Count(in, []byte{0})
 	ones := bytes.Count(in, []byte{1})
-	if zeros+ones == 0 {
+	high := len(in) > 0 && in[0] >= 0xfe
+	if zeros+ones == 0 && !high {
 		return in
 	}
 
-	out := make([]byte, len(in)+zeros+ones)
+	out := make([]byte, len(in)+zeros+ones+1)
 	pos := 0
-	if len(in) > 0 && in[0] >= 0xfe {
-       out[0] = 0xfe
-	   out[1] = in[0]
-	   pos += 2
-	   in = in[1:]     
+	if high {
+		out[0] = 0xfe
+		out[1] = in[0]
+		pos += 2
+		in = in[1:]
 	}
 
 	for _, ch := range in {
@@ -399,18 +621,60 @@ func EscapeString(in []byte) []byte {
 			pos += 1
 		}
 	}
+	return out[:pos]
+}
+
+// the reverse of EscapeString()
+func unescapeString(in []byte) []byte {
+	if bytes.IndexByte(in, 1) < 0 && (len(in) == 0 || in[0] != 0xfe) {
+		return in
+	}
+	out := make([]byte, 0, len(in))
+	if in[0] == 0xfe {
+		out = append(out, in[1])
+		in = in[2:]
+	}
+	for i := 0; i < len(in); i++ {
+		if in[i] == 0x01 {
+			i++
+			out = append(out, in[i]-1)
+		} else {
+			out = append(out, in[i])
+		}
+	}
 	return out
 }
 
 // for decode values from bytes
+// the types of the values are taken from `out`
 func decodeValues(in []byte, out []Value) {
-
+	for i := range out {
+		switch out[i].Type {
+		case TYPE_INT64:
+			u.Assert(len(in) >= 8)
+			x := binary.BigEndian.Uint64(in[:8])
+			out[i].I64 = int64(x - (1 << 63))
+			in = in[8:]
+		case TYPE_BYTES:
+			idx := bytes.IndexByte(in, 0)
+			u.Assert(idx >= 0)
+			// copied, the input can be a mapped page that is reused later
+			out[i].Str = append([]byte{}, unescapeString(in[:idx])...)
+			in = in[idx+1:]
+		default:
+			panic("bad type")
+		}
+	}
+	u.Assert(len(in) == 0)
 }
 
 func CheckIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 	icols := map[string]bool{}
 	for _, c := range index {
 		// check the index columns
+		if colIndex(tdef, c) < 0 {
+			return nil, fmt.Errorf("index column %s not found in table %s", c, tdef.Name)
+		}
 		if _, ok := icols[c]; ok {
 			return nil, fmt.Errorf("duplicate index column: %s", c)
 		}
@@ -422,7 +686,11 @@ func CheckIndexKeys(tdef *TableDef, index []string) ([]string, error) {
 			index = append(index, c)
 		}
 	}
-	u.Assert(len(index) < len(tdef.Cols))
+	if len(index) >= len(tdef.Cols) {
+		// the index key would be the whole row, there's nothing to look up
+		return nil, fmt.Errorf("table %s: the index (%s) covers all the columns",
+			tdef.Name, strings.Join(index, ", "))
+	}
 	return index, nil
 }
 
@@ -494,7 +762,7 @@ loop:
 	case TYPE_INT64:
 		out = append(out, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
 	default:
-		fmt.Errorf("what?")
+		panic("what?")
 	}
    }
    return out
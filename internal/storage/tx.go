@@ -0,0 +1,59 @@
+package storage
+
+// DB-level transactions.
+// the B-tree is copy-on-write, so a transaction only has to keep the new
+// pages in memory (KV.page.updates) and defer FlushPages until the commit.
+// aborting restores the old root and drops the pending pages.
+// there is at most 1 transaction at a time, the caller serializes access.
+
+// start a transaction
+func (db *DB) Begin() error {
+	if db.kv.tx.active {
+		return ErrTxActive
+	}
+	db.kv.tx.active = true
+	db.kv.tx.root = db.kv.tree.root
+	return nil
+}
+
+// persist the updates of the transaction
+func (db *DB) Commit() error {
+	if !db.kv.tx.active {
+		return ErrNoTx
+	}
+	db.kv.tx.active = false
+	if err := db.kv.flush(); err != nil {
+		// the pending updates are dropped, so are the caches
+		db.tables = nil
+		db.seqs = nil
+		db.keyspaces = nil
+		db.resetChanges()
+		return err
+	}
+	db.publishChanges()
+	return nil
+}
+
+// discard the updates of the transaction
+func (db *DB) Abort() error {
+	if !db.kv.tx.active {
+		return ErrNoTx
+	}
+	db.kv.tx.active = false
+	db.kv.tree.root = db.kv.tx.root
+	db.kv.page.nfree = 0
+	db.kv.page.nappend = 0
+	db.kv.page.updates = map[uint64][]byte{}
+	db.kv.log().Debug("transaction aborted", "root", db.kv.tree.root)
+	// the cached schemas, sequence reservations and keyspaces may be rolled back
+	db.tables = nil
+	db.seqs = nil
+	db.keyspaces = nil
+	db.resetChanges()
+	return nil
+}
+
+// is a transaction in progress?
+func (db *DB) InTx() bool {
+	return db.kv.tx.active
+}
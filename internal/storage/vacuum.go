@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// VACUUM, shrinking the database file.
+// the freed pages are not reused (see FreeList) and the file only grows.
+// a full vacuum copies the keys into a new file, packed into nodes like a
+// bulk load, and renames it over the database file.
+// an incremental vacuum moves the live pages at the end of the file into
+// the unused pages before them, then truncates the file. a moved page is
+// written before the links to it are updated, and the old copy stays
+// intact until the master page is stored, so a crash leaves either copy.
+// both reopen the file, so they refuse to run while a snapshot reads the
+// old mappings.
+
+type VacuumOptions struct {
+	// move the pages within the file instead of rewriting it
+	Incremental bool
+	// full: the share of a node filled with keys, BULK_FILL_FACTOR if 0
+	FillFactor float64
+	// incremental: move at most this many pages, 0 for no limit
+	MaxPages int
+}
+
+// what a vacuum did
+type VacuumStats struct {
+	SizeBefore int64 // the file size in bytes
+	SizeAfter  int64
+	Pages      int // used pages after, including the master page
+	Moved      int // incremental: pages moved
+}
+
+// shrink the file, serialized like the updates
+func (db *KV) Vacuum(opts VacuumOptions) (stats VacuumStats, err error) {
+	if db.tx.active {
+		return stats, ErrTxActive
+	}
+	if err := db.writable(); err != nil {
+		return stats, err
+	}
+	if n := db.snapshots.Load(); n > 0 {
+		return stats, fmt.Errorf("vacuum: %w: %d open", ErrSnapshotOpen, n)
+	}
+	if opts.FillFactor == 0 {
+		opts.FillFactor = BULK_FILL_FACTOR
+	}
+	if !(opts.FillFactor > 0 && opts.FillFactor <= 1) {
+		return stats, fmt.Errorf("vacuum: bad fill factor %v", opts.FillFactor)
+	}
+	start := time.Now()
+	stats.SizeBefore = int64(db.mmap.file)
+	if opts.Incremental {
+		err = db.vacuumIncremental(opts.MaxPages, &stats)
+	} else {
+		err = db.vacuumFull(opts.FillFactor, db.Options.Key)
+	}
+	db.shipReset() // even after a failure, pages may have moved
+	if err != nil {
+		return stats, fmt.Errorf("vacuum: %w", err)
+	}
+	stats.SizeAfter = int64(db.mmap.file)
+	stats.Pages = int(db.page.flushed)
+	db.log().Info("vacuum", "path", db.Path, "incremental", opts.Incremental,
+		"size_before", stats.SizeBefore, "size_after", stats.SizeAfter,
+		"moved", stats.Moved, "duration", time.Since(start))
+	return stats, nil
+}
+
+// copy the keys into a new file, then replace the database file with it.
+// the copy is encrypted with `key`, which differs from the current key
+// for a rekey.
+func (db *KV) vacuumFull(fill float64, key []byte) error {
+	crypt := db.crypt
+	if !bytes.Equal(key, db.Options.Key) {
+		crypt = nil
+		if key != nil {
+			var err error
+			if crypt, err = newPageCrypt(key); err != nil {
+				return err
+			}
+		}
+	}
+	tmp := db.Path + ".vacuum"
+	fp, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if fp != nil {
+			fp.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	// the pages are appended in the order they are built,
+	// the master page goes first and is written last
+	page, nodeSize := db.PageSize(), db.PageSize()
+	if crypt != nil {
+		nodeSize -= CRYPT_OVERHEAD
+	}
+	w := bufio.NewWriterSize(fp, 16*page)
+	var werr error
+	used := uint64(1)
+	w.Write(make([]byte, page))
+	b := &bulkBuilder{page: nodeSize, limit: int(fill * float64(nodeSize)), prefix: db.tree.Prefix, new: func(node BNode) uint64 {
+		data := node.Data
+		if crypt != nil {
+			var err error
+			if data, err = crypt.sealNext(used, node.Data); err != nil && werr == nil {
+				werr = err
+			}
+		}
+		if _, err := w.Write(data); err != nil && werr == nil {
+			werr = err
+		}
+		used++
+		return used - 1
+	}}
+	root, keys := uint64(0), 0
+	if db.tree.root != 0 {
+		b.add(0, nil, nil, 0) // the sentinel key
+		src := &treeSource{iter: db.tree.SeekLE(nil)}
+		err := bulkMerge([]bulkSource{src}, func(key []byte, val []byte) error {
+			b.add(0, key, val, 0)
+			keys++
+			return werr
+		})
+		if err != nil {
+			return err
+		}
+		root = b.finish()
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if werr != nil {
+		return werr
+	}
+	if _, err := fp.WriteAt(masterPage(root, used, page, crypt), 0); err != nil {
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	err = fp.Close()
+	fp = nil
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// check the copy before it replaces the database
+	vstats, err := VerifyFileKey(tmp, key)
+	if err == nil && vstats.Keys != keys {
+		err = fmt.Errorf("the copy has %d keys instead of %d", vstats.Keys, keys)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := db.close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, db.Path); err != nil {
+		os.Remove(tmp)
+		return errors.Join(err, db.open())
+	}
+	db.Options.Key = key
+	return db.open()
+}
+
+// move the live pages at the end of the file into the unused ones
+func (db *KV) vacuumIncremental(maxPages int, stats *VacuumStats) error {
+	// the live pages and the links to them, the root has no parent
+	type link struct {
+		parent uint64
+		idx    uint16
+	}
+	links := map[uint64]link{}
+	if db.tree.root != 0 {
+		links[db.tree.root] = link{}
+		queue := []uint64{db.tree.root}
+		for len(queue) > 0 {
+			node := db.tree.Get(queue[0])
+			if node.Btype() == BNODE_NODE {
+				for i := uint16(0); i < node.Nkeys(); i++ {
+					links[node.GetPtr(i)] = link{queue[0], i}
+					queue = append(queue, node.GetPtr(i))
+				}
+			}
+			queue = queue[1:]
+		}
+	}
+
+	// pair the last live pages with the first unused ones
+	moved := map[uint64]uint64{}
+	lo, hi := uint64(1), db.page.flushed-1
+	for maxPages <= 0 || len(moved) < maxPages {
+		for _, ok := links[lo]; ok && lo < hi; _, ok = links[lo] {
+			lo++
+		}
+		for _, ok := links[hi]; !ok && hi > lo; _, ok = links[hi] {
+			hi--
+		}
+		if lo >= hi {
+			break
+		}
+		moved[hi] = lo
+		lo, hi = lo+1, hi-1
+	}
+	used := uint64(1)
+	for ptr := range links {
+		if dst, ok := moved[ptr]; ok {
+			ptr = dst
+		}
+		used = max(used, ptr+1)
+	}
+
+	// write the copies with their links updated, they are unreachable yet
+	for src, dst := range moved {
+		page := BNode{append([]byte(nil), db.pageRead(src).Data...)}
+		if page.Btype() == BNODE_NODE {
+			for i := uint16(0); i < page.Nkeys(); i++ {
+				if kid, ok := moved[page.GetPtr(i)]; ok {
+					page.SetPtr(i, kid)
+				}
+			}
+		}
+		if err := db.pageWrite(dst, page.Data); err != nil {
+			return err
+		}
+	}
+	if err := db.writeBack(); err != nil {
+		return err
+	}
+	if err := db.fsync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	db.Options.Metrics.pagesWritten(len(moved))
+
+	// link them from the pages that stay, both copies are identical
+	root := db.tree.root
+	for src, dst := range moved {
+		l := links[src]
+		if l.parent == 0 {
+			root = dst
+		} else if _, ok := moved[l.parent]; !ok {
+			parent := BNode{append([]byte(nil), db.pageRead(l.parent).Data...)}
+			parent.SetPtr(l.idx, dst)
+			if err := db.pageWrite(l.parent, parent.Data); err != nil {
+				return err
+			}
+		}
+	}
+	if err := db.writeBack(); err != nil {
+		return err
+	}
+	db.tree.root = root
+	db.page.flushed = used
+	if err := MasterStore(db); err != nil {
+		return err
+	}
+	if err := db.fsync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	stats.Moved = len(moved)
+
+	// cut the tail, the file is reopened to drop the mappings
+	if err := db.close(); err != nil {
+		return err
+	}
+	err := os.Truncate(db.Path, int64(used)*int64(db.PageSize()))
+	return errors.Join(err, db.open())
+}
+
+// DB-level wrapper, serialized by the caller like the other DB calls
+
+// shrink the file, see KV.Vacuum
+func (db *DB) Vacuum(opts VacuumOptions) (VacuumStats, error) {
+	return db.kv.Vacuum(opts)
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the change data capture stream of the HTTP/JSON API:
+//
+//	GET /changes?from=   the committed row changes, one JSON object per line
+//
+// the changes kept in the changelog are sent from the sequence number
+// `from` (the oldest kept if omitted), then the new ones as they are
+// committed, until the client disconnects. a consumer resumes from the
+// last seq it has seen + 1. a 410 if the changes since `from` were
+// dropped from the changelog, the consumer has to start over.
+//
+//	{"seq": 7, "table": "users", "op": "update", "key": {"id": 1},
+//	 "old": {"id": 1, "name": "ann"}, "new": {"id": 1, "name": "anne"}}
+
+// the changes buffered for a consumer before it's disconnected
+const CHANGES_QUEUE = 4096
+
+// a consumer of the live changes
+type watcher struct {
+	changes chan storage.Change
+	stop    chan struct{} // closed when it's dropped
+}
+
+// the change hook, called with the DB locked
+func (srv *Server) publishChanges(changes []storage.Change) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for wt := range srv.watchers {
+	send:
+		for _, ch := range changes {
+			select {
+			case wt.changes <- ch:
+			default:
+				// too far behind, it resumes from its last seq
+				srv.dropWatcher(wt)
+				break send
+			}
+		}
+	}
+}
+
+// called with srv.mu held
+func (srv *Server) dropWatcher(wt *watcher) {
+	if _, ok := srv.watchers[wt]; ok {
+		delete(srv.watchers, wt)
+		close(wt.stop)
+	}
+}
+
+type changeJSON struct {
+	Seq   uint64                 `json:"seq"`
+	Table string                 `json:"table"`
+	Op    string                 `json:"op"`
+	Key   map[string]interface{} `json:"key"`
+	Old   map[string]interface{} `json:"old,omitempty"`
+	New   map[string]interface{} `json:"new,omitempty"`
+}
+
+func writeChange(bw *bufio.Writer, ch *storage.Change) {
+	out := changeJSON{Seq: ch.Seq, Table: ch.Table, Op: ch.Op, Key: rowObject(ch.Key)}
+	if ch.Old != nil {
+		out.Old = rowObject(*ch.Old)
+	}
+	if ch.New != nil {
+		out.New = rowObject(*ch.New)
+	}
+	data, _ := json.Marshal(out)
+	bw.Write(data)
+	bw.WriteByte('\n')
+}
+
+// GET /changes?from=
+// the kept changes are read in batches with the DB unlocked between them,
+// the consumer is subscribed with the last batch, so no change is missed.
+func (srv *Server) httpChanges(w http.ResponseWriter, r *http.Request) {
+	if srv.DB.Options.Changelog <= 0 {
+		writeError(w, httpErrorf(http.StatusNotFound, "the changelog is disabled, see changelog_size"))
+		return
+	}
+	from := uint64(0)
+	if s := r.URL.Query().Get("from"); s != "" {
+		var err error
+		if from, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, fmt.Errorf("bad from: %q", s))
+			return
+		}
+	}
+
+	wt := &watcher{changes: make(chan storage.Change, CHANGES_QUEUE), stop: make(chan struct{})}
+	defer func() {
+		srv.mu.Lock()
+		srv.dropWatcher(wt)
+		srv.mu.Unlock()
+	}()
+	rc := http.NewResponseController(w)
+	bw := bufio.NewWriter(w)
+	for started := false; ; started = true {
+		batch := []storage.Change{}
+		live := false
+		err := srv.locked(func(db *storage.DB) error {
+			err := db.ChangesSince(from, func(ch *storage.Change) bool {
+				batch = append(batch, *ch)
+				return len(batch) < HTTP_SCAN_BATCH
+			})
+			if err != nil || len(batch) == HTTP_SCAN_BATCH {
+				return err
+			}
+			// caught up, the next changes are sent to the watcher
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if srv.done {
+				return ErrServerClosed
+			}
+			db.SubscribeChanges(srv.publishChanges)
+			srv.watchers[wt] = struct{}{}
+			live = true
+			return nil
+		})
+		if err != nil && !started {
+			if errors.Is(err, storage.ErrChangesGone) {
+				err = httpErrorf(http.StatusGone, "%v", err)
+			}
+			writeError(w, err)
+			return
+		}
+		if err != nil {
+			return // the status is already sent, the consumer resumes
+		}
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		for i := range batch {
+			writeChange(bw, &batch[i])
+			from = batch[i].Seq + 1
+		}
+		if bw.Flush() != nil || rc.Flush() != nil {
+			return // the client is gone
+		}
+		if live {
+			break
+		}
+	}
+
+	for {
+		select {
+		case ch := <-wt.changes:
+			writeChange(bw, &ch)
+			// the changes of a commit come together
+			for n := len(wt.changes); n > 0; n-- {
+				ch := <-wt.changes
+				writeChange(bw, &ch)
+			}
+			if bw.Flush() != nil || rc.Flush() != nil {
+				return
+			}
+		case <-wt.stop:
+			return // lagging or shutting down
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1 +1,577 @@
-package api
\ No newline at end of file
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the table types, usable outside of this module
+type Value = storage.Value
+type Record = storage.Record
+
+var (
+	ErrClientClosed = errors.New("api: client closed")
+	ErrTxDone       = errors.New("api: transaction has already been committed or rolled back")
+)
+
+// an error reported by the server, the connection is still usable
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return "dungeondb: " + e.Msg
+}
+
+// client options, zero values use the defaults
+type Options struct {
+	DialTimeout time.Duration // default 5s
+	MaxOpen     int           // max connections, default 16
+	MaxIdle     int           // max idle connections kept in the pool, default 4
+}
+
+// the client is safe for concurrent use.
+// each request takes a connection from the pool,
+// broken connections are dropped and replaced on the next request.
+type Client struct {
+	addr string
+	opts Options
+	sem  chan struct{} // 1 token per open connection
+	mu   sync.Mutex    // guards the fields below
+	idle []*conn
+	done bool
+}
+
+// a pooled connection
+type conn struct {
+	nc    net.Conn
+	rd    *bufio.Reader
+	wr    *bufio.Writer
+	bad   bool              // I/O error, don't reuse
+	stmts map[string]uint64 // sql -> prepared statement id
+}
+
+// the result of a statement without rows
+type Result struct {
+	Affected     int64
+	LastInsertID int64
+}
+
+// connect to a server, the connection is checked with a ping
+func Dial(ctx context.Context, addr string, opts *Options) (*Client, error) {
+	c := &Client{addr: addr}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.DialTimeout <= 0 {
+		c.opts.DialTimeout = 5 * time.Second
+	}
+	if c.opts.MaxOpen <= 0 {
+		c.opts.MaxOpen = 16
+	}
+	if c.opts.MaxIdle <= 0 {
+		c.opts.MaxIdle = 4
+	}
+	c.sem = make(chan struct{}, c.opts.MaxOpen)
+	if err := c.Ping(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// close the idle connections, the busy ones are closed when released
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// take a connection from the pool or dial a new one
+func (c *Client) acquire(ctx context.Context) (*conn, error) {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	if c.done {
+		c.mu.Unlock()
+		<-c.sem
+		return nil, ErrClientClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		<-c.sem
+		return nil, err
+	}
+	return &conn{
+		nc:    nc,
+		rd:    bufio.NewReader(nc),
+		wr:    bufio.NewWriter(nc),
+		stmts: map[string]uint64{},
+	}, nil
+}
+
+// return a connection to the pool
+func (c *Client) release(cn *conn) {
+	c.mu.Lock()
+	if cn.bad || c.done || len(c.idle) >= c.opts.MaxIdle {
+		cn.nc.Close()
+	} else {
+		c.idle = append(c.idle, cn)
+	}
+	c.mu.Unlock()
+	<-c.sem
+}
+
+// errors of a single round trip
+type ioError struct {
+	err     error
+	written bool // the request may have reached the server
+}
+
+func (e *ioError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ioError) Unwrap() error {
+	return e.err
+}
+
+// send a request and read the response.
+// a cancelled context interrupts the I/O and breaks the connection.
+func (cn *conn) roundTrip(ctx context.Context, typ byte, payload []byte) (byte, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = cn.nc.SetDeadline(deadline)
+	} else {
+		_ = cn.nc.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = cn.nc.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	fail := func(err error, written bool) (byte, []byte, error) {
+		cn.bad = true
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return 0, nil, &ioError{err: err, written: written}
+	}
+	if err := writeFrame(cn.wr, typ, payload); err != nil {
+		return fail(err, false)
+	}
+	if err := cn.wr.Flush(); err != nil {
+		return fail(err, false)
+	}
+	rtyp, rpayload, err := readFrame(cn.rd)
+	if err != nil {
+		return fail(err, true)
+	}
+	if rtyp == RES_ERROR {
+		r := &reader{buf: rpayload}
+		msg := r.string()
+		return 0, nil, &ServerError{Msg: msg}
+	}
+	return rtyp, rpayload, nil
+}
+
+// requests that can be repeated safely
+func idempotent(typ byte) bool {
+	switch typ {
+	case REQ_GET, REQ_SCAN, REQ_PING, REQ_PREPARE:
+		return true
+	default:
+		return false
+	}
+}
+
+// a request on a pooled connection. a broken connection is replaced and
+// the request is retried once if it didn't reach the server or is read-only.
+func (c *Client) do(ctx context.Context, fn func(cn *conn) (byte, []byte, error)) (byte, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		cn, err := c.acquire(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
+		typ, payload, err := fn(cn)
+		c.release(cn)
+		var ioe *ioError
+		if attempt == 0 && errors.As(err, &ioe) && ctx.Err() == nil && !ioe.written {
+			continue
+		}
+		return typ, payload, err
+	}
+}
+
+func (c *Client) request(ctx context.Context, typ byte, payload []byte) (byte, []byte, error) {
+	return c.do(ctx, func(cn *conn) (byte, []byte, error) {
+		rtyp, rpayload, err := cn.roundTrip(ctx, typ, payload)
+		var ioe *ioError
+		if errors.As(err, &ioe) && idempotent(typ) {
+			ioe.written = false // safe to retry
+		}
+		return rtyp, rpayload, err
+	})
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	_, _, err := c.request(ctx, REQ_PING, nil)
+	return err
+}
+
+// convert Go values to table values: integers, string and []byte
+func toValues(args []interface{}) ([]storage.Value, error) {
+	vals := make([]storage.Value, len(args))
+	for i, arg := range args {
+		switch a := arg.(type) {
+		case storage.Value:
+			vals[i] = a
+		case int:
+			vals[i] = storage.Value{Type: storage.TYPE_INT64, I64: int64(a)}
+		case int32:
+			vals[i] = storage.Value{Type: storage.TYPE_INT64, I64: int64(a)}
+		case int64:
+			vals[i] = storage.Value{Type: storage.TYPE_INT64, I64: a}
+		case bool:
+			vals[i] = storage.Value{Type: storage.TYPE_INT64}
+			if a {
+				vals[i].I64 = 1
+			}
+		case string:
+			vals[i] = storage.Value{Type: storage.TYPE_BYTES, Str: []byte(a)}
+		case []byte:
+			vals[i] = storage.Value{Type: storage.TYPE_BYTES, Str: a}
+		default:
+			return nil, fmt.Errorf("api: unsupported argument type %T", arg)
+		}
+	}
+	return vals, nil
+}
+
+func queryPayload(sql string, args []interface{}) ([]byte, error) {
+	vals, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return putValues(putString(nil, sql), vals), nil
+}
+
+// run a statement that returns rows
+func (c *Client) Query(ctx context.Context, sql string, args ...interface{}) (*Rows, error) {
+	payload, err := queryPayload(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRows(c.request(ctx, REQ_QUERY, payload))
+}
+
+// run a statement without rows
+func (c *Client) Exec(ctx context.Context, sql string, args ...interface{}) (Result, error) {
+	payload, err := queryPayload(sql, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return decodeResult(c.request(ctx, REQ_QUERY, payload))
+}
+
+// get a single row by the primary key
+func (c *Client) Get(ctx context.Context, table string, key Record) (Record, bool, error) {
+	payload := putRecord(putString(nil, table), key)
+	rows, err := decodeRows(c.request(ctx, REQ_GET, payload))
+	if err != nil || !rows.Next() {
+		return Record{}, false, err
+	}
+	return rows.Record(), true, nil
+}
+
+// add a record with one of the storage.MODE_* update modes, reports if a key is added
+func (c *Client) Set(ctx context.Context, table string, rec Record, mode int) (bool, error) {
+	payload := putRecord(putUvarint(putString(nil, table), uint64(mode)), rec)
+	res, err := decodeResult(c.request(ctx, REQ_SET, payload))
+	return res.Affected > 0, err
+}
+
+func (c *Client) Delete(ctx context.Context, table string, key Record) (bool, error) {
+	payload := putRecord(putString(nil, table), key)
+	res, err := decodeResult(c.request(ctx, REQ_DEL, payload))
+	return res.Affected > 0, err
+}
+
+// a primary key range scan, see storage.Scanner. a negative limit means no limit.
+func (c *Client) Scan(
+	ctx context.Context, table string,
+	cmp1 int, key1 Record, cmp2 int, key2 Record, limit int64,
+) (*Rows, error) {
+	payload := putString(nil, table)
+	payload = putRecord(putVarint(payload, int64(cmp1)), key1)
+	payload = putRecord(putVarint(payload, int64(cmp2)), key2)
+	payload = putVarint(payload, limit)
+	return decodeRows(c.request(ctx, REQ_SCAN, payload))
+}
+
+func decodeResult(typ byte, payload []byte, err error) (Result, error) {
+	if err != nil {
+		return Result{}, err
+	}
+	if typ != RES_OK {
+		return Result{}, fmt.Errorf("api: unexpected response type %d", typ)
+	}
+	r := &reader{buf: payload}
+	res := Result{Affected: r.varint(), LastInsertID: r.varint()}
+	return res, r.done()
+}
+
+func decodeRows(typ byte, payload []byte, err error) (*Rows, error) {
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case RES_OK:
+		return &Rows{}, nil // a statement without rows
+	case RES_ROWS:
+		r := &reader{buf: payload}
+		rows := &Rows{pos: -1}
+		rows.Cols, rows.Types, rows.rows = r.rows()
+		return rows, r.done()
+	default:
+		return nil, fmt.Errorf("api: unexpected response type %d", typ)
+	}
+}
+
+// a prepared statement, prepared on each connection on first use
+type Stmt struct {
+	c   *Client
+	tx  *Tx // nil: use the pool
+	sql string
+}
+
+func (c *Client) Prepare(ctx context.Context, sql string) (*Stmt, error) {
+	stmt := &Stmt{c: c, sql: sql}
+	// check the syntax early
+	_, _, err := c.do(ctx, func(cn *conn) (byte, []byte, error) {
+		_, err := stmt.prepare(ctx, cn)
+		return 0, nil, err
+	})
+	return stmt, err
+}
+
+func (stmt *Stmt) prepare(ctx context.Context, cn *conn) (uint64, error) {
+	if id, ok := cn.stmts[stmt.sql]; ok {
+		return id, nil
+	}
+	typ, payload, err := cn.roundTrip(ctx, REQ_PREPARE, putString(nil, stmt.sql))
+	if err != nil {
+		return 0, err
+	}
+	if typ != RES_STMT {
+		return 0, fmt.Errorf("api: unexpected response type %d", typ)
+	}
+	r := &reader{buf: payload}
+	id := r.uvarint()
+	r.uvarint() // the number of params, checked by the server
+	if err := r.done(); err != nil {
+		return 0, err
+	}
+	cn.stmts[stmt.sql] = id
+	return id, nil
+}
+
+func (stmt *Stmt) exec(ctx context.Context, args []interface{}) (byte, []byte, error) {
+	vals, err := toValues(args)
+	if err != nil {
+		return 0, nil, err
+	}
+	run := func(cn *conn) (byte, []byte, error) {
+		id, err := stmt.prepare(ctx, cn)
+		if err != nil {
+			return 0, nil, err
+		}
+		return cn.roundTrip(ctx, REQ_EXEC, putValues(putUvarint(nil, id), vals))
+	}
+	if stmt.tx != nil {
+		return stmt.tx.on(run)
+	}
+	return stmt.c.do(ctx, run)
+}
+
+func (stmt *Stmt) Query(ctx context.Context, args ...interface{}) (*Rows, error) {
+	return decodeRows(stmt.exec(ctx, args))
+}
+
+func (stmt *Stmt) Exec(ctx context.Context, args ...interface{}) (Result, error) {
+	return decodeResult(stmt.exec(ctx, args))
+}
+
+// a transaction is pinned to a connection until it's finished.
+// a broken connection aborts the transaction on the server.
+type Tx struct {
+	c   *Client
+	ctx context.Context
+	cn  *conn // nil when finished
+}
+
+func (c *Client) Begin(ctx context.Context) (*Tx, error) {
+	cn, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := cn.roundTrip(ctx, REQ_BEGIN, nil); err != nil {
+		c.release(cn)
+		return nil, err
+	}
+	return &Tx{c: c, ctx: ctx, cn: cn}, nil
+}
+
+// run a request on the pinned connection
+func (tx *Tx) on(fn func(cn *conn) (byte, []byte, error)) (byte, []byte, error) {
+	if tx.cn == nil {
+		return 0, nil, ErrTxDone
+	}
+	typ, payload, err := fn(tx.cn)
+	if tx.cn.bad {
+		// the server has rolled back
+		tx.finish()
+	}
+	return typ, payload, err
+}
+
+func (tx *Tx) finish() {
+	if tx.cn != nil {
+		tx.c.release(tx.cn)
+		tx.cn = nil
+	}
+}
+
+func (tx *Tx) Query(ctx context.Context, sql string, args ...interface{}) (*Rows, error) {
+	payload, err := queryPayload(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRows(tx.on(func(cn *conn) (byte, []byte, error) {
+		return cn.roundTrip(ctx, REQ_QUERY, payload)
+	}))
+}
+
+func (tx *Tx) Exec(ctx context.Context, sql string, args ...interface{}) (Result, error) {
+	payload, err := queryPayload(sql, args)
+	if err != nil {
+		return Result{}, err
+	}
+	return decodeResult(tx.on(func(cn *conn) (byte, []byte, error) {
+		return cn.roundTrip(ctx, REQ_QUERY, payload)
+	}))
+}
+
+// a prepared statement bound to the transaction
+func (tx *Tx) Stmt(stmt *Stmt) *Stmt {
+	return &Stmt{c: tx.c, tx: tx, sql: stmt.sql}
+}
+
+func (tx *Tx) end(typ byte) error {
+	_, _, err := tx.on(func(cn *conn) (byte, []byte, error) {
+		return cn.roundTrip(tx.ctx, typ, nil)
+	})
+	tx.finish()
+	return err
+}
+
+func (tx *Tx) Commit() error {
+	return tx.end(REQ_COMMIT)
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.end(REQ_ROLLBACK)
+}
+
+// a row iterator
+type Rows struct {
+	Cols  []string // nil for statements without rows
+	Types []uint32
+	rows  [][]storage.Value
+	pos   int
+}
+
+// advance to the next row, false at the end
+func (rows *Rows) Next() bool {
+	if rows.pos+1 >= len(rows.rows) {
+		rows.pos = len(rows.rows)
+		return false
+	}
+	rows.pos++
+	return true
+}
+
+// the current row
+func (rows *Rows) Record() Record {
+	return Record{Cols: rows.Cols, Vals: rows.rows[rows.pos]}
+}
+
+// copy the current row into *int64, *int, *string or *[]byte
+func (rows *Rows) Scan(dest ...interface{}) error {
+	row := rows.rows[rows.pos]
+	if len(dest) != len(row) {
+		return fmt.Errorf("api: %d destinations for %d columns", len(dest), len(row))
+	}
+	for i, d := range dest {
+		v := row[i]
+		switch p := d.(type) {
+		case *storage.Value:
+			*p = v
+		case *int64:
+			if v.Type != storage.TYPE_INT64 {
+				return fmt.Errorf("api: column %s is not an integer", rows.Cols[i])
+			}
+			*p = v.I64
+		case *int:
+			if v.Type != storage.TYPE_INT64 {
+				return fmt.Errorf("api: column %s is not an integer", rows.Cols[i])
+			}
+			*p = int(v.I64)
+		case *string:
+			if v.Type != storage.TYPE_BYTES {
+				return fmt.Errorf("api: column %s is not a string", rows.Cols[i])
+			}
+			*p = string(v.Str)
+		case *[]byte:
+			if v.Type != storage.TYPE_BYTES {
+				return fmt.Errorf("api: column %s is not bytes", rows.Cols[i])
+			}
+			*p = append([]byte{}, v.Str...)
+		default:
+			return fmt.Errorf("api: unsupported destination type %T", d)
+		}
+	}
+	return nil
+}
+
+// the rows are fully received, Close only releases them
+func (rows *Rows) Close() error {
+	rows.rows = nil
+	rows.pos = 0
+	return nil
+}
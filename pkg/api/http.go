@@ -0,0 +1,625 @@
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the HTTP/JSON front-end:
+//
+//	POST   /query                     {"sql": "...", "args": [...]}
+//	GET    /tables                    the table definitions
+//	GET    /tables/{name}?from=&to=&limit=  a primary key range scan
+//	GET    /tables/{name}/rows/{pk}   a single row
+//	PUT    /tables/{name}/rows/{pk}   insert or update a row, ?mode=insert|update|upsert
+//	DELETE /tables/{name}/rows/{pk}   delete a row
+//	GET    /changes?from=             the row changes, see changes.go
+//
+// a composite primary key takes one path segment (or one from/to parameter) per column.
+// INT64 values are JSON numbers, BYTES values are strings if they are valid UTF-8
+// and {"base64": "..."} otherwise. integers can also be given as strings.
+
+// rows per locked step of a streamed scan
+const HTTP_SCAN_BATCH = 1000
+
+// an error with an HTTP status
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func httpErrorf(status int, format string, args ...interface{}) error {
+	return &httpError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func (srv *Server) ListenAndServeJSON(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeJSON(ln)
+}
+
+// serve the HTTP/JSON API until the listener is closed or the server is shut down
+func (srv *Server) ServeJSON(ln net.Listener) error {
+	return srv.serveHTTP(ln, srv.Handler())
+}
+
+func (srv *Server) ListenAndServeMetrics(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeMetrics(ln)
+}
+
+// serve only GET /metrics, for a listener separate from the API
+func (srv *Server) ServeMetrics(ln net.Listener) error {
+	if srv.Metrics == nil {
+		ln.Close()
+		return errors.New("api: no metrics registry")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", srv.Metrics.Handler())
+	return srv.serveHTTP(ln, mux)
+}
+
+func (srv *Server) serveHTTP(ln net.Listener, h http.Handler) error {
+	hs := &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second}
+	srv.mu.Lock()
+	if srv.done {
+		srv.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	srv.hsrvs[hs] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.hsrvs, hs)
+		srv.mu.Unlock()
+	}()
+
+	err := hs.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// the HTTP/JSON API as a handler, e.g. for mounting under another mux
+func (srv *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /query", srv.httpQuery)
+	mux.HandleFunc("GET /tables", srv.httpTables)
+	mux.HandleFunc("GET /tables/{name}", srv.httpScan)
+	mux.HandleFunc("GET /tables/{name}/rows/{pk...}", srv.httpGet)
+	mux.HandleFunc("PUT /tables/{name}/rows/{pk...}", srv.httpPut)
+	mux.HandleFunc("DELETE /tables/{name}/rows/{pk...}", srv.httpDelete)
+	mux.HandleFunc("GET /backup", srv.httpBackup)
+	mux.HandleFunc("GET /changes", srv.httpChanges)
+	if srv.Metrics != nil {
+		mux.Handle("GET /metrics", srv.Metrics.Handler())
+	}
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	var he *httpError
+	if errors.As(err, &he) {
+		status = he.status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// decode a JSON request body
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_FRAME_SIZE))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return httpErrorf(http.StatusBadRequest, "bad request body: %v", err)
+	}
+	return nil
+}
+
+func typeName(typ uint32) string {
+	switch typ {
+	case storage.TYPE_INT64:
+		return "int64"
+	case storage.TYPE_BYTES:
+		return "bytes"
+	default:
+		return "unknown"
+	}
+}
+
+func typeNames(types []uint32) []string {
+	names := make([]string, len(types))
+	for i, typ := range types {
+		names[i] = typeName(typ)
+	}
+	return names
+}
+
+// the JSON representation of a value
+func jsonValue(v storage.Value) interface{} {
+	switch v.Type {
+	case storage.TYPE_INT64:
+		return v.I64
+	case storage.TYPE_BYTES:
+		if utf8.Valid(v.Str) {
+			return string(v.Str)
+		}
+		return map[string]string{"base64": base64.StdEncoding.EncodeToString(v.Str)}
+	default:
+		return nil
+	}
+}
+
+func jsonValues(vals []storage.Value) []interface{} {
+	out := make([]interface{}, len(vals))
+	for i, v := range vals {
+		out[i] = jsonValue(v)
+	}
+	return out
+}
+
+// a value from its JSON representation (decoded with UseNumber).
+// the type is inferred if `typ` is TYPE_ERROR.
+func valueFromJSON(x interface{}, typ uint32) (storage.Value, error) {
+	switch x := x.(type) {
+	case json.Number:
+		if typ == storage.TYPE_BYTES {
+			return storage.Value{}, fmt.Errorf("expected a string, got %s", x)
+		}
+		i64, err := x.Int64()
+		if err != nil {
+			return storage.Value{}, fmt.Errorf("not an int64: %s", x)
+		}
+		return storage.Value{Type: storage.TYPE_INT64, I64: i64}, nil
+	case string:
+		if typ == storage.TYPE_INT64 {
+			i64, err := strconv.ParseInt(x, 10, 64)
+			if err != nil {
+				return storage.Value{}, fmt.Errorf("not an int64: %q", x)
+			}
+			return storage.Value{Type: storage.TYPE_INT64, I64: i64}, nil
+		}
+		return storage.Value{Type: storage.TYPE_BYTES, Str: []byte(x)}, nil
+	case map[string]interface{}:
+		enc, ok := x["base64"].(string)
+		if len(x) != 1 || !ok || typ == storage.TYPE_INT64 {
+			break
+		}
+		b, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			return storage.Value{}, fmt.Errorf("bad base64: %v", err)
+		}
+		return storage.Value{Type: storage.TYPE_BYTES, Str: b}, nil
+	}
+	return storage.Value{}, fmt.Errorf("unsupported JSON value: %v", x)
+}
+
+// the definition of a table, a 404 error if it does not exist
+func (srv *Server) tableDef(name string) (*storage.TableDef, error) {
+	var tdef *storage.TableDef
+	err := srv.locked(func(db *storage.DB) error {
+		tdef = db.GetTableDef(name)
+		return nil
+	})
+	if err == nil && tdef == nil {
+		err = httpErrorf(http.StatusNotFound, "table not found: %s", name)
+	}
+	return tdef, err
+}
+
+// a prefix of the primary key from string values
+func keyRecord(tdef *storage.TableDef, parts []string) (storage.Record, error) {
+	rec := storage.Record{}
+	if len(parts) > tdef.Pkeys {
+		return rec, fmt.Errorf("table %s: the primary key has %d columns", tdef.Name, tdef.Pkeys)
+	}
+	for i, part := range parts {
+		v, err := valueFromJSON(part, tdef.Types[i])
+		if err != nil {
+			return rec, fmt.Errorf("column %s: %v", tdef.Cols[i], err)
+		}
+		rec.Cols = append(rec.Cols, tdef.Cols[i])
+		rec.Vals = append(rec.Vals, v)
+	}
+	return rec, nil
+}
+
+// the full primary key from the path, one segment per column.
+// the segments are split before unescaping, so a value can contain "/".
+func pathKey(r *http.Request, tdef *storage.TableDef) (storage.Record, error) {
+	segs := strings.Split(r.URL.EscapedPath(), "/")[4:] // "", "tables", name, "rows", pk...
+	if len(segs) != tdef.Pkeys {
+		return storage.Record{}, fmt.Errorf("table %s: the primary key has %d columns", tdef.Name, tdef.Pkeys)
+	}
+	parts := make([]string, len(segs))
+	for i, seg := range segs {
+		part, err := url.PathUnescape(seg)
+		if err != nil {
+			return storage.Record{}, fmt.Errorf("bad path: %v", err)
+		}
+		parts[i] = part
+	}
+	return keyRecord(tdef, parts)
+}
+
+// POST /query
+func (srv *Server) httpQuery(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		SQL  string        `json:"sql"`
+		Args []interface{} `json:"args"`
+	}{}
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	// a script runs under a single lock, a transaction must end within it
+	texts, err := parser.Split(req.SQL)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(texts) > 1 && len(req.Args) > 0 {
+		writeError(w, errors.New("arguments are only allowed with a single statement"))
+		return
+	}
+	args := []storage.Value{}
+	for i, x := range req.Args {
+		v, err := valueFromJSON(x, storage.TYPE_ERROR)
+		if err != nil {
+			writeError(w, fmt.Errorf("argument %d: %v", i+1, err))
+			return
+		}
+		args = append(args, v)
+	}
+	stmts := []*parser.Statement{}
+	for _, text := range texts {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		stmts = append(stmts, stmt)
+	}
+
+	results := []*executer.Result{}
+	err = srv.locked(func(db *storage.DB) error {
+		for _, stmt := range stmts {
+			res, err := executer.Exec(db, stmt, args)
+			if err != nil {
+				return err
+			}
+			results = append(results, res)
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	out := []map[string]interface{}{}
+	for _, res := range results {
+		if res.Cols == nil {
+			out = append(out, map[string]interface{}{
+				"affected": res.Affected, "last_insert_id": res.LastInsertID,
+			})
+			continue
+		}
+		rows := make([][]interface{}, len(res.Rows))
+		for i, row := range res.Rows {
+			rows[i] = jsonValues(row)
+		}
+		out = append(out, map[string]interface{}{
+			"cols": res.Cols, "types": typeNames(res.Types), "rows": rows,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": out})
+}
+
+// GET /tables
+func (srv *Server) httpTables(w http.ResponseWriter, r *http.Request) {
+	var defs []*storage.TableDef
+	err := srv.locked(func(db *storage.DB) (err error) {
+		defs, err = db.TableDefs()
+		return err
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out := []map[string]interface{}{}
+	for _, tdef := range defs {
+		out = append(out, map[string]interface{}{
+			"name":           tdef.Name,
+			"cols":           tdef.Cols,
+			"types":          typeNames(tdef.Types),
+			"pkeys":          tdef.Pkeys,
+			"indexes":        tdef.Indexes,
+			"auto_increment": tdef.AutoIncrement,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tables": out})
+}
+
+// GET /tables/{name}?from=&to=&limit=
+// the rows are streamed in batches, the DB is unlocked between batches,
+// so a long scan is not a consistent snapshot.
+func (srv *Server) httpScan(w http.ResponseWriter, r *http.Request) {
+	tdef, err := srv.tableDef(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	from, err := keyRecord(tdef, q["from"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	to, err := keyRecord(tdef, q["to"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	limit := -1
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeError(w, fmt.Errorf("bad limit: %q", s))
+			return
+		}
+	}
+
+	// {"cols": [...], "types": [...], "rows": [[...], ...]}
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	head, _ := json.Marshal(tdef.Cols)
+	types, _ := json.Marshal(typeNames(tdef.Types))
+	fmt.Fprintf(bw, `{"cols":%s,"types":%s,"rows":[`, head, types)
+	rc := http.NewResponseController(w)
+
+	cmp1, key1 := storage.CMP_GE, from
+	for n := 0; limit < 0 || n < limit; {
+		batch := [][]storage.Value{}
+		err = srv.locked(func(db *storage.DB) error {
+			sc := storage.Scanner{Cmp1: cmp1, Key1: key1, Cmp2: storage.CMP_LE, Key2: to}
+			if err := db.Scan(tdef.Name, &sc); err != nil {
+				return err
+			}
+			for rec := (storage.Record{}); sc.Valid() && len(batch) < HTTP_SCAN_BATCH; sc.Next() {
+				if limit >= 0 && n+len(batch) >= limit {
+					break
+				}
+				sc.Deref(&rec)
+				batch = append(batch, append([]storage.Value{}, rec.Vals...))
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+		for _, row := range batch {
+			if n > 0 {
+				bw.WriteByte(',')
+			}
+			data, _ := json.Marshal(jsonValues(row))
+			bw.Write(data)
+			n++
+		}
+		if len(batch) < HTTP_SCAN_BATCH {
+			break
+		}
+		// continue after the last key
+		last := batch[len(batch)-1]
+		cmp1 = storage.CMP_GT
+		key1 = storage.Record{Cols: tdef.Cols[:tdef.Pkeys], Vals: last[:tdef.Pkeys]}
+		if bw.Flush() != nil || rc.Flush() != nil {
+			return // the client is gone
+		}
+	}
+	bw.WriteString("]")
+	if err != nil {
+		// the status is already sent
+		msg, _ := json.Marshal(err.Error())
+		fmt.Fprintf(bw, `,"error":%s`, msg)
+	}
+	bw.WriteString("}\n")
+	bw.Flush()
+}
+
+func rowObject(rec storage.Record) map[string]interface{} {
+	out := map[string]interface{}{}
+	for i, col := range rec.Cols {
+		out[col] = jsonValue(rec.Vals[i])
+	}
+	return out
+}
+
+// GET /tables/{name}/rows/{pk}
+func (srv *Server) httpGet(w http.ResponseWriter, r *http.Request) {
+	tdef, err := srv.tableDef(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rec, err := pathKey(r, tdef)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ok := false
+	err = srv.locked(func(db *storage.DB) (err error) {
+		ok, err = db.Get(tdef.Name, &rec)
+		return err
+	})
+	if err == nil && !ok {
+		err = httpErrorf(http.StatusNotFound, "row not found")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, rowObject(rec))
+}
+
+// PUT /tables/{name}/rows/{pk}?mode=insert|update|upsert
+// the body is an object of the other columns.
+func (srv *Server) httpPut(w http.ResponseWriter, r *http.Request) {
+	tdef, err := srv.tableDef(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rec, err := pathKey(r, tdef)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	mode := storage.MODE_UPSERT
+	switch m := r.URL.Query().Get("mode"); m {
+	case "", "upsert":
+	case "insert":
+		mode = storage.MODE_INSERT_ONLY
+	case "update":
+		mode = storage.MODE_UPDATE_ONLY
+	default:
+		writeError(w, fmt.Errorf("bad mode: %q", m))
+		return
+	}
+	body := map[string]interface{}{}
+	if err := readJSON(w, r, &body); err != nil {
+		writeError(w, err)
+		return
+	}
+	for i, col := range tdef.Cols[tdef.Pkeys:] {
+		x, ok := body[col]
+		if !ok {
+			continue // omitted, possibly filled by a default
+		}
+		delete(body, col)
+		v, err := valueFromJSON(x, tdef.Types[tdef.Pkeys+i])
+		if err != nil {
+			writeError(w, fmt.Errorf("column %s: %v", col, err))
+			return
+		}
+		rec.Cols = append(rec.Cols, col)
+		rec.Vals = append(rec.Vals, v)
+	}
+	for col, x := range body {
+		// the primary key can be repeated in the body, it must agree with the path
+		if v := rec.Get(col); v != nil {
+			if pv, err := valueFromJSON(x, v.Type); err == nil && jsonEqual(pv, *v) {
+				continue
+			}
+			writeError(w, fmt.Errorf("column %s: does not match the path", col))
+			return
+		}
+		writeError(w, fmt.Errorf("table %s: unknown column %s", tdef.Name, col))
+		return
+	}
+
+	added, exists := false, true
+	err = srv.locked(func(db *storage.DB) (err error) {
+		if mode == storage.MODE_UPDATE_ONLY {
+			// Set reports only the added rows
+			key := storage.Record{Cols: rec.Cols[:tdef.Pkeys], Vals: append([]storage.Value{}, rec.Vals[:tdef.Pkeys]...)}
+			if exists, err = db.Get(tdef.Name, &key); err != nil || !exists {
+				return err
+			}
+		}
+		added, err = db.Set(tdef.Name, rec, mode)
+		return err
+	})
+	switch {
+	case err != nil:
+	case !exists:
+		err = httpErrorf(http.StatusNotFound, "row not found")
+	case mode == storage.MODE_INSERT_ONLY && !added:
+		err = httpErrorf(http.StatusConflict, "row already exists")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if added {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, map[string]bool{"added": added})
+}
+
+func jsonEqual(a, b storage.Value) bool {
+	return a.Type == b.Type && a.I64 == b.I64 && string(a.Str) == string(b.Str)
+}
+
+// DELETE /tables/{name}/rows/{pk}
+func (srv *Server) httpDelete(w http.ResponseWriter, r *http.Request) {
+	tdef, err := srv.tableDef(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rec, err := pathKey(r, tdef)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	deleted := false
+	err = srv.locked(func(db *storage.DB) (err error) {
+		deleted, err = db.Delete(tdef.Name, rec)
+		return err
+	})
+	if err == nil && !deleted {
+		err = httpErrorf(http.StatusNotFound, "row not found")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stream an online backup, the DB is locked only to pin the last commit
+func (srv *Server) httpBackup(w http.ResponseWriter, r *http.Request) {
+	var snap *storage.Snapshot
+	_ = srv.locked(func(db *storage.DB) error {
+		snap = db.Snapshot()
+		return nil
+	})
+	defer snap.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := snap.WriteTo(w); err != nil {
+		// the status is sent, abort the response so that the client sees a failure
+		panic(http.ErrAbortHandler)
+	}
+}
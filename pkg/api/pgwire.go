@@ -0,0 +1,710 @@
+package api
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a front-end for the PostgreSQL v3 frontend/backend protocol,
+// enough for psql and the Go Postgres drivers:
+// startup (no TLS, no password), simple query, extended query
+// (Parse/Bind/Describe/Execute/Sync/Close), text and binary formats.
+// TYPE_INT64 is int8, TYPE_BYTES is text or bytea (Server.PGBytesOID).
+
+// type OIDs
+const (
+	PG_OID_BYTEA   = 17
+	PG_OID_INT8    = 20
+	PG_OID_INT2    = 21
+	PG_OID_INT4    = 23
+	PG_OID_TEXT    = 25
+	PG_OID_VARCHAR = 1043
+)
+
+// startup request codes
+const (
+	PG_PROTOCOL_V3    = 196608
+	PG_SSL_REQUEST    = 80877103
+	PG_GSSENC_REQUEST = 80877104
+	PG_CANCEL_REQUEST = 80877102
+)
+
+// SQLSTATE codes
+const (
+	PG_ERR_SYNTAX      = "42601"
+	PG_ERR_PROTOCOL    = "08P01"
+	PG_ERR_UNSUPPORTED = "0A000"
+	PG_ERR_INTERNAL    = "XX000"
+)
+
+const PG_MAX_MESSAGE = MAX_FRAME_SIZE
+
+// a prepared statement
+type pgStmt struct {
+	stmt  *parser.Statement
+	types []uint32 // storage types of the params
+	oids  []uint32 // reported param OIDs
+}
+
+// a bound statement
+type pgPortal struct {
+	stmt    *pgStmt
+	args    []storage.Value
+	formats []int16 // result formats
+	res     *executer.Result
+	pos     int // the next row for a suspended portal
+}
+
+type pgSession struct {
+	*srvConn
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	stmts   map[string]*pgStmt
+	portals map[string]*pgPortal
+	failed  bool // an extended query failed, skip to the next Sync
+}
+
+type pgError struct {
+	code string
+	msg  string
+}
+
+func (e *pgError) Error() string {
+	return e.msg
+}
+
+func pgErrorf(code string, format string, args ...interface{}) error {
+	return &pgError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+func (srv *Server) ListenAndServePG(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServePG(ln)
+}
+
+// serve the PostgreSQL protocol until the listener is closed or the server is shut down
+func (srv *Server) ServePG(ln net.Listener) error {
+	return srv.serve(ln, servePG)
+}
+
+func servePG(c *srvConn) {
+	s := &pgSession{
+		srvConn: c,
+		rd:      bufio.NewReader(c.nc),
+		wr:      bufio.NewWriter(c.nc),
+		stmts:   map[string]*pgStmt{},
+		portals: map[string]*pgPortal{},
+	}
+	if err := s.startup(); err != nil {
+		return
+	}
+	for {
+		typ, body, err := s.readMsg()
+		if err != nil {
+			return // disconnected or shutting down
+		}
+		if !c.begin() {
+			return // the request raced with the shutdown
+		}
+		quit := s.handle(typ, body)
+		if typ == 'S' || typ == 'H' || typ == 'Q' || s.wr.Buffered() > 64<<10 {
+			err = s.wr.Flush()
+		}
+		if !c.end() || err != nil || quit {
+			s.wr.Flush()
+			return
+		}
+	}
+}
+
+// messages
+type pgMsg struct {
+	buf []byte
+}
+
+func newMsg(typ byte) *pgMsg {
+	return &pgMsg{buf: []byte{typ, 0, 0, 0, 0}}
+}
+
+func (m *pgMsg) int16(x int) *pgMsg {
+	m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(x))
+	return m
+}
+
+func (m *pgMsg) int32(x int) *pgMsg {
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(x))
+	return m
+}
+
+func (m *pgMsg) str(s string) *pgMsg {
+	m.buf = append(append(m.buf, s...), 0)
+	return m
+}
+
+func (m *pgMsg) bytes(b []byte) *pgMsg {
+	m.buf = append(m.buf, b...)
+	return m
+}
+
+func (s *pgSession) send(m *pgMsg) {
+	binary.BigEndian.PutUint32(m.buf[1:5], uint32(len(m.buf)-1))
+	s.wr.Write(m.buf) // errors show up on Flush
+}
+
+func (s *pgSession) readMsg() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(s.rd, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size < 4 || size > PG_MAX_MESSAGE {
+		return 0, nil, fmt.Errorf("bad message size: %d", size)
+	}
+	body := make([]byte, size-4)
+	_, err := io.ReadFull(s.rd, body)
+	return hdr[0], body, err
+}
+
+// the message body decoder, the first error sticks
+type pgReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pgReader) fail() {
+	if r.err == nil {
+		r.err = pgErrorf(PG_ERR_PROTOCOL, "malformed message")
+	}
+	r.buf = nil
+}
+
+func (r *pgReader) int16() int {
+	if len(r.buf) < 2 {
+		r.fail()
+		return 0
+	}
+	x := int16(binary.BigEndian.Uint16(r.buf))
+	r.buf = r.buf[2:]
+	return int(x)
+}
+
+func (r *pgReader) int32() int {
+	if len(r.buf) < 4 {
+		r.fail()
+		return 0
+	}
+	x := int32(binary.BigEndian.Uint32(r.buf))
+	r.buf = r.buf[4:]
+	return int(x)
+}
+
+func (r *pgReader) str() string {
+	idx := strings.IndexByte(string(r.buf), 0)
+	if idx < 0 {
+		r.fail()
+		return ""
+	}
+	str := string(r.buf[:idx])
+	r.buf = r.buf[idx+1:]
+	return str
+}
+
+func (r *pgReader) bytes(n int) []byte {
+	if n < 0 || n > len(r.buf) {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pgReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (s *pgSession) startup() error {
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(s.rd, hdr[:]); err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size < 8 || size > 10000 {
+			return fmt.Errorf("bad startup message size: %d", size)
+		}
+		body := make([]byte, size-4)
+		if _, err := io.ReadFull(s.rd, body); err != nil {
+			return err
+		}
+		r := &pgReader{buf: body}
+		switch code := r.int32(); code {
+		case PG_SSL_REQUEST, PG_GSSENC_REQUEST:
+			// no encryption, the client continues in plaintext or gives up
+			if err := s.wr.WriteByte('N'); err != nil {
+				return err
+			}
+			if err := s.wr.Flush(); err != nil {
+				return err
+			}
+		case PG_PROTOCOL_V3:
+			params := map[string]string{}
+			for r.err == nil && len(r.buf) > 1 {
+				key := r.str()
+				params[key] = r.str()
+			}
+			if r.err != nil {
+				return r.err
+			}
+			s.send(newMsg('R').int32(0)) // AuthenticationOk
+			status := [][2]string{
+				{"server_version", "14.0 (DungeonDB)"},
+				{"server_encoding", "UTF8"},
+				{"client_encoding", "UTF8"},
+				{"DateStyle", "ISO, MDY"},
+				{"TimeZone", "UTC"},
+				{"integer_datetimes", "on"},
+				{"standard_conforming_strings", "on"},
+				{"application_name", params["application_name"]},
+			}
+			for _, kv := range status {
+				s.send(newMsg('S').str(kv[0]).str(kv[1]))
+			}
+			s.send(newMsg('K').int32(0).int32(0)) // BackendKeyData, cancel is not supported
+			s.readyForQuery()
+			return s.wr.Flush()
+		case PG_CANCEL_REQUEST:
+			return errors.New("cancel request is not supported")
+		default:
+			s.sendError(pgErrorf(PG_ERR_PROTOCOL, "unsupported protocol version %d.%d", code>>16, code&0xffff))
+			s.wr.Flush()
+			return fmt.Errorf("unsupported protocol version: %d", code)
+		}
+	}
+}
+
+func (s *pgSession) readyForQuery() {
+	status := byte('I')
+	if s.inTx {
+		status = 'T'
+	}
+	s.send(newMsg('Z').bytes([]byte{status}))
+}
+
+func (s *pgSession) sendError(err error) {
+	code := PG_ERR_INTERNAL
+	var pe *pgError
+	var se *parser.SyntaxError
+	switch {
+	case errors.As(err, &pe):
+		code = pe.code
+	case errors.As(err, &se):
+		code = PG_ERR_SYNTAX
+	}
+	s.send(newMsg('E').
+		bytes([]byte{'S'}).str("ERROR").
+		bytes([]byte{'V'}).str("ERROR").
+		bytes([]byte{'C'}).str(code).
+		bytes([]byte{'M'}).str(err.Error()).
+		bytes([]byte{0}))
+}
+
+// handle a message, returns true to close the connection
+func (s *pgSession) handle(typ byte, body []byte) bool {
+	r := &pgReader{buf: body}
+	if typ == 'Q' {
+		s.simpleQuery(r.str())
+		return false
+	}
+	if typ == 'X' {
+		return true
+	}
+	if typ == 'S' {
+		s.failed = false
+		s.readyForQuery()
+		return false
+	}
+	if s.failed {
+		return false // discard until Sync
+	}
+
+	var err error
+	switch typ {
+	case 'P':
+		err = s.parse(r)
+	case 'B':
+		err = s.bind(r)
+	case 'D':
+		err = s.describe(r)
+	case 'E':
+		err = s.execute(r)
+	case 'C':
+		kind, name := r.byte(), r.str()
+		if err = r.err; err == nil {
+			if kind == 'S' {
+				delete(s.stmts, name)
+			} else {
+				delete(s.portals, name)
+			}
+			s.send(newMsg('3')) // CloseComplete
+		}
+	case 'H':
+		// Flush, handled by the caller
+	default:
+		err = pgErrorf(PG_ERR_UNSUPPORTED, "unsupported message type %q", typ)
+	}
+	if err != nil {
+		s.sendError(err)
+		s.failed = true
+	}
+	return false
+}
+
+func (s *pgSession) simpleQuery(sql string) {
+	defer s.readyForQuery()
+	stmts, err := parser.Split(sql)
+	if err != nil {
+		s.sendError(err)
+		return
+	}
+	if len(stmts) == 0 {
+		s.send(newMsg('I')) // EmptyQueryResponse
+		return
+	}
+	for _, text := range stmts {
+		stmt, err := parser.Parse(text)
+		if err != nil {
+			s.sendError(err)
+			return
+		}
+		res, err := s.exec(stmt, nil)
+		if err != nil {
+			s.sendError(err)
+			return
+		}
+		if res.Cols != nil {
+			s.rowDescription(res.Cols, res.Types, nil)
+		}
+		portal := &pgPortal{res: res}
+		s.sendRows(portal, 0)
+		s.commandComplete(stmt, res)
+	}
+}
+
+// Parse: name, query, param OIDs
+func (s *pgSession) parse(r *pgReader) error {
+	name, query := r.str(), r.str()
+	n := r.int16()
+	oids := []uint32{}
+	for i := 0; i < n && r.err == nil; i++ {
+		oids = append(oids, uint32(r.int32()))
+	}
+	if r.err != nil {
+		return r.err
+	}
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return err
+	}
+	if len(oids) > stmt.NumParams {
+		return pgErrorf(PG_ERR_PROTOCOL, "%d parameter types for %d parameters", len(oids), stmt.NumParams)
+	}
+	ps := &pgStmt{stmt: stmt}
+	err = s.locked(func(db *storage.DB) error {
+		ps.types = executer.ParamTypes(db, stmt)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, typ := range ps.types {
+		oid := uint32(0)
+		if i < len(oids) {
+			oid = oids[i]
+		}
+		switch oid {
+		case PG_OID_INT2, PG_OID_INT4, PG_OID_INT8:
+			ps.types[i] = storage.TYPE_INT64
+		case PG_OID_TEXT, PG_OID_VARCHAR, PG_OID_BYTEA:
+			ps.types[i] = storage.TYPE_BYTES
+		case 0:
+			oid = s.typeOID(typ)
+		default:
+			return pgErrorf(PG_ERR_UNSUPPORTED, "unsupported parameter type OID %d", oid)
+		}
+		ps.oids = append(ps.oids, oid)
+	}
+	s.stmts[name] = ps
+	s.send(newMsg('1')) // ParseComplete
+	return nil
+}
+
+// Bind: portal, statement, param formats, params, result formats
+func (s *pgSession) bind(r *pgReader) error {
+	portal, name := r.str(), r.str()
+	ps, ok := s.stmts[name]
+	if !ok && r.err == nil {
+		return pgErrorf(PG_ERR_PROTOCOL, "unknown prepared statement %q", name)
+	}
+	pformats := []int16{}
+	for i, n := 0, r.int16(); i < n && r.err == nil; i++ {
+		pformats = append(pformats, int16(r.int16()))
+	}
+	nparams := r.int16()
+	if r.err == nil && nparams != ps.stmt.NumParams {
+		return pgErrorf(PG_ERR_PROTOCOL, "expected %d parameters, got %d", ps.stmt.NumParams, nparams)
+	}
+	args := []storage.Value{}
+	for i := 0; i < nparams && r.err == nil; i++ {
+		size := r.int32()
+		if size < 0 {
+			return pgErrorf(PG_ERR_UNSUPPORTED, "NULL parameters are not supported")
+		}
+		data := r.bytes(size)
+		v, err := s.decodeParam(data, formatAt(pformats, i), ps.types[i], ps.oids[i])
+		if err != nil {
+			return err
+		}
+		args = append(args, v)
+	}
+	rformats := []int16{}
+	for i, n := 0, r.int16(); i < n && r.err == nil; i++ {
+		rformats = append(rformats, int16(r.int16()))
+	}
+	if r.err != nil {
+		return r.err
+	}
+	s.portals[portal] = &pgPortal{stmt: ps, args: args, formats: rformats}
+	s.send(newMsg('2')) // BindComplete
+	return nil
+}
+
+// a format code list has 0 (all text), 1 (the same for all) or n entries
+func formatAt(formats []int16, i int) int16 {
+	switch len(formats) {
+	case 0:
+		return 0
+	case 1:
+		return formats[0]
+	default:
+		if i < len(formats) {
+			return formats[i]
+		}
+		return 0
+	}
+}
+
+func (s *pgSession) decodeParam(data []byte, format int16, typ uint32, oid uint32) (storage.Value, error) {
+	if format == 1 {
+		// binary
+		if typ == storage.TYPE_BYTES {
+			return storage.Value{Type: storage.TYPE_BYTES, Str: append([]byte{}, data...)}, nil
+		}
+		v := storage.Value{Type: storage.TYPE_INT64}
+		switch len(data) {
+		case 2:
+			v.I64 = int64(int16(binary.BigEndian.Uint16(data)))
+		case 4:
+			v.I64 = int64(int32(binary.BigEndian.Uint32(data)))
+		case 8:
+			v.I64 = int64(binary.BigEndian.Uint64(data))
+		default:
+			return v, pgErrorf(PG_ERR_PROTOCOL, "bad binary integer of %d bytes", len(data))
+		}
+		return v, nil
+	}
+	// text
+	text := string(data)
+	if typ == storage.TYPE_INT64 {
+		i64, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil {
+			return storage.Value{}, pgErrorf(PG_ERR_SYNTAX, "invalid integer: %q", text)
+		}
+		return storage.Value{Type: storage.TYPE_INT64, I64: i64}, nil
+	}
+	if oid == PG_OID_BYTEA && strings.HasPrefix(text, `\x`) {
+		b, err := hex.DecodeString(text[2:])
+		if err != nil {
+			return storage.Value{}, pgErrorf(PG_ERR_SYNTAX, "invalid bytea: %q", text)
+		}
+		return storage.Value{Type: storage.TYPE_BYTES, Str: b}, nil
+	}
+	return storage.Value{Type: storage.TYPE_BYTES, Str: []byte(text)}, nil
+}
+
+// Describe: 'S' statement or 'P' portal
+func (s *pgSession) describe(r *pgReader) error {
+	kind, name := r.byte(), r.str()
+	if r.err != nil {
+		return r.err
+	}
+	var ps *pgStmt
+	var args []storage.Value
+	var formats []int16
+	switch kind {
+	case 'S':
+		if ps = s.stmts[name]; ps == nil {
+			return pgErrorf(PG_ERR_PROTOCOL, "unknown prepared statement %q", name)
+		}
+		m := newMsg('t').int16(len(ps.oids)) // ParameterDescription
+		for _, oid := range ps.oids {
+			m.int32(int(oid))
+		}
+		s.send(m)
+	case 'P':
+		portal := s.portals[name]
+		if portal == nil {
+			return pgErrorf(PG_ERR_PROTOCOL, "unknown portal %q", name)
+		}
+		ps, args, formats = portal.stmt, portal.args, portal.formats
+	default:
+		return pgErrorf(PG_ERR_PROTOCOL, "bad describe kind %q", kind)
+	}
+
+	var cols []string
+	var types []uint32
+	err := s.locked(func(db *storage.DB) (err error) {
+		cols, types, err = executer.Describe(db, ps.stmt, args)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if cols == nil {
+		s.send(newMsg('n')) // NoData
+	} else {
+		s.rowDescription(cols, types, formats)
+	}
+	return nil
+}
+
+// Execute: portal, max rows (0 for all)
+func (s *pgSession) execute(r *pgReader) error {
+	name, max := r.str(), r.int32()
+	if r.err != nil {
+		return r.err
+	}
+	portal := s.portals[name]
+	if portal == nil {
+		return pgErrorf(PG_ERR_PROTOCOL, "unknown portal %q", name)
+	}
+	if portal.res == nil {
+		res, err := s.exec(portal.stmt.stmt, portal.args)
+		if err != nil {
+			return err
+		}
+		portal.res = res
+	}
+	if !s.sendRows(portal, max) {
+		s.send(newMsg('s')) // PortalSuspended
+		return nil
+	}
+	s.commandComplete(portal.stmt.stmt, portal.res)
+	return nil
+}
+
+func (s *pgSession) typeOID(typ uint32) uint32 {
+	if typ == storage.TYPE_INT64 {
+		return PG_OID_INT8
+	}
+	if s.srv.PGBytesOID != 0 {
+		return s.srv.PGBytesOID
+	}
+	return PG_OID_TEXT
+}
+
+func (s *pgSession) rowDescription(cols []string, types []uint32, formats []int16) {
+	m := newMsg('T').int16(len(cols))
+	for i, col := range cols {
+		size := -1
+		if types[i] == storage.TYPE_INT64 {
+			size = 8
+		}
+		m.str(col).int32(0).int16(0) // no table OID and attribute number
+		m.int32(int(s.typeOID(types[i]))).int16(size).int32(-1)
+		m.int16(int(formatAt(formats, i)))
+	}
+	s.send(m)
+}
+
+// send the remaining rows of a portal, up to `max` if > 0.
+// returns false if the portal is suspended.
+func (s *pgSession) sendRows(portal *pgPortal, max int) bool {
+	res := portal.res
+	for n := 0; portal.pos < len(res.Rows); n++ {
+		if max > 0 && n >= max {
+			return false
+		}
+		row := res.Rows[portal.pos]
+		portal.pos++
+		m := newMsg('D').int16(len(row))
+		for i, v := range row {
+			data := s.encodeValue(v, formatAt(portal.formats, i))
+			m.int32(len(data)).bytes(data)
+		}
+		s.send(m)
+	}
+	return true
+}
+
+func (s *pgSession) encodeValue(v storage.Value, format int16) []byte {
+	switch {
+	case v.Type == storage.TYPE_INT64 && format == 1:
+		return binary.BigEndian.AppendUint64(nil, uint64(v.I64))
+	case v.Type == storage.TYPE_INT64:
+		return strconv.AppendInt(nil, v.I64, 10)
+	case format == 0 && s.typeOID(v.Type) == PG_OID_BYTEA:
+		return append([]byte(`\x`), hex.EncodeToString(v.Str)...)
+	default:
+		return v.Str
+	}
+}
+
+func (s *pgSession) commandComplete(stmt *parser.Statement, res *executer.Result) {
+	tag := ""
+	switch stmt.Stmt.(type) {
+	case *parser.CreateTable:
+		tag = "CREATE TABLE"
+	case *parser.CreateSequence:
+		tag = "CREATE SEQUENCE"
+	case *parser.AlterSequence:
+		tag = "ALTER SEQUENCE"
+	case *parser.AlterTable:
+		tag = "ALTER TABLE"
+	case *parser.Insert:
+		tag = fmt.Sprintf("INSERT 0 %d", res.Affected)
+	case *parser.Select:
+		tag = fmt.Sprintf("SELECT %d", len(res.Rows))
+	case *parser.Update:
+		tag = fmt.Sprintf("UPDATE %d", res.Affected)
+	case *parser.Delete:
+		tag = fmt.Sprintf("DELETE %d", res.Affected)
+	case *parser.Begin:
+		tag = "BEGIN"
+	case *parser.Commit:
+		tag = "COMMIT"
+	case *parser.Rollback:
+		tag = "ROLLBACK"
+	case *parser.Vacuum:
+		tag = "VACUUM"
+	}
+	s.send(newMsg('C').str(tag))
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the framed binary protocol.
+// every message is a frame: | len | type | payload |
+// len is the 4-byte big-endian size of type + payload.
+// the client sends a request frame and reads exactly 1 response frame.
+//
+// payload encodings:
+//   - integers are varints (uvarint for counts and sizes)
+//   - strings and bytes are | uvarint len | data |
+//   - a value is | 1B type | int64 varint or bytes |
+//   - a record is | uvarint n | n column names | n values |
+//   - rows are | uvarint ncols | ncols x (name, 1B type) | uvarint nrows | values |
+const MAX_FRAME_SIZE = 64 << 20
+
+// request types
+const (
+	REQ_QUERY    = 1  // sql, args -> RES_ROWS or RES_OK
+	REQ_PREPARE  = 2  // sql -> RES_STMT
+	REQ_EXEC     = 3  // stmt id, args -> RES_ROWS or RES_OK
+	REQ_CLOSE    = 4  // stmt id -> RES_OK
+	REQ_GET      = 5  // table, key record -> RES_ROWS with 0 or 1 row
+	REQ_SET      = 6  // table, mode, record -> RES_OK, affected is 1 if added
+	REQ_DEL      = 7  // table, key record -> RES_OK, affected is 1 if deleted
+	REQ_SCAN     = 8  // table, cmp1, key1, cmp2, key2, limit -> RES_ROWS
+	REQ_BEGIN    = 9  // -> RES_OK
+	REQ_COMMIT   = 10 // -> RES_OK
+	REQ_ROLLBACK = 11 // -> RES_OK
+	REQ_PING     = 12 // -> RES_OK
+)
+
+// response types
+const (
+	RES_OK    = 128 // affected, last insert id
+	RES_ROWS  = 129 // rows
+	RES_STMT  = 130 // stmt id, number of params
+	RES_ERROR = 131 // message
+)
+
+var errBadPayload = errors.New("bad payload")
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(1+len(payload)))
+	hdr[4] = typ
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size < 1 || size > MAX_FRAME_SIZE {
+		return 0, nil, fmt.Errorf("bad frame size: %d", size)
+	}
+	payload := make([]byte, size-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], payload, nil
+}
+
+// encoders
+func putUvarint(out []byte, x uint64) []byte {
+	return binary.AppendUvarint(out, x)
+}
+
+func putVarint(out []byte, x int64) []byte {
+	return binary.AppendVarint(out, x)
+}
+
+func putBytes(out []byte, b []byte) []byte {
+	out = putUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func putString(out []byte, s string) []byte {
+	out = putUvarint(out, uint64(len(s)))
+	return append(out, s...)
+}
+
+func putValue(out []byte, v storage.Value) []byte {
+	out = append(out, byte(v.Type))
+	switch v.Type {
+	case storage.TYPE_INT64:
+		return putVarint(out, v.I64)
+	case storage.TYPE_BYTES:
+		return putBytes(out, v.Str)
+	default:
+		panic("bad type")
+	}
+}
+
+func putValues(out []byte, vals []storage.Value) []byte {
+	out = putUvarint(out, uint64(len(vals)))
+	for _, v := range vals {
+		out = putValue(out, v)
+	}
+	return out
+}
+
+func putRecord(out []byte, rec storage.Record) []byte {
+	out = putUvarint(out, uint64(len(rec.Cols)))
+	for _, c := range rec.Cols {
+		out = putString(out, c)
+	}
+	for _, v := range rec.Vals {
+		out = putValue(out, v)
+	}
+	return out
+}
+
+func putRows(out []byte, cols []string, types []uint32, rows [][]storage.Value) []byte {
+	out = putUvarint(out, uint64(len(cols)))
+	for i, c := range cols {
+		out = putString(out, c)
+		out = append(out, byte(types[i]))
+	}
+	out = putUvarint(out, uint64(len(rows)))
+	for _, row := range rows {
+		for _, v := range row {
+			out = putValue(out, v)
+		}
+	}
+	return out
+}
+
+// decoder, the first error sticks
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) fail() {
+	if r.err == nil {
+		r.err = errBadPayload
+	}
+	r.buf = nil
+}
+
+func (r *reader) byte() byte {
+	if len(r.buf) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *reader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *reader) varint() int64 {
+	x, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+// a count of items, each at least 1 byte, bounded by the remaining payload
+func (r *reader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return nil
+	}
+	b := append([]byte{}, r.buf[:n]...)
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
+
+func (r *reader) value() storage.Value {
+	v := storage.Value{Type: uint32(r.byte())}
+	switch v.Type {
+	case storage.TYPE_INT64:
+		v.I64 = r.varint()
+	case storage.TYPE_BYTES:
+		v.Str = r.bytes()
+	default:
+		r.fail()
+	}
+	return v
+}
+
+func (r *reader) values() []storage.Value {
+	n := r.count()
+	vals := make([]storage.Value, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		vals = append(vals, r.value())
+	}
+	return vals
+}
+
+func (r *reader) record() storage.Record {
+	n := r.count()
+	rec := storage.Record{}
+	for i := 0; i < n && r.err == nil; i++ {
+		rec.Cols = append(rec.Cols, r.string())
+	}
+	for i := 0; i < n && r.err == nil; i++ {
+		rec.Vals = append(rec.Vals, r.value())
+	}
+	return rec
+}
+
+func (r *reader) rows() ([]string, []uint32, [][]storage.Value) {
+	ncols := r.count()
+	cols, types := []string{}, []uint32{}
+	for i := 0; i < ncols && r.err == nil; i++ {
+		cols = append(cols, r.string())
+		types = append(types, uint32(r.byte()))
+	}
+	nrows := r.count()
+	rows := [][]storage.Value{}
+	for i := 0; i < nrows && r.err == nil; i++ {
+		row := make([]storage.Value, ncols)
+		for j := range row {
+			row[j] = r.value()
+		}
+		rows = append(rows, row)
+	}
+	return cols, types, rows
+}
+
+// the payload must be fully consumed
+func (r *reader) done() error {
+	if r.err == nil && len(r.buf) != 0 {
+		r.err = errBadPayload
+	}
+	return r.err
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// replication, a primary ships its commits to read-only followers.
+// a follower connects and says hello, the primary answers with a base
+// backup (the live pages of its last commit), then streams the page sets
+// of the next commits, see storage.PageSet. the follower replaces its
+// file with the base backup and applies the commits in order.
+// the primary doesn't keep the old commits: a follower that disconnects
+// or falls REPL_QUEUE commits behind reconnects for a new base backup,
+// so does every follower after a vacuum, a rekey or a bulk load.
+// it uses the frames of the binary protocol, the pages are sent in the
+// clear, use a private network or a tunnel.
+
+// replication frames
+const (
+	REPL_HELLO  = 64 // follower: version
+	REPL_BASE   = 65 // page size, node size, used: a base backup follows
+	REPL_PAGE   = 66 // page number, node
+	REPL_COMMIT = 67 // root, used: apply the pages since the last commit
+	REPL_RESET  = 68 // reconnect for a new base backup
+	REPL_PING   = 69 // keepalive while idle
+)
+
+const REPL_VERSION = 1
+
+// the commits buffered for a follower before it's dropped
+const REPL_QUEUE = 1024
+
+// the primary pings an idle follower, which gives up after 3 missed pings
+const REPL_HEARTBEAT = 5 * time.Second
+
+// the wait before a follower reconnects
+const REPL_RETRY = time.Second
+
+var errReplReset = errors.New("the primary asked for a new base backup")
+
+// a connected follower, on the primary
+type follower struct {
+	commits chan *storage.PageSet
+	stop    chan struct{} // closed when it's dropped
+}
+
+func (srv *Server) ListenAndServeReplication(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeReplication(ln)
+}
+
+// serve the followers until the listener is closed or the server is shut
+// down. the commits are shipped from now on.
+func (srv *Server) ServeReplication(ln net.Listener) error {
+	srv.dbmu.Lock()
+	srv.DB.ShipCommits(srv.ship)
+	srv.dbmu.Unlock()
+	return srv.serve(ln, serveFollower)
+}
+
+// the commit hook, called with the DB locked
+func (srv *Server) ship(ps *storage.PageSet) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for f := range srv.followers {
+		select {
+		case f.commits <- ps:
+		default:
+			// too far behind, it reconnects for a new base backup
+			srv.dropFollower(f)
+		}
+	}
+}
+
+// called with srv.mu held
+func (srv *Server) dropFollower(f *follower) {
+	if _, ok := srv.followers[f]; ok {
+		delete(srv.followers, f)
+		close(f.stop)
+	}
+}
+
+func serveFollower(c *srvConn) {
+	srv := c.srv
+	typ, payload, err := readFrame(bufio.NewReader(c.nc))
+	if err != nil {
+		return
+	}
+	r := &reader{buf: payload}
+	if version := r.uvarint(); typ != REPL_HELLO || r.done() != nil || version != REPL_VERSION {
+		srv.log().Warn("replication: bad hello", "follower", c.nc.RemoteAddr().String())
+		return
+	}
+
+	// pin the last commit and get the next ones, none is missed
+	f := &follower{commits: make(chan *storage.PageSet, REPL_QUEUE), stop: make(chan struct{})}
+	var snap *storage.Snapshot
+	err = srv.locked(func(db *storage.DB) error {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.done {
+			return ErrServerClosed
+		}
+		snap = db.Snapshot()
+		srv.followers[f] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		srv.mu.Lock()
+		srv.dropFollower(f)
+		srv.mu.Unlock()
+	}()
+	w := bufio.NewWriter(c.nc)
+	err = sendBase(w, snap)
+	snap.Close()
+	if err != nil {
+		srv.log().Warn("replication: base backup failed", "follower", c.nc.RemoteAddr().String(), "err", err)
+		return
+	}
+
+	ping := time.NewTicker(REPL_HEARTBEAT)
+	defer ping.Stop()
+	for {
+		reset := false
+		select {
+		case ps := <-f.commits:
+			reset = ps.Reset
+			err = sendCommit(w, ps)
+		case <-ping.C:
+			err = writeFrame(w, REPL_PING, nil)
+		case <-f.stop:
+			return // lagging or shutting down, the follower reconnects
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil || reset {
+			return
+		}
+	}
+}
+
+// the live pages of a snapshot at their page numbers
+func sendBase(w *bufio.Writer, snap *storage.Snapshot) error {
+	root, used := snap.Root()
+	page, node := snap.Sizes()
+	hdr := putUvarint(putUvarint(putUvarint(nil, uint64(page)), uint64(node)), used)
+	if err := writeFrame(w, REPL_BASE, hdr); err != nil {
+		return err
+	}
+	err := snap.Pages(func(ptr uint64, node []byte) error {
+		return writeFrame(w, REPL_PAGE, putBytes(putUvarint(nil, ptr), node))
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFrame(w, REPL_COMMIT, putUvarint(putUvarint(nil, root), used)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func sendCommit(w *bufio.Writer, ps *storage.PageSet) error {
+	if ps.Reset {
+		return writeFrame(w, REPL_RESET, nil)
+	}
+	for ptr, node := range ps.Pages {
+		if err := writeFrame(w, REPL_PAGE, putBytes(putUvarint(nil, ptr), node)); err != nil {
+			return err
+		}
+	}
+	return writeFrame(w, REPL_COMMIT, putUvarint(putUvarint(nil, ps.Root), ps.Used))
+}
+
+// follow the primary at `addr` until ctx is done: replace the database
+// with a base backup, then apply the commits as they come. it reconnects
+// when the connection is lost or the primary resets.
+// the DB is opened with Options.ReadOnly, the server serves the reads.
+func (srv *Server) Follow(ctx context.Context, addr string) error {
+	for {
+		err := srv.follow(ctx, addr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errReplReset) {
+			srv.log().Info("replication: taking a new base backup", "primary", addr, "reason", err)
+			continue
+		}
+		srv.log().Warn("replication: connection lost, reconnecting", "primary", addr, "err", err, "retry", REPL_RETRY)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(REPL_RETRY):
+		}
+	}
+}
+
+func (srv *Server) follow(ctx context.Context, addr string) error {
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	defer context.AfterFunc(ctx, func() { nc.Close() })()
+	if err := writeFrame(nc, REPL_HELLO, putUvarint(nil, REPL_VERSION)); err != nil {
+		return err
+	}
+	rd := bufio.NewReader(nc)
+	next := func() (byte, *reader, error) {
+		_ = nc.SetReadDeadline(time.Now().Add(3 * REPL_HEARTBEAT))
+		typ, payload, err := readFrame(rd)
+		return typ, &reader{buf: payload}, err
+	}
+
+	// the base backup, into a new file
+	typ, r, err := next()
+	if err != nil {
+		return err
+	}
+	page, node, used := r.uvarint(), r.uvarint(), r.uvarint()
+	if err := r.done(); err != nil || typ != REPL_BASE {
+		return fmt.Errorf("expected a base backup, got frame %d", typ)
+	}
+	base, err := srv.DB.NewBase(int(page), int(node), used)
+	if err != nil {
+		return err
+	}
+	root, _, err := receiveCommit(next, base.Add)
+	if err == nil {
+		err = base.Finish(root)
+	}
+	if err != nil {
+		base.Abort()
+		return err
+	}
+	err = srv.locked(func(db *storage.DB) error { return db.ReplaceWithBase(base) })
+	if err != nil {
+		return err
+	}
+	srv.log().Info("replication: following the primary", "primary", addr, "base_pages", used)
+
+	// the commits
+	for {
+		pages := map[uint64][]byte{}
+		root, used, err := receiveCommit(next, func(ptr uint64, node []byte) error {
+			pages[ptr] = node
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = srv.locked(func(db *storage.DB) error {
+			return db.ApplyPages(&storage.PageSet{Root: root, Used: used, Pages: pages})
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// read the pages of a commit, returns its root and number of pages
+func receiveCommit(next func() (byte, *reader, error), add func(ptr uint64, node []byte) error) (uint64, uint64, error) {
+	for {
+		typ, r, err := next()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch typ {
+		case REPL_PAGE:
+			ptr, node := r.uvarint(), r.bytes()
+			if err := r.done(); err != nil {
+				return 0, 0, err
+			}
+			if err := add(ptr, node); err != nil {
+				return 0, 0, err
+			}
+		case REPL_COMMIT:
+			root, used := r.uvarint(), r.uvarint()
+			return root, used, r.done()
+		case REPL_PING:
+		case REPL_RESET:
+			return 0, 0, errReplReset
+		default:
+			return 0, 0, fmt.Errorf("unexpected frame %d", typ)
+		}
+	}
+}
@@ -0,0 +1,632 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a Redis (RESP2) front-end on a raw keyspace of the DB.
+// the values are strings, their expirations are those of the keyspace:
+// expired keys read as absent and are deleted by the expiry sweeper.
+
+// the keyspace of the Redis front-end
+const RESP_KEYSPACE = "redis"
+
+// limits of the RESP requests
+const (
+	RESP_MAX_ARGS   = 1024 * 1024
+	RESP_MAX_BULK   = 512 * 1024
+	RESP_MAX_INLINE = 64 * 1024
+)
+
+// SCAN cursors kept by the server, the oldest are dropped
+const RESP_MAX_CURSORS = 4096
+
+// the default SCAN COUNT
+const RESP_SCAN_COUNT = 10
+
+// SCAN resumes from the key stored under the cursor id,
+// cursors are shared by the connections since clients use pools
+type respCursors struct {
+	mu   sync.Mutex
+	next uint64
+	keys map[uint64][]byte
+}
+
+func (rc *respCursors) put(key []byte) uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.keys == nil {
+		rc.keys = map[uint64][]byte{}
+	}
+	rc.next++
+	rc.keys[rc.next] = key
+	delete(rc.keys, rc.next-RESP_MAX_CURSORS)
+	return rc.next
+}
+
+func (rc *respCursors) get(id uint64) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	key, ok := rc.keys[id]
+	return key, ok
+}
+
+// a reply error
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+var (
+	errRespSyntax  = respError("ERR syntax error")
+	errRespInteger = respError("ERR value is not an integer or out of range")
+)
+
+func errRespArgs(cmd string) error {
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
+
+func (srv *Server) ListenAndServeRESP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.ServeRESP(ln)
+}
+
+// serve the Redis protocol until the listener is closed or the server is shut down
+func (srv *Server) ServeRESP(ln net.Listener) error {
+	return srv.serve(ln, serveRESP)
+}
+
+type respSession struct {
+	*srvConn
+	rd *bufio.Reader
+	wr *bufio.Writer
+}
+
+func serveRESP(c *srvConn) {
+	s := &respSession{
+		srvConn: c,
+		rd:      bufio.NewReader(c.nc),
+		wr:      bufio.NewWriter(c.nc),
+	}
+	for {
+		args, err := s.readCommand()
+		if err != nil {
+			var re respError
+			if errors.As(err, &re) {
+				s.writeError(re) // a protocol error closes the connection
+				s.wr.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue // an empty inline command
+		}
+		if !c.begin() {
+			return // the request raced with the shutdown
+		}
+		quit := s.handle(args)
+		// pipelined commands are answered together
+		if s.rd.Buffered() == 0 || s.wr.Buffered() > 64<<10 {
+			err = s.wr.Flush()
+		}
+		if !c.end() || err != nil || quit {
+			s.wr.Flush()
+			return
+		}
+	}
+}
+
+// read a command, an array of bulk strings or an inline command
+func (s *respSession) readCommand() ([][]byte, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		if len(line) > RESP_MAX_INLINE {
+			return nil, respError("ERR Protocol error: too big inline request")
+		}
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > RESP_MAX_ARGS {
+		return nil, respError("ERR Protocol error: invalid multibulk length")
+	}
+	args := [][]byte{}
+	for i := 0; i < n; i++ {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, respError(fmt.Sprintf("ERR Protocol error: expected '$', got '%s'", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > RESP_MAX_BULK {
+			return nil, respError("ERR Protocol error: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(s.rd, buf); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(buf, []byte("\r\n")) {
+			return nil, respError("ERR Protocol error: bad bulk string")
+		}
+		args = append(args, buf[:size])
+	}
+	return args, nil
+}
+
+func (s *respSession) readLine() ([]byte, error) {
+	line := []byte{}
+	for {
+		chunk, isPrefix, err := s.rd.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > RESP_MAX_INLINE {
+			return nil, respError("ERR Protocol error: too big request")
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// replies
+func (s *respSession) writeSimple(str string) {
+	s.wr.WriteString("+" + str + "\r\n")
+}
+
+func (s *respSession) writeError(err error) {
+	msg := err.Error()
+	if _, ok := err.(respError); !ok {
+		msg = "ERR " + msg
+	}
+	s.wr.WriteString("-" + strings.ReplaceAll(msg, "\r\n", " ") + "\r\n")
+}
+
+func (s *respSession) writeInt(n int64) {
+	s.wr.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// a nil slice is the null bulk string
+func (s *respSession) writeBulk(b []byte) {
+	if b == nil {
+		s.wr.WriteString("$-1\r\n")
+		return
+	}
+	s.wr.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	s.wr.Write(b)
+	s.wr.WriteString("\r\n")
+}
+
+func (s *respSession) writeArray(n int) {
+	s.wr.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// a value and its expiration
+type respValue struct {
+	expireAt int64 // Unix milliseconds, 0 for none
+	data     []byte
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// get a live value
+func respGet(ks *storage.Keyspace, key []byte) (respValue, bool) {
+	val, ok := ks.Get(key)
+	if !ok {
+		return respValue{}, false
+	}
+	return respValue{expireAt: ks.Expiry(key), data: val}, true
+}
+
+// set a value with an update mode, an expired key counts as absent
+func respSet(ks *storage.Keyspace, key []byte, v respValue, mode int) (bool, error) {
+	if len(v.data) > ks.MaxVal() {
+		return false, respError("ERR value is too large")
+	}
+	return ks.SetEx(key, v.data, v.expireAt, mode)
+}
+
+// run a write command atomically
+func atomically(db *storage.DB, fn func() error) error {
+	if db.InTx() {
+		return fn()
+	}
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		_ = db.Abort()
+		return err
+	}
+	return db.Commit()
+}
+
+// execute a command and write the reply, returns true to close the connection
+func (s *respSession) handle(args [][]byte) bool {
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch cmd {
+	case "PING":
+		switch len(args) {
+		case 0:
+			s.writeSimple("PONG")
+		case 1:
+			s.writeBulk(args[0])
+		default:
+			s.writeError(errRespArgs(cmd))
+		}
+		return false
+	case "ECHO":
+		if len(args) != 1 {
+			s.writeError(errRespArgs(cmd))
+		} else {
+			s.writeBulk(args[0])
+		}
+		return false
+	case "QUIT":
+		s.writeSimple("OK")
+		return true
+	case "SELECT":
+		if len(args) != 1 {
+			s.writeError(errRespArgs(cmd))
+		} else if string(args[0]) != "0" {
+			s.writeError(respError("ERR DB index is out of range"))
+		} else {
+			s.writeSimple("OK")
+		}
+		return false
+	}
+
+	// the commands on the keyspace
+	var reply func()
+	err := s.locked(func(db *storage.DB) error {
+		ks, err := db.Keyspace(RESP_KEYSPACE)
+		if err != nil {
+			return err
+		}
+		reply, err = s.exec(db, ks, cmd, args)
+		return err
+	})
+	if err != nil {
+		s.writeError(err)
+	} else {
+		reply()
+	}
+	return false
+}
+
+// execute a keyspace command, returns a function writing the reply
+func (s *respSession) exec(db *storage.DB, ks *storage.Keyspace, cmd string, args [][]byte) (func(), error) {
+	switch cmd {
+	case "GET":
+		if len(args) != 1 {
+			return nil, errRespArgs(cmd)
+		}
+		v, ok := respGet(ks, args[0])
+		if !ok {
+			return func() { s.writeBulk(nil) }, nil
+		}
+		return func() { s.writeBulk(v.data) }, nil
+	case "SET":
+		return s.set(ks, args)
+	case "DEL":
+		if len(args) == 0 {
+			return nil, errRespArgs(cmd)
+		}
+		n := int64(0)
+		err := atomically(db, func() error {
+			for _, key := range args {
+				_, live := respGet(ks, key)
+				deleted, err := ks.Del(key)
+				if err != nil {
+					return err
+				}
+				if deleted && live {
+					n++
+				}
+			}
+			return nil
+		})
+		return func() { s.writeInt(n) }, err
+	case "EXISTS":
+		if len(args) == 0 {
+			return nil, errRespArgs(cmd)
+		}
+		n := int64(0)
+		for _, key := range args {
+			if _, ok := respGet(ks, key); ok {
+				n++
+			}
+		}
+		return func() { s.writeInt(n) }, nil
+	case "MGET":
+		if len(args) == 0 {
+			return nil, errRespArgs(cmd)
+		}
+		vals := [][]byte{}
+		for _, key := range args {
+			v, ok := respGet(ks, key)
+			if ok && v.data == nil {
+				v.data = []byte{}
+			}
+			vals = append(vals, v.data)
+		}
+		return func() {
+			s.writeArray(len(vals))
+			for _, val := range vals {
+				s.writeBulk(val)
+			}
+		}, nil
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			return nil, errRespArgs(cmd)
+		}
+		err := atomically(db, func() error {
+			for i := 0; i < len(args); i += 2 {
+				_, err := respSet(ks, args[i], respValue{data: args[i+1]}, storage.MODE_UPSERT)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return func() { s.writeSimple("OK") }, err
+	case "INCR":
+		if len(args) != 1 {
+			return nil, errRespArgs(cmd)
+		}
+		v, _ := respGet(ks, args[0])
+		n := int64(0)
+		if v.data != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(v.data), 10, 64); err != nil {
+				return nil, errRespInteger
+			}
+		}
+		if n == 1<<63-1 {
+			return nil, respError("ERR increment or decrement would overflow")
+		}
+		n++
+		v.data = strconv.AppendInt(nil, n, 10) // keeps the expiration
+		_, err := respSet(ks, args[0], v, storage.MODE_UPSERT)
+		return func() { s.writeInt(n) }, err
+	case "EXPIRE":
+		if len(args) != 2 {
+			return nil, errRespArgs(cmd)
+		}
+		secs, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || secs > (1<<62)/1000 || secs < -(1<<62)/1000 {
+			return nil, errRespInteger
+		}
+		v, ok := respGet(ks, args[0])
+		if !ok {
+			return func() { s.writeInt(0) }, nil
+		}
+		if secs <= 0 {
+			_, err = ks.Del(args[0])
+		} else {
+			v.expireAt = nowMillis() + secs*1000
+			_, err = respSet(ks, args[0], v, storage.MODE_UPSERT)
+		}
+		return func() { s.writeInt(1) }, err
+	case "TTL":
+		if len(args) != 1 {
+			return nil, errRespArgs(cmd)
+		}
+		v, ok := respGet(ks, args[0])
+		ttl := int64(-2)
+		switch {
+		case ok && v.expireAt == 0:
+			ttl = -1
+		case ok:
+			ttl = (v.expireAt - nowMillis() + 999) / 1000
+		}
+		return func() { s.writeInt(ttl) }, nil
+	case "SCAN":
+		return s.scan(ks, args)
+	default:
+		return nil, respError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(cmd)))
+	}
+}
+
+// SET key value [NX|XX] [EX seconds|PX milliseconds] [GET]
+func (s *respSession) set(ks *storage.Keyspace, args [][]byte) (func(), error) {
+	if len(args) < 2 {
+		return nil, errRespArgs("SET")
+	}
+	key, v := args[0], respValue{data: args[1]}
+	mode, get := storage.MODE_UPSERT, false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX", "XX":
+			if mode != storage.MODE_UPSERT {
+				return nil, errRespSyntax
+			}
+			mode = storage.MODE_INSERT_ONLY
+			if opt == "XX" {
+				mode = storage.MODE_UPDATE_ONLY
+			}
+		case "EX", "PX":
+			if v.expireAt != 0 || i+1 >= len(args) {
+				return nil, errRespSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 || n > (1<<62)/1000 {
+				return nil, respError("ERR invalid expire time in 'set' command")
+			}
+			if opt == "EX" {
+				n *= 1000
+			}
+			v.expireAt = nowMillis() + n
+		case "GET":
+			get = true
+		default:
+			return nil, errRespSyntax
+		}
+	}
+	old, _ := respGet(ks, key)
+	ok, err := respSet(ks, key, v, mode)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case get:
+		return func() { s.writeBulk(old.data) }, nil
+	case ok:
+		return func() { s.writeSimple("OK") }, nil
+	default:
+		return func() { s.writeBulk(nil) }, nil
+	}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (s *respSession) scan(ks *storage.Keyspace, args [][]byte) (func(), error) {
+	if len(args) == 0 || len(args)%2 != 1 {
+		return nil, errRespArgs("SCAN")
+	}
+	id, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, respError("ERR invalid cursor")
+	}
+	pattern, count, typ := []byte("*"), RESP_SCAN_COUNT, "string"
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				return nil, errRespSyntax
+			}
+		case "TYPE":
+			typ = strings.ToLower(string(args[i+1]))
+		default:
+			return nil, errRespSyntax
+		}
+	}
+
+	start := []byte{}
+	if id != 0 {
+		var ok bool
+		if start, ok = s.srv.resp.get(id); !ok {
+			return nil, respError("ERR invalid cursor")
+		}
+	}
+	// visit up to `count` keys, the matching ones are returned
+	keys := [][]byte{}
+	var next []byte
+	n := 0
+	ks.Scan(start, func(key []byte, val []byte) bool {
+		if n == count {
+			next = append([]byte{}, key...)
+			return false
+		}
+		n++
+		if typ == "string" && globMatch(pattern, key) {
+			keys = append(keys, append([]byte{}, key...))
+		}
+		return true
+	})
+	cursor := uint64(0)
+	if next != nil {
+		cursor = s.srv.resp.put(next)
+	}
+	return func() {
+		s.writeArray(2)
+		s.writeBulk([]byte(strconv.FormatUint(cursor, 10)))
+		s.writeArray(len(keys))
+		for _, key := range keys {
+			s.writeBulk(key)
+		}
+	}, nil
+}
+
+// Redis glob-style matching: * ? [abc] [^a-z] and \ escapes
+func globMatch(pattern []byte, str []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if globMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			end := bytes.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false // unterminated class
+			}
+			class := pattern[1 : 1+end]
+			negate := len(class) > 0 && class[0] == '^'
+			if negate {
+				class = class[1:]
+			}
+			match := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (lo <= str[0] && str[0] <= hi)
+					i += 2
+				} else {
+					match = match || class[i] == str[0]
+				}
+			}
+			if match == negate {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[2+end:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(str) == 0 || str[0] != pattern[0] {
+				return false
+			}
+			str = str[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(str) == 0
+}
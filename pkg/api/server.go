@@ -1 +1,598 @@
-package api
\ No newline at end of file
+package api
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/metrics"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown
+var ErrServerClosed = errors.New("api: server closed")
+
+// the server multiplexes many clients onto a single DB.
+// requests are executed one at a time, a client in a transaction
+// holds the DB until it commits, rolls back or disconnects, or
+// until it stays idle for IdleInTxTimeout.
+// the protocol front-ends share the DB and the shutdown logic.
+type Server struct {
+	DB *storage.DB
+	// the PostgreSQL type reported for TYPE_BYTES, PG_OID_TEXT if 0
+	PGBytesOID uint32
+	// exposed on GET /metrics by the HTTP front-ends if set
+	Metrics *metrics.Registry
+	// roll back the transaction of a client idle for longer and close
+	// its connection, like PostgreSQL. no limit if 0
+	IdleInTxTimeout time.Duration
+	// diagnostics, the DB's logger by NewServer, silent if nil
+	Logger storage.Logger
+	// internals
+	dbmu     sync.Mutex     // serializes access to the DB
+	dbClosed bool           // by CloseDB, guarded by dbmu
+	wg       sync.WaitGroup // running connections
+	mu       sync.Mutex     // guards the fields below
+	done     bool           // shutting down
+	lns      map[net.Listener]struct{}
+	conns    map[*srvConn]struct{}
+	hsrvs    map[*http.Server]struct{} // the HTTP front-ends
+	resp     respCursors               // the Redis SCAN cursors
+	// the connected followers of a primary, see replication.go
+	followers map[*follower]struct{}
+	// the consumers of the live changes, see changes.go
+	watchers map[*watcher]struct{}
+}
+
+// a connection of any protocol front-end
+type srvConn struct {
+	srv  *Server
+	nc   net.Conn
+	inTx bool // holds srv.dbmu across requests
+	busy bool // executing a request, guarded by srv.mu
+	// the idle in transaction timer, guarded by srv.mu.
+	// a new request or the close invalidates it by moving `idle` on.
+	idle      uint64
+	idleTimer *time.Timer
+}
+
+// a binary protocol connection
+type session struct {
+	*srvConn
+	rd    *bufio.Reader
+	wr    *bufio.Writer
+	stmts map[uint64]*parser.Statement
+	next  uint64 // the next statement id
+}
+
+func NewServer(db *storage.DB) *Server {
+	return &Server{
+		DB:        db,
+		Logger:    db.Options.Logger,
+		lns:       map[net.Listener]struct{}{},
+		conns:     map[*srvConn]struct{}{},
+		hsrvs:     map[*http.Server]struct{}{},
+		followers: map[*follower]struct{}{},
+		watchers:  map[*watcher]struct{}{},
+	}
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ln)
+}
+
+// serve the binary protocol until the listener is closed or the server is shut down
+func (srv *Server) Serve(ln net.Listener) error {
+	return srv.serve(ln, serveBinary)
+}
+
+// accept connections and run `handle` for each of them
+func (srv *Server) serve(ln net.Listener, handle func(c *srvConn)) error {
+	srv.mu.Lock()
+	if srv.done {
+		srv.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	srv.lns[ln] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.lns, ln)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			srv.mu.Lock()
+			done := srv.done
+			srv.mu.Unlock()
+			if done {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		c := &srvConn{srv: srv, nc: nc}
+		srv.mu.Lock()
+		if srv.done {
+			srv.mu.Unlock()
+			nc.Close()
+			return ErrServerClosed
+		}
+		srv.conns[c] = struct{}{}
+		srv.wg.Add(1)
+		srv.mu.Unlock()
+		go func() {
+			defer c.close()
+			handle(c)
+		}()
+	}
+}
+
+// stop accepting connections, let the in-flight requests finish,
+// then close idle connections and wait for them to exit.
+// the caller closes the DB afterwards, see CloseDB.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.done = true
+	for ln := range srv.lns {
+		ln.Close()
+	}
+	for c := range srv.conns {
+		c.interrupt()
+	}
+	for f := range srv.followers {
+		srv.dropFollower(f)
+	}
+	for wt := range srv.watchers {
+		srv.dropWatcher(wt)
+	}
+	hsrvs := []*http.Server{}
+	for hs := range srv.hsrvs {
+		hsrvs = append(hsrvs, hs)
+	}
+	srv.mu.Unlock()
+
+	// the HTTP servers drain their own requests
+	var herr error
+	for _, hs := range hsrvs {
+		if err := hs.Shutdown(ctx); err != nil && herr == nil {
+			herr = err
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return herr
+	case <-ctx.Done():
+		// force the remaining connections closed
+		srv.mu.Lock()
+		for c := range srv.conns {
+			c.nc.Close()
+		}
+		srv.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (srv *Server) log() storage.Logger {
+	if srv.Logger == nil {
+		return storage.NopLogger()
+	}
+	return srv.Logger
+}
+
+// close the DB after Shutdown. it waits for the DB lock: after a timed
+// out Shutdown, a request may still be running. the requests that come
+// later fail with ErrServerClosed.
+func (srv *Server) CloseDB() error {
+	srv.dbmu.Lock()
+	defer srv.dbmu.Unlock()
+	srv.dbClosed = true
+	return srv.DB.Close()
+}
+
+// wake up a connection blocked on reading the next request.
+// called with srv.mu held.
+func (c *srvConn) interrupt() {
+	if !c.busy {
+		_ = c.nc.SetReadDeadline(time.Now())
+	}
+}
+
+// mark the start of a request, false if the server is shutting down
+func (c *srvConn) begin() bool {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	c.stopIdle()
+	c.busy = !c.srv.done
+	return c.busy
+}
+
+// mark the end of a request, false if the connection should be closed
+func (c *srvConn) end() bool {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+	c.busy = false
+	if c.inTx && c.srv.IdleInTxTimeout > 0 {
+		idle := c.idle
+		c.idleTimer = time.AfterFunc(c.srv.IdleInTxTimeout, func() { c.idleTimeout(idle) })
+	}
+	return !c.srv.done
+}
+
+// invalidate the idle timer, called with srv.mu held
+func (c *srvConn) stopIdle() {
+	c.idle++
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+}
+
+// roll back the transaction of an idle connection and close it,
+// unless a request or the close came first
+func (c *srvConn) idleTimeout(idle uint64) {
+	srv := c.srv
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if idle != c.idle || c.busy || !c.inTx {
+		return
+	}
+	// the connection holds dbmu and is not using the DB
+	_ = srv.DB.Abort()
+	c.inTx = false
+	srv.dbmu.Unlock()
+	srv.log().Warn("idle transaction rolled back", "remote", c.nc.RemoteAddr().String(), "timeout", srv.IdleInTxTimeout)
+	c.nc.Close()
+}
+
+func (c *srvConn) close() {
+	srv := c.srv
+	srv.mu.Lock()
+	c.stopIdle()
+	srv.mu.Unlock()
+	if c.inTx {
+		// an unfinished transaction is rolled back
+		_ = srv.DB.Abort()
+		c.inTx = false
+		srv.dbmu.Unlock()
+	}
+	c.nc.Close()
+	srv.mu.Lock()
+	delete(srv.conns, c)
+	srv.mu.Unlock()
+	srv.wg.Done()
+}
+
+// run `fn` with exclusive access to the DB.
+// the DB stays locked while the connection is in a transaction.
+func (c *srvConn) locked(fn func(db *storage.DB) error) (err error) {
+	if !c.inTx {
+		c.srv.dbmu.Lock()
+		if c.srv.dbClosed {
+			c.srv.dbmu.Unlock()
+			return ErrServerClosed
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// storage asserts on corrupted input, keep serving the others.
+			// the transaction in progress is in an unknown state, be it
+			// the client's or the one of the statement, roll it back.
+			c.srv.log().Error("panic while handling a request", "remote", c.nc.RemoteAddr().String(), "panic", r)
+			err = fmt.Errorf("internal error: %v", r)
+			if c.srv.DB.InTx() {
+				_ = c.srv.DB.Abort()
+				if c.inTx {
+					err = fmt.Errorf("%w, the transaction was rolled back", err)
+				}
+			}
+		}
+		c.inTx = c.srv.DB.InTx()
+		if !c.inTx {
+			c.srv.dbmu.Unlock()
+		}
+	}()
+	return fn(c.srv.DB)
+}
+
+// run `fn` with exclusive access to the DB for a request
+// that is not bound to a connection, such as an HTTP request.
+// a transaction left open by `fn` is rolled back.
+func (srv *Server) locked(fn func(db *storage.DB) error) (err error) {
+	srv.dbmu.Lock()
+	defer srv.dbmu.Unlock()
+	if srv.dbClosed {
+		return ErrServerClosed
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			srv.log().Error("panic while handling a request", "panic", r)
+			err = fmt.Errorf("internal error: %v", r)
+		}
+		if srv.DB.InTx() {
+			_ = srv.DB.Abort()
+			if err == nil {
+				err = errors.New("the transaction was not committed")
+			}
+		}
+	}()
+	return fn(srv.DB)
+}
+
+// delete the expired rows and entries every `interval` until ctx is done,
+// a batch at a time so that the requests are not kept waiting.
+// see storage.DB.SweepExpired.
+func (srv *Server) SweepExpired(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		for n := storage.EXPIRY_BATCH; n == storage.EXPIRY_BATCH && ctx.Err() == nil; {
+			err := srv.locked(func(db *storage.DB) (err error) {
+				n, err = db.SweepExpired(storage.EXPIRY_BATCH)
+				return err
+			})
+			if err != nil {
+				srv.log().Error("deleting the expired rows", "err", err)
+				break
+			}
+		}
+	}
+}
+
+// run a parsed statement
+func (c *srvConn) exec(stmt *parser.Statement, args []storage.Value) (*executer.Result, error) {
+	var res *executer.Result
+	err := c.locked(func(db *storage.DB) (err error) {
+		res, err = executer.Exec(db, stmt, args)
+		return err
+	})
+	return res, err
+}
+
+func serveBinary(c *srvConn) {
+	s := &session{
+		srvConn: c,
+		rd:      bufio.NewReader(c.nc),
+		wr:      bufio.NewWriter(c.nc),
+		stmts:   map[uint64]*parser.Statement{},
+		next:    1,
+	}
+	for {
+		typ, payload, err := readFrame(s.rd)
+		if err != nil {
+			return // disconnected or shutting down
+		}
+		if !c.begin() {
+			return // the request raced with the shutdown
+		}
+		rtyp, rpayload := s.handle(typ, payload)
+		err = writeFrame(s.wr, rtyp, rpayload)
+		if err == nil {
+			err = s.wr.Flush()
+		}
+		if !c.end() || err != nil {
+			return
+		}
+	}
+}
+
+// execute a request, returns the response
+func (s *session) handle(typ byte, payload []byte) (byte, []byte) {
+	var out []byte
+	var err error
+	r := &reader{buf: payload}
+	switch typ {
+	case REQ_QUERY:
+		sql, args := r.string(), r.values()
+		if err = r.done(); err == nil {
+			var stmt *parser.Statement
+			if stmt, err = parser.Parse(sql); err == nil {
+				typ, out, err = s.exec(stmt, args)
+			}
+		}
+	case REQ_PREPARE:
+		sql := r.string()
+		if err = r.done(); err == nil {
+			var stmt *parser.Statement
+			if stmt, err = parser.Parse(sql); err == nil {
+				id := s.next
+				s.next++
+				s.stmts[id] = stmt
+				typ, out = RES_STMT, putUvarint(putUvarint(nil, id), uint64(stmt.NumParams))
+			}
+		}
+	case REQ_EXEC:
+		id, args := r.uvarint(), r.values()
+		if err = r.done(); err == nil {
+			stmt, ok := s.stmts[id]
+			if !ok {
+				err = fmt.Errorf("unknown statement id: %d", id)
+			} else {
+				typ, out, err = s.exec(stmt, args)
+			}
+		}
+	case REQ_CLOSE:
+		id := r.uvarint()
+		if err = r.done(); err == nil {
+			delete(s.stmts, id)
+			typ, out = RES_OK, okPayload(0, 0)
+		}
+	case REQ_GET:
+		table, key := r.string(), r.record()
+		if err = r.done(); err == nil {
+			typ, out, err = s.get(table, key)
+		}
+	case REQ_SET:
+		table, mode, rec := r.string(), int(r.uvarint()), r.record()
+		if err = r.done(); err == nil {
+			typ, out, err = s.set(table, mode, rec)
+		}
+	case REQ_DEL:
+		table, key := r.string(), r.record()
+		if err = r.done(); err == nil {
+			typ, out, err = s.del(table, key)
+		}
+	case REQ_SCAN:
+		table := r.string()
+		sc := storage.Scanner{}
+		sc.Cmp1, sc.Key1 = int(r.varint()), r.record()
+		sc.Cmp2, sc.Key2 = int(r.varint()), r.record()
+		limit := r.varint()
+		if err = r.done(); err == nil {
+			typ, out, err = s.scan(table, &sc, limit)
+		}
+	case REQ_BEGIN:
+		typ, out, err = s.exec(&parser.Statement{Stmt: &parser.Begin{}}, nil)
+	case REQ_COMMIT:
+		typ, out, err = s.exec(&parser.Statement{Stmt: &parser.Commit{}}, nil)
+	case REQ_ROLLBACK:
+		typ, out, err = s.exec(&parser.Statement{Stmt: &parser.Rollback{}}, nil)
+	case REQ_PING:
+		typ, out = RES_OK, okPayload(0, 0)
+	default:
+		err = fmt.Errorf("unknown request type: %d", typ)
+	}
+	if err != nil {
+		return RES_ERROR, putString(nil, err.Error())
+	}
+	return typ, out
+}
+
+func okPayload(affected int64, lastID int64) []byte {
+	return putVarint(putVarint(nil, affected), lastID)
+}
+
+func (s *session) exec(stmt *parser.Statement, args []storage.Value) (byte, []byte, error) {
+	res, err := s.srvConn.exec(stmt, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	if res.Cols != nil {
+		return RES_ROWS, putRows(nil, res.Cols, res.Types, res.Rows), nil
+	}
+	return RES_OK, okPayload(res.Affected, res.LastInsertID), nil
+}
+
+func (s *session) get(table string, key storage.Record) (byte, []byte, error) {
+	var tdef *storage.TableDef
+	ok := false
+	err := s.locked(func(db *storage.DB) (err error) {
+		tdef = db.GetTableDef(table)
+		ok, err = db.Get(table, &key)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	rows := [][]storage.Value{}
+	if ok {
+		rows = append(rows, key.Vals)
+	}
+	return RES_ROWS, putRows(nil, key.Cols, recordTypes(tdef, key.Cols), rows), nil
+}
+
+func (s *session) set(table string, mode int, rec storage.Record) (byte, []byte, error) {
+	added := false
+	lastID := int64(0)
+	err := s.locked(func(db *storage.DB) (err error) {
+		if mode == storage.MODE_INSERT_ONLY {
+			added, err = db.Insert(table, &rec)
+			if tdef := db.GetTableDef(table); err == nil && tdef.AutoIncrement {
+				lastID = rec.Get(tdef.Cols[0]).I64
+			}
+		} else {
+			added, err = db.Set(table, rec, mode)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	affected := int64(0)
+	if added {
+		affected = 1
+	}
+	return RES_OK, okPayload(affected, lastID), nil
+}
+
+func (s *session) del(table string, key storage.Record) (byte, []byte, error) {
+	deleted := false
+	err := s.locked(func(db *storage.DB) (err error) {
+		deleted, err = db.Delete(table, key)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	affected := int64(0)
+	if deleted {
+		affected = 1
+	}
+	return RES_OK, okPayload(affected, 0), nil
+}
+
+// a negative limit means no limit
+func (s *session) scan(table string, sc *storage.Scanner, limit int64) (byte, []byte, error) {
+	var tdef *storage.TableDef
+	rows := [][]storage.Value{}
+	err := s.locked(func(db *storage.DB) error {
+		if err := db.Scan(table, sc); err != nil {
+			return err
+		}
+		tdef = db.GetTableDef(table)
+		for rec := (storage.Record{}); sc.Valid(); sc.Next() {
+			if limit >= 0 && int64(len(rows)) >= limit {
+				break
+			}
+			sc.Deref(&rec)
+			rows = append(rows, append([]storage.Value{}, rec.Vals...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return RES_ROWS, putRows(nil, tdef.Cols, tdef.Types, rows), nil
+}
+
+// the column types of a record
+func recordTypes(tdef *storage.TableDef, cols []string) []uint32 {
+	types := make([]uint32, len(cols))
+	for i, c := range cols {
+		for j, tc := range tdef.Cols {
+			if tc == c {
+				types[i] = tdef.Types[j]
+			}
+		}
+	}
+	return types
+}
@@ -0,0 +1,577 @@
+// Package dungeondb is the embeddable DungeonDB engine.
+//
+//	db, err := dungeondb.Open("app.db", nil)
+//	if err != nil {
+//		...
+//	}
+//	defer db.Close()
+//
+//	err = db.CreateTable(&dungeondb.TableDef{
+//		Name:  "users",
+//		Cols:  []string{"id", "name"},
+//		Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES},
+//		Pkeys: 1,
+//	})
+//	err = db.Insert("users", (&dungeondb.Record{}).AddInt64("id", 1).AddStr("name", []byte("ann")))
+//	row, err := db.Get("users", *(&dungeondb.Record{}).AddInt64("id", 1))
+//
+// a DB is safe for concurrent use, the operations are serialized.
+// each DB method is atomic, a Tx groups several of them and holds
+// the DB until it commits or rolls back.
+package dungeondb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a table cell, see TYPE_INT64 and TYPE_BYTES
+type Value = storage.Value
+
+// a row or a key, a list of column names and values
+type Record = storage.Record
+
+// a table schema, the prefixes are assigned by CreateTable
+type TableDef = storage.TableDef
+
+// a leveled logger, *slog.Logger satisfies it
+type Logger = storage.Logger
+
+// options for BulkLoad, the zero value is the default
+type BulkOptions = storage.BulkOptions
+
+// options for Vacuum, the zero value is a full vacuum
+type VacuumOptions = storage.VacuumOptions
+
+// a row change recorded in the changelog, see Options.Changelog
+type Change = storage.Change
+
+// value types
+const (
+	TYPE_BYTES = storage.TYPE_BYTES
+	TYPE_INT64 = storage.TYPE_INT64
+)
+
+// errors, test for them with errors.Is
+var (
+	// the DB or the Tx is used after Close
+	ErrClosed = errors.New("dungeondb: database is closed")
+	// the Tx has already been committed or rolled back
+	ErrTxDone = errors.New("dungeondb: transaction has already been committed or rolled back")
+	// Get, Update or Delete of a missing row
+	ErrNotFound = errors.New("dungeondb: row not found")
+	// Insert of an existing primary key
+	ErrExists = errors.New("dungeondb: row already exists")
+	// the table does not exist
+	ErrTableNotFound = storage.ErrTableNotFound
+	// CreateTable with a name in use
+	ErrTableExists = storage.ErrTableExists
+	// Changes from a sequence number no longer kept
+	ErrChangesGone = storage.ErrChangesGone
+	// a row violates the column types, NOT NULL or CHECK constraints
+	ErrConstraint = storage.ErrConstraint
+)
+
+// options for Open, the zero value is the default
+type Options struct {
+	// fail with an os.ErrNotExist error instead of creating a new file
+	MustExist bool
+	// the page size of a new file, a power of 2 from 1KiB to 32KiB,
+	// 4KiB if 0. an existing file keeps the page size it was created with.
+	PageSize int
+	// read and write the pages through a cache of this many pages
+	// instead of mapping the file, 0 to map it
+	PageCache int
+	// the AES key of 16, 24 or 32 bytes encrypting the file, which is then
+	// read and written through a page cache. nil for an unencrypted file.
+	Key []byte
+	// record the row changes and keep the last Changelog of them for
+	// Changes, none if 0
+	Changelog int
+	// diagnostics of the storage engine, e.g. a *slog.Logger, silent if nil
+	Logger Logger
+}
+
+// options for Scan, the zero value scans the whole table in order
+type ScanOptions struct {
+	// the range of primary keys, a bound can be a prefix of the
+	// primary key columns, an empty Record means no bound
+	From, To Record
+	// exclude the rows equal to the bounds
+	FromExclusive, ToExclusive bool
+	// from To down to From
+	Reverse bool
+	// the maximum number of rows, 0 means no limit
+	Limit int
+}
+
+// rows read per locked step of a Scan outside of a Tx
+const SCAN_BATCH = 256
+
+type DB struct {
+	mu      sync.Mutex // held by a Tx until it ends
+	db      *storage.DB
+	closed  bool
+	backups sync.WaitGroup // running backups, Close waits for them
+	done    chan struct{}  // closed by Close, stops the expiry sweeper
+}
+
+// open or create a database file
+func Open(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.MustExist {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("dungeondb: %w", err)
+		}
+	}
+	sopts := storage.Options{PageSize: opts.PageSize, Key: opts.Key, Changelog: opts.Changelog, Logger: opts.Logger}
+	if opts.PageCache > 0 {
+		sopts.Backend, sopts.PageCache = storage.BACKEND_POOL, opts.PageCache
+	}
+	db := &DB{db: &storage.DB{Path: path, Options: sopts}, done: make(chan struct{})}
+	if err := db.db.Open(); err != nil {
+		return nil, fmt.Errorf("dungeondb: %w", err)
+	}
+	go db.sweepExpired()
+	return db, nil
+}
+
+// delete the expired rows in the background, see TableDef.TTL.
+// a batch at a time, a running Tx delays it.
+func (db *DB) sweepExpired() {
+	tick := time.NewTicker(storage.EXPIRY_INTERVAL)
+	defer tick.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-tick.C:
+		}
+		for n := storage.EXPIRY_BATCH; n == storage.EXPIRY_BATCH; {
+			err := db.view(func(sdb *storage.DB) (err error) {
+				n, err = sdb.SweepExpired(storage.EXPIRY_BATCH)
+				return err
+			})
+			if err != nil {
+				break // closed, or retried at the next tick
+			}
+		}
+	}
+}
+
+// close the file, waits for a running Tx
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	close(db.done)
+	db.backups.Wait()
+	return db.db.Close()
+}
+
+// write a backup of the committed data to `w` while the DB stays usable.
+// the result is a compacted database file that Open accepts.
+func (db *DB) Backup(w io.Writer) error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrClosed
+	}
+	snap := db.db.Snapshot()
+	db.backups.Add(1)
+	db.mu.Unlock()
+	defer db.backups.Done()
+	defer snap.Close()
+	_, err := snap.WriteTo(w)
+	return err
+}
+
+// run `fn` with exclusive access, the updates are atomic
+func (db *DB) update(fn func(sdb *storage.DB) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := db.db.Begin(); err != nil {
+		return err
+	}
+	err := protect(func() error { return fn(db.db) })
+	if err == nil {
+		err = protect(db.db.Commit)
+	}
+	if db.db.InTx() {
+		_ = db.db.Abort()
+	}
+	return err
+}
+
+func (db *DB) view(fn func(sdb *storage.DB) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	err := protect(func() error { return fn(db.db) })
+	if db.db.InTx() {
+		_ = db.db.Abort()
+	}
+	return err
+}
+
+// run `fn`, a panic of the storage is turned into an error.
+// the storage asserts on inputs it can't handle, the caller
+// rolls back the transaction left in an unknown state.
+func protect(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("dungeondb: internal error: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// create a table
+func (db *DB) CreateTable(tdef *TableDef) error {
+	return db.update(func(sdb *storage.DB) error { return sdb.TableNew(tdef) })
+}
+
+// change the compression of a table: "none" or "flate", or "" for the
+// format without a codec. the rows keep their codec until they are updated,
+// except when switching to or from "", which rewrites the table.
+func (db *DB) SetCompression(table string, codec string) error {
+	return db.update(func(sdb *storage.DB) error { return sdb.SetCompression(table, codec) })
+}
+
+// the definition of a table, nil if it does not exist
+func (db *DB) Table(name string) (tdef *TableDef, err error) {
+	err = db.view(func(sdb *storage.DB) error {
+		tdef = sdb.GetTableDef(name)
+		return nil
+	})
+	return tdef, err
+}
+
+// the definitions of all tables, ordered by name
+func (db *DB) Tables() (defs []*TableDef, err error) {
+	err = db.view(func(sdb *storage.DB) (err error) {
+		defs, err = sdb.TableDefs()
+		return err
+	})
+	return defs, err
+}
+
+// get a row by its primary key
+func (db *DB) Get(table string, key Record) (row Record, err error) {
+	err = db.view(func(sdb *storage.DB) (err error) {
+		row, err = get(sdb, table, key)
+		return err
+	})
+	return row, err
+}
+
+// insert a new row, the AUTOINCREMENT primary key is added to `rec` if omitted
+func (db *DB) Insert(table string, rec *Record) error {
+	return db.update(func(sdb *storage.DB) error { return insert(sdb, table, rec) })
+}
+
+// replace an existing row
+func (db *DB) Update(table string, rec Record) error {
+	return db.update(func(sdb *storage.DB) error { return update(sdb, table, rec) })
+}
+
+// insert or replace a row, returns true if it was inserted
+func (db *DB) Upsert(table string, rec Record) (added bool, err error) {
+	err = db.update(func(sdb *storage.DB) (err error) {
+		added, err = sdb.Upsert(table, rec)
+		return err
+	})
+	return added, err
+}
+
+// delete a row by its primary key
+func (db *DB) Delete(table string, key Record) error {
+	return db.update(func(sdb *storage.DB) error { return del(sdb, table, key) })
+}
+
+// insert many rows at once. the rows are sorted unless opts.Sorted
+// says they are in primary key order, and the B-tree is rebuilt from
+// the leaves up, which is much faster than inserting them one by one.
+// it's atomic, a duplicate primary key or a bad row inserts nothing.
+func (db *DB) BulkLoad(table string, rows iter.Seq[Record], opts *BulkOptions) error {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	next, stop := iter.Pull(rows)
+	defer stop()
+	// not in db.update, the bulk load is a transaction of its own
+	return db.view(func(sdb *storage.DB) error {
+		_, err := sdb.BulkLoad(table, func() (Record, bool, error) {
+			rec, ok := next()
+			return rec, ok, nil
+		}, *opts)
+		return err
+	})
+}
+
+// shrink the database file, the freed pages are never reused otherwise.
+// it fails while a Backup is running.
+func (db *DB) Vacuum(opts *VacuumOptions) error {
+	if opts == nil {
+		opts = &VacuumOptions{}
+	}
+	return db.view(func(sdb *storage.DB) error {
+		_, err := sdb.Vacuum(*opts)
+		return err
+	})
+}
+
+// re-encrypt the database file under a new key, nil to decrypt it.
+// it rewrites the file like a full Vacuum, and fails while a Backup is
+// running.
+func (db *DB) Rekey(key []byte) error {
+	return db.view(func(sdb *storage.DB) error { return sdb.Rekey(key) })
+}
+
+// the committed row changes from the sequence number `from`, at most
+// `limit` of them, 0 for no limit. `from` 0 starts from the oldest kept.
+// a consumer resumes from the Seq of the last change + 1, ErrChangesGone
+// if the changelog no longer has it.
+func (db *DB) Changes(from uint64, limit int) ([]Change, error) {
+	changes := []Change{}
+	err := db.view(func(sdb *storage.DB) error {
+		return sdb.ChangesSince(from, func(ch *storage.Change) bool {
+			changes = append(changes, *ch)
+			return limit <= 0 || len(changes) < limit
+		})
+	})
+	return changes, err
+}
+
+// iterate over a range of rows in primary key order.
+// the rows are read in batches, so a long scan sees the updates made
+// between the batches, use a Tx for a consistent scan.
+func (db *DB) Scan(table string, opts ScanOptions) iter.Seq2[Record, error] {
+	return scan(db.view, table, opts, SCAN_BATCH)
+}
+
+// a transaction, not safe for concurrent use
+type Tx struct {
+	db   *DB
+	done bool
+}
+
+// start a transaction, it holds the DB until Commit or Rollback.
+// the other DB methods block meanwhile, don't call them from the Tx goroutine.
+func (db *DB) Begin() (*Tx, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if err := db.db.Begin(); err != nil {
+		db.mu.Unlock()
+		return nil, err
+	}
+	return &Tx{db: db}, nil
+}
+
+func (tx *Tx) run(fn func(sdb *storage.DB) error) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	panicked := true
+	err := protect(func() error {
+		err := fn(tx.db.db)
+		panicked = false
+		return err
+	})
+	if panicked {
+		// the updates are in an unknown state, the Tx is rolled back
+		_ = tx.end(false)
+		err = fmt.Errorf("%w, the transaction was rolled back", err)
+	}
+	return err
+}
+
+// end the transaction
+func (tx *Tx) end(commit bool) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	defer tx.db.mu.Unlock()
+	if commit {
+		return tx.db.db.Commit()
+	}
+	return tx.db.db.Abort()
+}
+
+// persist the updates
+func (tx *Tx) Commit() error {
+	return tx.end(true)
+}
+
+// discard the updates
+func (tx *Tx) Rollback() error {
+	return tx.end(false)
+}
+
+func (tx *Tx) CreateTable(tdef *TableDef) error {
+	return tx.run(func(sdb *storage.DB) error { return sdb.TableNew(tdef) })
+}
+
+func (tx *Tx) Get(table string, key Record) (row Record, err error) {
+	err = tx.run(func(sdb *storage.DB) (err error) {
+		row, err = get(sdb, table, key)
+		return err
+	})
+	return row, err
+}
+
+func (tx *Tx) Insert(table string, rec *Record) error {
+	return tx.run(func(sdb *storage.DB) error { return insert(sdb, table, rec) })
+}
+
+func (tx *Tx) Update(table string, rec Record) error {
+	return tx.run(func(sdb *storage.DB) error { return update(sdb, table, rec) })
+}
+
+func (tx *Tx) Upsert(table string, rec Record) (added bool, err error) {
+	err = tx.run(func(sdb *storage.DB) (err error) {
+		added, err = sdb.Upsert(table, rec)
+		return err
+	})
+	return added, err
+}
+
+func (tx *Tx) Delete(table string, key Record) error {
+	return tx.run(func(sdb *storage.DB) error { return del(sdb, table, key) })
+}
+
+// a consistent scan, the updates of the Tx must not be interleaved with the iteration
+func (tx *Tx) Scan(table string, opts ScanOptions) iter.Seq2[Record, error] {
+	return scan(tx.run, table, opts, 0)
+}
+
+// the operations shared by DB and Tx
+func get(sdb *storage.DB, table string, key Record) (Record, error) {
+	row := Record{Cols: append([]string{}, key.Cols...), Vals: append([]Value{}, key.Vals...)}
+	ok, err := sdb.Get(table, &row)
+	if err == nil && !ok {
+		err = ErrNotFound
+	}
+	return row, err
+}
+
+func insert(sdb *storage.DB, table string, rec *Record) error {
+	added, err := sdb.Insert(table, rec)
+	if err == nil && !added {
+		err = ErrExists
+	}
+	return err
+}
+
+func update(sdb *storage.DB, table string, rec Record) error {
+	tdef := sdb.GetTableDef(table)
+	if tdef == nil {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, table)
+	}
+	// Update reports only the changes, check the existence first
+	key := Record{}
+	for _, col := range tdef.Cols[:tdef.Pkeys] {
+		if v := rec.Get(col); v != nil {
+			key.Cols = append(key.Cols, col)
+			key.Vals = append(key.Vals, *v)
+		}
+	}
+	if _, err := get(sdb, table, key); err != nil {
+		return err
+	}
+	_, err := sdb.Update(table, rec)
+	return err
+}
+
+func del(sdb *storage.DB, table string, key Record) error {
+	deleted, err := sdb.Delete(table, key)
+	if err == nil && !deleted {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// scan in batches of `batch` rows, each under a call to `run`.
+// a batch of 0 reads everything in a single call.
+func scan(run func(fn func(sdb *storage.DB) error) error, table string, opts ScanOptions, batch int) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		sc := storage.Scanner{
+			Cmp1: storage.CMP_GE, Key1: opts.From,
+			Cmp2: storage.CMP_LE, Key2: opts.To,
+		}
+		if opts.FromExclusive {
+			sc.Cmp1 = storage.CMP_GT
+		}
+		if opts.ToExclusive {
+			sc.Cmp2 = storage.CMP_LT
+		}
+		if opts.Reverse {
+			sc.Cmp1, sc.Cmp2 = sc.Cmp2, sc.Cmp1
+			sc.Key1, sc.Key2 = sc.Key2, sc.Key1
+		}
+
+		for n := 0; ; {
+			rows := []Record{}
+			var tdef *TableDef
+			err := run(func(sdb *storage.DB) error {
+				if err := sdb.Scan(table, &sc); err != nil {
+					return err
+				}
+				tdef = sdb.GetTableDef(table)
+				for ; sc.Valid(); sc.Next() {
+					if (batch > 0 && len(rows) == batch) || (opts.Limit > 0 && n+len(rows) == opts.Limit) {
+						break
+					}
+					rec := Record{}
+					sc.Deref(&rec)
+					rows = append(rows, rec)
+				}
+				return nil
+			})
+			if err != nil {
+				yield(Record{}, err)
+				return
+			}
+			for _, rec := range rows {
+				if !yield(rec, nil) {
+					return
+				}
+			}
+			n += len(rows)
+			if batch == 0 || len(rows) < batch || (opts.Limit > 0 && n == opts.Limit) {
+				return
+			}
+			// continue after the last primary key
+			last := rows[len(rows)-1]
+			sc = storage.Scanner{
+				Cmp1: storage.CMP_GT,
+				Key1: Record{Cols: tdef.Cols[:tdef.Pkeys], Vals: last.Vals[:tdef.Pkeys]},
+				Cmp2: sc.Cmp2, Key2: sc.Key2,
+			}
+			if opts.Reverse {
+				sc.Cmp1 = storage.CMP_LT
+			}
+		}
+	}
+}
@@ -0,0 +1,442 @@
+// Package sqldriver registers the "dungeondb" database/sql driver
+// over the embedded DB:
+//
+//	import _ "github.com/Ricky004/dungeonDB/pkg/sqldriver"
+//
+//	db, err := sql.Open("dungeondb", "file:app.db")
+//
+// the connections to the same file share a single storage.DB,
+// statements are executed one at a time and a connection in a
+// transaction holds the DB until it commits or rolls back.
+// INT64 columns scan as int64, BYTES columns as []byte or string.
+// placeholders are `?` or `$n`, NULL is not supported.
+package sqldriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/Ricky004/dungeonDB/internal/executer"
+	"github.com/Ricky004/dungeonDB/internal/parser"
+	"github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the registered driver name
+const DRIVER_NAME = "dungeondb"
+
+func init() {
+	sql.Register(DRIVER_NAME, &Driver{})
+}
+
+// Driver implements driver.Driver and driver.DriverContext
+type Driver struct{}
+
+// an open database file shared by the connections
+type handle struct {
+	path string
+	db   *storage.DB
+	sem  chan struct{} // the DB lock, a channel so waiting can be cancelled
+	refs int           // guarded by handles.mu
+}
+
+// the open files by absolute path
+var handles = struct {
+	mu sync.Mutex
+	m  map[string]*handle
+}{m: map[string]*handle{}}
+
+func acquire(path string) (*handle, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	h, ok := handles.m[abs]
+	if !ok {
+		h = &handle{path: abs, db: &storage.DB{Path: abs}, sem: make(chan struct{}, 1)}
+		if err := h.db.Open(); err != nil {
+			return nil, err
+		}
+		handles.m[abs] = h
+	}
+	h.refs++
+	return h, nil
+}
+
+func (h *handle) release() error {
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	h.refs--
+	if h.refs > 0 {
+		return nil
+	}
+	delete(handles.m, h.path)
+	return h.db.Close()
+}
+
+// the file path of a DSN: "file:app.db" or "app.db"
+func parseDSN(dsn string) (string, error) {
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return "", fmt.Errorf("dungeondb: DSN options are not supported: %q", path[i:])
+	}
+	if path == "" {
+		return "", errors.New("dungeondb: empty DSN")
+	}
+	return path, nil
+}
+
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	defer c.(*connector).Close()
+	return c.Connect(context.Background())
+}
+
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	path, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	h, err := acquire(path)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{drv: d, h: h}, nil
+}
+
+// keeps the file open for the lifetime of the sql.DB
+type connector struct {
+	drv  *Driver
+	h    *handle
+	once sync.Once
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	h, err := acquire(c.h.path)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{h: h}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.drv
+}
+
+// called by sql.DB.Close
+func (c *connector) Close() (err error) {
+	c.once.Do(func() { err = c.h.release() })
+	return err
+}
+
+var _ io.Closer = (*connector)(nil)
+
+type conn struct {
+	h      *handle
+	inTx   bool // holds the DB lock across calls
+	closed bool
+}
+
+var (
+	_ driver.ConnBeginTx        = (*conn)(nil)
+	_ driver.ConnPrepareContext = (*conn)(nil)
+	_ driver.ExecerContext      = (*conn)(nil)
+	_ driver.QueryerContext     = (*conn)(nil)
+	_ driver.Validator          = (*conn)(nil)
+)
+
+// run `fn` with exclusive access to the DB,
+// the DB stays locked while the connection is in a transaction.
+// waiting for the DB ends with ctx.
+func (c *conn) locked(ctx context.Context, fn func(db *storage.DB) error) (err error) {
+	if c.closed {
+		return driver.ErrBadConn
+	}
+	if !c.inTx {
+		select {
+		case c.h.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			// the transaction in progress is in an unknown state
+			err = fmt.Errorf("dungeondb: internal error: %v", r)
+			if c.h.db.InTx() {
+				_ = c.h.db.Abort()
+				if c.inTx {
+					err = fmt.Errorf("%w, the transaction was rolled back", err)
+				}
+			}
+		}
+		c.inTx = c.h.db.InTx()
+		if !c.inTx {
+			<-c.h.sem
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn(c.h.db)
+}
+
+func (c *conn) exec(ctx context.Context, stmt *parser.Statement, args []driver.NamedValue) (*executer.Result, error) {
+	vals, err := toValues(args)
+	if err != nil {
+		return nil, err
+	}
+	var res *executer.Result
+	err = c.locked(ctx, func(db *storage.DB) (err error) {
+		res, err = executer.ExecContext(ctx, db, stmt, vals)
+		return err
+	})
+	return res, err
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmtHandle{c: c, stmt: stmt}, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmtHandle{c: c, stmt: stmt}).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	stmt, err := parser.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmtHandle{c: c, stmt: stmt}).QueryContext(ctx, args)
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if opts.ReadOnly {
+		return nil, errors.New("dungeondb: read-only transactions are not supported")
+	}
+	level := sql.IsolationLevel(opts.Isolation)
+	if level != sql.LevelDefault && level != sql.LevelSerializable {
+		// transactions are serialized
+		return nil, fmt.Errorf("dungeondb: isolation level %v is not supported", level)
+	}
+	if c.inTx {
+		return nil, errors.New("dungeondb: a transaction is already in progress")
+	}
+	err := c.locked(ctx, func(db *storage.DB) error {
+		return db.Begin()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tx{c: c}, nil
+}
+
+func (c *conn) IsValid() bool {
+	return !c.closed
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	if c.inTx {
+		// an unfinished transaction is rolled back
+		_ = c.h.db.Abort()
+		c.inTx = false
+		<-c.h.sem
+	}
+	c.closed = true
+	return c.h.release()
+}
+
+type tx struct {
+	c *conn
+}
+
+func (t *tx) Commit() error {
+	return t.end(func(db *storage.DB) error { return db.Commit() })
+}
+
+func (t *tx) Rollback() error {
+	return t.end(func(db *storage.DB) error { return db.Abort() })
+}
+
+func (t *tx) end(fn func(db *storage.DB) error) error {
+	if !t.c.inTx {
+		return sql.ErrTxDone
+	}
+	return t.c.locked(context.Background(), fn)
+}
+
+type stmtHandle struct {
+	c    *conn
+	stmt *parser.Statement
+}
+
+var (
+	_ driver.StmtExecContext  = (*stmtHandle)(nil)
+	_ driver.StmtQueryContext = (*stmtHandle)(nil)
+)
+
+func (s *stmtHandle) Close() error {
+	return nil
+}
+
+func (s *stmtHandle) NumInput() int {
+	return s.stmt.NumParams
+}
+
+func (s *stmtHandle) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stmtHandle) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+func (s *stmtHandle) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	res, err := s.c.exec(ctx, s.stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	return result{res.LastInsertID, res.Affected}, nil
+}
+
+func (s *stmtHandle) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := s.c.exec(ctx, s.stmt, args)
+	if err != nil {
+		return nil, err
+	}
+	if res.Cols == nil {
+		return &rows{res: &executer.Result{Cols: []string{}}}, nil
+	}
+	return &rows{res: res}, nil
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+// the placeholder values, after the default conversion of database/sql
+func toValues(args []driver.NamedValue) ([]storage.Value, error) {
+	vals := make([]storage.Value, len(args))
+	for _, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("dungeondb: named argument %s is not supported", arg.Name)
+		}
+		v := &vals[arg.Ordinal-1]
+		switch x := arg.Value.(type) {
+		case int64:
+			*v = storage.Value{Type: storage.TYPE_INT64, I64: x}
+		case bool:
+			*v = storage.Value{Type: storage.TYPE_INT64}
+			if x {
+				v.I64 = 1
+			}
+		case []byte:
+			*v = storage.Value{Type: storage.TYPE_BYTES, Str: append([]byte{}, x...)}
+		case string:
+			*v = storage.Value{Type: storage.TYPE_BYTES, Str: []byte(x)}
+		case nil:
+			return nil, fmt.Errorf("dungeondb: argument %d: NULL is not supported", arg.Ordinal)
+		default:
+			return nil, fmt.Errorf("dungeondb: argument %d: unsupported type %T", arg.Ordinal, x)
+		}
+	}
+	return vals, nil
+}
+
+type result struct {
+	lastID   int64
+	affected int64
+}
+
+func (r result) LastInsertId() (int64, error) {
+	return r.lastID, nil
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return r.affected, nil
+}
+
+// the rows are materialized by the executer
+type rows struct {
+	res *executer.Result
+	pos int
+}
+
+var (
+	_ driver.RowsColumnTypeDatabaseTypeName = (*rows)(nil)
+	_ driver.RowsColumnTypeScanType         = (*rows)(nil)
+)
+
+func (r *rows) Columns() []string {
+	return r.res.Cols
+}
+
+func (r *rows) Close() error {
+	r.pos = len(r.res.Rows)
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.res.Rows) {
+		return io.EOF
+	}
+	for i, v := range r.res.Rows[r.pos] {
+		switch v.Type {
+		case storage.TYPE_INT64:
+			dest[i] = v.I64
+		default:
+			dest[i] = v.Str
+		}
+	}
+	r.pos++
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string {
+	if r.res.Types[i] == storage.TYPE_INT64 {
+		return "INT64"
+	}
+	return "BYTES"
+}
+
+func (r *rows) ColumnTypeScanType(i int) reflect.Type {
+	if r.res.Types[i] == storage.TYPE_INT64 {
+		return reflect.TypeOf(int64(0))
+	}
+	return reflect.TypeOf([]byte(nil))
+}
@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a writer slow enough to overlap with the updates
+type slowWriter struct {
+	w io.Writer
+}
+
+func (sw slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return sw.w.Write(p)
+}
+
+// a backup is the last commit before it started, the updates
+// during the copy don't change it
+func TestBackupSnapshot(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	createTable(t, db, kvTable("t"))
+	const n = 2000
+	for i := 0; i < n; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint("v", i)))
+	}
+	// not in the backup
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	insertRow(t, db, "t", i64(-1), str("pending"))
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := db.Snapshot()
+	done := make(chan error)
+	go func() {
+		_, err := snap.WriteTo(slowWriter{fp})
+		done <- err
+	}()
+	// free and reuse pages, and grow the file, while the backup runs
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := db.Delete("t", *(&s.Record{}).AddInt64("id", int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		insertRow(t, db, "t", i64(int64(n+i)), str(strings.Repeat("x", 300)))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+	fp.Close()
+
+	stats, err := s.VerifyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != snap.Stats() || stats.Keys < n {
+		t.Fatalf("%+v, the snapshot wrote %+v", stats, snap.Stats())
+	}
+	backup := openDB(t, &s.DB{Path: path})
+	checkIDs(t, backup, "t", func(id int64) bool { return 0 <= id && id < n }, n)
+	if rows := scanRows(t, db, "t"); len(rows) != n+1 {
+		t.Fatalf("%d rows", len(rows))
+	}
+	if _, err := snap.WriteTo(io.Discard); err == nil {
+		t.Fatal("expected an error for a closed snapshot")
+	}
+
+	// a damaged copy fails the verification
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bad := range map[string][]byte{
+		"truncated":   data[:len(data)-s.BTREE_PAGE_SIZE],
+		"signature":   append([]byte("x"), data[1:]...),
+		"odd size":    data[:len(data)-1],
+		"bad root":    append(append(append([]byte{}, data[:16]...), 0xff, 0xff), data[18:]...),
+		"empty pages": append(append([]byte{}, data[:s.BTREE_PAGE_SIZE]...), make([]byte, len(data)-s.BTREE_PAGE_SIZE)...),
+	} {
+		p := filepath.Join(t.TempDir(), "bad.db")
+		if err := os.WriteFile(p, bad, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.VerifyFile(p); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBackupHTTP(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	createTable(t, db, kvTable("t"))
+	for i := 0; i < 100; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str("v"))
+	}
+	url := "http://" + listen(t, newServer(t, db).ServeJSON)
+	resp, err := http.Get(url + "/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	path := filepath.Join(t.TempDir(), "backup.db")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(fp, resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if stats, err := s.VerifyFile(path); err != nil || stats.Keys < 100 {
+		t.Fatalf("%+v: %v", stats, err)
+	}
+	backup := openDB(t, &s.DB{Path: path})
+	if rows := scanRows(t, backup, "t"); len(rows) != 100 {
+		t.Fatalf("%d rows", len(rows))
+	}
+}
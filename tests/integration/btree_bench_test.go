@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the pages used on a real file with and without the leaf prefix.
+// the primary keys have a long shared head, as in an encoded string column.
+func BenchmarkLeafPrefix(b *testing.B) {
+	for _, noPrefix := range []bool{true, false} {
+		b.Run(fmt.Sprintf("NoLeafPrefix=%v", noPrefix), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				opts := s.Options{NoLeafPrefix: noPrefix, SyncMode: s.SYNC_OFF}
+				db := openDB(b, &s.DB{Options: opts})
+				createTable(b, db, &s.TableDef{
+					Name:  "customer",
+					Cols:  []string{"id", "v"},
+					Types: []uint32{s.TYPE_BYTES, s.TYPE_BYTES},
+					Pkeys: 1,
+				})
+				const nkeys = 100000
+				if err := db.Begin(); err != nil {
+					b.Fatal(err)
+				}
+				for i := 0; i < nkeys; i++ {
+					rec := (&s.Record{}).AddStr("id", []byte(fmt.Sprintf("customer/eu-west/%010d", i))).AddStr("v", []byte("v"))
+					if _, err := db.Insert("customer", rec); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := db.Commit(); err != nil {
+					b.Fatal(err)
+				}
+
+				// the pages reachable from the root, not the file size
+				snap := db.Snapshot()
+				if _, err := snap.WriteTo(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				stats := snap.Stats()
+				snap.Close()
+				b.ReportMetric(float64(stats.Keys)/float64(stats.Pages), "keys/page")
+				b.ReportMetric(float64(stats.Pages), "pages")
+				b.ReportMetric(float64(stats.Pages*s.BTREE_PAGE_SIZE), "bytes")
+				db.Close()
+			}
+		})
+	}
+}
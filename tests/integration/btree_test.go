@@ -1,6 +1,9 @@
 package integration
 
 import (
+	"fmt"
+	"strings"
+	"testing"
 	"unsafe"
 
 	s "github.com/Ricky004/dungeonDB/internal/storage"
@@ -49,3 +52,101 @@ func (c *C) del(key string) bool {
 	delete(c.ref, key)
 	return c.tree.Delete([]byte(key))
 }
+
+// the KVs of the leaves must be the reference, every page must fit
+func (c *C) verify(t *testing.T) {
+	t.Helper()
+	got := map[string]string{}
+	for _, node := range c.pages {
+		if node.Nbytes() > s.BTREE_PAGE_SIZE {
+			t.Fatalf("page of %d bytes", node.Nbytes())
+		}
+		if node.Btype() != s.BNODE_LEAF {
+			continue
+		}
+		for i := uint16(0); i < node.Nkeys(); i++ {
+			if key := string(node.GetKey(i)); key != "" { // the sentinel
+				if _, ok := got[key]; ok {
+					t.Fatalf("duplicate key %q", key)
+				}
+				got[key] = string(node.GetVal(i))
+			}
+		}
+	}
+	if len(got) != len(c.ref) {
+		t.Fatalf("%d keys, want %d", len(got), len(c.ref))
+	}
+	for key, val := range c.ref {
+		if got[key] != val {
+			t.Fatalf("key %q: %d bytes, want %d", key, len(got[key]), len(val))
+		}
+	}
+}
+
+// values of varied sizes up to the 3000 bytes of a 4KiB page,
+// some large enough to split a node in 3
+func testVal(i int, round int) string {
+	return strings.Repeat(string(rune('a'+round)), (i*7919)%3000/(1+i%4))
+}
+
+func TestBTreeSplitMerge(t *testing.T) {
+	c := newC()
+	const n = 3000
+	for i := 0; i < n; i++ {
+		c.add(fmt.Sprintf("key%08d", (i*7)%n), testVal(i, 0))
+	}
+	c.verify(t)
+
+	// updates in place, growing and shrinking the values
+	for i := 0; i < n; i += 3 {
+		c.add(fmt.Sprintf("key%08d", i), testVal(i+1, 1))
+	}
+	c.verify(t)
+
+	// deletes merge the nodes back
+	for i := 0; i < n; i++ {
+		if i%10 != 0 && !c.del(fmt.Sprintf("key%08d", i)) {
+			t.Fatalf("key %d not deleted", i)
+		}
+	}
+	c.verify(t)
+	if c.del("key-missing") {
+		t.Fatal("a missing key was deleted")
+	}
+	for i := 0; i < n; i += 10 {
+		c.del(fmt.Sprintf("key%08d", i))
+	}
+	c.verify(t)
+	if len(c.pages) != 1 {
+		t.Fatalf("%d pages left in an empty tree", len(c.pages))
+	}
+}
+
+// a full scan of a tree of 3+ levels ends after the last key
+func TestBTreeDeepIteration(t *testing.T) {
+	c := newC()
+	const n = 20000
+	for i := 0; i < n; i++ {
+		c.add(fmt.Sprintf("key%08d", i), strings.Repeat("v", 200))
+	}
+	c.verify(t)
+
+	for _, start := range []int{0, n / 2, n - 1} {
+		count := 0
+		prev := ""
+		iter := c.tree.Seek([]byte(fmt.Sprintf("key%08d", start)), s.CMP_GE)
+		for ; iter.Valid(); iter.Next() {
+			key, _ := iter.Deref()
+			if string(key) <= prev {
+				t.Fatalf("key %q after %q", key, prev)
+			}
+			prev = string(key)
+			if count++; count > n {
+				t.Fatal("the iteration doesn't end")
+			}
+		}
+		if count != n-start {
+			t.Fatalf("from %d: %d keys, want %d", start, count, n-start)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package integration
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a row source of `n` rows of kvTable from id `from` by `step`
+func kvRows(from int64, step int64, n int) s.RowSource {
+	i := 0
+	return func() (s.Record, bool, error) {
+		if i == n {
+			return s.Record{}, false, nil
+		}
+		id := from + int64(i)*step
+		i++
+		return s.Record{Cols: []string{"id", "v"}, Vals: []s.Value{i64(id), str(fmt.Sprint("v", id))}}, true, nil
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	// small pages for a deeper tree
+	db := openDB(t, &s.DB{Options: s.Options{PageSize: s.BTREE_MIN_PAGE_SIZE}})
+	for _, name := range []string{"a", "b", "c"} {
+		createTable(t, db, kvTable(name))
+	}
+	// a tree of a few levels around the table b
+	const n = 5000
+	for _, name := range []string{"a", "c"} {
+		if _, err := db.BulkLoad(name, kvRows(0, 1, n), s.BulkOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := backupKeys(t, db)
+
+	// a small load rewrites its range, not the database
+	stats, err := db.BulkLoad("b", kvRows(0, 1, 10), s.BulkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rows != 10 || stats.Pages > 10 {
+		t.Fatalf("%+v", stats)
+	}
+	if got := backupKeys(t, db); got != keys+10 {
+		t.Fatalf("%d keys, expected %d", got, keys+10)
+	}
+
+	// interleaved with the rows of a table, unsorted and spilled to files
+	stats, err = db.BulkLoad("a", kvRows(2*n-1, -2, n/2), s.BulkOptions{SortMemory: 16 << 10, FillFactor: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Runs < 2 {
+		t.Fatalf("%+v", stats)
+	}
+	// a duplicate changes nothing
+	if _, err := db.BulkLoad("a", kvRows(n+1, 1, 10), s.BulkOptions{Sorted: true}); err == nil {
+		t.Fatal("expected a duplicate key error")
+	}
+	if _, err := db.BulkLoad("a", kvRows(3*n, -1, 10), s.BulkOptions{Sorted: true}); err == nil {
+		t.Fatal("expected an unsorted input error")
+	}
+
+	db = reopen(t, db)
+	isA := func(id int64) bool { return id < n || id%2 == 1 && id < 2*n }
+	checkIDs(t, db, "a", isA, n+n/2)
+	checkIDs(t, db, "b", func(id int64) bool { return id < 10 }, 10)
+	checkIDs(t, db, "c", func(id int64) bool { return id < n }, n)
+
+	// the nodes at the edges of the loads are updated like the others
+	for id := int64(0); id < 2*n; id++ {
+		if id%3 == 0 || !isA(id) {
+			continue
+		}
+		if _, err := db.Delete("a", *(&s.Record{}).AddInt64("id", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := int64(0); id < 10; id++ {
+		if _, err := db.Delete("b", *(&s.Record{}).AddInt64("id", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertRow(t, db, "b", i64(42), str("v42"))
+	checkIDs(t, db, "a", func(id int64) bool { return isA(id) && id%3 == 0 }, len(scanRows(t, db, "a")))
+	checkIDs(t, db, "b", func(id int64) bool { return id == 42 }, 1)
+	checkIDs(t, db, "c", func(id int64) bool { return id < n }, n)
+	backupKeys(t, db)
+
+	// down to an empty tree
+	for _, name := range []string{"c", "a", "b"} {
+		for _, rec := range scanRows(t, db, name) {
+			if _, err := db.Delete(name, s.Record{Cols: rec.Cols[:1], Vals: rec.Vals[:1]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		checkIDs(t, db, name, nil, 0)
+	}
+	backupKeys(t, db)
+}
+
+// the index keys are loaded with the rows
+func TestBulkLoadIndex(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	createTable(t, db, &s.TableDef{
+		Name:    "t",
+		Cols:    []string{"id", "v", "w"},
+		Types:   []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_BYTES},
+		Pkeys:   1,
+		Indexes: [][]string{{"w"}},
+	})
+	const n = 2000
+	i := 0
+	rows := func() (s.Record, bool, error) {
+		if i == n {
+			return s.Record{}, false, nil
+		}
+		i++
+		return s.Record{Cols: []string{"id", "v", "w"}, Vals: []s.Value{
+			i64(int64(i)), str(fmt.Sprint("v", i)), str(strings.Repeat("w", i%50)),
+		}}, true, nil
+	}
+	if _, err := db.BulkLoad("t", rows, s.BulkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	// a row and 1 index key each, and the sentinel is not counted
+	keys := backupKeys(t, db)
+	for id := int64(1); id <= n; id++ {
+		if _, err := db.Delete("t", *(&s.Record{}).AddInt64("id", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := backupKeys(t, db); keys-got != 2*n {
+		t.Fatalf("%d keys left of %d", got, keys)
+	}
+}
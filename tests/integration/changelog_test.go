@@ -0,0 +1,168 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the kept changes from `from`, as "seq op key"
+func changesSince(t *testing.T, db *s.DB, from uint64) []string {
+	t.Helper()
+	out := []string{}
+	err := db.ChangesSince(from, func(ch *s.Change) bool {
+		out = append(out, fmt.Sprint(ch.Seq, " ", ch.Op, " ", ch.Key.Vals[0].I64))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestChangelog(t *testing.T) {
+	db := openDB(t, &s.DB{Options: s.Options{Changelog: 5}})
+	createTable(t, db, kvTable("t"))
+	published := []s.Change{}
+	db.SubscribeChanges(func(changes []s.Change) {
+		published = append(published, changes...)
+	})
+
+	insertRow(t, db, "t", i64(1), str("a"))
+	if _, err := db.Update("t", s.Record{Cols: []string{"id", "v"}, Vals: []s.Value{i64(1), str("b")}}); err != nil {
+		t.Fatal(err)
+	}
+	// the changes of a transaction are published at the commit
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	insertRow(t, db, "t", i64(2), str(strings.Repeat("x", 2000)))
+	// both images of the update do not fit in a value, it is split in chunks
+	if _, err := db.Update("t", s.Record{Cols: []string{"id", "v"}, Vals: []s.Value{i64(2), str(strings.Repeat("y", 2000))}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Delete("t", *(&s.Record{}).AddInt64("id", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 2 {
+		t.Fatalf("%d published before the commit", len(published))
+	}
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// a rolled back change is not recorded, its seq is reused
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	insertRow(t, db, "t", i64(3), str("c"))
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(published) != 5 {
+		t.Fatalf("%d published", len(published))
+	}
+	upd := published[1]
+	if upd.Seq != 2 || upd.Op != s.CHANGE_UPDATE || string(upd.Old.Get("v").Str) != "a" || string(upd.New.Get("v").Str) != "b" {
+		t.Fatalf("%+v", upd)
+	}
+	if published[2].Old != nil || published[4].New != nil || string(published[4].Old.Get("v").Str) != "b" {
+		t.Fatalf("%+v", published[2:])
+	}
+	want := "[1 insert 1 2 update 1 3 insert 2 4 update 2 5 delete 1]"
+	if got := fmt.Sprint(changesSince(t, db, 0)); got != want {
+		t.Fatalf("%s, expected %s", got, want)
+	}
+	if got := fmt.Sprint(changesSince(t, db, 4)); got != "[4 update 2 5 delete 1]" {
+		t.Fatalf("from 4: %s", got)
+	}
+	if got := changesSince(t, db, 6); len(got) != 0 {
+		t.Fatalf("from 6: %v", got)
+	}
+	var big *s.Change
+	err := db.ChangesSince(4, func(ch *s.Change) bool { big = ch; return false })
+	if err != nil || big.Seq != 4 || string(big.Old.Get("v").Str) != strings.Repeat("x", 2000) || string(big.New.Get("v").Str) != strings.Repeat("y", 2000) {
+		t.Fatalf("%v: %v", big, err)
+	}
+
+	// the oldest are dropped, the sequence continues after a reopen
+	db = reopen(t, db)
+	for i := int64(10); i < 13; i++ {
+		insertRow(t, db, "t", i64(i), str("d"))
+	}
+	want = "[4 update 2 5 delete 1 6 insert 10 7 insert 11 8 insert 12]"
+	if got := fmt.Sprint(changesSince(t, db, 0)); got != want {
+		t.Fatalf("%s, expected %s", got, want)
+	}
+	if err := db.ChangesSince(3, func(*s.Change) bool { return true }); !errors.Is(err, s.ErrChangesGone) {
+		t.Fatalf("from 3: %v", err)
+	}
+	// the changelog itself is not a table
+	if defs, err := db.TableDefs(); err != nil || len(defs) != 1 {
+		t.Fatalf("%d tables: %v", len(defs), err)
+	}
+}
+
+func TestChangesHTTP(t *testing.T) {
+	db := openDB(t, &s.DB{Options: s.Options{Changelog: 100}})
+	url := "http://" + listen(t, newServer(t, db).ServeJSON)
+	query := func(sql string) {
+		t.Helper()
+		body := fmt.Sprintf(`{"sql": %q}`, sql)
+		if st := httpDo(t, "POST", url+"/query", body, nil); st != 200 {
+			t.Fatalf("%s: %d", sql, st)
+		}
+	}
+	query("CREATE TABLE t (id int64 PRIMARY KEY, v text)")
+	query("INSERT INTO t VALUES (1, 'a')")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/changes?from=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// the kept change, then the live ones
+	query("UPDATE t SET v = 'b' WHERE id = 1")
+	query("DELETE FROM t WHERE id = 1")
+	sc := bufio.NewScanner(resp.Body)
+	got := []string{}
+	for len(got) < 3 && sc.Scan() {
+		ch := struct {
+			Seq      uint64
+			Op       string
+			Key      map[string]any
+			Old, New map[string]any
+		}{}
+		if err := json.Unmarshal(sc.Bytes(), &ch); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %v %v %v", ch.Seq, ch.Op, ch.Key["id"], ch.Old["v"], ch.New["v"]))
+	}
+	if fmt.Sprint(got) != "[1 insert 1 <nil> a 2 update 1 a b 3 delete 1 b <nil>]" {
+		t.Fatalf("%v", got)
+	}
+
+	if st := httpDo(t, "GET", url+"/changes?from=x", "", nil); st != 400 {
+		t.Fatalf("bad from: %d", st)
+	}
+	nolog := "http://" + listen(t, newServer(t, openDB(t, &s.DB{})).ServeJSON)
+	if st := httpDo(t, "GET", nolog+"/changes", "", nil); st != 404 {
+		t.Fatalf("disabled: %d", st)
+	}
+}
@@ -0,0 +1,117 @@
+package integration
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+	"github.com/Ricky004/dungeonDB/pkg/api"
+)
+
+// a server on the DB, shut down at the end of the test
+func newServer(t *testing.T, db *s.DB) *api.Server {
+	srv := api.NewServer(db)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return srv
+}
+
+// serve a front-end on a loopback port
+func listen(t *testing.T, serve func(ln net.Listener) error) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(ln)
+	return ln.Addr().String()
+}
+
+// start a binary protocol server on a new DB
+func startServer(t *testing.T) string {
+	return listen(t, newServer(t, openDB(t, &s.DB{})).Serve)
+}
+
+// a client of the binary protocol, closed at the end of the test
+func dial(t *testing.T, addr string) *api.Client {
+	c, err := api.Dial(context.Background(), addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func countRows(t *testing.T, c *api.Client, table string) int {
+	t.Helper()
+	rows, err := c.Query(context.Background(), "SELECT * FROM "+table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n
+}
+
+func TestClientQuery(t *testing.T) {
+	ctx := context.Background()
+	c, err := api.Dial(ctx, startServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	_, err = c.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY AUTOINCREMENT, name text NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Exec(ctx, "INSERT INTO t (name) VALUES (?), (?)", "a", "b")
+	if err != nil || res.Affected != 2 || res.LastInsertID != 2 {
+		t.Fatalf("insert: %+v %v", res, err)
+	}
+
+	// a rolled back transaction leaves no trace
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM t WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := c.Query(ctx, "SELECT id, name FROM t WHERE id >= ?", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Fatalf("rows: %v", names)
+	}
+
+	// a cancelled request fails without breaking the client
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Query(cctx, "SELECT * FROM t"); err == nil {
+		t.Fatal("expected a cancellation error")
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
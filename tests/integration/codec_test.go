@@ -0,0 +1,115 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the pages of the last commit
+func livePages(t *testing.T, db *s.DB) int {
+	t.Helper()
+	snap := db.Snapshot()
+	defer snap.Close()
+	if _, err := snap.WriteTo(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	return snap.Stats().Pages
+}
+
+func codecValue(id int64) string {
+	if id%2 == 0 {
+		return fmt.Sprint("v", id) // too short to compress
+	}
+	return fmt.Sprint(id, strings.Repeat(" compressible", 40))
+}
+
+func TestCompression(t *testing.T) {
+	const n = 500
+	pages := map[string]int{}
+	for _, codec := range []string{"", "none", "flate"} {
+		db := openDB(t, &s.DB{})
+		tdef := kvTable("t")
+		tdef.Compression = codec
+		createTable(t, db, tdef)
+		for i := 0; i < n; i++ {
+			insertRow(t, db, "t", i64(int64(i)), str(codecValue(int64(i))))
+		}
+		pages[codec] = livePages(t, db)
+	}
+	if pages["flate"] >= pages[""]/2 || pages["none"] < pages[""] {
+		t.Fatalf("pages by codec: %v", pages)
+	}
+	bad := kvTable("bad")
+	bad.Compression = "zstd"
+	if err := openDB(t, &s.DB{}).TableNew(bad); err == nil {
+		t.Fatal("expected an error for an unknown codec")
+	}
+}
+
+// the rows of every codec can be read after the table switches codecs
+func TestCompressionSwitch(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	tdef := kvTable("t")
+	tdef.Compression = "flate"
+	createTable(t, db, tdef)
+	// another table in the key range after it is not rewritten
+	createTable(t, db, kvTable("u"))
+	insertRow(t, db, "u", i64(1), str("u"))
+
+	id := int64(0)
+	check := func(db *s.DB) {
+		t.Helper()
+		rows := scanRows(t, db, "t")
+		if len(rows) != int(id) {
+			t.Fatalf("%d rows, expected %d", len(rows), id)
+		}
+		for i, rec := range rows {
+			if v := string(rec.Get("v").Str); v != codecValue(int64(i)) {
+				t.Fatalf("row %d: %q", i, v)
+			}
+		}
+		if rows := scanRows(t, db, "u"); len(rows) != 1 || string(rows[0].Get("v").Str) != "u" {
+			t.Fatalf("u: %v", rows)
+		}
+	}
+	for _, codec := range []string{"none", "flate", "", "none", "", "flate"} {
+		for i := 0; i < 300; i++ {
+			insertRow(t, db, "t", i64(id), str(codecValue(id)))
+			id++
+		}
+		if err := db.SetCompression("t", codec); err != nil {
+			t.Fatal(err)
+		}
+		check(db)
+		db = reopen(t, db)
+		check(db)
+		if got := db.GetTableDef("t").Compression; got != codec {
+			t.Fatalf("compression %q, expected %q", got, codec)
+		}
+	}
+
+	// a rolled back switch leaves the rows and the definition
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetCompression("t", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if got := db.GetTableDef("t").Compression; got != "flate" {
+		t.Fatalf("compression %q after a rollback", got)
+	}
+	if err := db.SetCompression("t", "zstd"); err == nil {
+		t.Fatal("expected an error for an unknown codec")
+	}
+	if err := db.SetCompression("none", "flate"); err == nil {
+		t.Fatal("expected an error for a missing table")
+	}
+}
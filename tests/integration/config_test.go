@@ -0,0 +1,127 @@
+package integration
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/config"
+)
+
+func writeFile(t *testing.T, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadConfig(args ...string) (*config.Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return config.Load(fs, args)
+}
+
+// a flag beats the environment, which beats the file, which beats the defaults
+func TestConfigLayers(t *testing.T) {
+	toml := writeFile(t, "db.toml", `
+# the file layer
+data_path = "file.db"
+sync_mode = "normal"
+page_size = "4KiB"
+mmap_initial_size = "1MiB"
+shutdown_timeout = "5s"
+
+[listen]
+http = "127.0.0.1:8080"
+`)
+	t.Setenv(config.ENV_CONFIG, toml)
+	t.Setenv("DUNGEONDB_SYNC_MODE", "off")
+	t.Setenv("DUNGEONDB_DATA_PATH", "env.db")
+	cfg, err := loadConfig("-db", "flag.db", "-pg-bytea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := config.Default()
+	want.DataPath, want.SyncMode, want.ShutdownTimeout = "flag.db", "off", 5*time.Second
+	want.PageSize, want.MmapInitialSize = 4096, 1<<20
+	want.Listen.HTTP, want.PGBytea = "127.0.0.1:8080", true
+	if *cfg != *want {
+		t.Fatalf("%+v\nexpected %+v", cfg, want)
+	}
+	if opts := cfg.StorageOptions(); opts.PageSize != 4096 || opts.MmapInitial != 1<<20 {
+		t.Fatalf("%+v", opts)
+	}
+
+	// the printed config loads back the same
+	buf := bytes.Buffer{}
+	if err := cfg.WriteTOML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("DUNGEONDB_SYNC_MODE")
+	os.Unsetenv("DUNGEONDB_DATA_PATH")
+	again, err := loadConfig("-config", writeFile(t, "printed.toml", buf.String()))
+	if err != nil || *again != *cfg {
+		t.Fatalf("%+v: %v\n%s", again, err, buf.String())
+	}
+
+	// a JSON file is nested like the TOML tables
+	json := writeFile(t, "db.json", `{"data_path": "j.db", "max_db_size": "1MiB", "listen": {"resp": "127.0.0.1:6379"}}`)
+	cfg, err = loadConfig("-config", json)
+	if err != nil || cfg.DataPath != "j.db" || cfg.MaxDBSize != 1<<20 || cfg.Listen.RESP != "127.0.0.1:6379" {
+		t.Fatalf("%+v: %v", cfg, err)
+	}
+}
+
+// every bad setting is reported, with the layer it comes from
+func TestConfigErrors(t *testing.T) {
+	bad := writeFile(t, "bad.toml", "sync_mode = \"fast\"\nlog_level = \"loud\"\nio_backend = \"disk\"\npage_size = 3000\nmmap_initial_size = 0\nlisten.binary = \"nowhere\"\n")
+	_, err := loadConfig("-config", bad, "-max-db-size", "100")
+	for _, want := range []string{"sync_mode", "log_level", "io_backend", "page_size", "mmap_initial_size", "listen.binary", "max_db_size"} {
+		if err == nil || !strings.Contains(err.Error(), "config: "+want) {
+			t.Errorf("%s: %v", want, err)
+		}
+	}
+	for name, c := range map[string]struct {
+		file, env, flag string
+	}{
+		"unknown setting": {file: "cache = 1\n"},
+		"bad size":        {file: "max_db_size = \"1XB\"\n"},
+		"bad env":         {env: "12 pages"},
+		"bad flag":        {flag: "-page-cache-size=x"},
+		"missing file":    {flag: "-config=" + filepath.Join(t.TempDir(), "none.toml")},
+		"no listener":     {flag: "-listen="},
+	} {
+		args := []string{}
+		if c.file != "" {
+			args = append(args, "-config", writeFile(t, "c.toml", c.file))
+		}
+		if c.flag != "" {
+			args = append(args, c.flag)
+		}
+		t.Setenv("DUNGEONDB_PAGE_CACHE_SIZE", "64")
+		if c.env != "" {
+			t.Setenv("DUNGEONDB_PAGE_CACHE_SIZE", c.env)
+		}
+		if _, err := loadConfig(args...); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	for v, want := range map[string]int64{"4096": 4096, "64KiB": 64 << 10, "2m": 2 << 20, "1GB": 1 << 30, "1_000": 1000} {
+		if n, err := config.ParseSize(v); err != nil || n != want {
+			t.Errorf("%s: %d %v", v, n, err)
+		}
+	}
+	for _, v := range []string{"", "-1", "1X", "16EiB"} {
+		if _, err := config.ParseSize(v); err == nil {
+			t.Errorf("%s: expected an error", v)
+		}
+	}
+}
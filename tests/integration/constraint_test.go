@@ -0,0 +1,101 @@
+package integration
+
+import (
+	"strings"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+func TestConstraints(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	zero := i64(0)
+	def := str("none")
+	createTable(t, db, &s.TableDef{
+		Name:     "t",
+		Cols:     []string{"id", "name", "age", "tag"},
+		Types:    []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_INT64, s.TYPE_BYTES},
+		Pkeys:    1,
+		Defaults: []*s.Value{nil, nil, &zero, &def},
+		NotNull:  []bool{false, true, false, false},
+		Checks:   []string{"age >= 0", "age<150", "tag <> 'it''s'", `name != ""`},
+	})
+
+	for name, tdef := range map[string]*s.TableDef{
+		"unknown column": {Checks: []string{"x > 1"}},
+		"no operator":    {Checks: []string{"id 1"}},
+		"bad integer":    {Checks: []string{"id > 'a'"}},
+		"unquoted":       {Checks: []string{"v = a"}},
+		"default type":   {Defaults: []*s.Value{nil, &zero}},
+		"defaults":       {Defaults: []*s.Value{nil}},
+		"not null flags": {NotNull: []bool{true}},
+	} {
+		tdef.Name, tdef.Cols, tdef.Types, tdef.Pkeys = "bad", []string{"id", "v"}, []uint32{s.TYPE_INT64, s.TYPE_BYTES}, 1
+		if err := db.TableNew(tdef); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// the omitted columns get their defaults
+	rec := (&s.Record{}).AddInt64("id", 1).AddStr("name", []byte("a"))
+	if _, err := db.Insert("t", rec); err != nil {
+		t.Fatal(err)
+	}
+	got := (&s.Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("t", got); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if got.Get("age").I64 != 0 || string(got.Get("tag").Str) != "none" {
+		t.Fatalf("defaults: %v", got.Vals)
+	}
+	// an update keeps the omitted columns instead
+	up := (&s.Record{}).AddInt64("id", 1).AddStr("tag", []byte("x"))
+	if _, err := db.Update("t", *up); err != nil {
+		t.Fatal(err)
+	}
+	got = (&s.Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("t", got); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if string(got.Get("name").Str) != "a" || got.Get("age").I64 != 0 || string(got.Get("tag").Str) != "x" {
+		t.Fatalf("partial update: %v", got.Vals)
+	}
+	// with no row to update, the missing NOT NULL column is not an error
+	up = (&s.Record{}).AddInt64("id", 2).AddStr("tag", []byte("x"))
+	if _, err := db.Update("t", *up); err != nil {
+		t.Fatalf("absent row: %v", err)
+	}
+
+	check := func(db *s.DB) {
+		t.Helper()
+		for want, rec := range map[string]*s.Record{
+			"NOT NULL":               (&s.Record{}).AddInt64("id", 2),
+			"CHECK (age >= 0)":       (&s.Record{}).AddInt64("id", 2).AddStr("name", []byte("b")).AddInt64("age", -1),
+			"CHECK (age<150)":        (&s.Record{}).AddInt64("id", 2).AddStr("name", []byte("b")).AddInt64("age", 150),
+			"CHECK (tag <> 'it''s')": (&s.Record{}).AddInt64("id", 2).AddStr("name", []byte("b")).AddStr("tag", []byte("it's")),
+			`CHECK (name != "")`:     (&s.Record{}).AddInt64("id", 2).AddStr("name", nil),
+			"got bytes":              (&s.Record{}).AddInt64("id", 2).AddStr("name", []byte("b")).AddStr("age", []byte("1")),
+			"primary key":            (&s.Record{}).AddStr("name", []byte("b")),
+		} {
+			_, err := db.Insert("t", rec)
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: %v", want, err)
+			}
+		}
+		// a failed update keeps the row
+		up := (&s.Record{}).AddInt64("id", 1).AddStr("name", []byte("a")).AddInt64("age", 200)
+		if _, err := db.Update("t", *up); err == nil {
+			t.Error("expected an error")
+		}
+		got := (&s.Record{}).AddInt64("id", 1)
+		if ok, err := db.Get("t", got); !ok || err != nil || got.Get("age").I64 != 0 || string(got.Get("tag").Str) != "x" {
+			t.Fatalf("row 1: %v %v %v", got.Vals, ok, err)
+		}
+		if ok, err := db.Get("t", (&s.Record{}).AddInt64("id", 2)); ok || err != nil {
+			t.Fatalf("row 2: %v %v", ok, err)
+		}
+	}
+	check(db)
+	// the constraints are loaded with the table
+	check(reopen(t, db))
+}
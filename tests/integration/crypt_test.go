@@ -0,0 +1,224 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+const secret = "a secret value"
+
+// open the file with a key, an error if it fails
+func openKey(path string, key []byte) (*s.DB, error) {
+	db := &s.DB{Path: path, Options: s.Options{Key: key}}
+	return db, db.Open()
+}
+
+func fileContains(t *testing.T, path string, text string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Contains(data, []byte(text))
+}
+
+func TestEncryption(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	for _, size := range []int{s.BTREE_MIN_PAGE_SIZE, s.BTREE_PAGE_SIZE} {
+		db := openDB(t, &s.DB{Options: s.Options{Key: key, PageSize: size}})
+		createTable(t, db, kvTable("t"))
+		for i := 0; i < 1000; i++ {
+			insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint(secret, i)))
+		}
+		path := db.Path
+		db = reopen(t, db)
+		checkRows := func(db *s.DB) {
+			t.Helper()
+			rows := scanRows(t, db, "t")
+			if len(rows) != 1000 || string(rows[999].Get("v").Str) != fmt.Sprint(secret, 999) {
+				t.Fatalf("page size %d: %d rows", size, len(rows))
+			}
+		}
+		checkRows(db)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fileContains(t, path, secret) {
+			t.Fatalf("page size %d: the file is readable", size)
+		}
+
+		for name, bad := range map[string][]byte{
+			"no key":    nil,
+			"wrong key": bytes.Repeat([]byte("x"), 32),
+			"short key": []byte("short"),
+		} {
+			if _, err := openKey(path, bad); !errors.Is(err, s.ErrBadKey) {
+				t.Errorf("page size %d: %s: %v", size, name, err)
+			}
+		}
+		db = openDB(t, &s.DB{Path: path, Options: s.Options{Key: key}})
+		checkRows(db)
+
+		// a backup is encrypted with the same key
+		backup := filepath.Join(t.TempDir(), "backup.db")
+		fp, err := os.Create(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Backup(fp); err != nil {
+			t.Fatal(err)
+		}
+		fp.Close()
+		if _, err := s.VerifyFileKey(backup, key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.VerifyFile(backup); err == nil {
+			t.Fatal("verified an encrypted backup without the key")
+		}
+		if fileContains(t, backup, secret) {
+			t.Fatal("the backup is readable")
+		}
+
+		// a changed page fails the authentication
+		data, err := os.ReadFile(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[2*size-100] ^= 1
+		if err := os.WriteFile(backup, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.VerifyFileKey(backup, key); err == nil {
+			t.Fatal("expected an error for a changed page")
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	keys := [][]byte{nil, bytes.Repeat([]byte("a"), 16), bytes.Repeat([]byte("b"), 24), nil, bytes.Repeat([]byte("c"), 32)}
+	db := openDB(t, &s.DB{})
+	createTable(t, db, kvTable("t"))
+	for i := 0; i < 500; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint(secret, i)))
+	}
+	path := db.Path
+	n := 500
+	for i, key := range keys[1:] {
+		old := keys[i]
+		if err := db.Rekey(key); err != nil {
+			t.Fatalf("rekey %d: %v", i, err)
+		}
+		// the DB is usable after a rekey
+		insertRow(t, db, "t", i64(int64(n)), str(fmt.Sprint(secret, n)))
+		n++
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if fileContains(t, path, secret) != (key == nil) {
+			t.Fatalf("rekey %d: the file is readable: %v", i, key == nil)
+		}
+		if _, err := openKey(path, old); !errors.Is(err, s.ErrBadKey) {
+			t.Fatalf("rekey %d: opened with the old key: %v", i, err)
+		}
+		db = openDB(t, &s.DB{Path: path, Options: s.Options{Key: key}})
+		rows := scanRows(t, db, "t")
+		if len(rows) != n {
+			t.Fatalf("rekey %d: %d rows", i, len(rows))
+		}
+	}
+
+	if err := db.Rekey([]byte("short")); !errors.Is(err, s.ErrBadKey) {
+		t.Fatalf("a bad key: %v", err)
+	}
+	snap := db.Snapshot()
+	if err := db.Rekey(nil); !errors.Is(err, s.ErrSnapshotOpen) {
+		t.Fatalf("with a snapshot: %v", err)
+	}
+	snap.Close()
+	if rows := scanRows(t, db, "t"); len(rows) != n {
+		t.Fatalf("%d rows", len(rows))
+	}
+}
+
+// write a backup of the DB to `path`
+func backupTo(t *testing.T, db *s.DB, path string) {
+	t.Helper()
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := db.Backup(fp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// the nonces of the used pages of an encrypted file, see crypt.go
+func pageNonces(t *testing.T, path string) map[[12]byte]bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int(binary.LittleEndian.Uint32(data[32:]))
+	used := int(binary.LittleEndian.Uint64(data[24:]))
+	salt := data[80:92]
+	out := map[[12]byte]bool{}
+	for ptr := 1; ptr < used; ptr++ {
+		var nonce [12]byte
+		binary.LittleEndian.PutUint32(nonce[0:], uint32(ptr))
+		copy(nonce[4:], data[ptr*size:ptr*size+8]) // the counter
+		for i := range nonce {
+			nonce[i] ^= salt[i]
+		}
+		out[nonce] = true
+	}
+	return out
+}
+
+// a restored backup continues from the counters of its database,
+// its own salt keeps the nonces apart
+func TestBackupNonces(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	db := openDB(t, &s.DB{Options: s.Options{Key: key}})
+	createTable(t, db, kvTable("t"))
+	for i := 0; i < 300; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint(secret, i)))
+	}
+	// a restored database is compact like its own backups, both continue
+	// at the same page numbers
+	dir := t.TempDir()
+	restored, copied := filepath.Join(dir, "restored.db"), filepath.Join(dir, "copied.db")
+	backupTo(t, db, restored)
+	db = openDB(t, &s.DB{Path: restored, Options: s.Options{Key: key}})
+	backupTo(t, db, copied)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{restored, copied} {
+		db := openDB(t, &s.DB{Path: path, Options: s.Options{Key: key}})
+		for i := 300; i < 400; i++ {
+			insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint(secret, i)))
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := pageNonces(t, restored), pageNonces(t, copied)
+	if len(a) < 100 || len(b) < 100 {
+		t.Fatalf("%d and %d nonces", len(a), len(b))
+	}
+	for nonce := range b {
+		if a[nonce] {
+			t.Fatalf("a nonce is used by both files: %x", nonce)
+		}
+	}
+}
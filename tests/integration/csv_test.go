@@ -0,0 +1,79 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Ricky004/dungeonDB/internal/dump"
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+func TestCSV(t *testing.T) {
+	db := dumpSource(t)
+	out := bytes.Buffer{}
+	n, err := dump.ExportCSV(db, "people", &out, dump.CSVOptions{Header: true})
+	if err != nil || n != 6 {
+		t.Fatalf("%d: %v", n, err)
+	}
+	// the header maps the columns, in another order
+	if err := db.TableNew(&s.TableDef{
+		Name:  "copy",
+		Cols:  []string{"id", "tag", "n", "name"},
+		Types: []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_INT64, s.TYPE_BYTES},
+		Pkeys: 1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bulk := range []*s.BulkOptions{nil, {}} {
+		stats, err := dump.ImportCSV(db, "copy", bytes.NewReader(out.Bytes()), dump.CSVOptions{Bulk: bulk})
+		if err != nil || stats.Rows != 6 || len(stats.Errors) != 0 {
+			t.Fatalf("%+v: %v", stats, err)
+		}
+		back := bytes.Buffer{}
+		if _, err := dump.ExportQueryCSV(db, "SELECT id, name, n, tag FROM copy", &back, dump.CSVOptions{Header: true}); err != nil {
+			t.Fatal(err)
+		}
+		if back.String() != out.String() {
+			t.Fatalf("%s\nexpected\n%s", back.String(), out.String())
+		}
+		for _, rec := range scanRows(t, db, "copy") {
+			if _, err := db.Delete("copy", s.Record{Cols: rec.Cols[:1], Vals: rec.Vals[:1]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the bad lines are skipped and reported, up to MaxErrors
+	in := "id;name;n\n11;a;1\nx;b;2\n13;c\n14;;\\N\n15;e;5\n"
+	stats, err := dump.ImportCSV(db, "people", strings.NewReader(in), dump.CSVOptions{Comma: ';', Null: `\N`})
+	if err != nil || stats.Rows != 2 || len(stats.Errors) != 3 {
+		t.Fatalf("%+v: %v", stats, err)
+	}
+	for i, line := range []int{3, 4, 5} {
+		if msg := stats.Errors[i].Error(); !strings.Contains(msg, fmt.Sprint("line ", line)) {
+			t.Errorf("error %d: %s", i, msg)
+		}
+	}
+	if _, err := dump.ImportCSV(db, "people", strings.NewReader(in), dump.CSVOptions{Comma: ';', MaxErrors: 1}); err == nil {
+		t.Fatal("expected an error after too many bad lines")
+	}
+
+	// quoting
+	for quote, want := range map[string]string{
+		dump.QUOTE_MINIMAL: "0,\"line\nbreak\"\n",
+		dump.QUOTE_ALL:     "\"0\",\"line\nbreak\"\n",
+	} {
+		out := bytes.Buffer{}
+		if _, err := dump.ExportQueryCSV(db, "SELECT n, name FROM people WHERE id = 3", &out, dump.CSVOptions{Quote: quote}); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != want {
+			t.Errorf("%s: %s", quote, out.String())
+		}
+	}
+	if _, err := dump.ExportCSV(db, "people", &bytes.Buffer{}, dump.CSVOptions{Quote: dump.QUOTE_NONE}); err == nil {
+		t.Fatal("expected an error for a field that needs quoting")
+	}
+}
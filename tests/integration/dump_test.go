@@ -0,0 +1,111 @@
+package integration
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Ricky004/dungeonDB/internal/dump"
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a DB with every kind of table attribute and awkward values
+func dumpSource(t *testing.T) *s.DB {
+	db := openDB(t, &s.DB{})
+	neg := i64(-5)
+	none := str("it's")
+	createTable(t, db, &s.TableDef{
+		Name:          "people",
+		Cols:          []string{"id", "name", "n", "tag"},
+		Types:         []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_INT64, s.TYPE_BYTES},
+		Pkeys:         1,
+		Indexes:       [][]string{{"name"}},
+		Defaults:      []*s.Value{nil, nil, &neg, &none},
+		NotNull:       []bool{false, true, false, false},
+		Checks:        []string{"n < 1000", "name != ''"},
+		AutoIncrement: true,
+		Compression:   "flate",
+	})
+	createTable(t, db, &s.TableDef{
+		Name:  "odd name",
+		Cols:  []string{"k", "ts", "v"},
+		Types: []uint32{s.TYPE_BYTES, s.TYPE_INT64, s.TYPE_BYTES},
+		Pkeys: 2,
+		TTL:   "ts",
+	})
+	for i, name := range []string{"ann", "o'brien", "line\nbreak", strings.Repeat("long ", 50), "ünï"} {
+		rec := (&s.Record{}).AddStr("name", []byte(name)).AddInt64("n", int64(i-2))
+		if _, err := db.Insert("people", rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Insert("people", (&s.Record{}).AddStr("name", []byte("defaults"))); err != nil {
+		t.Fatal(err)
+	}
+	insertRow(t, db, "odd name", str("\x00\xff"), i64(0), str("binary"))
+	insertRow(t, db, "odd name", str("k"), i64(-1<<63), str(""))
+	if err := db.SequenceNew("standalone", 42); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func dumpString(t *testing.T, db *s.DB, format string) string {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if _, err := dump.Dump(db, &buf, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// a restored dump dumps the same
+func TestDumpRestore(t *testing.T) {
+	src := dumpSource(t)
+	for _, format := range []string{dump.FORMAT_SQL, dump.FORMAT_JSONL} {
+		out := dumpString(t, src, format)
+		dst := openDB(t, &s.DB{})
+		stats, err := dump.Restore(dst, strings.NewReader(out), format)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, out)
+		}
+		if stats != (dump.Stats{Tables: 2, Rows: 8, Sequences: 2}) {
+			t.Errorf("%s: %+v", format, stats)
+		}
+		if again := dumpString(t, dst, format); again != out {
+			t.Fatalf("%s: the restored DB dumps as\n%s\nexpected\n%s", format, again, out)
+		}
+
+		// the table attributes work in the restored DB
+		rec := (&s.Record{}).AddStr("name", []byte("new"))
+		if _, err := dst.Insert("people", rec); err != nil || rec.Get("id").I64 <= 6 {
+			t.Fatalf("%s: %v %v", format, rec.Get("id"), err)
+		}
+		if _, err := dst.Insert("people", (&s.Record{}).AddStr("name", nil)); err == nil {
+			t.Fatalf("%s: the CHECK is lost", format)
+		}
+		if got := dumpString(t, dst, format); !strings.Contains(got, "flate") {
+			t.Fatalf("%s: the compression is lost", format)
+		}
+		if v, err := dst.NextVal("standalone"); err != nil || v < 42 {
+			t.Fatalf("%s: %d %v", format, v, err)
+		}
+
+		// the existing tables are not replaced, the error has the line
+		_, err = dump.Restore(dst, strings.NewReader(out), format)
+		if err == nil || !strings.Contains(err.Error(), "line ") {
+			t.Fatalf("%s: %v", format, err)
+		}
+	}
+
+	for format, bad := range map[string]string{
+		dump.FORMAT_SQL:   "CREATE TABLE t (id INT64, PRIMARY KEY (id));\nINSERT INTO t (id) VALUES ('x');\n",
+		dump.FORMAT_JSONL: `{"table":{"name":"t","cols":["id"],"types":["int64"],"pkeys":1}}` + "\n{\"row\":\"t\",\"values\":[1,2]}\n",
+		"xml":             "",
+	} {
+		_, err := dump.Restore(openDB(t, &s.DB{}), strings.NewReader(bad), format)
+		if err == nil || format != "xml" && !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package integration
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ricky004/dungeonDB/pkg/dungeondb"
+)
+
+func openEmbedded(t *testing.T, opts *dungeondb.Options) *dungeondb.DB {
+	t.Helper()
+	db, err := dungeondb.Open(filepath.Join(t.TempDir(), "test.db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func key(id int64) dungeondb.Record {
+	return *(&dungeondb.Record{}).AddInt64("id", id)
+}
+
+func row(id int64, v string) *dungeondb.Record {
+	return (&dungeondb.Record{}).AddInt64("id", id).AddStr("v", []byte(v))
+}
+
+// fail instead of hanging if the DB is left locked
+func within(t *testing.T, fn func() error) error {
+	t.Helper()
+	errc := make(chan error, 1)
+	go func() { errc <- fn() }()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("the DB is locked")
+		return nil
+	}
+}
+
+func TestEmbeddedIndexedDelete(t *testing.T) {
+	db := openEmbedded(t, nil)
+	tdef := &dungeondb.TableDef{
+		Name:    "t",
+		Cols:    []string{"id", "v", "n"},
+		Types:   []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES, dungeondb.TYPE_INT64},
+		Pkeys:   1,
+		Indexes: [][]string{{"v"}},
+	}
+	if err := db.CreateTable(tdef); err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range []string{"a", "b", "c"} {
+		if err := db.Insert("t", row(int64(i), v).AddInt64("n", 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("t", key(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("t", key(1)); !errors.Is(err, dungeondb.ErrNotFound) {
+		t.Fatalf("deleted twice: %v", err)
+	}
+	// the index entry is gone with the row, it can be added again
+	if err := db.Insert("t", row(3, "b").AddInt64("n", 0)); err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for rec, err := range db.Scan("t", dungeondb.ScanOptions{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(rec.Get("v").Str))
+	}
+	if strings.Join(got, ",") != "a,c,b" {
+		t.Fatalf("rows: %v", got)
+	}
+}
+
+// the inputs the storage can't handle are errors
+func TestEmbeddedBadInput(t *testing.T) {
+	db := openEmbedded(t, nil)
+	if err := db.CreateTable(kvTable("t")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert("t", row(1, "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, k := range map[string]dungeondb.Record{
+		"non-key column": *row(1, "a"),
+		"missing key":    *(&dungeondb.Record{}).AddStr("v", []byte("a")),
+		"wrong type":     *(&dungeondb.Record{}).AddStr("id", []byte("1")),
+		"duplicate":      *(&dungeondb.Record{}).AddInt64("id", 1).AddInt64("id", 2),
+	} {
+		if _, err := db.Get("t", k); err == nil {
+			t.Errorf("Get with a %s: expected an error", name)
+		}
+		if err := db.Delete("t", k); err == nil {
+			t.Errorf("Delete with a %s: expected an error", name)
+		}
+	}
+
+	for name, tdef := range map[string]*dungeondb.TableDef{
+		"no primary key":  {Name: "a", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES}},
+		"too many pkeys":  {Name: "b", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES}, Pkeys: 3},
+		"bad type":        {Name: "c", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, 42}, Pkeys: 1},
+		"duplicate col":   {Name: "d", Cols: []string{"id", "id"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_INT64}, Pkeys: 1},
+		"full index":      {Name: "e", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES}, Pkeys: 1, Indexes: [][]string{{"v", "id"}}},
+		"unknown index":   {Name: "f", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES}, Pkeys: 1, Indexes: [][]string{{"w"}}},
+		"assigned prefix": {Name: "g", Cols: []string{"id", "v"}, Types: []uint32{dungeondb.TYPE_INT64, dungeondb.TYPE_BYTES}, Pkeys: 1, Prefix: 1000},
+	} {
+		if err := db.CreateTable(tdef); err == nil {
+			t.Errorf("CreateTable with %s: expected an error", name)
+		}
+	}
+
+	// an oversized row fails without leaving the DB locked or half updated
+	big := strings.Repeat("x", 5000)
+	if err := within(t, func() error { return db.Insert("t", row(2, big)) }); err == nil {
+		t.Fatal("expected an error")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert("t", row(3, "c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Insert("t", row(4, big)); err == nil {
+		t.Fatal("expected an error")
+	}
+	_ = tx.Rollback()
+	if err := within(t, func() error { return db.Insert("t", row(5, "e")) }); err != nil {
+		t.Fatal(err)
+	}
+	for id, ok := range map[int64]bool{1: true, 2: false, 3: false, 5: true} {
+		if _, err := db.Get("t", key(id)); (err == nil) != ok {
+			t.Errorf("row %d: %v", id, err)
+		}
+	}
+}
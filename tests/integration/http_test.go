@@ -0,0 +1,222 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Ricky004/dungeonDB/internal/metrics"
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+	"github.com/Ricky004/dungeonDB/pkg/api"
+)
+
+// send a request to the JSON API, the reply body is decoded into `out`
+func httpDo(t *testing.T, method string, url string, body string, out any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: %v: %s", method, url, err, data)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestHTTPRows(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	// more rows than a scan batch
+	createTable(t, db, kvTable("kv"))
+	for i := 0; i < api.HTTP_SCAN_BATCH+10; i++ {
+		insertRow(t, db, "kv", i64(int64(i)), str(fmt.Sprint("v", i)))
+	}
+	url := "http://" + listen(t, newServer(t, db).ServeJSON)
+
+	res := struct {
+		Results []map[string]any
+		Error   string
+	}{}
+	query := `{"sql": "CREATE TABLE t (a int64, b text, v text, PRIMARY KEY (a, b)); INSERT INTO t (a, b, v) VALUES (1, 'x/y', 'one')"}`
+	if st := httpDo(t, "POST", url+"/query", query, &res); st != 200 || len(res.Results) != 2 {
+		t.Fatalf("%d %+v", st, res)
+	}
+	query = `{"sql": "SELECT a, v FROM t WHERE a = ?", "args": [1]}`
+	if st := httpDo(t, "POST", url+"/query", query, &res); st != 200 || fmt.Sprint(res.Results[0]["rows"]) != "[[1 one]]" {
+		t.Fatalf("%d %+v", st, res)
+	}
+	query = `{"sql": "SELECT 1; SELECT 2", "args": [1]}`
+	if st := httpDo(t, "POST", url+"/query", query, &res); st != 400 || res.Error == "" {
+		t.Fatalf("%d %+v", st, res)
+	}
+
+	tables := struct{ Tables []struct{ Name string } }{}
+	if httpDo(t, "GET", url+"/tables", "", &tables); len(tables.Tables) != 2 {
+		t.Fatalf("%+v", tables)
+	}
+
+	// a key with an escaped "/", and bytes that are not UTF-8
+	row := map[string]any{}
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"GET", "/tables/t/rows/1/x%2Fy", "", 200},
+		{"PUT", "/tables/t/rows/2/z?mode=insert", `{"v": {"base64": "/w=="}}`, 201},
+		{"PUT", "/tables/t/rows/2/z?mode=insert", `{"v": "two"}`, 409},
+		{"PUT", "/tables/t/rows/3/z?mode=update", `{"v": "three"}`, 404},
+		{"PUT", "/tables/t/rows/2/z?mode=bad", `{"v": "two"}`, 400},
+		{"PUT", "/tables/t/rows/2/z", `{"v": "two", "w": 1}`, 400},
+		{"PUT", "/tables/t/rows/2/z", `{"v": 2}`, 400},
+		{"PUT", "/tables/t/rows/2/z", `{"v": "two", "a": 3}`, 400},
+		{"PUT", "/tables/t/rows/2/z", `{"v": "two", "a": 2}`, 200},
+		{"PUT", "/tables/t/rows/x/z", `{"v": "two"}`, 400},
+		{"PUT", "/tables/t/rows/2", `{"v": "two"}`, 400},
+		{"GET", "/tables/none/rows/1", "", 404},
+		{"GET", "/tables/t/rows/1/z", "", 404},
+		{"DELETE", "/tables/t/rows/1/x%2Fy", "", 204},
+		{"DELETE", "/tables/t/rows/1/x%2Fy", "", 404},
+	} {
+		if st := httpDo(t, c.method, url+c.path, c.body, &row); st != c.status {
+			t.Errorf("%s %s: %d %v", c.method, c.path, st, row)
+		}
+	}
+	row = map[string]any{}
+	httpDo(t, "GET", url+"/tables/t/rows/2/z", "", &row)
+	if fmt.Sprint(row) != "map[a:2 b:z v:two]" {
+		t.Fatalf("%v", row)
+	}
+	httpDo(t, "PUT", url+"/tables/t/rows/3/z", `{"v": {"base64": "/w=="}}`, nil)
+	httpDo(t, "GET", url+"/tables/t/rows/3/z", "", &row)
+	if fmt.Sprint(row["v"]) != "map[base64:/w==]" {
+		t.Fatalf("%v", row)
+	}
+
+	// the scans continue across batches
+	scan := struct {
+		Cols []string
+		Rows [][]any
+	}{}
+	for q, want := range map[string][2]int{
+		"":                   {0, api.HTTP_SCAN_BATCH + 10},
+		"?from=5&to=9":       {5, 5},
+		"?from=990&limit=20": {990, 20},
+		"?from=1005":         {1005, 5},
+		"?from=2000":         {0, 0},
+		"?limit=0":           {0, 0},
+		"?to=999":            {0, 1000},
+	} {
+		if st := httpDo(t, "GET", url+"/tables/kv"+q, "", &scan); st != 200 || len(scan.Rows) != want[1] {
+			t.Fatalf("%s: %d %d rows", q, st, len(scan.Rows))
+		}
+		for i, r := range scan.Rows {
+			if fmt.Sprint(r) != fmt.Sprintf("[%d v%d]", want[0]+i, want[0]+i) {
+				t.Fatalf("%s: row %d: %v", q, i, r)
+			}
+		}
+	}
+	if st := httpDo(t, "GET", url+"/tables/kv?limit=-1", "", nil); st != 400 {
+		t.Fatalf("bad limit: %d", st)
+	}
+}
+
+// GET /metrics, the value of each series by its name and labels
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("%d %v: %s", resp.StatusCode, err, data)
+	}
+	series := map[string]float64{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("bad line: %q", line)
+		}
+		series[line[:i]] = v
+	}
+	return series
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	db := openDB(t, &s.DB{Options: s.Options{Metrics: s.NewMetrics(reg)}})
+	srv := newServer(t, db)
+	srv.Metrics = reg
+	url := "http://" + listen(t, srv.ServeJSON)
+	mon := "http://" + listen(t, srv.ServeMetrics)
+	if st := httpDo(t, "POST", url+"/query", `{"sql": "CREATE TABLE t (id int64, v text, PRIMARY KEY (id))"}`, nil); st != 200 {
+		t.Fatalf("create: %d", st)
+	}
+
+	// both the API and the metrics listener serve the same registry
+	const inserts = `dungeondb_row_ops_total{table="t",op="insert"}`
+	const writes = "dungeondb_page_writes_total"
+	const reads = "dungeondb_page_reads_total"
+	moved := func(before map[string]float64, name string) {
+		t.Helper()
+		for _, u := range []string{url, mon} {
+			if after := scrape(t, u); after[name] <= before[name] {
+				t.Errorf("%s %s: %v -> %v", u, name, before[name], after[name])
+			}
+		}
+	}
+	before := scrape(t, mon)
+	for i := 0; i < 10; i++ {
+		if st := httpDo(t, "PUT", fmt.Sprintf("%s/tables/t/rows/%d", url, i), `{"v": "x"}`, nil); st != 201 {
+			t.Fatalf("put %d: %d", i, st)
+		}
+	}
+	moved(before, inserts)
+	moved(before, writes)
+	if after := scrape(t, url); after[inserts]-before[inserts] != 10 {
+		t.Fatalf("inserts: %v -> %v", before[inserts], after[inserts])
+	}
+
+	before = scrape(t, url)
+	for i := 0; i < 10; i++ {
+		if st := httpDo(t, "GET", fmt.Sprintf("%s/tables/t/rows/%d", url, i), "", nil); st != 200 {
+			t.Fatalf("get %d: %d", i, st)
+		}
+	}
+	moved(before, reads)
+	if after := scrape(t, mon); after[writes] != before[writes] {
+		t.Fatalf("reads wrote pages: %v -> %v", before[writes], after[writes])
+	}
+
+	// the metrics listener serves nothing else
+	if st := httpDo(t, "GET", mon+"/tables", "", nil); st != 404 {
+		t.Fatalf("tables on the metrics listener: %d", st)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := api.NewServer(db).ServeMetrics(ln); err == nil {
+		t.Fatal("expected an error without a registry")
+	}
+}
@@ -0,0 +1,74 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a log written by the server goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// the records of a JSON log
+func logRecords(t *testing.T, log string) []map[string]any {
+	t.Helper()
+	out := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(log), "\n") {
+		if line == "" {
+			continue
+		}
+		rec := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := s.NewJSONLogger(&buf, "WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn", "pages", 3)
+	logger.Error("error", "err", "failed")
+	recs := logRecords(t, buf.String())
+	if len(recs) != 2 {
+		t.Fatalf("%d records: %s", len(recs), buf.String())
+	}
+	if recs[0]["level"] != "WARN" || recs[0]["msg"] != "warn" || recs[0]["pages"] != 3.0 || recs[0]["time"] == nil {
+		t.Fatalf("%v", recs[0])
+	}
+	if recs[1]["level"] != "ERROR" || recs[1]["err"] != "failed" {
+		t.Fatalf("%v", recs[1])
+	}
+
+	for _, level := range []string{"", "loud", "warning"} {
+		if _, err := s.NewJSONLogger(&buf, level); err == nil {
+			t.Errorf("level %q: expected an error", level)
+		}
+	}
+}
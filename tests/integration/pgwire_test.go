@@ -0,0 +1,89 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// the PostgreSQL front-end through lib/pq and database/sql
+func TestPGWire(t *testing.T) {
+	srv := newServer(t, openDB(t, &s.DB{}))
+	addr := listen(t, srv.ServePG)
+	db, err := sql.Open("postgres", "postgres://test@"+addr+"/test?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE t (id int64 PRIMARY KEY, name text NOT NULL, n int64 DEFAULT 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO t (id, name) VALUES ($1, $2), ($3, $4)", 1, "a", 2, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Fatalf("%d rows inserted", n)
+	}
+
+	// a committed and a rolled back transaction
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE t SET n = $1 WHERE id = $2", 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM t WHERE id = $1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT id, name, n FROM t WHERE id >= $1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := []string{}
+	for rows.Next() {
+		var id, n int64
+		var name string
+		if err := rows.Scan(&id, &name, &n); err != nil {
+			t.Fatal(err)
+		}
+		if id == 1 && n != 10 || id == 2 && n != 0 {
+			t.Fatalf("row %d: n = %d", id, n)
+		}
+		got = append(got, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("rows: %v", got)
+	}
+
+	// an error is reported without breaking the connection
+	if _, err := db.Exec("INSERT INTO t (id) VALUES (3)"); err == nil {
+		t.Fatal("expected a NOT NULL error")
+	}
+	var name string
+	if err := db.QueryRow("SELECT name FROM t WHERE id = 1").Scan(&name); err != nil || name != "a" {
+		t.Fatalf("%q %v", name, err)
+	}
+}
@@ -0,0 +1,94 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Ricky004/dungeonDB/internal/metrics"
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a buffer pool much smaller than the data, the frames are evicted all the time
+func TestBufferPool(t *testing.T) {
+	reg := metrics.NewRegistry()
+	opts := s.Options{Backend: s.BACKEND_POOL, PageCache: 8, Metrics: s.NewMetrics(reg)}
+	db := openDB(t, &s.DB{Options: opts})
+	createTable(t, db, kvTable("t"))
+
+	// more dirty pages than frames
+	const n = 3000
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint("v", i)))
+	}
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an aborted transaction evicts its dirty pages too, the commit is intact
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := db.Update("t", s.Record{Cols: []string{"id", "v"}, Vals: []s.Value{i64(int64(i)), str("aborted")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	all := func(id int64) bool { return 0 <= id && id < n }
+	checkIDs(t, db, "t", all, n)
+
+	// a snapshot reads through the pool while the writer uses it
+	snap := db.Snapshot()
+	done := make(chan error)
+	go func() {
+		_, err := snap.WriteTo(io.Discard)
+		done <- err
+	}()
+	for i := 0; i < n; i += 3 {
+		if _, err := db.Delete("t", *(&s.Record{}).AddInt64("id", int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if snap.Stats().Keys < n {
+		t.Fatalf("%+v", snap.Stats())
+	}
+	snap.Close()
+
+	text := bytes.Buffer{}
+	if err := reg.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range []string{"hit", "miss"} {
+		re := regexp.MustCompile(`dungeondb_page_cache_total\{result="` + result + `"\} [1-9]`)
+		if !re.Match(text.Bytes()) {
+			t.Fatalf("no page cache %s:\n%s", result, text.String())
+		}
+	}
+
+	// the file is the same for both backends
+	left := func(id int64) bool { return all(id) && id%3 != 0 }
+	for _, backend := range []int{s.BACKEND_MMAP, s.BACKEND_POOL, s.BACKEND_MMAP} {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db = openDB(t, &s.DB{Path: db.Path, Options: s.Options{Backend: backend, PageCache: 8}})
+		checkIDs(t, db, "t", left, n-n/3)
+		insertRow(t, db, "t", i64(int64(backend)*3), str(strings.Repeat("x", 10)))
+		if _, err := db.Delete("t", *(&s.Record{}).AddInt64("id", int64(backend)*3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backupKeys(t, db)
+}
@@ -0,0 +1,137 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+	"github.com/Ricky004/dungeonDB/pkg/api"
+)
+
+// follow the primary at `addr`, until the returned function is called
+func follow(t *testing.T, srv *api.Server, addr string) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.Follow(ctx, addr) }()
+	stop := func() {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("follow: %v", err)
+		}
+	}
+	return stop
+}
+
+// wait until the follower has `n` rows
+func waitRows(t *testing.T, c *api.Client, table string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rows, err := c.Query(context.Background(), "SELECT * FROM "+table)
+		got := 0
+		if err == nil {
+			for rows.Next() {
+				got++
+			}
+		}
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: %d rows on the follower, expected %d: %v", table, got, n, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	primary := newServer(t, openDB(t, &s.DB{}))
+	pc := dial(t, listen(t, primary.Serve))
+	repl := listen(t, primary.ServeReplication)
+	insert := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if _, err := pc.Exec(ctx, "INSERT INTO t VALUES (?, ?)", int64(i), fmt.Sprint("v", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := pc.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY, v text)"); err != nil {
+		t.Fatal(err)
+	}
+	// in the base backup
+	insert(0, 100)
+
+	follower := openDB(t, &s.DB{Options: s.Options{ReadOnly: true}})
+	fsrv := newServer(t, follower)
+	fc := dial(t, listen(t, fsrv.Serve))
+	stop := follow(t, fsrv, repl)
+	waitRows(t, fc, "t", 100)
+
+	// the commits, in a transaction too
+	insert(100, 200)
+	tx, err := pc.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 200; i < 300; i++ {
+		if _, err := tx.Exec(ctx, "INSERT INTO t VALUES (?, 'tx')", int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.Exec(ctx, "DELETE FROM t WHERE id < 50"); err != nil {
+		t.Fatal(err)
+	}
+	waitRows(t, fc, "t", 250)
+	if _, err := fc.Exec(ctx, "INSERT INTO t VALUES (1000, 'x')"); err == nil {
+		t.Fatal("expected an error for a write on the follower")
+	}
+
+	// a vacuum moves the pages, the follower starts over from a base backup
+	if _, err := pc.Exec(ctx, "DELETE FROM t WHERE id < 150"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.Exec(ctx, "VACUUM"); err != nil {
+		t.Fatal(err)
+	}
+	insert(300, 310)
+	waitRows(t, fc, "t", 160)
+
+	// a follower that was away catches up
+	stop()
+	insert(310, 400)
+	if _, err := pc.Exec(ctx, "VACUUM INCREMENTAL"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, fc, "t"); n != 160 {
+		t.Fatalf("%d rows on a stopped follower", n)
+	}
+	stop = follow(t, fsrv, repl)
+	waitRows(t, fc, "t", 250)
+	rows, err := fc.Query(ctx, "SELECT id, v FROM t WHERE id >= 399")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	var v string
+	if !rows.Next() || rows.Scan(&id, &v) != nil || id != 399 || v != "v399" {
+		t.Fatalf("the last row: %d %q", id, v)
+	}
+
+	// the follower keeps the data after a reopen
+	stop()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	fsrv.Shutdown(ctx)
+	follower = reopen(t, follower)
+	if rows := scanRows(t, follower, "t"); len(rows) != 250 {
+		t.Fatalf("%d rows after a reopen", len(rows))
+	}
+}
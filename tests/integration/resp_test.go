@@ -0,0 +1,263 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+// a minimal Redis client
+type respConn struct {
+	t  *testing.T
+	nc net.Conn
+	rd *bufio.Reader
+}
+
+func dialRESP(t *testing.T, addr string) *respConn {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &respConn{t: t, nc: nc, rd: bufio.NewReader(nc)}
+}
+
+// send a command, the reply is a string, an int64, nil, an error or a []any
+func (c *respConn) do(args ...string) any {
+	c.t.Helper()
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.nc, cmd); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.read()
+}
+
+func (c *respConn) read() any {
+	c.t.Helper()
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			c.t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		out := []any{}
+		for i := 0; i < n; i++ {
+			out = append(out, c.read())
+		}
+		return out
+	}
+	c.t.Fatalf("bad reply %q", line)
+	return nil
+}
+
+// expiring keys read as absent and are deleted by the sweeper
+func TestRESPExpiry(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	srv := newServer(t, db)
+	c := dialRESP(t, listen(t, srv.ServeRESP))
+
+	for _, cmd := range [][]string{
+		{"SET", "a", "1", "PX", "100"},
+		{"SET", "b", "2"},
+		{"SET", "c", "3", "EX", "100"},
+		{"EXPIRE", "b", "100"},
+		{"SET", "c", "4"}, // drops the expiration
+	} {
+		if r := c.do(cmd...); r != "OK" && r != int64(1) {
+			t.Fatalf("%v: %v", cmd, r)
+		}
+	}
+	if r := c.do("TTL", "b"); r != int64(100) {
+		t.Fatalf("TTL b: %v", r)
+	}
+	if r := c.do("TTL", "c"); r != int64(-1) {
+		t.Fatalf("TTL c: %v", r)
+	}
+	if r := c.do("INCR", "b"); r != int64(3) {
+		t.Fatalf("INCR b: %v", r)
+	}
+	if r := c.do("TTL", "b"); r != int64(100) {
+		t.Fatalf("TTL b after INCR: %v", r)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if r := c.do("GET", "a"); r != nil {
+		t.Fatalf("GET a: %v", r)
+	}
+	if r := c.do("TTL", "a"); r != int64(-2) {
+		t.Fatalf("TTL a: %v", r)
+	}
+	if r := c.do("SCAN", "0"); fmt.Sprint(r) != "[0 [b c]]" {
+		t.Fatalf("SCAN: %v", r)
+	}
+	if r := c.do("SET", "a", "5", "NX"); r != "OK" {
+		t.Fatalf("SET NX of an expired key: %v", r)
+	}
+	if r := c.do("SET", "d", "6", "PX", "50"); r != "OK" {
+		t.Fatalf("SET d: %v", r)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		srv.SweepExpired(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	c.do("QUIT")
+
+	// the sweeper left nothing to delete
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
+	if n, err := db.SweepExpired(100); err != nil || n != 0 {
+		t.Fatalf("%d left to sweep: %v", n, err)
+	}
+	ks, err := db.Keyspace("redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ks.Get([]byte("d")); ok {
+		t.Fatal("d is still there")
+	}
+	if v, ok := ks.Get([]byte("a")); !ok || string(v) != "5" {
+		t.Fatalf("a: %q", v)
+	}
+}
+
+func TestRESPCommands(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	addr := listen(t, newServer(t, db).ServeRESP)
+	c := dialRESP(t, addr)
+
+	for _, cmd := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "PONG"},
+		{[]string{"ping", "hi"}, "hi"},
+		{[]string{"ECHO", "a b"}, "a b"},
+		{[]string{"SELECT", "1"}, "ERR DB index is out of range"},
+		{[]string{"SET", "k", "1", "XX"}, "<nil>"},
+		{[]string{"SET", "k", "1", "NX"}, "OK"},
+		{[]string{"SET", "k", "2", "NX"}, "<nil>"},
+		{[]string{"SET", "k", "3", "XX", "GET"}, "1"},
+		{[]string{"SET", "k", "3", "NX", "XX"}, "ERR syntax error"},
+		{[]string{"SET", "k", "3", "EX", "0"}, "ERR invalid expire time in 'set' command"},
+		{[]string{"GET", "k"}, "3"},
+		{[]string{"INCR", "k"}, "4"},
+		{[]string{"INCR", "new"}, "1"},
+		{[]string{"SET", "max", "9223372036854775807"}, "OK"},
+		{[]string{"INCR", "max"}, "ERR increment or decrement would overflow"},
+		{[]string{"SET", "s", "abc"}, "OK"},
+		{[]string{"INCR", "s"}, "ERR value is not an integer or out of range"},
+		{[]string{"SET", "empty", ""}, "OK"},
+		{[]string{"MSET", "a", "1", "b"}, "ERR wrong number of arguments for 'mset' command"},
+		{[]string{"MSET", "a", "1", "b", "2"}, "OK"},
+		{[]string{"MGET", "a", "none", "empty", "b"}, "[1 <nil>  2]"},
+		{[]string{"EXISTS", "a", "a", "none"}, "2"},
+		{[]string{"DEL", "a", "none", "a"}, "1"},
+		{[]string{"EXPIRE", "none", "10"}, "0"},
+		{[]string{"EXPIRE", "b", "0"}, "1"},
+		{[]string{"GET", "b"}, "<nil>"},
+		{[]string{"GET"}, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"HSET", "h", "f", "v"}, "ERR unknown command 'hset'"},
+	} {
+		if r := fmt.Sprint(c.do(cmd.args...)); r != cmd.want {
+			t.Errorf("%v: %s, expected %s", cmd.args, r, cmd.want)
+		}
+	}
+
+	// inline and pipelined commands
+	if _, err := io.WriteString(c.nc, "SET inline v\r\nGET inline\r\n\r\nPING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"OK", "v", "PONG"} {
+		if r := fmt.Sprint(c.read()); r != want {
+			t.Fatalf("%s, expected %s", r, want)
+		}
+	}
+
+	// SCAN visits every key once, a cursor can be resumed on another connection
+	for i := 0; i < 50; i++ {
+		c.do("SET", fmt.Sprint("user:", i), "x")
+	}
+	c2 := dialRESP(t, addr)
+	keys := []string{}
+	cursor := "0"
+	for i := 0; ; i++ {
+		conn := c
+		if i%2 == 1 {
+			conn = c2
+		}
+		r := conn.do("SCAN", cursor, "MATCH", "user:[1-2]*", "COUNT", "7").([]any)
+		for _, key := range r[1].([]any) {
+			keys = append(keys, key.(string))
+		}
+		if cursor = r[0].(string); cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) != 22 || keys[0] != "user:1" || keys[21] != "user:29" {
+		t.Fatalf("SCAN: %v", keys)
+	}
+	if r := fmt.Sprint(c.do("SCAN", "12345")); r != "ERR invalid cursor" {
+		t.Fatalf("SCAN: %s", r)
+	}
+
+	// a protocol error closes the connection
+	if _, err := io.WriteString(c2.nc, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if r := fmt.Sprint(c2.read()); !strings.HasPrefix(r, "ERR Protocol error") {
+		t.Fatalf("%s", r)
+	}
+	if _, err := c2.rd.ReadByte(); err != io.EOF {
+		t.Fatalf("the connection is open: %v", err)
+	}
+
+	// the keys are stored in the DB
+	c.do("QUIT")
+	ks, err := db.Keyspace("redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := ks.Get([]byte("k")); !ok || string(v) != "4" {
+		t.Fatalf("k: %q", v)
+	}
+}
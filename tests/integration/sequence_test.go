@@ -0,0 +1,119 @@
+package integration
+
+import (
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+func nextVal(t *testing.T, db *s.DB, name string) int64 {
+	t.Helper()
+	v, err := db.NextVal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// sequences never go backwards, across reopens and aborted transactions
+func TestSequences(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	if err := db.SequenceNew("s", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SequenceNew("s", 1); err == nil {
+		t.Fatal("expected an error for an existing sequence")
+	}
+	if _, err := db.NextVal("none"); err == nil {
+		t.Fatal("expected an error for a missing sequence")
+	}
+	if _, err := db.CurrVal("s"); err == nil {
+		t.Fatal("expected an error before NEXTVAL")
+	}
+	for want := int64(10); want < 10+2*s.SEQ_BATCH; want++ {
+		if v := nextVal(t, db, "s"); v != want {
+			t.Fatalf("NEXTVAL %d, expected %d", v, want)
+		}
+	}
+	if v, err := db.CurrVal("s"); err != nil || v != 10+2*s.SEQ_BATCH-1 {
+		t.Fatalf("CURRVAL %d: %v", v, err)
+	}
+
+	// a reopened DB skips the rest of the reserved batch
+	last := int64(10 + 2*s.SEQ_BATCH - 1)
+	db = reopen(t, db)
+	v := nextVal(t, db, "s")
+	if v <= last {
+		t.Fatalf("NEXTVAL %d after %d", v, last)
+	}
+	last = v
+	if v := nextVal(t, db, "s"); v != last+1 {
+		t.Fatalf("NEXTVAL %d after %d", v, last)
+	}
+	last++
+
+	// the values of an aborted transaction may be handed out again,
+	// but not the committed ones
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*s.SEQ_BATCH; i++ {
+		nextVal(t, db, "s")
+	}
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if v := nextVal(t, db, "s"); v <= last {
+		t.Fatalf("NEXTVAL %d after %d", v, last)
+	}
+
+	if err := db.SequenceRestart("s", 5); err != nil {
+		t.Fatal(err)
+	}
+	if v := nextVal(t, db, "s"); v != 5 {
+		t.Fatalf("NEXTVAL %d after a restart", v)
+	}
+	if err := db.SequenceRestart("none", 5); err == nil {
+		t.Fatal("expected an error for a missing sequence")
+	}
+	db = reopen(t, db)
+	if seqs, err := db.Sequences(); err != nil || len(seqs) != 1 || seqs["s"] <= 5 {
+		t.Fatalf("%v: %v", seqs, err)
+	}
+}
+
+func TestAutoIncrement(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	tdef := kvTable("t")
+	tdef.AutoIncrement = true
+	createTable(t, db, tdef)
+	bad := kvTable("bad")
+	bad.Types[0], bad.AutoIncrement = s.TYPE_BYTES, true
+	if err := db.TableNew(bad); err == nil {
+		t.Fatal("expected an error for a bytes key")
+	}
+
+	insert := func(db *s.DB, v string) int64 {
+		t.Helper()
+		rec := (&s.Record{}).AddStr("v", []byte(v))
+		if ok, err := db.Insert("t", rec); !ok || err != nil {
+			t.Fatal(ok, err)
+		}
+		return rec.Get("id").I64
+	}
+	for want := int64(1); want <= 3; want++ {
+		if id := insert(db, "a"); id != want {
+			t.Fatalf("id %d, expected %d", id, want)
+		}
+	}
+	// an explicit key is kept
+	insertRow(t, db, "t", i64(100), str("b"))
+	db = reopen(t, db)
+	if id := insert(db, "c"); id <= 3 {
+		t.Fatalf("id %d after a reopen", id)
+	}
+	got := (&s.Record{}).AddInt64("id", 100)
+	if ok, err := db.Get("t", got); !ok || err != nil || string(got.Get("v").Str) != "b" {
+		t.Fatalf("row 100: %v %v %v", got.Vals, ok, err)
+	}
+}
@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+	"github.com/Ricky004/dungeonDB/pkg/api"
+)
+
+func TestServerErrors(t *testing.T) {
+	ctx := context.Background()
+	c := dial(t, startServer(t))
+	if _, err := c.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY, v text NOT NULL)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range []string{
+		"SELEC 1",
+		"SELECT * FROM missing",
+		"INSERT INTO t (id) VALUES (1)",
+		"COMMIT",
+	} {
+		if _, err := c.Exec(ctx, sql); err == nil {
+			t.Fatalf("%s: expected an error", sql)
+		}
+	}
+	// the session is still usable
+	if _, err := c.Exec(ctx, "INSERT INTO t VALUES (1, 'a')"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, c, "t"); n != 1 {
+		t.Fatalf("%d rows", n)
+	}
+}
+
+// a request that can't be stored fails, and the DB is not left locked
+func TestServerOversizedRow(t *testing.T) {
+	ctx := context.Background()
+	addr := startServer(t)
+	c1, c2 := dial(t, addr), dial(t, addr)
+	if _, err := c1.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY, v text)"); err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 5000)
+
+	// outside of a transaction
+	if _, err := c1.Exec(ctx, "INSERT INTO t VALUES (1, ?)", big); err == nil {
+		t.Fatal("expected an error")
+	}
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := c2.Exec(tctx, "INSERT INTO t VALUES (2, 'b')"); err != nil {
+		t.Fatalf("the other client: %v", err)
+	}
+
+	// in a transaction, which is finished by the client
+	tx, err := c1.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO t VALUES (3, 'c')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO t VALUES (4, ?)", big); err == nil {
+		t.Fatal("expected an error")
+	}
+	_ = tx.Rollback()
+	if _, err := c2.Exec(tctx, "INSERT INTO t VALUES (5, 'e')"); err != nil {
+		t.Fatalf("the other client: %v", err)
+	}
+	if n := countRows(t, c1, "t"); n != 2 {
+		t.Fatalf("%d rows", n)
+	}
+}
+
+// a client in a transaction holds the DB, the others wait for it
+func TestServerConcurrentSessions(t *testing.T) {
+	ctx := context.Background()
+	addr := startServer(t)
+	c := dial(t, addr)
+	if _, err := c.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY, v text)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := c.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, "INSERT INTO t VALUES (0, 'tx')"); err != nil {
+		t.Fatal(err)
+	}
+
+	const clients, rows = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ci, err := api.Dial(ctx, addr, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer ci.Close()
+			for j := 0; j < rows; j++ {
+				id := 1 + i*rows + j
+				if _, err := ci.Exec(ctx, "INSERT INTO t VALUES (?, ?)", id, fmt.Sprint(i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	// the transaction doesn't see the others until it's finished
+	time.Sleep(100 * time.Millisecond)
+	rs, err := tx.Query(ctx, "SELECT * FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for rs.Next() {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("%d rows in the transaction", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := countRows(t, c, "t"); n != 1+clients*rows {
+		t.Fatalf("%d rows", n)
+	}
+}
+
+// a transaction idle for too long is rolled back and releases the DB
+func TestServerIdleInTx(t *testing.T) {
+	ctx := context.Background()
+	var log syncBuffer
+	logger, err := s.NewJSONLogger(&log, "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server logs to the logger of the DB
+	srv := newServer(t, openDB(t, &s.DB{Options: s.Options{Logger: logger}}))
+	srv.IdleInTxTimeout = 200 * time.Millisecond
+	addr := listen(t, srv.Serve)
+	c1, c2 := dial(t, addr), dial(t, addr)
+	if _, err := c1.Exec(ctx, "CREATE TABLE t (id int64 PRIMARY KEY, v text)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a busy transaction is kept
+	tx, err := c1.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		time.Sleep(srv.IdleInTxTimeout / 2)
+		if _, err := tx.Exec(ctx, "INSERT INTO t VALUES (?, 'a')", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an idle one is not, the other client gets the DB
+	if tx, err = c1.Begin(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM t WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := c2.Exec(tctx, "INSERT INTO t VALUES (6, 'b')"); err != nil {
+		t.Fatalf("the other client: %v", err)
+	}
+	if d := time.Since(start); d < srv.IdleInTxTimeout/2 {
+		t.Fatalf("the other client did not wait: %v", d)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM t WHERE id = 2"); err == nil {
+		t.Fatal("the connection of the idle transaction is still open")
+	}
+	_ = tx.Rollback()
+	if n := countRows(t, c1, "t"); n != 6 {
+		t.Fatalf("%d rows", n)
+	}
+	found := false
+	for _, rec := range logRecords(t, log.String()) {
+		found = found || rec["msg"] == "idle transaction rolled back" && rec["level"] == "WARN" && rec["remote"] != nil
+	}
+	if !found {
+		t.Fatalf("no log of the rollback: %s", log.String())
+	}
+}
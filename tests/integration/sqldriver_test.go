@@ -0,0 +1,143 @@
+package integration
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/Ricky004/dungeonDB/pkg/sqldriver"
+)
+
+func openSQL(t *testing.T, path string) *sql.DB {
+	db, err := sql.Open("dungeondb", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLDriver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := openSQL(t, path)
+	_, err := db.Exec("CREATE TABLE t (id int64 PRIMARY KEY AUTOINCREMENT, name text NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO t (name) VALUES (?), (?)", "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := res.LastInsertId(); id != 2 {
+		t.Fatalf("last insert id %d", id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE t SET name = $1 WHERE id = $2", "c", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true}); err == nil {
+		t.Fatal("expected an error for a read-only transaction")
+	}
+
+	// another sql.DB on the same file shares the DB
+	other := openSQL(t, path)
+	var id int64
+	var name []byte
+	if err := other.QueryRow("SELECT id, name FROM t WHERE id = 1").Scan(&id, &name); err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || string(name) != "a" {
+		t.Fatalf("%d %q", id, name)
+	}
+	if _, err := db.Exec("INSERT INTO t (name) VALUES (?)", nil); err == nil {
+		t.Fatal("expected an error for NULL")
+	}
+}
+
+// a statement that fails leaves the DB usable by the other connections
+func TestSQLDriverFailure(t *testing.T) {
+	db := openSQL(t, filepath.Join(t.TempDir(), "test.db"))
+	if _, err := db.Exec("CREATE TABLE t (id int64 PRIMARY KEY, v text)"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conns := [2]*sql.Conn{}
+	for i := range conns {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	if _, err := conns[0].ExecContext(ctx, "INSERT INTO t VALUES (1, ?)", strings.Repeat("x", 5000)); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := conns[1].ExecContext(ctx, "INSERT INTO t VALUES (2, 'b')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conns[0].ExecContext(ctx, "INSERT INTO t VALUES (3, 'c')"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSQLDriverCancel(t *testing.T) {
+	db := openSQL(t, filepath.Join(t.TempDir(), "test.db"))
+	if _, err := db.Exec("CREATE TABLE t (id int64 PRIMARY KEY, n int64)"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.Prepare("INSERT INTO t VALUES (?, 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	for i := 0; i < n; i++ {
+		if _, err := stmt.Exec(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// waiting for the connection in the transaction
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (-1, 0)"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("waiting: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a running statement is interrupted and rolled back
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "UPDATE t SET n = 1 WHERE n = 0"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("running: %v", err)
+	}
+	var count int64
+	rows, err := db.Query("SELECT id FROM t WHERE n = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		count++
+	}
+	if count != 0 {
+		t.Fatalf("%d rows updated by the interrupted statement", count)
+	}
+}
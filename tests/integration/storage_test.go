@@ -0,0 +1,242 @@
+package integration
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+func i64(v int64) s.Value {
+	return s.Value{Type: s.TYPE_INT64, I64: v}
+}
+
+func str(v string) s.Value {
+	return s.Value{Type: s.TYPE_BYTES, Str: []byte(v)}
+}
+
+// a table of (id int64, v bytes) keyed by id
+func kvTable(name string) *s.TableDef {
+	return &s.TableDef{
+		Name:  name,
+		Cols:  []string{"id", "v"},
+		Types: []uint32{s.TYPE_INT64, s.TYPE_BYTES},
+		Pkeys: 1,
+	}
+}
+
+// open a DB in a temp dir, closed at the end of the test
+func openDB(t testing.TB, db *s.DB) *s.DB {
+	if db.Path == "" {
+		db.Path = filepath.Join(t.TempDir(), "test.db")
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func createTable(t testing.TB, db *s.DB, tdef *s.TableDef) {
+	t.Helper()
+	if err := db.TableNew(tdef); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertRow(t *testing.T, db *s.DB, table string, vals ...s.Value) {
+	t.Helper()
+	tdef := db.GetTableDef(table)
+	rec := s.Record{Cols: tdef.Cols, Vals: vals}
+	if added, err := db.Insert(table, &rec); err != nil || !added {
+		t.Fatalf("insert %v: %v %v", vals, added, err)
+	}
+}
+
+// the rows of a table in the primary key order
+func scanRows(t *testing.T, db *s.DB, table string) []s.Record {
+	t.Helper()
+	sc := s.Scanner{Cmp1: s.CMP_GE, Cmp2: s.CMP_LE}
+	if err := db.Scan(table, &sc); err != nil {
+		t.Fatal(err)
+	}
+	out := []s.Record{}
+	for ; sc.Valid(); sc.Next() {
+		rec := s.Record{}
+		sc.Deref(&rec)
+		out = append(out, rec)
+	}
+	return out
+}
+
+// the table has `n` rows, each with an id accepted by `want` and the value "v<id>"
+func checkIDs(t *testing.T, db *s.DB, table string, want func(id int64) bool, n int) {
+	t.Helper()
+	rows := scanRows(t, db, table)
+	if len(rows) != n {
+		t.Fatalf("%s: %d rows, expected %d", table, len(rows), n)
+	}
+	for _, rec := range rows {
+		if id := rec.Get("id").I64; !want(id) || string(rec.Get("v").Str) != fmt.Sprint("v", id) {
+			t.Fatalf("%s: row %d: %q", table, id, rec.Get("v").Str)
+		}
+	}
+}
+
+// the keys of a backup of the DB, which checks the tree
+func backupKeys(t *testing.T, db *s.DB) int {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup.db")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	if err := db.Backup(fp); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := s.VerifyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats.Keys
+}
+
+// reopen a DB with the same options
+func reopen(t *testing.T, db *s.DB) *s.DB {
+	t.Helper()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openDB(t, &s.DB{Path: db.Path, Options: db.Options})
+}
+
+// a transaction larger than the mapped file is committed
+func TestLargeTransaction(t *testing.T) {
+	db := openDB(t, &s.DB{Options: s.Options{MmapInitial: 64 * s.BTREE_PAGE_SIZE}})
+	createTable(t, db, kvTable("t"))
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(strings.Repeat("v", 200)))
+	}
+	if err := db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db = reopen(t, db)
+	rows := scanRows(t, db, "t")
+	if len(rows) != n {
+		t.Fatalf("%d rows", len(rows))
+	}
+	for i, rec := range rows {
+		if id := rec.Get("id").I64; id != int64(i) {
+			t.Fatalf("row %d: id %d", i, id)
+		}
+	}
+}
+
+// the supported page sizes, and the rows too large for a page
+func TestPageSize(t *testing.T) {
+	for _, size := range []int{512, 3000, 64 << 10} {
+		db := &s.DB{Path: filepath.Join(t.TempDir(), "test.db"), Options: s.Options{PageSize: size}}
+		if err := db.Open(); err == nil {
+			db.Close()
+			t.Fatalf("page size %d: expected an error", size)
+		}
+	}
+	for size := s.BTREE_MIN_PAGE_SIZE; size <= s.BTREE_MAX_PAGE_SIZE; size *= 2 {
+		db := openDB(t, &s.DB{Options: s.Options{PageSize: size}})
+		createTable(t, db, &s.TableDef{
+			Name:    "t",
+			Cols:    []string{"id", "v", "w"},
+			Types:   []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_BYTES},
+			Pkeys:   1,
+			Indexes: [][]string{{"w"}},
+		})
+		const n = 200
+		v := strings.Repeat("v", s.MaxValSize(size)/2)
+		for i := 0; i < n; i++ {
+			insertRow(t, db, "t", i64(int64(i)), str(v), str(fmt.Sprint(i)))
+		}
+
+		// too large for the value, then for the index key
+		for _, vals := range [][]s.Value{
+			{i64(n), str(strings.Repeat("v", s.MaxValSize(size))), str("")},
+			{i64(n), str(""), str(strings.Repeat("w", s.MaxKeySize(size)))},
+		} {
+			rec := s.Record{Cols: []string{"id", "v", "w"}, Vals: vals}
+			if _, err := db.Insert("t", &rec); err == nil || !strings.Contains(err.Error(), "too large") {
+				t.Fatalf("page size %d: %v", size, err)
+			}
+		}
+
+		db = reopen(t, db)
+		// the page size is stored in the master page
+		data, err := os.ReadFile(db.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.LittleEndian.Uint32(data[32:]); got != uint32(size) {
+			t.Fatalf("page size %d: stored %d", size, got)
+		}
+		if rows := scanRows(t, db, "t"); len(rows) != n {
+			t.Fatalf("page size %d: %d rows", size, len(rows))
+		}
+	}
+}
+
+// the rows past the time of their TTL column read as absent and are swept
+func TestRowExpiry(t *testing.T) {
+	db := openDB(t, &s.DB{})
+	createTable(t, db, &s.TableDef{
+		Name:    "t",
+		Cols:    []string{"id", "v", "exp"},
+		Types:   []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_INT64},
+		Pkeys:   1,
+		Indexes: [][]string{{"v"}},
+		TTL:     "exp",
+	})
+	now := time.Now().UnixMilli()
+	insertRow(t, db, "t", i64(1), str("a"), i64(now+50))
+	insertRow(t, db, "t", i64(2), str("b"), i64(0))
+	insertRow(t, db, "t", i64(3), str("c"), i64(now+time.Hour.Milliseconds()))
+	insertRow(t, db, "t", i64(4), str("d"), i64(now+50))
+	// the expiry of a row follows its updates
+	if _, err := db.Update("t", s.Record{Cols: []string{"id", "v", "exp"}, Vals: []s.Value{i64(4), str("d"), i64(0)}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if rows := scanRows(t, db, "t"); len(rows) != 3 {
+		t.Fatalf("%d rows", len(rows))
+	}
+	rec := (&s.Record{}).AddInt64("id", 1)
+	if ok, err := db.Get("t", rec); err != nil || ok {
+		t.Fatalf("expired row: %v %v", ok, err)
+	}
+	// an expired row is replaced like an absent one
+	insertRow(t, db, "t", i64(1), str("a"), i64(now+100))
+	time.Sleep(150 * time.Millisecond)
+
+	if n, err := db.SweepExpired(100); err != nil || n != 1 {
+		t.Fatalf("swept %d: %v", n, err)
+	}
+	if n, err := db.SweepExpired(100); err != nil || n != 0 {
+		t.Fatalf("swept %d again: %v", n, err)
+	}
+	db = reopen(t, db)
+	got := []string{}
+	for _, rec := range scanRows(t, db, "t") {
+		got = append(got, string(rec.Get("v").Str))
+	}
+	if strings.Join(got, ",") != "b,c,d" {
+		t.Fatalf("rows: %v", got)
+	}
+}
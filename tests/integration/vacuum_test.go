@@ -0,0 +1,113 @@
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	s "github.com/Ricky004/dungeonDB/internal/storage"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+// a DB with 1 row in 10 left of `n`, most of the file is garbage
+func vacuumSource(t *testing.T, opts s.Options, n int) *s.DB {
+	db := openDB(t, &s.DB{Options: opts})
+	createTable(t, db, kvTable("t"))
+	createTable(t, db, &s.TableDef{
+		Name: "i", Cols: []string{"id", "v", "w"}, Pkeys: 1,
+		Types:   []uint32{s.TYPE_INT64, s.TYPE_BYTES, s.TYPE_INT64},
+		Indexes: [][]string{{"w"}},
+	})
+	for i := 0; i < n; i++ {
+		insertRow(t, db, "t", i64(int64(i)), str(fmt.Sprint("v", i)))
+		insertRow(t, db, "i", i64(int64(i)), str(strings.Repeat("x", 100)), i64(int64(-i)))
+	}
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		for _, table := range []string{"t", "i"} {
+			if _, err := db.Delete(table, *(&s.Record{}).AddInt64("id", int64(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return db
+}
+
+func TestVacuum(t *testing.T) {
+	const n = 3000
+	isLeft := func(id int64) bool { return id%10 == 0 }
+	for _, backend := range []int{s.BACKEND_MMAP, s.BACKEND_POOL} {
+		for _, opts := range []s.VacuumOptions{{}, {FillFactor: 0.5}, {Incremental: true}, {Incremental: true, MaxPages: 10}} {
+			name := fmt.Sprintf("backend %d, %+v", backend, opts)
+			db := vacuumSource(t, s.Options{Backend: backend, SyncMode: s.SYNC_OFF}, n)
+			keys := backupKeys(t, db)
+			before := fileSize(t, db.Path)
+
+			stats, err := db.Vacuum(opts)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			after := fileSize(t, db.Path)
+			if stats.SizeBefore != before || stats.SizeAfter != after || after >= before/2 && opts.MaxPages == 0 {
+				t.Fatalf("%s: %+v, the file is %d bytes", name, stats, after)
+			}
+			if after != int64(stats.Pages)*s.BTREE_PAGE_SIZE {
+				t.Fatalf("%s: %+v, the file is %d bytes", name, stats, after)
+			}
+			if opts.MaxPages > 0 && (stats.Moved == 0 || stats.Moved > opts.MaxPages) {
+				t.Fatalf("%s: %+v", name, stats)
+			}
+
+			// the data is the same, also after a reopen and more updates
+			for i := 0; i < 2; i++ {
+				checkIDs(t, db, "t", isLeft, n/10)
+				if got := backupKeys(t, db); got != keys {
+					t.Fatalf("%s: %d keys, expected %d", name, got, keys)
+				}
+				db = reopen(t, db)
+			}
+			insertRow(t, db, "i", i64(1), str("y"), i64(-1))
+			if _, err := db.Delete("i", *(&s.Record{}).AddInt64("id", 0)); err != nil {
+				t.Fatal(err)
+			}
+			if got := backupKeys(t, db); got != keys {
+				t.Fatalf("%s: %d keys, expected %d", name, got, keys)
+			}
+		}
+	}
+}
+
+func TestVacuumErrors(t *testing.T) {
+	db := vacuumSource(t, s.Options{}, 100)
+	snap := db.Snapshot()
+	if _, err := db.Vacuum(s.VacuumOptions{}); !errors.Is(err, s.ErrSnapshotOpen) {
+		t.Fatalf("with a snapshot: %v", err)
+	}
+	snap.Close()
+	if err := db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Vacuum(s.VacuumOptions{Incremental: true}); !errors.Is(err, s.ErrTxActive) {
+		t.Fatalf("in a transaction: %v", err)
+	}
+	if err := db.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Vacuum(s.VacuumOptions{FillFactor: 1.5}); err == nil {
+		t.Fatal("expected an error for the fill factor")
+	}
+	// nothing changed
+	checkIDs(t, db, "t", func(id int64) bool { return id%10 == 0 }, 10)
+}